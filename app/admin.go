@@ -0,0 +1,83 @@
+package main
+
+/*
+This module contains the admin interface: an HTTP server, meant to be bound to a loopback address, that exposes the
+server's internal state for debugging, and the "cache" subcommand that queries it.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DefaultAdminAddr is where the "cache" subcommand looks for the admin interface unless told otherwise
+const DefaultAdminAddr = "127.0.0.1:8053"
+
+// startAdminServer serves the admin interface on addr in the background
+func startAdminServer(addr string, forwarder *Forwarder) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		writeCacheDump(w, forwarder.Cache.Dump(), r.URL.Query().Get("format"))
+	})
+	for _, plugin := range forwarder.plugins {
+		if plugin, ok := plugin.(AdminPlugin); ok {
+			plugin.RegisterAdmin(mux)
+		}
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Println("Admin interface stopped:", err)
+		}
+	}()
+	fmt.Println("Admin interface listening on", addr)
+}
+
+// writeCacheDump writes the cache entries sorted by name as JSON or, by default, in presentation format with each
+// RRset's remaining TTL and source in a comment
+func writeCacheDump(w http.ResponseWriter, infos []CacheEntryInfo, format string) {
+	slices.SortFunc(infos, func(a, b CacheEntryInfo) int {
+		return strings.Compare(a.Name+" "+a.Type, b.Name+" "+b.Type)
+	})
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(infos)
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, info := range infos {
+			fmt.Fprintf(w, "; %s %s %s ttl=%d hits=%d source=%s\n", info.Name, info.Class, info.Type, info.TTLRemaining, info.Hits, info.Source)
+			for _, record := range info.Records {
+				fmt.Fprintln(w, record)
+			}
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+// runCacheDump implements the "cache" subcommand, which prints the cache of a running server
+func runCacheDump(args []string) error {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	admin := flags.String("admin", DefaultAdminAddr, "Admin interface address of the server")
+	format := flags.String("format", "text", "Output format: text or json")
+	flags.Parse(args)
+	response, err := http.Get("http://" + *admin + "/cache?format=" + *format)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("admin interface returned %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(os.Stdout, response.Body)
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+/*
+This module contains the "bench" subcommand, which sends generated queries, or replays the "name type" lines of a
+query file in dnsperf style, to a server at a configurable rate and concurrency and reports throughput, latency
+percentiles, the RCODE distribution, and loss.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchResult is the outcome of a single benchmark query
+type benchResult struct {
+	latency time.Duration
+	rCode   uint16
+	err     error
+}
+
+// runBench implements the "bench" subcommand
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:2053", "Server to benchmark in the form [udp://|tcp://|tls://]ip:port")
+	qps := flags.Int("qps", 1000, "Target queries per second")
+	concurrency := flags.Int("concurrency", 16, "Number of concurrent senders")
+	duration := flags.Duration("duration", 10*time.Second, "How long to send queries for")
+	names := flags.String("names", "example.com", "Comma-separated names to query")
+	random := flags.Bool("random-subdomains", false, "Prefix every name with a random label to defeat caching")
+	qType := flags.Uint("type", 1, "Query type")
+	queriesFile := flags.String("queries", "", "File of \"name [type]\" lines replayed in order, looping until --duration elapses (overrides --names and --type)")
+	flags.Parse(args)
+	if *qps <= 0 || *concurrency <= 0 {
+		return fmt.Errorf("--qps and --concurrency must be positive")
+	}
+	var replay []CacheKey
+	if *queriesFile != "" {
+		var err error
+		if replay, err = LoadQuestionFile(*queriesFile); err != nil {
+			return err
+		}
+		if len(replay) == 0 {
+			return fmt.Errorf("%s holds no queries", *queriesFile)
+		}
+	}
+	var sequence atomic.Uint64 // Position in the replayed query file
+	client, err := NewClient(*target)
+	if err != nil {
+		return err
+	}
+	nameList := strings.Split(*names, ",")
+
+	tokens := make(chan struct{}, *concurrency)
+	go func() {
+		defer close(tokens)
+		ticker := time.NewTicker(time.Second / time.Duration(*qps))
+		defer ticker.Stop()
+		deadline := time.After(*duration)
+		for {
+			select {
+			case <-deadline:
+				return
+			case <-ticker.C:
+				select {
+				case tokens <- struct{}{}:
+				default: // All senders busy; the achieved rate will show the shortfall
+				}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range tokens {
+				question := DNSQuestionOptions{Name: nameList[rand.IntN(len(nameList))], Type: uint16(*qType), Class: 1}
+				if replay != nil {
+					key := replay[(sequence.Add(1)-1)%uint64(len(replay))]
+					question = DNSQuestionOptions{Name: key.Name, Type: key.Type, Class: key.Class}
+				} else if *random {
+					question.Name = fmt.Sprintf("%08x.%s", rand.Uint32(), question.Name)
+				}
+				response, latency, err := client.Query(question)
+				result := benchResult{latency: latency, err: err}
+				if err == nil {
+					result.rCode = response.Header.Flags & RCodeMask >> RCodeShift
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	printBenchReport(results, time.Since(start))
+	return nil
+}
+
+// printBenchReport summarizes benchmark results
+func printBenchReport(results []benchResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	rCodes := map[uint16]int{}
+	lost := 0
+	for _, result := range results {
+		if result.err != nil {
+			lost++
+			continue
+		}
+		latencies = append(latencies, result.latency)
+		rCodes[result.rCode]++
+	}
+	slices.Sort(latencies)
+	fmt.Printf("Sent:      %d queries in %s (%.1f qps)\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	if len(results) > 0 {
+		fmt.Printf("Answered:  %d (%.1f qps)\n", len(latencies), float64(len(latencies))/elapsed.Seconds())
+		fmt.Printf("Lost:      %d (%.2f%%)\n", lost, 100*float64(lost)/float64(len(results)))
+	}
+	if len(latencies) > 0 {
+		fmt.Printf("Latency:   p50=%s p90=%s p99=%s max=%s\n",
+			percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+	codes := make([]uint16, 0, len(rCodes))
+	for code := range rCodes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Printf("%-10s %d\n", RCodeString(code), rCodes[code])
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[min(len(sorted)-1, int(float64(len(sorted))*p))]
+}
@@ -0,0 +1,70 @@
+package main
+
+/*
+This module contains the Blocklist of domains that are answered with NXDOMAIN instead of being resolved; blocking a
+domain also blocks all of its subdomains.
+*/
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Blocklist is a set of blocked domains; a nil Blocklist blocks nothing
+type Blocklist struct {
+	tree *DomainTree[struct{}]
+}
+
+// NewBlocklist creates a blocklist of domains
+func NewBlocklist(domains ...string) *Blocklist {
+	blocklist := &Blocklist{tree: NewDomainTree[struct{}]()}
+	for _, domain := range domains {
+		blocklist.tree.Insert(domain, struct{}{})
+	}
+	return blocklist
+}
+
+// LoadBlocklist reads a blocklist file holding one domain per line, either bare or in hosts-file form
+// ("0.0.0.0 ads.example"); '#' starts a comment
+func LoadBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	blocklist := NewBlocklist()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			blocklist.tree.Insert(fields[0], struct{}{})
+		default:
+			for _, domain := range fields[1:] {
+				blocklist.tree.Insert(domain, struct{}{})
+			}
+		}
+	}
+	return blocklist, scanner.Err()
+}
+
+// Blocked reports whether name or any of its parent domains is blocked
+func (b *Blocklist) Blocked(name string) bool {
+	if b == nil {
+		return false
+	}
+	_, _, blocked := b.tree.LongestSuffix(name)
+	return blocked
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return b.tree.Len()
+}
@@ -0,0 +1,167 @@
+package main
+
+/*
+This module contains the resolution of upstreams given by host name. The name is resolved when the upstream is
+created, through a bootstrap resolver given by address or else the system resolver, and re-resolved in the background
+as the answer's TTL runs out, so an upstream whose address changes keeps being reached without a restart. Each name has
+a single refresher, however many upstreams use it.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBootstrapRefresh is how often upstream host names resolved by the system resolver, which reports no TTL,
+	// are re-resolved
+	DefaultBootstrapRefresh = 5 * time.Minute
+	// minBootstrapRefresh keeps short TTLs and failures from turning re-resolution into a busy loop
+	minBootstrapRefresh = 30 * time.Second
+)
+
+// upstreamAddress is the address of an upstream given as host:port, where the host is an IP address or a name that is
+// kept resolved
+type upstreamAddress struct {
+	host     string
+	port     string
+	resolved *resolvedHost
+}
+
+// resolvedHost is a host name kept resolved by a single refresher, shared by every upstream address naming it
+type resolvedHost struct {
+	host      string
+	bootstrap string                     // Resolver for the host name as ip:port; empty for the system resolver
+	current   atomic.Pointer[netip.Addr] // Address currently in use
+	stop      chan struct{}              // Closed to end the refresher
+}
+
+// resolvedHosts holds the host names being kept resolved, keyed by "<host> <bootstrap>"
+var resolvedHosts = struct {
+	sync.Mutex
+	hosts map[string]*resolvedHost
+}{hosts: map[string]*resolvedHost{}}
+
+// newUpstreamAddress resolves address, failing if a host name has no address, and keeps a host name resolved
+func newUpstreamAddress(address, bootstrap string) (*upstreamAddress, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	a := &upstreamAddress{host: host, port: port}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		a.resolved = &resolvedHost{host: host}
+		a.resolved.current.Store(&ip)
+		return a, nil
+	}
+	key := host + " " + bootstrap
+	resolvedHosts.Lock()
+	a.resolved = resolvedHosts.hosts[key]
+	resolvedHosts.Unlock()
+	if a.resolved != nil {
+		return a, nil
+	}
+	resolved := &resolvedHost{host: host, bootstrap: bootstrap, stop: make(chan struct{})}
+	ip, ttl, err := resolved.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream host %s: %w", host, err)
+	}
+	resolvedHosts.Lock()
+	defer resolvedHosts.Unlock()
+	if a.resolved = resolvedHosts.hosts[key]; a.resolved != nil {
+		return a, nil // Resolved meanwhile for another upstream
+	}
+	resolved.store(ip)
+	resolvedHosts.hosts[key] = resolved
+	a.resolved = resolved
+	go resolved.refresh(ttl)
+	return a, nil
+}
+
+// stopBootstrapRefresh ends the re-resolution of every upstream host name, which keep their last addresses
+func stopBootstrapRefresh() {
+	resolvedHosts.Lock()
+	defer resolvedHosts.Unlock()
+	for key, resolved := range resolvedHosts.hosts {
+		close(resolved.stop)
+		delete(resolvedHosts.hosts, key)
+	}
+}
+
+// String returns the address currently in use, as ip:port
+func (a *upstreamAddress) String() string {
+	return net.JoinHostPort(a.resolved.current.Load().String(), a.port)
+}
+
+// store publishes a resolved address, logging changes
+func (r *resolvedHost) store(ip netip.Addr) {
+	if previous := r.current.Swap(&ip); previous == nil || *previous != ip {
+		fmt.Printf("Upstream host %s resolves to %s\n", r.host, ip)
+	}
+}
+
+// refresh re-resolves the host name whenever the previous answer expires, keeping the last address on failures, until
+// stopped
+func (r *resolvedHost) refresh(ttl time.Duration) {
+	for {
+		timer := time.NewTimer(max(ttl, minBootstrapRefresh))
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		ip, next, err := r.resolve()
+		if err != nil {
+			fmt.Printf("Failed to re-resolve upstream host %s, keeping %s: %v\n", r.host, r.current.Load(), err)
+			ttl = minBootstrapRefresh
+			continue
+		}
+		r.store(ip)
+		ttl = next
+	}
+}
+
+// resolve looks up an address of the host name, preferring IPv4, along with how long it may be used
+func (r *resolvedHost) resolve() (netip.Addr, time.Duration, error) {
+	if r.bootstrap == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), UpstreamTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", r.host)
+		if err != nil {
+			return netip.Addr{}, 0, err
+		}
+		for _, ip := range ips {
+			if ip.Unmap().Is4() {
+				return ip.Unmap(), DefaultBootstrapRefresh, nil
+			}
+		}
+		return ips[0], DefaultBootstrapRefresh, nil
+	}
+	client, err := NewClient("udp://" + r.bootstrap)
+	if err != nil {
+		return netip.Addr{}, 0, err
+	}
+	for _, qType := range []uint16{TypeA, TypeAAAA} {
+		response, _, err := client.Query(DNSQuestionOptions{Name: r.host, Type: qType, Class: ClassIN})
+		if err != nil {
+			return netip.Addr{}, 0, err
+		}
+		for _, answer := range response.Answers {
+			for _, record := range answer.ResourceRecords {
+				if record.Type != qType {
+					continue // CNAMEs leading to the address
+				}
+				if ip, ok := netip.AddrFromSlice(record.Data); ok {
+					return ip, time.Duration(record.TTL) * time.Second, nil
+				}
+			}
+		}
+	}
+	return netip.Addr{}, 0, fmt.Errorf("bootstrap resolver %s returned no address", r.bootstrap)
+}
@@ -0,0 +1,34 @@
+package main
+
+/*
+This module contains the pool of UDP packet buffers shared by the client listener and the downstream exchanges, so
+steady-state operation allocates no fresh buffer per packet.
+*/
+
+import "sync"
+
+// UDPMessageSize is the maximum size of a DNS message carried over UDP without EDNS
+const UDPMessageSize = 512
+
+// packetBufferSize is the size of pooled buffers, and so the largest datagram that can be received; it is set once at
+// startup, before any buffer is taken. The default fits the responses to queries advertising our own EDNS size.
+var packetBufferSize = EDNSUDPSize
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, packetBufferSize)
+		return &buffer
+	},
+}
+
+// getBuffer takes a full-length packet buffer from the pool
+func getBuffer() *[]byte {
+	buffer := bufferPool.Get().(*[]byte)
+	*buffer = (*buffer)[:cap(*buffer)]
+	return buffer
+}
+
+// putBuffer returns a packet buffer to the pool; it must not be used afterwards
+func putBuffer(buffer *[]byte) {
+	bufferPool.Put(buffer)
+}
@@ -0,0 +1,368 @@
+package main
+
+/*
+This module contains the answer cache: a fixed number of shards sharing a global memory budget so that cache cost stays
+predictable under load. Entries are immutable apart from atomic counters, so lookups read them through a concurrent
+map without taking any lock; writers serialize per shard and evict with the CLOCK approximation of LRU, which only
+needs readers to set a reference bit instead of reordering a list.
+*/
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCacheShards is the number of cache shards used when none is configured
+	DefaultCacheShards = 16
+	// DefaultCacheMaxBytes is the cache memory budget used when none is configured
+	DefaultCacheMaxBytes = 16 << 20
+	// DefaultPrefetchMinHits is the number of hits that makes an entry eligible for prefetching
+	DefaultPrefetchMinHits = 3
+	// cacheEntryOverhead approximates the bookkeeping cost of an entry (list element, map slot, structs)
+	cacheEntryOverhead = 128
+	// cacheRecordOverhead approximates the fixed cost of a cached resource record
+	cacheRecordOverhead = 48
+)
+
+// CacheKey identifies a cached RRset
+type CacheKey struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// CacheOptions represents the options for creating a new Cache
+type CacheOptions struct {
+	Shards   int
+	MaxBytes int64
+}
+
+// CacheStats is a snapshot of the cache counters
+type CacheStats struct {
+	Entries   int
+	Bytes     int64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+}
+
+// PrefetchOptions represents the options for the cache prefetcher
+type PrefetchOptions struct {
+	Interval time.Duration // How often the cache is scanned for entries to refresh
+	MinHits  uint64        // Hits an entry needs since it was cached to count as popular
+	Window   float64       // Fraction of the original TTL remaining below which popular entries are refreshed
+}
+
+// CacheEntryInfo describes a cached RRset for inspection
+type CacheEntryInfo struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Class        string   `json:"class"`
+	TTLRemaining uint32   `json:"ttl_remaining"`
+	Hits         uint64   `json:"hits"`
+	Source       string   `json:"source"`
+	Records      []string `json:"records"`
+}
+
+// cacheEntry is a cached RRset together with its accounting data; only the atomic fields change after creation
+type cacheEntry struct {
+	key        CacheKey
+	records    []ResourceRecord
+	encoded    *EncodedResponse // Pre-encoded response to the RRset's question, if any
+	source     string           // Upstream the RRset was learned from
+	ttl        time.Duration
+	stored     time.Time // When the entry was cached, from which served TTLs are decremented
+	expires    time.Time
+	size       int64
+	hits       atomic.Uint64 // Hits since the entry was cached
+	referenced atomic.Bool   // Set on every hit, cleared by the eviction sweep
+	element    *list.Element // Position in the shard's clock; guarded by the shard lock
+}
+
+// cacheShard is a partition of the cache whose lookups are lock-free and whose writers share one lock
+type cacheShard struct {
+	index sync.Map // CacheKey -> *cacheEntry, read without locking
+	mu    sync.Mutex
+	clock *list.List // Entries in insertion order; the back is where the eviction sweep starts
+	count int
+	bytes int64
+}
+
+// Cache is a memory-bounded, sharded LRU cache of RRsets
+type Cache struct {
+	shards        []*cacheShard
+	maxShardBytes int64
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	expired       atomic.Uint64
+}
+
+// NewCache creates a new cache with the given options
+func NewCache(opts CacheOptions) *Cache {
+	if opts.Shards <= 0 {
+		opts.Shards = DefaultCacheShards
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultCacheMaxBytes
+	}
+	cache := &Cache{shards: make([]*cacheShard, opts.Shards), maxShardBytes: opts.MaxBytes / int64(opts.Shards)}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{clock: list.New()}
+	}
+	return cache
+}
+
+// CacheKeyFromQuestion derives the cache key for a question
+func CacheKeyFromQuestion(question *DNSQuestion) CacheKey {
+	name, _ := LabelsToString(question.Name)
+	return CacheKey{Name: CanonicalName(name), Type: question.Type, Class: question.Class}
+}
+
+// shard selects the shard responsible for key
+func (c *Cache) shard(key CacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.Name))
+	h.Write([]byte{byte(key.Type >> 8), byte(key.Type), byte(key.Class >> 8), byte(key.Class)})
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Get returns the cached records for key, if present and unexpired, with their TTLs decremented by the time spent in
+// the cache; it never blocks behind writers
+func (c *Cache) Get(key CacheKey) ([]ResourceRecord, bool) {
+	entry := c.lookup(key)
+	if entry == nil {
+		return nil, false
+	}
+	return ageRecords(entry.records, entry.age(time.Now())), true
+}
+
+// GetEncoded returns the pre-encoded response cached for key, if present and unexpired, along with the seconds it has
+// spent in the cache, by which its TTLs must be decremented when served
+func (c *Cache) GetEncoded(key CacheKey) (*EncodedResponse, uint32, bool) {
+	entry := c.lookup(key)
+	if entry == nil || entry.encoded == nil {
+		return nil, 0, false
+	}
+	return entry.encoded, entry.age(time.Now()), true
+}
+
+// age returns the whole seconds the entry has spent in the cache at now
+func (entry *cacheEntry) age(now time.Time) uint32 {
+	return uint32(now.Sub(entry.stored) / time.Second)
+}
+
+// ageRecords returns records with their TTLs decremented by age, flooring at zero; records are only copied if they
+// change
+func ageRecords(records []ResourceRecord, age uint32) []ResourceRecord {
+	if age == 0 {
+		return records
+	}
+	aged := make([]ResourceRecord, len(records))
+	for i, record := range records {
+		record.TTL -= min(record.TTL, age)
+		aged[i] = record
+	}
+	return aged
+}
+
+// lookup finds the unexpired entry for key and records the hit or miss
+func (c *Cache) lookup(key CacheKey) *cacheEntry {
+	value, ok := c.shard(key).index.Load(key)
+	if !ok {
+		c.misses.Add(1)
+		return nil
+	}
+	entry := value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		// Expired entries are left for writers to reclaim so that readers never lock
+		c.expired.Add(1)
+		c.misses.Add(1)
+		return nil
+	}
+	entry.referenced.Store(true)
+	entry.hits.Add(1)
+	c.hits.Add(1)
+	return entry
+}
+
+// Set caches records learned from source under key for ttl along with their optional pre-encoded response, evicting
+// entries of the shard to stay within budget
+func (c *Cache) Set(key CacheKey, records []ResourceRecord, ttl time.Duration, encoded *EncodedResponse, source string) {
+	if ttl <= 0 || len(records) == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		records: records,
+		encoded: encoded,
+		source:  source,
+		ttl:     ttl,
+		stored:  now,
+		expires: now.Add(ttl),
+		size:    entrySize(key, records, encoded),
+	}
+	if entry.size > c.maxShardBytes {
+		return
+	}
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if previous, ok := shard.index.Load(key); ok {
+		shard.remove(previous.(*cacheEntry))
+	}
+	entry.element = shard.clock.PushFront(entry)
+	shard.index.Store(key, entry)
+	shard.count++
+	shard.bytes += entry.size
+	evicted := shard.evict(c.maxShardBytes)
+	c.evictions.Add(evicted)
+	debugf(ComponentCache, "Cached %s %s from %s for %s, evicting %d entries", key.Name, TypeString(key.Type), source, ttl, evicted)
+}
+
+// evict sweeps the clock from the back until the shard fits in budget: expired entries and entries not referenced
+// since the last sweep are removed, referenced ones get a second chance; the caller must hold the shard lock
+func (shard *cacheShard) evict(maxBytes int64) uint64 {
+	var evicted uint64
+	now := time.Now()
+	for shard.bytes > maxBytes {
+		entry := shard.clock.Back().Value.(*cacheEntry)
+		if entry.referenced.Swap(false) && now.Before(entry.expires) {
+			shard.clock.MoveToFront(entry.element)
+			continue
+		}
+		shard.remove(entry)
+		evicted++
+	}
+	return evicted
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Expired:   c.expired.Load(),
+	}
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		stats.Entries += shard.count
+		stats.Bytes += shard.bytes
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// Dump describes every unexpired entry, with the TTLs of its records reduced by the time spent in the cache
+func (c *Cache) Dump() []CacheEntryInfo {
+	var infos []CacheEntryInfo
+	now := time.Now()
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for element := shard.clock.Front(); element != nil; element = element.Next() {
+			entry := element.Value.(*cacheEntry)
+			remaining := entry.expires.Sub(now)
+			if remaining <= 0 {
+				continue
+			}
+			info := CacheEntryInfo{
+				Name:         entry.key.Name,
+				Type:         TypeString(entry.key.Type),
+				Class:        ClassString(entry.key.Class),
+				TTLRemaining: uint32(remaining / time.Second),
+				Hits:         entry.hits.Load(),
+				Source:       entry.source,
+			}
+			for _, record := range ageRecords(entry.records, entry.age(now)) {
+				info.Records = append(info.Records, FormatRecord(record))
+			}
+			infos = append(infos, info)
+		}
+		shard.mu.Unlock()
+	}
+	return infos
+}
+
+// StartPrefetcher launches a background goroutine that calls refresh for popular entries nearing expiry, so that hot
+// names are re-resolved before clients ever miss on them; calling the returned function stops the prefetcher
+func (c *Cache) StartPrefetcher(opts PrefetchOptions, refresh func(CacheKey) error) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, key := range c.prefetchCandidates(opts) {
+					if err := refresh(key); err != nil {
+						fmt.Printf("Failed to prefetch %s: %v\n", key.Name, err)
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// prefetchCandidates collects the keys of popular entries within the refresh window
+func (c *Cache) prefetchCandidates(opts PrefetchOptions) []CacheKey {
+	var keys []CacheKey
+	now := time.Now()
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for element := shard.clock.Front(); element != nil; element = element.Next() {
+			entry := element.Value.(*cacheEntry)
+			remaining := entry.expires.Sub(now)
+			if entry.hits.Load() >= opts.MinHits && remaining > 0 && remaining < time.Duration(float64(entry.ttl)*opts.Window) {
+				keys = append(keys, entry.key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return keys
+}
+
+// remove unlinks an entry from the shard; the caller must hold the shard lock
+func (shard *cacheShard) remove(entry *cacheEntry) {
+	shard.clock.Remove(entry.element)
+	shard.index.CompareAndDelete(entry.key, entry)
+	shard.count--
+	shard.bytes -= entry.size
+}
+
+// entrySize estimates the memory footprint of a cache entry
+func entrySize(key CacheKey, records []ResourceRecord, encoded *EncodedResponse) int64 {
+	size := int64(cacheEntryOverhead + len(key.Name))
+	if encoded != nil {
+		size += int64(len(encoded.Wire) + 8*len(encoded.TTLOffsets))
+	}
+	for _, record := range records {
+		size += cacheRecordOverhead + int64(len(record.Data))
+		for _, label := range record.Name {
+			size += int64(len(label.Content)) + 1
+		}
+	}
+	return size
+}
+
+// minTTL returns the smallest TTL among records
+func minTTL(records []ResourceRecord) uint32 {
+	if len(records) == 0 {
+		return 0
+	}
+	ttl := records[0].TTL
+	for _, record := range records[1:] {
+		ttl = min(ttl, record.TTL)
+	}
+	return ttl
+}
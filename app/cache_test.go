@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkCacheKeys is how many distinct names the cache benchmarks spread their operations over
+const benchmarkCacheKeys = 1024
+
+// newBenchmarkCache returns a cache holding an A record for each of the benchmark keys, and the keys
+func newBenchmarkCache(b *testing.B) (*Cache, []CacheKey) {
+	cache := NewCache(CacheOptions{})
+	keys := make([]CacheKey, benchmarkCacheKeys)
+	for i := range keys {
+		name := fmt.Sprintf("host-%d.example.com.", i)
+		record, err := NewResourceRecord(name, TypeA, ClassIN, 300, []string{"192.0.2.1"}, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys[i] = CacheKey{Name: name, Type: TypeA, Class: ClassIN}
+		cache.Set(keys[i], []ResourceRecord{record}, time.Hour, nil, "")
+	}
+	return cache, keys
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	cache, keys := newBenchmarkCache(b)
+	var next atomic.Uint64 // Spreads the goroutines over different keys
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(benchmarkCacheKeys / 8)
+		for pb.Next() {
+			if _, ok := cache.Get(keys[i%benchmarkCacheKeys]); !ok {
+				b.Error("cached key missing")
+				return
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkCacheGetSet reads nine times for every write, as a resolver with a warm cache does
+func BenchmarkCacheGetSet(b *testing.B) {
+	cache, keys := newBenchmarkCache(b)
+	records := make([][]ResourceRecord, len(keys))
+	for i, key := range keys {
+		records[i], _ = cache.Get(key)
+	}
+	var next atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(benchmarkCacheKeys / 8)
+		for pb.Next() {
+			key := i % benchmarkCacheKeys
+			if i%10 == 0 {
+				cache.Set(keys[key], records[key], time.Hour, nil, "")
+			} else {
+				cache.Get(keys[key])
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+/*
+This module contains catalog zones (RFC 9432), secondary zones given with --catalog that list other zones rather than
+being answered from: each PTR record under the catalog's "zones" label names a member zone, which the server then keeps
+as a secondary zone of its own, transferred from the catalog's primary with the catalog's TSIG key. Every transfer of
+the catalog provisions the members it added and deprovisions those it dropped, so zones come and go on the primary
+without this server's configuration changing. Zones given with --secondary are left alone even if a catalog lists them.
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// catalogVersion is the version of the catalog zone schema understood, given by the TXT record at "version"
+const catalogVersion = "2"
+
+// catalogMembers returns the member zones listed in a copy of a catalog zone, canonical and absolute
+func catalogMembers(catalog string, current *secondaryCopy) ([]string, error) {
+	version := ""
+	var members []string
+	for _, record := range current.records {
+		name, err := LabelsToString(record.Name)
+		if err != nil {
+			return nil, err
+		}
+		name = CanonicalName(strings.TrimSuffix(name, ".") + ".")
+		switch {
+		case record.Type == TypeTXT && name == "version."+catalog:
+			if len(record.Data) > 0 && int(record.Data[0]) == len(record.Data)-1 {
+				version = string(record.Data[1:])
+			}
+		case record.Type == TypePTR:
+			// Members are at "<unique id>.zones.<catalog>"; names further down hold their properties
+			labels := splitName(name)
+			if len(labels) < 2 || strings.Join(labels[1:], ".")+"." != "zones."+catalog {
+				continue
+			}
+			member, _, ok := wireName(record.Data)
+			if !ok {
+				return nil, fmt.Errorf("malformed member %s", name)
+			}
+			members = append(members, CanonicalName(member))
+		}
+	}
+	if version != catalogVersion {
+		return nil, fmt.Errorf("unsupported catalog zone version %q, expected %q", version, catalogVersion)
+	}
+	return members, nil
+}
+
+// provision brings the member zones of a catalog in line with a new copy of it, starting the zones it added and
+// stopping those it dropped
+func (z *SecondaryZones) provision(catalog *SecondaryZone, current *secondaryCopy) error {
+	members, err := catalogMembers(catalog.Zone, current)
+	if err != nil {
+		return err
+	}
+	listed := map[string]bool{}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, member := range members {
+		listed[member] = true
+		if _, ok := z.zones[member]; ok {
+			continue
+		}
+		zone := z.newZone(SecondaryOptions{Zone: member, Primary: catalog.Primary, Key: catalog.Key}, catalog)
+		z.zones[member] = zone
+		fmt.Printf("Provisioned secondary zone %s from catalog zone %s\n", member, catalog.Zone)
+		go zone.maintain()
+	}
+	for name, zone := range z.zones {
+		if zone.catalog == catalog && !listed[name] {
+			close(zone.stop)
+			delete(z.zones, name)
+			fmt.Printf("Deprovisioned secondary zone %s, dropped from catalog zone %s\n", name, catalog.Zone)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+/*
+This module contains the fault injection toward clients enabled with the --chaos-* flags, for testing the retry logic of
+software built on top of the server. Every response may be delayed, and then independently dropped, replaced by
+SERVFAIL, or truncated; truncation only applies over UDP, so a client that retries over TCP succeeds. Delays hold the
+handling worker like a slow upstream would.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// DefaultChaosMaxDelay is the longest delay injected by default
+const DefaultChaosMaxDelay = 2 * time.Second
+
+// chaos is set once at startup, before any packet is handled
+var chaos ChaosOptions
+
+// ChaosOptions are the probabilities, each between 0 and 1, with which faults are injected into client responses
+type ChaosOptions struct {
+	Drop     float64
+	ServFail float64
+	Truncate float64
+	Delay    float64
+	MaxDelay time.Duration // Delays are uniformly distributed up to MaxDelay
+}
+
+// Validate checks that the probabilities are in range and that the exclusive faults together do not exceed 1
+func (opts ChaosOptions) Validate() error {
+	for _, p := range []float64{opts.Drop, opts.ServFail, opts.Truncate, opts.Delay} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("chaos probabilities must be between 0 and 1, got %g", p)
+		}
+	}
+	if sum := opts.Drop + opts.ServFail + opts.Truncate; sum > 1 {
+		return fmt.Errorf("the drop, SERVFAIL, and truncation probabilities add up to %g, more than 1", sum)
+	}
+	if opts.Delay > 0 && opts.MaxDelay <= 0 {
+		return fmt.Errorf("delays need a positive maximum delay")
+	}
+	return nil
+}
+
+// Enabled reports whether any fault is injected
+func (opts ChaosOptions) Enabled() bool {
+	return opts.Drop > 0 || opts.ServFail > 0 || opts.Truncate > 0 || opts.Delay > 0
+}
+
+// Apply injects faults into the encoded response to a client at source, returning nil if it is to be dropped
+func (opts ChaosOptions) Apply(response []byte, source net.Addr) []byte {
+	if response == nil || !opts.Enabled() {
+		return response
+	}
+	if rand.Float64() < opts.Delay {
+		delay := rand.N(opts.MaxDelay)
+		debugf(ComponentPolicy, "Chaos: delaying the response to %s by %s", source, delay)
+		time.Sleep(delay)
+	}
+	_, stream := source.(*net.TCPAddr)
+	switch roll := rand.Float64(); {
+	case roll < opts.Drop:
+		debugf(ComponentPolicy, "Chaos: dropping the response to %s", source)
+		return nil
+	case roll < opts.Drop+opts.ServFail:
+		debugf(ComponentPolicy, "Chaos: answering %s with SERVFAIL", source)
+		return stripRecords(response, 0, RCodeServFail)
+	case roll < opts.Drop+opts.ServFail+opts.Truncate && !stream:
+		debugf(ComponentPolicy, "Chaos: truncating the response to %s", source)
+		return stripRecords(response, TCMask, RCodeNoError)
+	}
+	return response
+}
+
+// stripRecords returns the header and question of an encoded response with every record removed, the given flags set,
+// and rCode in place of the original one; the response is returned unchanged if its question cannot be located
+func stripRecords(response []byte, flags, rCode uint16) []byte {
+	message, err := ParseLazy(response)
+	if err != nil {
+		return response
+	}
+	questions, err := message.SectionBytes(SectionQuestion)
+	if err != nil {
+		return response
+	}
+	stripped := append([]byte(nil), response[:DNSHeaderSize+len(questions)]...)
+	header := binary.BigEndian.Uint16(stripped[2:])
+	binary.BigEndian.PutUint16(stripped[2:], header&^RCodeMask|flags|rCode<<RCodeShift)
+	clear(stripped[6:DNSHeaderSize]) // Answer, authority, and additional counts
+	return stripped
+}
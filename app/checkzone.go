@@ -0,0 +1,175 @@
+package main
+
+/*
+This module contains the zone validator and the "checkzone" subcommand built on it. Beyond record syntax, a zone is
+checked for the rules of RFC 1034/1035 and RFC 2181 that servers otherwise trip over at runtime: a single SOA at the
+apex, apex NS records, CNAMEs without other data, glue for in-zone name servers, and no data hidden below delegations.
+*/
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ZoneProblem is a rule violation found in a zone, tied to the offending record where there is one
+type ZoneProblem struct {
+	Record  *ZoneRecord
+	Message string
+}
+
+func (problem ZoneProblem) String() string {
+	if problem.Record == nil {
+		return problem.Message
+	}
+	return problem.Record.Position() + ": " + problem.Message
+}
+
+// runCheckZone implements the "checkzone" subcommand
+func runCheckZone(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: checkzone <origin> <file>")
+	}
+	origin := strings.TrimSuffix(args[0], ".") + "."
+	records, syntaxErr := ParseZoneFile(args[1], origin)
+	if records == nil && syntaxErr != nil {
+		return syntaxErr
+	}
+	failed := syntaxErr != nil
+	if syntaxErr != nil {
+		fmt.Println(syntaxErr)
+	}
+	problems := CheckZone(origin, records)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if failed || len(problems) > 0 {
+		return fmt.Errorf("zone %s/IN: not loaded due to errors", args[0])
+	}
+	fmt.Printf("zone %s/IN: loaded %d records, serial %d\nOK\n", args[0], len(records), zoneSerial(origin, records))
+	return nil
+}
+
+// CheckZone validates the records of the zone origin and returns the problems found, in file order
+func CheckZone(origin string, records []ZoneRecord) []ZoneProblem {
+	var problems []ZoneProblem
+	report := func(record *ZoneRecord, format string, args ...any) {
+		problems = append(problems, ZoneProblem{Record: record, Message: fmt.Sprintf(format, args...)})
+	}
+	names := NewDomainTree[map[uint16][]*ZoneRecord]()
+	for i := range records {
+		record := &records[i]
+		name, err := LabelsToString(record.Name)
+		if err != nil {
+			report(record, "invalid owner name: %v", err)
+			continue
+		}
+		if !inDomain(name, origin) {
+			report(record, "%s is outside the zone %s", name, origin)
+			continue
+		}
+		names.Update(name, func(byType map[uint16][]*ZoneRecord, present bool) map[uint16][]*ZoneRecord {
+			if !present {
+				byType = map[uint16][]*ZoneRecord{}
+			}
+			byType[record.Type] = append(byType[record.Type], record)
+			return byType
+		})
+	}
+
+	apex, _ := names.Get(origin)
+	switch soas := apex[TypeSOA]; {
+	case len(soas) == 0:
+		report(nil, "zone %s has no SOA record at its apex", origin)
+	case len(soas) > 1:
+		for _, soa := range soas[1:] {
+			report(soa, "zone %s has more than one SOA record", origin)
+		}
+	}
+	if len(apex[TypeNS]) == 0 {
+		report(nil, "zone %s has no NS records at its apex", origin)
+	}
+
+	delegations := NewDomainTree[string]()
+	names.Walk(func(name string, byType map[uint16][]*ZoneRecord) {
+		if !EqualNames(name, origin) && len(byType[TypeNS]) > 0 {
+			delegations.Insert(name, name)
+		}
+	})
+	names.Walk(func(name string, byType map[uint16][]*ZoneRecord) {
+		if !EqualNames(name, origin) {
+			for _, soa := range byType[TypeSOA] {
+				report(soa, "SOA record for %s is not at the zone apex", name)
+			}
+		}
+		if cnames := byType[TypeCNAME]; len(cnames) > 0 {
+			for _, cname := range cnames[1:] {
+				report(cname, "%s has more than one CNAME record", name)
+			}
+			for recordType, others := range byType {
+				if recordType != TypeCNAME {
+					report(others[0], "%s has a CNAME record and other data (%s)", name, TypeString(recordType))
+				}
+			}
+		}
+		if cut, labels, ok := delegations.LongestSuffix(name); ok && labels < len(reversedLabels(name)) {
+			for recordType, hidden := range byType {
+				if recordType != TypeA && recordType != TypeAAAA {
+					report(hidden[0], "%s record for %s is hidden below the delegation at %s", TypeString(recordType), name, cut)
+				}
+			}
+		}
+		for _, ns := range byType[TypeNS] {
+			target, rest, ok := wireName(ns.Data)
+			if !ok || len(rest) > 0 {
+				continue
+			}
+			if !inDomain(target, origin) {
+				continue
+			}
+			if targetTypes, _ := names.Get(target); len(targetTypes[TypeA])+len(targetTypes[TypeAAAA]) == 0 {
+				report(ns, "name server %s of %s is inside the zone but has no A or AAAA record (missing glue)", target, name)
+			}
+		}
+	})
+
+	slices.SortStableFunc(problems, func(a, b ZoneProblem) int {
+		if a.Record == nil || b.Record == nil {
+			return cmp.Compare(boolRank(a.Record != nil), boolRank(b.Record != nil))
+		}
+		return cmp.Or(cmp.Compare(a.Record.File, b.Record.File), cmp.Compare(a.Record.Line, b.Record.Line))
+	})
+	return problems
+}
+
+// inDomain reports whether name equals domain or is below it, ignoring case
+func inDomain(name, domain string) bool {
+	name, domain = CanonicalName(name), CanonicalName(domain)
+	return domain == "." || name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// boolRank orders false before true
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// zoneSerial returns the serial of the zone's apex SOA record, or zero without one
+func zoneSerial(origin string, records []ZoneRecord) uint32 {
+	for _, record := range records {
+		name, _ := LabelsToString(record.Name)
+		if record.Type != TypeSOA || !EqualNames(name, origin) {
+			continue
+		}
+		if _, rest, ok := wireName(record.Data); ok {
+			if _, rest, ok = wireName(rest); ok && len(rest) == 20 {
+				return binary.BigEndian.Uint32(rest)
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+/*
+This module contains the routing of questions by class. Only the IN class is forwarded: upstreams are Internet
+resolvers, and a question of another class passed on to them would at best be answered for the wrong namespace. Other
+classes are answered from the local records, which may hold records of any class, and for CH from the built-in records
+describing the server (version.bind and version.server); anything else is refused.
+*/
+
+// ServerVersion is the version string the server reports for version.bind and version.server queries in class CH
+const ServerVersion = "CodeCrafters-Go-DNS"
+
+// chaosVersionNames lists the CH names reporting ServerVersion
+var chaosVersionNames = []string{"version.bind.", "version.server."}
+
+// Forwardable reports whether questions of class can be forwarded upstream
+func Forwardable(class uint16) bool {
+	return class == ClassIN
+}
+
+// answerClass answers a request whose question is of a class that is not forwarded, from the built-in records if they
+// cover it and with REFUSED otherwise
+func (f *Forwarder) answerClass(requestMessage *DNSMessage) (*DNSMessage, error) {
+	question := requestMessage.Questions[0]
+	name, err := LabelsToString(question.Name)
+	if err != nil {
+		return nil, err
+	}
+	if records, ok := builtinRecords(name, question.Type, question.Class); ok {
+		debugf(ComponentPolicy, "Built-in answer: %s", question)
+		header, err := requestMessage.Header.ModifyDNSHeader(ModifyAA(1))
+		if err != nil {
+			return nil, err
+		}
+		return &DNSMessage{Header: header, Questions: requestMessage.Questions, Answers: []*DNSAnswer{{ResourceRecords: records}}}, nil
+	}
+	debugf(ComponentPolicy, "Refusing question of class %s: %s", ClassString(question.Class), question)
+	header, err := requestMessage.Header.ModifyDNSHeader(ModifyRCode(RCodeRefused))
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{Header: header, Questions: requestMessage.Questions}, nil
+}
+
+// builtinRecords returns the built-in records of qType and qClass under name
+func builtinRecords(name string, qType, qClass uint16) ([]ResourceRecord, bool) {
+	if qClass != ClassCH || qType != TypeTXT {
+		return nil, false
+	}
+	for _, versionName := range chaosVersionNames {
+		if EqualNames(name, versionName) {
+			record, err := NewResourceRecord(name, TypeTXT, ClassCH, 0, []string{ServerVersion}, "")
+			return []ResourceRecord{record}, err == nil
+		}
+	}
+	return nil, false
+}
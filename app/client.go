@@ -0,0 +1,42 @@
+package main
+
+/*
+This module contains the Client, a small stub-resolver library built on the codec and the upstream transports, used by
+the client-side subcommands.
+*/
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Client sends queries to a single DNS server
+type Client struct {
+	upstream Upstream
+}
+
+// NewClient creates a client for a server given as [udp://|tcp://|tls://]ip:port[#tls-server-name]
+func NewClient(server string) (*Client, error) {
+	upstream, err := NewUpstream(server, UpstreamOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{upstream: upstream}, nil
+}
+
+// Query asks the server a single question and returns its response along with the round-trip time
+func (c *Client) Query(opts DNSQuestionOptions) (*DNSMessage, time.Duration, error) {
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.Exchange(query)
+}
+
+// Exchange sends a prepared query message and returns the server's response along with the round-trip time
+func (c *Client) Exchange(query *DNSMessage) (*DNSMessage, time.Duration, error) {
+	start := time.Now()
+	response, err := c.upstream.Exchange(context.Background(), query)
+	return response, time.Since(start), err
+}
@@ -0,0 +1,506 @@
+package main
+
+/*
+This module contains the server configuration and its parsing from command-line flags.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListenConfig holds the settings of the client-facing sockets
+type ListenConfig struct {
+	Address        string // IP address to bind
+	Port           int
+	UDP            bool
+	TCP            bool
+	MaxUDPSize     int           // Largest datagram received and largest response sent to EDNS clients over UDP
+	TCPIdleTimeout time.Duration // How long a client connection may stay without a query
+	DoHAddr        string        // Address to answer DNS over HTTPS on, as host:port; empty disables it
+	DoHCert        string        // Certificate of the DNS-over-HTTPS listener; empty serves plain HTTP
+	DoHKey         string
+	ProxyProtocol  []netip.Prefix // Networks of load balancers whose stream connections start with a PROXY protocol header
+}
+
+// Addr returns the address the client sockets bind, as ip:port
+func (listen ListenConfig) Addr() string {
+	return net.JoinHostPort(listen.Address, strconv.Itoa(listen.Port))
+}
+
+// Config holds the settings the server runs with
+type Config struct {
+	Listen           ListenConfig
+	Resolver         string
+	Search           *ResolvConf // Search list of the system resolver configuration in stub mode
+	CacheShards      int
+	CacheMaxBytes    int64
+	PrefetchHits     uint64
+	TTLBounds        TTLBounds
+	Upstream         UpstreamOptions
+	RecordsFile      string
+	Records          []ResourceRecord // Local records given inline with --record
+	HostsFiles       []string
+	AutoPTR          bool // Whether A and AAAA records of Records and RecordsFile also answer reverse lookups
+	BlocklistFile    string
+	WarmFile         string
+	WatchInterval    time.Duration
+	AdminAddr        string
+	RaceStagger      time.Duration
+	RetransmitWindow time.Duration // How long client queries are remembered to suppress their retransmits
+	SharedCache      string        // Redis server shared by instances as a second cache level, if set
+	Registry         string        // Consul or etcd prefix whose service registrations are served, if set
+	Kubernetes       KubernetesOptions
+	Plugins          []string // Plugins questions are resolved through, in order
+	Geo              GeoOptions
+	Flatten          FlattenOptions
+	Rotation         RotationOptions
+	TypeRoutes       []TypeRoute
+	Secondaries      []SecondaryOptions
+	Rewrites         []*RewriteRule
+	Health           HealthOptions
+	MDNS             MDNSOptions
+	DDNS             DDNSOptions
+	Limiter          LimiterOptions
+	Workers          WorkerPoolOptions
+	Verbosity        int      // 0 by default, 1 with -v, 2 with -vv
+	Debug            []string // Components whose debug messages are logged
+	Chaos            ChaosOptions
+	DumpPackets      bool
+	StrictEncode     bool   // Fail to encode messages whose header counts do not match their sections
+	QueryLog         string // File every client query is appended to, if set
+	Webhooks         []WebhookOptions
+	WebhookInterval  time.Duration
+	Daemon           DaemonOptions
+	Flags            *flag.FlagSet     // The flags the configuration was parsed from, holding the effective values
+	Sources          map[string]string // Where each setting that is not a default came from, by flag name
+}
+
+// Captures the command-line flags, layered over the values of the --config file, into a Config
+func parseFlags(flags *flag.FlagSet, args []string) (*Config, error) {
+	configFile := flags.String("config", "", "JSON file of settings keyed by flag name, applied beneath the command-line flags")
+	listenAddress := flags.String("listen", "127.0.0.1", "IP address to listen on for clients")
+	port := flags.Int("port", 2053, "Port to listen on for clients")
+	udp := flags.Bool("udp", true, "Accept client queries over UDP")
+	tcp := flags.Bool("tcp", false, "Accept client queries over TCP")
+	maxUDPSize := flags.Int("max-udp-size", EDNSUDPSize, "Largest UDP message received from or sent to clients; responses only exceed 512 bytes for EDNS clients advertising more")
+	tcpIdleTimeout := flags.Duration("tcp-idle-timeout", DefaultTCPIdleTimeout, "How long a client TCP connection may stay without a query before it is closed")
+	dohAddr := flags.String("doh", "", "Address to answer DNS over HTTPS (RFC 8484) and the JSON API on at "+dohPath+", as host:port (disabled by default)")
+	dohCert := flags.String("doh-cert", "", "Certificate (PEM) of the --doh listener; without one it serves plain HTTP")
+	dohKey := flags.String("doh-key", "", "Private key (PEM) of --doh-cert")
+	proxyProtocol := flags.String("proxy-protocol", "", "Comma-separated networks of TCP load balancers whose connections to the TCP and --doh listeners start with a PROXY protocol (v1 or v2) header giving the client's address, e.g. 10.0.0.0/24")
+	resolverFlag := flags.String("resolver", "", "The resolver address in the form [udp://|tcp://|tls://]host:port[#tls-server-name], host names being resolved via --bootstrap; a comma-separated list races queries across several resolvers (defaults to the nameservers of --resolv-conf)")
+	resolvConfPath := flags.String("resolv-conf", DefaultResolvConfPath, "Resolver configuration whose nameservers and search list are used when --resolver is omitted")
+	cacheShards := flags.Int("cache-shards", DefaultCacheShards, "Number of independently locked cache shards")
+	cacheMaxBytes := flags.Int64("cache-size", DefaultCacheMaxBytes, "Approximate cache memory budget in bytes")
+	prefetchHits := flags.Uint64("prefetch-hits", DefaultPrefetchMinHits, "Cache hits that make an entry refreshed shortly before it expires (0 disables prefetching)")
+	minTTL := flags.Uint("min-ttl", 0, "Lowest TTL in seconds applied to cached and served answers")
+	maxTTL := flags.Uint("max-ttl", 0, "Highest TTL in seconds applied to cached and served answers (0 disables)")
+	bootstrap := flags.String("bootstrap", "", "Resolver (ip[:port]) for resolver host names, queried over UDP; it must be an address, not a host name, and defaults to the system resolver")
+	upstreamCA := flags.String("upstream-ca", "", "PEM bundle of certificate authorities tls:// upstreams are trusted by besides the system trust store, e.g. a corporate proxy's or a private resolver's")
+	upstreamCert := flags.String("upstream-cert", "", "Client certificate (PEM) presented to tls:// upstreams that ask for one")
+	upstreamKey := flags.String("upstream-key", "", "Private key (PEM) of --upstream-cert")
+	upstreamIdle := flags.Duration("upstream-idle", DefaultUpstreamIdleTimeout, "How long unused TCP/TLS upstream connections stay open")
+	upstreamStreams := flags.Int("upstream-streams", DefaultUpstreamMaxStreams, "Maximum outstanding queries per TCP/TLS upstream connection")
+	upstreamConns := flags.Int("upstream-conns", DefaultUpstreamMaxConns, "Maximum TCP/TLS connections per upstream")
+	recordsFile := flags.String("records", "", "File of local records, one per line in presentation format (\"nas.home. 300 IN A 192.168.1.10\")")
+	var inlineRecords stringList
+	var services stringList
+	flags.Var(&services, "service", "DNS-SD service advertised to unicast browsers, as \"<instance> <_service._proto> <domain> <target> <port> [<key=value>...]\", e.g. '\"Office Printer\" _ipp._tcp home. printer.home. 631 rp=queue'; may be repeated")
+	flags.Var(&inlineRecords, "record", "Local record in presentation format, e.g. \"nas.home 300 IN A 192.168.1.10\"; may be repeated")
+	hostsFiles := flags.String("hosts", DefaultHostsPath, "Comma-separated hosts files whose names are answered locally with A, AAAA, and PTR records (empty disables)")
+	autoPTR := flags.Bool("auto-ptr", false, "Answer reverse lookups for the A and AAAA records of --record and --records that have no PTR record of their own")
+	watchInterval := flags.Duration("watch-interval", DefaultWatchInterval, "How often local data files are checked for changes and reloaded (0 disables)")
+	blocklistFile := flags.String("blocklist", "", "File of domains to answer with NXDOMAIN, one per line or in hosts-file form")
+	warmFile := flags.String("warm-file", "", "File of popular names (optionally followed by a record type) to resolve into the cache at startup")
+	adminAddr := flags.String("admin", "", "Address to serve the admin interface on, e.g. "+DefaultAdminAddr+" (disabled by default)")
+	raceStagger := flags.Duration("race-stagger", DefaultRaceStagger, "How long a query waits for an answer before also being sent to the next resolver")
+	sharedCache := flags.String("shared-cache", "", "Redis server, as redis://[:password@]host:port[/db], holding a cache shared with other instances behind the in-memory one")
+	registry := flags.String("registry", "", "Service registry whose registrations are served as records, as consul://host:port[/prefix] or etcd://host:port[/prefix] (prefix "+DefaultRegistryPrefix+" by default)")
+	plugins := flags.String("plugins", DefaultPlugins, "Comma-separated plugins questions are resolved through, in order, before being forwarded: any of "+strings.Join(RegisteredPlugins(), ", "))
+	rotate := flags.String("rotate", RotateNone, "How the address records of local names are reordered per response: none, round-robin, random, or weighted")
+	var secondaryZones stringList
+	flags.Var(&secondaryZones, "secondary", "Zone kept as a secondary by transfers from its primary and answered authoritatively, as \"<zone> <primary>[ <key name>:<base64 secret>]\"; the primary's NOTIFY messages trigger transfers, and must be signed with the TSIG key if one is given; may be repeated")
+	var catalogZones stringList
+	flags.Var(&catalogZones, "catalog", "Catalog zone (RFC 9432) kept like --secondary, as \"<zone> <primary>[ <key name>:<base64 secret>]\", whose member zones are kept as secondary zones from the same primary with the same key; may be repeated")
+	var typeRoutes stringList
+	flags.Var(&typeRoutes, "route-type", "Upstream the questions of a record type are forwarded to instead of --resolver, or \""+TypeRouteBlock+"\" to refuse them, as \"<type> <upstream>\", e.g. \"PTR udp://192.168.1.1:53\" or \"ANY "+TypeRouteBlock+"\"; may be repeated")
+	var rewriteRules stringList
+	flags.Var(&rewriteRules, "rewrite", "Rule of the rewrite plugin, as \"name exact|suffix|regex <from> <to>\" to resolve questions for another name (e.g. \"name suffix corp.example.com home\") or \"answer <address> <address>\" to replace an address in answers; may be repeated")
+	var recordWeights stringList
+	flags.Var(&recordWeights, "record-weight", "Weight of a local address record for --rotate weighted, as \"<name> <address> <weight>\" (1 by default); may be repeated")
+	var healthChecks stringList
+	flags.Var(&healthChecks, "health-check", "Health check of the addresses of a local name, as \"<name> tcp:<port>\" or \"<name> http[s]:<port>[/path]\"; failing addresses are left out of answers; may be repeated")
+	healthInterval := flags.Duration("health-interval", DefaultHealthInterval, "How often health checks probe the addresses of local names")
+	healthTimeout := flags.Duration("health-timeout", DefaultHealthTimeout, "How long a health check probe may take")
+	geoDatabase := flags.String("geoip-db", "", "MaxMind DB (.mmdb) locating clients for the geo plugin")
+	var geoRecords, geoUpstreams stringList
+	flags.Var(&geoRecords, "geo-record", "Record answering clients of the given countries or continents through the geo plugin, as \"<region>[,<region>...] <record>\", e.g. \"DE,AT www.home 300 IN A 192.0.2.1\"; may be repeated")
+	flags.Var(&geoUpstreams, "geo-upstream", "Upstream the geo plugin forwards the questions of clients of the given countries or continents to, as \"<region>[,<region>...] <upstream>\"; may be repeated")
+	flatten := flags.String("flatten", "", "Comma-separated names whose CNAME chains the flatten plugin resolves, answering A and AAAA questions for them with the addresses at the end")
+	flattenDepth := flags.Int("flatten-depth", DefaultFlattenDepth, "How many CNAMEs the flatten plugin follows before answering SERVFAIL")
+	kubernetesAPI := flags.String("kubernetes", "", "Kubernetes API server whose services are answered beneath --kubernetes-zone, as the URL of e.g. \"kubectl proxy\", or \""+KubernetesInCluster+"\" inside a pod")
+	kubernetesZone := flags.String("kubernetes-zone", DefaultKubernetesZone, "Cluster domain answered from --kubernetes")
+	mdnsMode := flags.String("mdns", MDNSNXDomain, "How questions for names under local., which RFC 6762 reserves for Multicast DNS, are answered: nxdomain, resolve (with multicast queries on the link), or forward (upstream, like any other)")
+	mdnsTimeout := flags.Duration("mdns-timeout", DefaultMDNSTimeout, "How long a multicast query for a local. name waits for a response with --mdns=resolve")
+	ddnsName := flags.String("ddns-name", "", "Host name kept pointing at this machine's address with dynamic DNS updates (RFC 2136); empty disables them")
+	ddnsZone := flags.String("ddns-zone", "", "Zone holding --ddns-name")
+	ddnsServer := flags.String("ddns-server", "", "Primary server of --ddns-zone, which updates are sent to, as [udp://|tcp://]host:port")
+	ddnsInterface := flags.String("ddns-interface", "", "Network interface whose address is published (by default, the public address reported by --ddns-address-url)")
+	ddnsAddressURL := flags.String("ddns-address-url", DefaultDDNSAddressURL, "Web service answering with the public address of the machine as plain text")
+	ddnsInterval := flags.Duration("ddns-interval", DefaultDDNSInterval, "How often the address published with --ddns-name is checked")
+	ddnsTTL := flags.Uint("ddns-ttl", DefaultDDNSTTL, "TTL of the address record published with --ddns-name")
+	ddnsKey := flags.String("ddns-key", "", "TSIG key signing the updates, as <name>:<base64 secret> for HMAC-SHA256")
+	retransmitWindow := flags.Duration("retransmit-window", DefaultRetransmitWindow, "How long a client query is remembered, so that retransmits of it are dropped or answered with its response instead of being resolved again (0 disables)")
+	upstreamMinTimeout := flags.Duration("upstream-min-timeout", DefaultUpstreamMinTimeout, "Lower bound of the per-query upstream timeout derived from the smoothed RTT")
+	upstreamLatency := flags.String("upstream-latency", "", "Delay injected into every upstream exchange, for testing timeouts and racing; a comma-separated list gives one per --resolver")
+	upstreamJitter := flags.Duration("upstream-jitter", 0, "Upper bound of a random delay injected on top of --upstream-latency")
+	jitterSeed := flags.Uint64("upstream-jitter-seed", 0, "Seed making --upstream-jitter reproducible (0 picks a random one)")
+	upstreamMaxTimeout := flags.Duration("upstream-max-timeout", UpstreamTimeout, "Upper bound of the per-query upstream timeout, used until an upstream's RTT is known")
+	maxUpstreamQueries := flags.Int64("max-upstream-queries", DefaultMaxUpstreamQueries, "Maximum upstream queries outstanding at once; raced queries count once per resolver")
+	upstreamQueue := flags.Int("upstream-queue", DefaultUpstreamQueueSize, "Queries that may wait for the upstream limit before further ones are answered with SERVFAIL")
+	upstreamQueueTimeout := flags.Duration("upstream-queue-timeout", DefaultUpstreamQueueTimeout, "How long a query may wait for the upstream limit before it is answered with SERVFAIL")
+	workers := flags.Int("workers", DefaultWorkers(), "Number of workers handling client packets (defaults to a multiple of GOMAXPROCS)")
+	workerQueue := flags.Int("worker-queue", DefaultWorkerQueueDepth, "Packets each worker may have waiting")
+	overload := flags.String("overload", OverloadDrop, "What to do with packets when their worker's queue is full: drop or queue")
+	logLevel := flags.String("log-level", LogLevelError, "Amount of logging: error (startup, reload, and failures), info (adds a line per client query), or debug (adds every component's debug messages)")
+	verbose := flags.Bool("v", false, "Log a line per client query")
+	veryVerbose := flags.Bool("vv", false, "Log a line per client query and the debug messages of every component")
+	debugFlag := flags.String("debug", "", "Comma-separated components whose debug messages are logged: "+strings.Join(debugComponents, ", "))
+	chaosDrop := flags.Float64("chaos-drop", 0, "Probability with which a client response is dropped, for testing client retries")
+	chaosServFail := flags.Float64("chaos-servfail", 0, "Probability with which a client response is replaced by SERVFAIL")
+	chaosTruncate := flags.Float64("chaos-truncate", 0, "Probability with which a UDP client response is emptied and marked truncated")
+	chaosDelay := flags.Float64("chaos-delay", 0, "Probability with which a client response is delayed by up to --chaos-max-delay")
+	chaosMaxDelay := flags.Duration("chaos-max-delay", DefaultChaosMaxDelay, "Longest delay injected by --chaos-delay")
+	dumpPackets := flags.Bool("dump-packets", false, "Log an annotated hexdump of every message received or sent")
+	strictEncode := flags.Bool("strict-encode", false, "Fail to encode messages whose preserved header counts do not match their sections instead of sending them")
+	var webhookSpecs stringList
+	flags.Var(&webhookSpecs, "webhook", "Webhook POSTed batches of matching queries, as \"<url> <event>[,<event>...]\" with events blocked, nxdomain, nxdomain-spike=<n>, and name=<domain>; may be repeated")
+	webhookInterval := flags.Duration("webhook-interval", DefaultWebhookInterval, "How often the events collected for webhooks are sent")
+	queryLogFile := flags.String("query-log", "", "File every client query is appended to as a line of JSON, for the \"replay\" subcommand")
+	pidFile := flags.String("pidfile", "", "File to write the process ID to")
+	dir := flags.String("chdir", "", "Directory to change into once the listening socket is bound")
+	userName := flags.String("user", "", "User to switch to once the listening socket is bound")
+	groupName := flags.String("group", "", "Group to switch to once the listening socket is bound (defaults to the user's primary group)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	sources := map[string]string{}
+	flags.Visit(func(f *flag.Flag) { sources[f.Name] = SourceFlag })
+	if err := applyEnvironment(flags, sources); err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		if err := applyConfigFile(flags, *configFile, sources); err != nil {
+			return nil, err
+		}
+	}
+	var search *ResolvConf
+	if *resolverFlag == "" {
+		conf, err := LoadResolvConf(*resolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("no --resolver given and no usable %s: %w", *resolvConfPath, err)
+		}
+		flags.Set("resolver", strings.Join(conf.Nameservers, ","))
+		search, sources["resolver"] = conf, *resolvConfPath
+	}
+	if net.ParseIP(*listenAddress) == nil {
+		return nil, fmt.Errorf("--listen must be an IP address, got %q", *listenAddress)
+	}
+	if *port < 0 || *port > 65535 {
+		return nil, fmt.Errorf("--port must be between 0 and 65535, got %d", *port)
+	}
+	if !*udp && !*tcp {
+		return nil, fmt.Errorf("at least one of --udp and --tcp must be enabled")
+	}
+	if (*upstreamCert == "") != (*upstreamKey == "") {
+		return nil, fmt.Errorf("--upstream-cert and --upstream-key must be given together")
+	}
+	rootCAs, clientCert, err := LoadUpstreamTLS(*upstreamCA, *upstreamCert, *upstreamKey)
+	if err != nil {
+		return nil, fmt.Errorf("--upstream-ca, --upstream-cert: %w", err)
+	}
+	if (*dohCert == "") != (*dohKey == "") {
+		return nil, fmt.Errorf("--doh-cert and --doh-key must be given together")
+	}
+	var proxyNetworks []netip.Prefix
+	for _, item := range splitList(*proxyProtocol) {
+		network, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return nil, fmt.Errorf("--proxy-protocol must be a list of networks or addresses, got %q", item)
+			}
+			network = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxyNetworks = append(proxyNetworks, network.Masked())
+	}
+	if *maxUDPSize < UDPMessageSize || *maxUDPSize > MaxStreamMessageSize {
+		return nil, fmt.Errorf("--max-udp-size must be between %d and %d, got %d", UDPMessageSize, MaxStreamMessageSize, *maxUDPSize)
+	}
+	if *bootstrap != "" {
+		if _, err := netip.ParseAddr(*bootstrap); err == nil {
+			*bootstrap = net.JoinHostPort(*bootstrap, "53")
+		}
+		if _, err := netip.ParseAddrPort(*bootstrap); err != nil {
+			return nil, fmt.Errorf("--bootstrap must be an IP address with an optional port: %w", err)
+		}
+	}
+	var latencies []time.Duration
+	for _, item := range splitList(*upstreamLatency) {
+		latency, err := time.ParseDuration(item)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("--upstream-latency must be a list of non-negative durations, got %q", item)
+		}
+		latencies = append(latencies, latency)
+	}
+	if *upstreamMinTimeout > *upstreamMaxTimeout {
+		return nil, fmt.Errorf("--upstream-min-timeout (%s) must not exceed --upstream-max-timeout (%s)", *upstreamMinTimeout, *upstreamMaxTimeout)
+	}
+	if *maxTTL > 0 && *minTTL > *maxTTL {
+		return nil, fmt.Errorf("--min-ttl (%d) must not exceed --max-ttl (%d)", *minTTL, *maxTTL)
+	}
+	verbosity := slices.Index(logLevels, *logLevel)
+	if verbosity < 0 {
+		return nil, fmt.Errorf("--log-level must be one of %s, got %q", strings.Join(logLevels, ", "), *logLevel)
+	}
+	if *veryVerbose {
+		verbosity = max(verbosity, 2)
+	} else if *verbose {
+		verbosity = max(verbosity, 1)
+	}
+	debug := splitList(*debugFlag)
+	for _, component := range debug {
+		if !slices.Contains(debugComponents, component) {
+			return nil, fmt.Errorf("--debug: unknown component %q (want %s)", component, strings.Join(debugComponents, ", "))
+		}
+	}
+	chaosOptions := ChaosOptions{Drop: *chaosDrop, ServFail: *chaosServFail, Truncate: *chaosTruncate, Delay: *chaosDelay, MaxDelay: *chaosMaxDelay}
+	if err := chaosOptions.Validate(); err != nil {
+		return nil, fmt.Errorf("--chaos-*: %w", err)
+	}
+	mdns := MDNSOptions{Mode: *mdnsMode, Timeout: *mdnsTimeout}
+	if err := mdns.Validate(); err != nil {
+		return nil, fmt.Errorf("--mdns: %w", err)
+	}
+	ddns := DDNSOptions{
+		Name:       *ddnsName,
+		Zone:       *ddnsZone,
+		Server:     *ddnsServer,
+		Interface:  *ddnsInterface,
+		AddressURL: *ddnsAddressURL,
+		Interval:   *ddnsInterval,
+		TTL:        uint32(*ddnsTTL),
+	}
+	if *ddnsKey != "" {
+		key, err := ParseTSIGKey(*ddnsKey)
+		if err != nil {
+			return nil, fmt.Errorf("--ddns-key: %w", err)
+		}
+		ddns.Key = key
+	}
+	if err := ddns.Validate(); err != nil {
+		return nil, fmt.Errorf("--ddns-*: %w", err)
+	}
+	rotation := RotationOptions{Strategy: *rotate}
+	for _, line := range recordWeights {
+		if rotation.Weights == nil {
+			rotation.Weights = map[string]map[netip.Addr]float64{}
+		}
+		if err := ParseRecordWeight(line, rotation.Weights); err != nil {
+			return nil, fmt.Errorf("--record-weight: %w", err)
+		}
+	}
+	if err := rotation.Validate(); err != nil {
+		return nil, fmt.Errorf("--rotate: %w", err)
+	}
+	var routes []TypeRoute
+	for _, line := range typeRoutes {
+		route, err := ParseTypeRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("--route-type: %w", err)
+		}
+		routes = append(routes, route)
+	}
+	var secondaries []SecondaryOptions
+	for _, line := range secondaryZones {
+		secondary, err := ParseSecondary(line)
+		if err != nil {
+			return nil, fmt.Errorf("--secondary: %w", err)
+		}
+		secondaries = append(secondaries, secondary)
+	}
+	for _, line := range catalogZones {
+		catalog, err := ParseSecondary(line)
+		if err != nil {
+			return nil, fmt.Errorf("--catalog: %w", err)
+		}
+		catalog.Catalog = true
+		secondaries = append(secondaries, catalog)
+	}
+	var rewrites []*RewriteRule
+	for _, line := range rewriteRules {
+		rule, err := ParseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("--rewrite: %w", err)
+		}
+		rewrites = append(rewrites, rule)
+	}
+	health := HealthOptions{Interval: *healthInterval, Timeout: *healthTimeout}
+	for _, line := range healthChecks {
+		check, err := ParseHealthCheck(line)
+		if err != nil {
+			return nil, fmt.Errorf("--health-check: %w", err)
+		}
+		health.Checks = append(health.Checks, check)
+	}
+	geo := GeoOptions{Database: *geoDatabase}
+	for _, line := range geoRecords {
+		record, err := ParseGeoRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("--geo-record %q: %w", line, err)
+		}
+		geo.Records = append(geo.Records, record)
+	}
+	for _, line := range geoUpstreams {
+		upstream, err := ParseGeoUpstream(line)
+		if err != nil {
+			return nil, fmt.Errorf("--geo-upstream %q: %w", line, err)
+		}
+		geo.Upstreams = append(geo.Upstreams, upstream)
+	}
+	var flattenNames []string
+	for _, name := range splitList(*flatten) {
+		flattenNames = append(flattenNames, CanonicalName(strings.TrimSuffix(name, ".")+"."))
+	}
+	var webhookOptions []WebhookOptions
+	for _, spec := range webhookSpecs {
+		opts, err := ParseWebhook(spec)
+		if err != nil {
+			return nil, fmt.Errorf("--webhook: %w", err)
+		}
+		webhookOptions = append(webhookOptions, opts)
+	}
+	kubernetes := KubernetesOptions{API: *kubernetesAPI, Zone: *kubernetesZone}
+	if err := kubernetes.Validate(); err != nil {
+		return nil, fmt.Errorf("--kubernetes: %w", err)
+	}
+	var records []ResourceRecord
+	for _, line := range inlineRecords {
+		record, err := ParseResourceRecord(line, RecordParseOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("--record %q: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	serviceRecords, err := ParseServices(services)
+	if err != nil {
+		return nil, fmt.Errorf("--service: %w", err)
+	}
+	records = append(records, serviceRecords...)
+	return &Config{
+		Listen: ListenConfig{
+			Address:        *listenAddress,
+			Port:           *port,
+			UDP:            *udp,
+			TCP:            *tcp,
+			MaxUDPSize:     *maxUDPSize,
+			TCPIdleTimeout: *tcpIdleTimeout,
+			DoHAddr:        *dohAddr,
+			DoHCert:        *dohCert,
+			DoHKey:         *dohKey,
+			ProxyProtocol:  proxyNetworks,
+		},
+		Resolver:      *resolverFlag,
+		Search:        search,
+		CacheShards:   *cacheShards,
+		CacheMaxBytes: *cacheMaxBytes,
+		PrefetchHits:  *prefetchHits,
+		TTLBounds:     TTLBounds{Min: uint32(*minTTL), Max: uint32(*maxTTL)},
+		Upstream: UpstreamOptions{
+			IdleTimeout: *upstreamIdle,
+			MaxStreams:  *upstreamStreams,
+			MaxConns:    *upstreamConns,
+			MinTimeout:  *upstreamMinTimeout,
+			MaxTimeout:  *upstreamMaxTimeout,
+			Bootstrap:   *bootstrap,
+			Latency:     latencies,
+			Jitter:      *upstreamJitter,
+			JitterSeed:  *jitterSeed,
+			RootCAs:     rootCAs,
+			ClientCert:  clientCert,
+		},
+		RecordsFile:      *recordsFile,
+		Records:          records,
+		HostsFiles:       splitList(*hostsFiles),
+		AutoPTR:          *autoPTR,
+		BlocklistFile:    *blocklistFile,
+		WarmFile:         *warmFile,
+		WatchInterval:    *watchInterval,
+		AdminAddr:        *adminAddr,
+		RaceStagger:      *raceStagger,
+		RetransmitWindow: *retransmitWindow,
+		SharedCache:      *sharedCache,
+		Registry:         *registry,
+		Kubernetes:       kubernetes,
+		Plugins:          splitList(*plugins),
+		Geo:              geo,
+		Flatten:          FlattenOptions{Names: flattenNames, Depth: *flattenDepth},
+		Rotation:         rotation,
+		TypeRoutes:       routes,
+		Secondaries:      secondaries,
+		Rewrites:         rewrites,
+		Health:           health,
+		MDNS:             mdns,
+		DDNS:             ddns,
+		Workers:          WorkerPoolOptions{Workers: *workers, QueueDepth: *workerQueue, Overload: *overload},
+		Limiter:          LimiterOptions{MaxOutstanding: *maxUpstreamQueries, MaxQueue: *upstreamQueue, QueueTimeout: *upstreamQueueTimeout},
+		Verbosity:        verbosity,
+		Debug:            debug,
+		Chaos:            chaosOptions,
+		DumpPackets:      *dumpPackets,
+		StrictEncode:     *strictEncode,
+		QueryLog:         *queryLogFile,
+		Webhooks:         webhookOptions,
+		WebhookInterval:  *webhookInterval,
+		Daemon:           DaemonOptions{PIDFile: *pidFile, Dir: *dir, User: *userName, Group: *groupName},
+		Flags:            flags,
+		Sources:          sources,
+	}, nil
+}
+
+// stringList is the value of a flag that may be repeated, collecting every occurrence
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, "; ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) Get() any {
+	return []string(*l)
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,58 @@
+package main
+
+/*
+This module contains the environment variable layer of the configuration. Every flag can be set with a variable named
+after it, prefixed with DNS_, upper-cased, and with dashes turned into underscores (DNS_LISTEN, DNS_RESOLVER,
+DNS_LOG_LEVEL, ...). Variables apply beneath the command-line flags and above the configuration file, so a container
+can be configured without templating a file.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix starts the name of every configuration variable
+const EnvPrefix = "DNS_"
+
+// envName returns the variable that sets the flag called name
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvironment sets every flag whose variable is set and that is not already in sources, recording it there;
+// repeatable flags take one value per line
+func applyEnvironment(flags *flag.FlagSet, sources map[string]string) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if _, set := sources[f.Name]; !ok || set || err != nil {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = splitLines(value)
+		}
+		for _, value := range values {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s=%q: %w", envName(f.Name), value, setErr)
+				return
+			}
+		}
+		sources[f.Name] = SourceEnv + " " + envName(f.Name)
+	})
+	return err
+}
+
+// splitLines returns the non-blank lines of value
+func splitLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
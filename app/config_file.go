@@ -0,0 +1,169 @@
+package main
+
+/*
+This module contains the configuration file layer and the "config" subcommand. A configuration file is a JSON object
+whose keys are flag names; its values apply wherever neither the command line nor the environment sets the same flag,
+so any setting can live in any of the three places. "config dump" prints the settings that result from all layers
+together.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of configuration values, as reported by "config dump"
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// applyConfigFile sets every flag named in the JSON object of path that is not already in sources, recording it there
+func applyConfigFile(flags *flag.FlagSet, path string, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // Keeps integers out of float64 so that they print back exactly
+	var values map[string]any
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, value := range values {
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if _, set := sources[name]; set {
+			continue
+		}
+		var text string
+		switch value := value.(type) {
+		case string:
+			text = value
+		case json.Number, bool:
+			text = fmt.Sprint(value)
+		case []any: // Lists are accepted for the comma-separated and the repeatable settings
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			if _, repeatable := flags.Lookup(name).Value.(*stringList); repeatable {
+				for _, item := range items {
+					if err := flags.Set(name, item); err != nil {
+						return fmt.Errorf("%s: setting %q: %w", path, name, err)
+					}
+				}
+				sources[name] = SourceFile
+				continue
+			}
+			text = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: setting %q must be a string, number, boolean, or list", path, name)
+		}
+		if err := flags.Set(name, text); err != nil {
+			return fmt.Errorf("%s: setting %q: %w", path, name, err)
+		}
+		sources[name] = SourceFile
+	}
+	return nil
+}
+
+// runConfig implements the "config" subcommand; "config dump [json|yaml] [server flags...]" prints the effective
+// configuration the server would run with given the same flags
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return fmt.Errorf("usage: config dump [json|yaml] [server flags...]")
+	}
+	args = args[1:]
+	format := "json"
+	if len(args) > 0 && (args[0] == "json" || args[0] == "yaml") {
+		format, args = args[0], args[1:]
+	}
+	config, err := parseFlags(flag.NewFlagSet("config dump", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	var settings []configSetting
+	config.Flags.VisitAll(func(f *flag.Flag) {
+		source, ok := config.Sources[f.Name]
+		if !ok {
+			source = SourceDefault
+		}
+		settings = append(settings, configSetting{name: f.Name, value: settingValue(f), source: source})
+	})
+	if format == "yaml" {
+		printYAMLSettings(settings)
+		return nil
+	}
+	return printJSONSettings(settings)
+}
+
+// configSetting is an effective setting with its origin
+type configSetting struct {
+	name   string
+	value  any
+	source string
+}
+
+// settingValue returns the typed value of a flag, rendering durations in their flag syntax
+func settingValue(f *flag.Flag) any {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String()
+	}
+	if duration, ok := getter.Get().(time.Duration); ok {
+		return duration.String()
+	}
+	return getter.Get()
+}
+
+// printJSONSettings prints settings as one JSON object in flag-name order
+func printJSONSettings(settings []configSetting) error {
+	var out strings.Builder
+	out.WriteString("{\n")
+	for i, setting := range settings {
+		value, err := json.Marshal(setting.value)
+		if err != nil {
+			return err
+		}
+		separator := ","
+		if i == len(settings)-1 {
+			separator = ""
+		}
+		fmt.Fprintf(&out, "  %q: %s%s\n", setting.name, value, separator)
+	}
+	out.WriteString("}")
+	fmt.Println(out.String())
+	return nil
+}
+
+// printYAMLSettings prints settings as YAML, noting where each one that is not a default came from
+func printYAMLSettings(settings []configSetting) {
+	for _, setting := range settings {
+		value := fmt.Sprint(setting.value)
+		switch typed := setting.value.(type) {
+		case string:
+			value = strconv.Quote(typed)
+		case []string: // As a flow sequence
+			quoted := make([]string, len(typed))
+			for i, item := range typed {
+				quoted[i] = strconv.Quote(item)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		}
+		if setting.source == SourceDefault {
+			fmt.Printf("%s: %s\n", setting.name, value)
+		} else {
+			fmt.Printf("%s: %s # from %s\n", setting.name, value, setting.source)
+		}
+	}
+}
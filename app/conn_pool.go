@@ -0,0 +1,158 @@
+package main
+
+/*
+This module contains the pool of warm stream connections (TCP or TLS) kept per upstream. Exchanges are spread over at
+most MaxConns pipelined connections with at most MaxStreams outstanding queries each; broken connections are replaced
+on demand and idle ones are closed after IdleTimeout.
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstreamIdleTimeout is how long an unused upstream connection is kept open by default
+	DefaultUpstreamIdleTimeout = 30 * time.Second
+	// DefaultUpstreamMaxStreams is the default limit of outstanding queries per upstream connection
+	DefaultUpstreamMaxStreams = 64
+	// DefaultUpstreamMaxConns is the default limit of connections per upstream
+	DefaultUpstreamMaxConns = 4
+)
+
+// connPool manages the stream connections to one upstream; it is safe for concurrent use
+type connPool struct {
+	addr      *upstreamAddress
+	tlsConfig *tls.Config // Nil for plain TCP
+	opts      UpstreamOptions
+	mu        sync.Mutex
+	available *sync.Cond // Signalled whenever a stream is released
+	conns     []*pipelinedConn
+	dialing   int // Connections being dialed, which count against MaxConns
+	reaping   bool
+}
+
+// newConnPool creates an empty pool for addr; connections are dialed lazily
+func newConnPool(addr *upstreamAddress, tlsConfig *tls.Config, opts UpstreamOptions) *connPool {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultUpstreamIdleTimeout
+	}
+	if opts.MaxStreams <= 0 {
+		opts.MaxStreams = DefaultUpstreamMaxStreams
+	}
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = DefaultUpstreamMaxConns
+	}
+	pool := &connPool{addr: addr, tlsConfig: tlsConfig, opts: opts}
+	pool.available = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// Acquire returns the least loaded healthy connection with a free stream, dialing a new one when all are busy and the
+// pool has room, or waiting for a stream to be released otherwise; release must be called when the exchange is done
+func (p *connPool) Acquire() (conn *pipelinedConn, release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		p.prune()
+		for _, candidate := range p.conns {
+			if candidate.streams < p.opts.MaxStreams && (conn == nil || candidate.streams < conn.streams) {
+				conn = candidate
+			}
+		}
+		if conn == nil && len(p.conns)+p.dialing < p.opts.MaxConns {
+			// The slot is reserved while dialing without the lock, so a slow upstream does not stall the pool
+			p.dialing++
+			p.mu.Unlock()
+			conn, err = p.dial()
+			p.mu.Lock()
+			p.dialing--
+			if err != nil {
+				p.available.Signal() // The slot is free for another waiter to dial
+				return nil, nil, err
+			}
+			p.conns = append(p.conns, conn)
+			p.startReaper()
+			p.available.Broadcast() // Its other streams are free for those who waited on the dial
+		}
+		if conn != nil {
+			break
+		}
+		p.available.Wait()
+	}
+	conn.streams++
+	return conn, func() { p.release(conn) }, nil
+}
+
+// release returns a stream to the pool
+func (p *connPool) release(conn *pipelinedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.streams--
+	conn.lastUsed = time.Now()
+	p.available.Signal()
+}
+
+// dial opens a new pipelined connection; the caller must not hold the pool lock
+func (p *connPool) dial() (*pipelinedConn, error) {
+	dialer := &net.Dialer{Timeout: UpstreamTimeout}
+	var conn net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr.String(), p.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", p.addr.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream %s: %w", p.addr, err)
+	}
+	pipelined := newPipelinedConn(conn)
+	pipelined.lastUsed = time.Now()
+	return pipelined, nil
+}
+
+// prune drops broken connections so they are replaced on demand; the caller must hold the pool lock
+func (p *connPool) prune() {
+	healthy := p.conns[:0]
+	for _, conn := range p.conns {
+		if !conn.Broken() {
+			healthy = append(healthy, conn)
+		}
+	}
+	clear(p.conns[len(healthy):])
+	p.conns = healthy
+}
+
+// startReaper launches the idle reaper unless it is already running; the caller must hold the pool lock
+func (p *connPool) startReaper() {
+	if p.reaping {
+		return
+	}
+	p.reaping = true
+	go p.reap()
+}
+
+// reap periodically closes connections idle for longer than IdleTimeout, exiting once the pool is empty
+func (p *connPool) reap() {
+	ticker := time.NewTicker(p.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		now := time.Now()
+		for _, conn := range p.conns {
+			if conn.streams == 0 && now.Sub(conn.lastUsed) > p.opts.IdleTimeout {
+				conn.fail(fmt.Errorf("idle for %s", p.opts.IdleTimeout))
+			}
+		}
+		p.prune()
+		if len(p.conns) == 0 {
+			p.reaping = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
@@ -3,6 +3,10 @@ package main
 const (
 	// DNSHeaderSize is the size of a DNS header in bytes
 	DNSHeaderSize = 12
+	// MaxLabelLength is the maximum length of a label's content in bytes
+	MaxLabelLength = 63
+	// MaxNameLength is the maximum length of an uncompressed name on the wire, length bytes and null label included
+	MaxNameLength = 255
 	// QRMax is the maximum value for the QR field
 	QRMax = 1
 	// OpCodeMax is the maximum value for the OpCode field
@@ -49,6 +53,66 @@ const (
 	RAMask = 1 << RAShift
 	// ZMask is the mask for the Z field
 	ZMask = 7 << ZShift
+	// ADMask is the mask for the AD (authentic data) bit of the Z field (RFC 4035)
+	ADMask = 2 << ZShift
+	// CDMask is the mask for the CD (checking disabled) bit of the Z field (RFC 4035)
+	CDMask = 1 << ZShift
 	// RCodeMask is the mask for the RCode field
 	RCodeMask = 15 << RCodeShift
 )
+
+// Resource record types
+const (
+	TypeA          = 1
+	TypeNS         = 2
+	TypeCNAME      = 5
+	TypeSOA        = 6
+	TypePTR        = 12
+	TypeMX         = 15
+	TypeTXT        = 16
+	TypeAAAA       = 28
+	TypeSRV        = 33
+	TypeOPT        = 41
+	TypeRRSIG      = 46
+	TypeDNSKEY     = 48
+	TypeNSEC3      = 50
+	TypeNSEC3PARAM = 51
+	TypeTSIG       = 250 // Meta-record signing a message, never stored
+)
+
+// Query types, which only appear in questions
+const (
+	TypeIXFR  = 251
+	TypeAXFR  = 252
+	TypeMAILB = 253
+	TypeMAILA = 254
+	TypeANY   = 255
+)
+
+// Resource record classes
+const (
+	ClassIN   = 1
+	ClassCH   = 3
+	ClassHS   = 4
+	ClassNONE = 254 // Deletes a record in updates (RFC 2136)
+	ClassANY  = 255 // Deletes an RRset in updates (RFC 2136), and the class of TSIG records
+)
+
+// Opcodes
+const (
+	OpCodeQuery  = 0
+	OpCodeIQuery = 1 // Obsolete (RFC 3425)
+	OpCodeStatus = 2
+	OpCodeNotify = 4
+	OpCodeUpdate = 5
+)
+
+// Response codes
+const (
+	RCodeNoError  = 0
+	RCodeFormErr  = 1
+	RCodeServFail = 2
+	RCodeNXDomain = 3
+	RCodeNotImp   = 4
+	RCodeRefused  = 5
+)
@@ -0,0 +1,67 @@
+package main
+
+/*
+This module contains the conveniences for running the server as a traditional daemon: a PID file, a working directory,
+and dropping root privileges once the privileged work (binding the listening socket and writing the PID file) is done.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// DaemonOptions represents the process settings applied once the server's socket is bound
+type DaemonOptions struct {
+	PIDFile string // File the process ID is written to, removed again on exit if the dropped privileges allow
+	Dir     string // Directory to change into
+	User    string // User name or ID to switch to
+	Group   string // Group name or ID to switch to; defaults to the primary group of User
+}
+
+// Setup writes the PID file, changes the working directory, and drops privileges, in that order, so that the PID file
+// can still be written somewhere only root may write to; the returned function removes the PID file
+func (opts DaemonOptions) Setup() (cleanup func(), err error) {
+	cleanup = func() {}
+	if opts.PIDFile != "" {
+		// The path is made absolute so that the file can still be found after changing directory
+		pidFile, err := filepath.Abs(opts.PIDFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return nil, fmt.Errorf("failed to write PID file: %w", err)
+		}
+		cleanup = func() { os.Remove(pidFile) }
+	}
+	if opts.Dir != "" {
+		if err := os.Chdir(opts.Dir); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to change directory: %w", err)
+		}
+	}
+	if opts.User != "" || opts.Group != "" {
+		if err := dropPrivileges(opts.User, opts.Group); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	return cleanup, nil
+}
+
+// closeOnSignal closes the client sockets on SIGINT or SIGTERM, which ends the loops serving them so that deferred
+// cleanup such as removing the PID file runs
+func closeOnSignal(closers ...io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		fmt.Printf("Received %s, shutting down\n", <-signals)
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+}
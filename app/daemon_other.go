@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+/*
+This module contains the stand-in for dropping privileges on platforms other than Unix, which cannot switch the user
+and group of a running process.
+*/
+
+import "fmt"
+
+// dropPrivileges fails, as the platform cannot switch the process to another user or group
+func dropPrivileges(userName, groupName string) error {
+	return fmt.Errorf("--user and --group are only supported on Unix platforms")
+}
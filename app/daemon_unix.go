@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+/*
+This module contains the dropping of root privileges on Unix platforms, where a process can switch its user and group.
+*/
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to userName and groupName; supplementary groups are cleared first, and the group
+// is changed before the user, while the process still has the right to
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		account, err := user.Lookup(userName)
+		if err != nil {
+			if account, err = user.LookupId(userName); err != nil {
+				return fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(account.Uid)
+		gid, _ = strconv.Atoi(account.Gid)
+	}
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			if group, err = user.LookupGroupId(groupName); err != nil {
+				return fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("failed to clear supplementary groups: %w", err)
+	}
+	if gid >= 0 {
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("failed to switch to group %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("failed to switch to user %d: %w", uid, err)
+		}
+	}
+	fmt.Printf("Dropped privileges to uid %d, gid %d\n", os.Getuid(), os.Getgid())
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+/*
+This module contains the dynamic DNS client, which keeps a host name pointing at the address of the machine running the
+server, for home networks whose public address changes. The address is read from a network interface or, by default,
+asked of a web service reporting the address requests come from; whenever it changes, the name's address records are
+replaced with an RFC 2136 update sent to the zone's primary server, signed with TSIG if a key is configured.
+*/
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDDNSInterval is how often the address is checked by default
+	DefaultDDNSInterval = 5 * time.Minute
+	// DefaultDDNSTTL is the TTL of the published address record by default, kept short as the address may change
+	DefaultDDNSTTL = 300
+	// DefaultDDNSAddressURL is the web service asked for the public address by default
+	DefaultDDNSAddressURL = "https://api.ipify.org"
+)
+
+// DDNSOptions configures the dynamic DNS client
+type DDNSOptions struct {
+	Name       string        // Host name kept current; empty disables the client
+	Zone       string        // Zone holding Name, whose primary server accepts the updates
+	Server     string        // Server updates are sent to, as [udp://|tcp://]host:port
+	Interface  string        // Network interface whose address is published; empty asks AddressURL
+	AddressURL string        // Web service answering with the address of the client as plain text
+	Interval   time.Duration // How often the address is checked
+	TTL        uint32
+	Key        *TSIGKey // Signs the updates; nil sends them unsigned
+}
+
+// Validate checks that the options are usable
+func (opts DDNSOptions) Validate() error {
+	if opts.Name == "" {
+		return nil
+	}
+	if opts.Zone == "" || opts.Server == "" {
+		return fmt.Errorf("updating %s needs the zone holding it and its primary server", opts.Name)
+	}
+	if !isSubdomain(strings.TrimSuffix(opts.Name, ".")+".", strings.TrimSuffix(opts.Zone, ".")+".") {
+		return fmt.Errorf("%s is not in zone %s", opts.Name, opts.Zone)
+	}
+	if opts.Interval <= 0 {
+		return fmt.Errorf("the check interval must be positive, got %s", opts.Interval)
+	}
+	return nil
+}
+
+// RunDDNS checks the address every interval and pushes it to the server whenever it changes; it never returns
+func RunDDNS(opts DDNSOptions) {
+	client, err := NewClient(opts.Server)
+	if err != nil {
+		fmt.Println("Dynamic DNS disabled:", err)
+		return
+	}
+	var published netip.Addr
+	for ; ; time.Sleep(opts.Interval) {
+		addr, err := opts.currentAddress()
+		if err != nil {
+			fmt.Println("Failed to determine the address to publish:", err)
+			continue
+		}
+		if addr == published {
+			continue
+		}
+		if err := opts.push(client, addr); err != nil {
+			fmt.Printf("Failed to update %s to %s: %v\n", opts.Name, addr, err)
+			continue
+		}
+		fmt.Printf("Updated %s to %s\n", opts.Name, addr)
+		published = addr
+	}
+}
+
+// currentAddress returns the address to publish: the first global unicast address of the interface, IPv4 preferred,
+// or the one reported by the address service
+func (opts DDNSOptions) currentAddress() (netip.Addr, error) {
+	if opts.Interface == "" {
+		return fetchAddress(opts.AddressURL)
+	}
+	iface, err := net.InterfaceByName(opts.Interface)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var found netip.Addr
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil || !prefix.Addr().IsGlobalUnicast() {
+			continue
+		}
+		if ip := prefix.Addr().Unmap(); !found.IsValid() || (ip.Is4() && !found.Is4()) {
+			found = ip
+		}
+	}
+	if !found.IsValid() {
+		return netip.Addr{}, fmt.Errorf("interface %s has no global unicast address", opts.Interface)
+	}
+	return found, nil
+}
+
+// fetchAddress asks the web service at url for the address requests come from
+func fetchAddress(url string) (netip.Addr, error) {
+	if url == "" {
+		url = DefaultDDNSAddressURL
+	}
+	client := http.Client{Timeout: UpstreamTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("%s answered %s", url, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 256))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s did not answer with an address: %w", url, err)
+	}
+	return addr.Unmap(), nil
+}
+
+// push replaces the address records of the name with one for addr
+func (opts DDNSOptions) push(client *Client, addr netip.Addr) error {
+	update, err := NewUpdateMessage(uint16(rand.IntN(1<<16)), opts.Zone, opts.Name, opts.TTL, addr)
+	if err != nil {
+		return err
+	}
+	if opts.Key != nil {
+		if update, err = opts.Key.Sign(update, time.Now()); err != nil {
+			return err
+		}
+	}
+	response, _, err := client.Exchange(update)
+	if err != nil {
+		return err
+	}
+	if rCode := response.Header.Flags & RCodeMask >> RCodeShift; rCode != RCodeNoError {
+		return fmt.Errorf("%s refused the update with %s", opts.Server, RCodeString(rCode))
+	}
+	return nil
+}
+
+// NewUpdateMessage creates an RFC 2136 update to zone that replaces the address records of name, of the family of addr,
+// with a single one for addr. The zone is carried in the question section and the changes in the authority section,
+// which updates call the zone and update sections.
+func NewUpdateMessage(id uint16, zone, name string, ttl uint32, addr netip.Addr) (*DNSMessage, error) {
+	header, err := NewDNSHeader(DNSHeaderOptions{ID: id, OpCode: OpCodeUpdate})
+	if err != nil {
+		return nil, err
+	}
+	zoneQuestion, err := NewDNSQuestion(DNSQuestionOptions{Name: absoluteName(zone, ""), Type: TypeSOA, Class: ClassIN})
+	if err != nil {
+		return nil, err
+	}
+	recordType := uint16(TypeA)
+	if addr.Is6() {
+		recordType = TypeAAAA
+	}
+	labels, err := StringToLabels(absoluteName(name, ""))
+	if err != nil {
+		return nil, err
+	}
+	deletion := ResourceRecord{Name: labels, Type: recordType, Class: ClassANY} // Deletes the whole RRset
+	addition, err := NewResourceRecord(absoluteName(name, ""), recordType, ClassIN, ttl, []string{addr.String()}, "")
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{
+		Header:      header,
+		Questions:   []*DNSQuestion{zoneQuestion},
+		Authorities: []*DNSAnswer{{ResourceRecords: []ResourceRecord{deletion, addition}}},
+	}, nil
+}
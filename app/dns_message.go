@@ -3,10 +3,19 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 )
 
+// ErrTrailingData is returned when decoding a message that has bytes left over after its last section
+var ErrTrailingData = errors.New("message has data after its last section")
+
+// strictEncoding makes encoding fail on messages whose preserved header counts do not match their sections; it is set
+// once at startup, before any message is encoded
+var strictEncoding bool
+
 // NewDNSHeader creates a new DNS header with the given options
 func NewDNSHeader(opts DNSHeaderOptions) (*DNSHeader, error) {
 	if err := validateHeaderOptions(opts); err != nil {
@@ -19,7 +28,11 @@ func NewDNSHeader(opts DNSHeaderOptions) (*DNSHeader, error) {
 
 // NewDNSQuestion creates a new DNS question section with the given options
 func NewDNSQuestion(opts DNSQuestionOptions) (*DNSQuestion, error) {
-	questionLabels, err := StringToLabels(opts.Name)
+	asciiName, err := ToASCIIName(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	questionLabels, err := StringToLabels(asciiName)
 	if err != nil {
 		return nil, err
 	}
@@ -35,7 +48,11 @@ func NewDNSQuestion(opts DNSQuestionOptions) (*DNSQuestion, error) {
 func NewDNSAnswer(opts []ResourceRecordOptions) (*DNSAnswer, error) {
 	var answer DNSAnswer
 	for _, record := range opts {
-		labels, err := StringToLabels(record.Name)
+		asciiName, err := ToASCIIName(record.Name)
+		if err != nil {
+			return nil, err
+		}
+		labels, err := StringToLabels(asciiName)
 		if err != nil {
 			return nil, err
 		}
@@ -55,6 +72,31 @@ func NewDNSAnswer(opts []ResourceRecordOptions) (*DNSAnswer, error) {
 	return &answer, nil
 }
 
+// String renders the question in presentation format, with A-labels shown as Unicode
+func (question *DNSQuestion) String() string {
+	name, _ := LabelsToString(question.Name)
+	return fmt.Sprintf("%s type=%d class=%d", ToUnicodeName(name), question.Type, question.Class)
+}
+
+// String renders the resource record in presentation format, with A-labels shown as Unicode
+func (record *ResourceRecord) String() string {
+	name, _ := LabelsToString(record.Name)
+	return fmt.Sprintf("%s %d type=%d class=%d %v", ToUnicodeName(name), record.TTL, record.Type, record.Class, record.Data)
+}
+
+// NewQueryMessage creates a new recursion-desired query message for a single question
+func NewQueryMessage(id uint16, opts DNSQuestionOptions) (*DNSMessage, error) {
+	header, err := NewDNSHeader(DNSHeaderOptions{ID: id, RD: 1, QDCount: 1})
+	if err != nil {
+		return nil, err
+	}
+	question, err := NewDNSQuestion(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{Header: header, Questions: []*DNSQuestion{question}}, nil
+}
+
 // Serialize the DNS header into a 12-byte slice
 func (header *DNSHeader) Encode() ([]byte, error) {
 	buf := new(bytes.Buffer)
@@ -68,15 +110,8 @@ func (header *DNSHeader) Encode() ([]byte, error) {
 // Serialize the DNS question into a byte slice
 func (question *DNSQuestion) Encode() ([]byte, error) {
 	buf := new(bytes.Buffer)
-	for _, label := range question.Name {
-		buf.WriteByte(label.Length)
-		if label.Length == 0 {
-			break
-		}
-		_, err := buf.Write(label.Content)
-		if err != nil {
-			return nil, err
-		}
+	if err := writeName(buf, question.Name); err != nil {
+		return nil, err
 	}
 	err := binary.Write(buf, binary.BigEndian, question.Type)
 	if err != nil {
@@ -93,12 +128,8 @@ func (question *DNSQuestion) Encode() ([]byte, error) {
 func (answer *DNSAnswer) Encode() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	for _, record := range answer.ResourceRecords {
-		for _, label := range record.Name {
-			buf.WriteByte(label.Length)
-			_, err := buf.Write(label.Content)
-			if err != nil {
-				return nil, err
-			}
+		if err := writeName(buf, record.Name); err != nil {
+			return nil, err
 		}
 		err := binary.Write(buf, binary.BigEndian, record.Type)
 		if err != nil {
@@ -112,7 +143,10 @@ func (answer *DNSAnswer) Encode() ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = binary.Write(buf, binary.BigEndian, record.Length)
+		if len(record.Data) > 0xFFFF {
+			return nil, fmt.Errorf("data of %d bytes is too long for a record", len(record.Data))
+		}
+		err = binary.Write(buf, binary.BigEndian, uint16(len(record.Data)))
 		if err != nil {
 			return nil, err
 		}
@@ -121,9 +155,46 @@ func (answer *DNSAnswer) Encode() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// writeName writes name uncompressed, up to its first empty label. Label lengths are taken from the label contents
+// rather than their Length fields, and the terminating root label is always written, so that names built by hand
+// encode the same as decoded ones.
+func writeName(buf *bytes.Buffer, name []DNSLabel) error {
+	for _, label := range name {
+		if len(label.Content) == 0 {
+			break
+		}
+		if len(label.Content) > MaxLabelLength {
+			return fmt.Errorf("label of %d bytes is longer than %d bytes", len(label.Content), MaxLabelLength)
+		}
+		buf.WriteByte(byte(len(label.Content)))
+		buf.Write(label.Content)
+	}
+	return buf.WriteByte(0)
+}
+
+// nameWireLength returns the length of name as written by writeName
+func nameWireLength(name []DNSLabel) int {
+	length := 1
+	for _, label := range name {
+		if len(label.Content) == 0 {
+			break
+		}
+		length += 1 + len(label.Content)
+	}
+	return length
+}
+
 // Serialize the DNS message into a byte slice to send to the client
+//   - Unless PreserveCounts is set, the header section counts are derived from the section slices.
+//   - Label and RDATA lengths are likewise derived from their contents, so the bytes only depend on the message's
+//     content: nothing needs setting up beforehand, the message is left untouched, and encoding it twice yields the
+//     same bytes.
 func (message *DNSMessage) Encode() ([]byte, error) {
-	header, err := message.Header.Encode()
+	messageHeader, err := message.encodedHeader()
+	if err != nil {
+		return nil, err
+	}
+	header, err := messageHeader.Encode()
 	if err != nil {
 		return nil, err
 	}
@@ -135,15 +206,52 @@ func (message *DNSMessage) Encode() ([]byte, error) {
 		}
 		questions.Write(encodedQuestion)
 	}
-	answers := new(bytes.Buffer)
-	for _, answer := range message.Answers {
-		encodedAnswer, err := answer.Encode()
-		if err != nil {
-			return nil, err
+	records := new(bytes.Buffer)
+	for _, section := range [][]*DNSAnswer{message.Answers, message.Authorities, message.Additionals} {
+		for _, answer := range section {
+			encodedAnswer, err := answer.Encode()
+			if err != nil {
+				return nil, err
+			}
+			records.Write(encodedAnswer)
+		}
+	}
+	return append(header, append(questions.Bytes(), records.Bytes()...)...), nil
+}
+
+// encodedHeader returns the header to encode the message with, its section counts derived from the sections unless
+// PreserveCounts is set. Sections too large for their count are rejected rather than encoded under a wrapped-around
+// count, as are, with strictEncoding, preserved counts that do not match the sections.
+func (message *DNSMessage) encodedHeader() (DNSHeader, error) {
+	header := *message.Header
+	counts := [4]int{
+		len(message.Questions),
+		len(sectionRecords(message.Answers)),
+		len(sectionRecords(message.Authorities)),
+		len(sectionRecords(message.Additionals)),
+	}
+	for i, count := range counts {
+		if count > 0xFFFF {
+			return header, fmt.Errorf("%d entries in the %s section exceed the count field", count, sectionNames[i])
 		}
-		answers.Write(encodedAnswer)
 	}
-	return append(header, append(questions.Bytes(), answers.Bytes()...)...), nil
+	derived := [4]uint16{uint16(counts[0]), uint16(counts[1]), uint16(counts[2]), uint16(counts[3])}
+	preserved := [4]uint16{header.QDCount, header.ANCount, header.NSCount, header.ARCount}
+	if !message.PreserveCounts {
+		header.QDCount, header.ANCount, header.NSCount, header.ARCount = derived[0], derived[1], derived[2], derived[3]
+	} else if strictEncoding && preserved != derived {
+		return header, fmt.Errorf("header counts %v do not match the %v entries of the sections", preserved, derived)
+	}
+	return header, nil
+}
+
+// sectionRecords returns the resource records of a message section in order, however they are grouped
+func sectionRecords(section []*DNSAnswer) []ResourceRecord {
+	var records []ResourceRecord
+	for _, answer := range section {
+		records = append(records, answer.ResourceRecords...)
+	}
+	return records
 }
 
 // Deserialize the DNS header from a 12-byte slice
@@ -174,104 +282,145 @@ func (question *DNSQuestion) Decode(buf *bytes.Reader) error {
 	return nil
 }
 
-// Deserialize the DNS answer from the byte slice after the questions in a response
+// Deserialize a single resource record
+func (record *ResourceRecord) Decode(buf *bytes.Reader) error {
+	rrNameBytes, err := ReadQName(buf)
+	if err != nil {
+		return err
+	}
+	rrName, err := BytesToLabels(rrNameBytes)
+	if err != nil {
+		return err
+	}
+	record.Name = rrName
+	if err := binary.Read(buf, binary.BigEndian, &record.Type); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &record.Class); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &record.TTL); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &record.Length); err != nil {
+		return err
+	}
+	start := buf.Size() - int64(buf.Len())
+	record.Data = make([]byte, record.Length)
+	if _, err := io.ReadFull(buf, record.Data); err != nil {
+		return err
+	}
+	// Names embedded in the RDATA may point into the message being read, so they are expanded while it is at hand
+	expanded, err := expandRData(buf, record.Type, start, record.Data)
+	if err != nil {
+		return err
+	}
+	record.Data, record.Length = expanded, uint16(len(expanded))
+	return nil
+}
+
+// Deserialize the DNS answer from the byte slice after the questions in a response; consumes all remaining bytes
 func (answer *DNSAnswer) Decode(buf *bytes.Reader) error {
-	for {
-		rrNameBytes, err := ReadQName(buf)
-		if err != nil {
-			return err
-		}
-		rrName, err := BytesToLabels(rrNameBytes)
-		if err != nil {
-			return err
-		}
+	for buf.Len() > 0 {
 		var record ResourceRecord
-		record.Name = rrName
-		if err := binary.Read(buf, binary.BigEndian, &record.Type); err != nil {
-			return err
-		}
-		if err := binary.Read(buf, binary.BigEndian, &record.Class); err != nil {
-			return err
-		}
-		if err := binary.Read(buf, binary.BigEndian, &record.TTL); err != nil {
-			return err
-		}
-		if err := binary.Read(buf, binary.BigEndian, &record.Length); err != nil {
-			return err
-		}
-		record.Data = make([]byte, record.Length)
-		if _, err := buf.Read(record.Data); err != nil {
+		if err := record.Decode(buf); err != nil {
 			return err
 		}
 		answer.ResourceRecords = append(answer.ResourceRecords, record)
-		if buf.Len() == 0 {
-			break
-		}
 	}
 	return nil
 }
 
+// decodeSection deserializes exactly count resource records into a message section
+func decodeSection(buf *bytes.Reader, count uint16) ([]*DNSAnswer, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	answer := &DNSAnswer{ResourceRecords: make([]ResourceRecord, count)}
+	for i := range answer.ResourceRecords {
+		if err := answer.ResourceRecords[i].Decode(buf); err != nil {
+			return nil, err
+		}
+	}
+	return []*DNSAnswer{answer}, nil
+}
+
 // Deserialize the DNS message from a byte slice received from the client
+//   - Every read is bounds-checked: a message cut short anywhere, or whose counts promise more than it holds, fails
+//     with an error wrapping io.ErrUnexpectedEOF that names the section it ends in.
 func (message *DNSMessage) Decode(buf *bytes.Reader) error {
 	// Parse header
 	receivedHeader := &DNSHeader{}
 	if err := receivedHeader.Decode(buf); err != nil {
-		return err
+		return sectionError("header", err)
 	}
 	// Parse questions
 	receivedQuestions := make([]*DNSQuestion, receivedHeader.QDCount)
 	for i := 0; i < int(receivedHeader.QDCount); i++ {
 		receivedQuestion := &DNSQuestion{}
 		if err := receivedQuestion.Decode(buf); err != nil {
-			return err
+			return sectionError(sectionNames[SectionQuestion], err)
 		}
 		receivedQuestions[i] = receivedQuestion
 	}
-	// Parse answers
-	receivedAnswers := make([]*DNSAnswer, receivedHeader.ANCount)
-	for i := 0; i < int(receivedHeader.ANCount); i++ {
-		receivedAnswer := &DNSAnswer{}
-		if err := receivedAnswer.Decode(buf); err != nil {
-			return err
-		}
-		receivedAnswers[i] = receivedAnswer
+	// Parse answer, authority, and additional sections
+	receivedAnswers, err := decodeSection(buf, receivedHeader.ANCount)
+	if err != nil {
+		return sectionError(sectionNames[SectionAnswer], err)
 	}
-	// Change header response code from query
-	var rCodeMod DNSHeaderModification
-	if receivedHeader.Flags&OpCodeMask == 0 {
-		rCodeMod = ModifyRCode(0) // No Error
-	} else {
-		rCodeMod = ModifyRCode(4) // Not Implemented
+	receivedAuthorities, err := decodeSection(buf, receivedHeader.NSCount)
+	if err != nil {
+		return sectionError(sectionNames[SectionAuthority], err)
 	}
-	receivedHeader, err := receivedHeader.ModifyDNSHeader(rCodeMod)
+	receivedAdditionals, err := decodeSection(buf, receivedHeader.ARCount)
 	if err != nil {
-		return err
+		return sectionError(sectionNames[SectionAdditional], err)
+	}
+	if buf.Len() > 0 {
+		return fmt.Errorf("%w (%d bytes)", ErrTrailingData, buf.Len())
 	}
 	// Assemble message
-	message.Header, message.Questions, message.Answers = receivedHeader, receivedQuestions, receivedAnswers
+	message.Header, message.Questions = receivedHeader, receivedQuestions
+	message.Answers, message.Authorities, message.Additionals = receivedAnswers, receivedAuthorities, receivedAdditionals
 	return nil
 }
 
-// ModifyDNSHeader modifies an existing DNS header with the given options; if any modification fails, the original header is returned
-func (header *DNSHeader) ModifyDNSHeader(modifications ...DNSHeaderModification) (*DNSHeader, error) {
-	newHeader := *header
+// sectionError places a decoding error in the section it occurred in; running out of data is always reported as
+// io.ErrUnexpectedEOF, even where nothing at all was left to read, which binary.Read reports as io.EOF
+func sectionError(section string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("invalid %s section: %w", section, err)
+}
+
+// applyModifications applies modifications to a copy of target; if any modification fails, the original target is returned
+func applyModifications[T any, M DNSModification[T]](target *T, modifications ...M) (*T, error) {
+	modified := *target
 	for _, mod := range modifications {
-		if err := mod(&newHeader); err != nil {
-			return header, err
+		if err := mod(&modified); err != nil {
+			return target, err
 		}
 	}
-	return &newHeader, nil
+	return &modified, nil
+}
+
+// ModifyDNSHeader modifies an existing DNS header with the given options; if any modification fails, the original header is returned
+func (header *DNSHeader) ModifyDNSHeader(modifications ...DNSHeaderModification) (*DNSHeader, error) {
+	return applyModifications(header, modifications...)
 }
 
 // ModifyDNSQuestion modifies an existing DNS question with the given options; if any modification fails, the original question is returned
 func (question *DNSQuestion) ModifyDNSQuestion(modifications ...DNSQuestionModification) (*DNSQuestion, error) {
-	newQuestion := *question
-	for _, mod := range modifications {
-		if err := mod(&newQuestion); err != nil {
-			return question, err
-		}
+	return applyModifications(question, modifications...)
+}
+
+// ModifyID modifies the ID field of a DNS header
+func ModifyID(id uint16) DNSHeaderModification {
+	return func(header *DNSHeader) error {
+		header.ID = id
+		return nil
 	}
-	return &newQuestion, nil
 }
 
 // ModifyQR modifies the QR field of a DNS header
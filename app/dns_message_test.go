@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTruncated(t *testing.T) {
+	name := []byte("\x07example\x03com\x00")
+	nsName := []byte("\x02ns\x07example\x03com\x00")
+	record := func(owner []byte, rrType byte, rdata []byte) []byte {
+		fixed := []byte{0, rrType, 0, 1, 0, 0, 0x0e, 0x10, 0, byte(len(rdata))}
+		return append(append(append([]byte{}, owner...), fixed...), rdata...)
+	}
+	sections := []struct {
+		name string
+		data []byte
+	}{
+		{"header", []byte{0, 1, 0x81, 0x80, 0, 1, 0, 1, 0, 1, 0, 1}},
+		{"question", append(append([]byte{}, name...), 0, 1, 0, 1)},
+		{"answer", record(name, TypeA, []byte{192, 0, 2, 1})},
+		{"authority", record(name, TypeNS, nsName)},
+		{"additional", record(nsName, TypeA, []byte{192, 0, 2, 53})},
+	}
+	var raw []byte
+	ends := make([]int, len(sections)) // Offset at which each section ends
+	for i, section := range sections {
+		raw = append(raw, section.data...)
+		ends[i] = len(raw)
+	}
+	if err := new(DNSMessage).Decode(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("Decode() of the whole message = %v", err)
+	}
+	for cut := 0; cut < len(raw); cut++ {
+		section := 0
+		for cut >= ends[section] {
+			section++
+		}
+		want := "invalid " + sections[section].name + " section"
+		err := new(DNSMessage).Decode(bytes.NewReader(raw[:cut]))
+		if err == nil || !strings.HasPrefix(err.Error(), want) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Decode() of the first %d bytes = %v, want %q wrapping %v", cut, err, want, io.ErrUnexpectedEOF)
+		}
+	}
+}
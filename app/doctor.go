@@ -0,0 +1,191 @@
+package main
+
+/*
+This module contains the "doctor" subcommand, which probes every configured upstream before the server is put into
+service: whether it answers over its own transport and over TCP, how long it takes, whether it speaks EDNS, and whether
+it returns DNSSEC signatures when asked for them.
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+const (
+	// doctorProbes is the number of queries whose round-trip times are measured per upstream
+	doctorProbes = 3
+	// doctorTimeout bounds every probe
+	doctorTimeout = 2 * time.Second
+	// doctorProbeName is the name whose SOA record is queried; its zone is DNSSEC-signed
+	doctorProbeName = "example.com"
+)
+
+// doctorCheck is the outcome of one check of an upstream
+type doctorCheck struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+// runDoctor implements the "doctor" subcommand; it takes the server's flags to find the upstreams
+func runDoctor(args []string) error {
+	config, err := parseFlags(flag.NewFlagSet("doctor", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	specs := strings.Split(config.Resolver, ",")
+	unhealthy := 0
+	for _, spec := range specs {
+		checks := diagnoseUpstream(spec, config.Upstream)
+		fmt.Println(spec)
+		for _, check := range checks {
+			status := "ok"
+			if !check.ok {
+				status = "FAIL"
+			}
+			fmt.Printf("  %-10s %-5s %s\n", check.name, status, check.detail)
+		}
+		if !checks[0].ok {
+			unhealthy++
+		}
+	}
+	if unhealthy > 0 {
+		return fmt.Errorf("%d of %d upstreams unhealthy", unhealthy, len(specs))
+	}
+	return nil
+}
+
+// diagnoseUpstream runs the checks against one upstream; the first check is reachability, and the others are skipped
+// if it fails
+func diagnoseUpstream(spec string, opts UpstreamOptions) []doctorCheck {
+	upstream, err := NewUpstream(spec, opts)
+	if err != nil {
+		return []doctorCheck{{name: "reachable", detail: err.Error()}}
+	}
+	reachable := probeReachability(upstream)
+	checks := []doctorCheck{reachable}
+	if !reachable.ok {
+		return checks
+	}
+	if strings.HasPrefix(upstream.String(), "udp://") {
+		checks = append(checks, probeTCP(upstream, opts))
+	}
+	return append(checks, probeEDNS(upstream), probeDNSSEC(upstream))
+}
+
+// probeReachability measures the round-trip time of a few probe queries, which must be answered without error
+func probeReachability(upstream Upstream) doctorCheck {
+	check := doctorCheck{name: "reachable"}
+	var total, fastest time.Duration
+	answered := 0
+	var lastErr error
+	var rCode uint16
+	for i := 0; i < doctorProbes; i++ {
+		response, rtt, err := doctorExchange(upstream, false, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answered++
+		total += rtt
+		if fastest == 0 || rtt < fastest {
+			fastest = rtt
+		}
+		rCode = response.Header.Flags & RCodeMask >> RCodeShift
+	}
+	if answered == 0 {
+		check.detail = fmt.Sprintf("no answer to %d queries: %v", doctorProbes, lastErr)
+		return check
+	}
+	check.ok = rCode == RCodeNoError
+	check.detail = fmt.Sprintf("%d/%d answered, rtt min %s avg %s, status %s",
+		answered, doctorProbes, fastest.Round(time.Microsecond), (total / time.Duration(answered)).Round(time.Microsecond), RCodeString(rCode))
+	return check
+}
+
+// probeTCP checks that a UDP upstream also answers over TCP, which truncated answers fall back to
+func probeTCP(upstream Upstream, opts UpstreamOptions) doctorCheck {
+	check := doctorCheck{name: "tcp"}
+	tcp, err := NewUpstream("tcp://"+strings.TrimPrefix(upstream.String(), "udp://"), opts)
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	_, rtt, err := doctorExchange(tcp, false, false)
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	check.ok, check.detail = true, fmt.Sprintf("rtt %s", rtt.Round(time.Microsecond))
+	return check
+}
+
+// probeEDNS checks that an upstream answers a query carrying an OPT record with one of its own
+func probeEDNS(upstream Upstream) doctorCheck {
+	check := doctorCheck{name: "edns"}
+	response, _, err := doctorExchange(upstream, true, false)
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	opt, ok := FindOPT(response)
+	switch {
+	case response.Header.Flags&RCodeMask>>RCodeShift == RCodeFormErr:
+		check.detail = "query with OPT rejected with FORMERR"
+	case !ok:
+		check.detail = "no OPT record in the response"
+	default:
+		check.ok, check.detail = true, fmt.Sprintf("version %d, udp size %d", opt.TTL>>16&0xFF, opt.Class)
+	}
+	return check
+}
+
+// probeDNSSEC checks that an upstream returns signatures for the signed probe zone when the DO bit is set
+func probeDNSSEC(upstream Upstream) doctorCheck {
+	check := doctorCheck{name: "dnssec"}
+	response, _, err := doctorExchange(upstream, true, true)
+	if err != nil {
+		check.detail = err.Error()
+		return check
+	}
+	signed := false
+	for _, answer := range response.Answers {
+		for _, record := range answer.ResourceRecords {
+			signed = signed || record.Type == TypeRRSIG
+		}
+	}
+	opt, ok := FindOPT(response)
+	switch {
+	case !ok || opt.TTL&EDNSFlagDO == 0:
+		check.detail = "DO bit not echoed; the upstream does not support DNSSEC"
+	case !signed:
+		check.detail = "no RRSIG records returned; signatures are stripped"
+	default:
+		check.ok, check.detail = true, "RRSIG records returned"
+	}
+	return check
+}
+
+// doctorExchange sends the probe query, optionally with EDNS and the DO bit, and returns the response and its RTT
+func doctorExchange(upstream Upstream, edns, dnssec bool) (*DNSMessage, time.Duration, error) {
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), DNSQuestionOptions{Name: doctorProbeName, Type: TypeSOA, Class: ClassIN})
+	if err != nil {
+		return nil, 0, err
+	}
+	if edns {
+		opt := NewOPTRecord(EDNSUDPSize)
+		if dnssec {
+			opt.TTL = EDNSFlagDO
+		}
+		query.Additionals = []*DNSAnswer{{ResourceRecords: []ResourceRecord{opt}}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	start := time.Now()
+	response, err := upstream.Exchange(ctx, query)
+	return response, time.Since(start), err
+}
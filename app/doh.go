@@ -0,0 +1,247 @@
+package main
+
+/*
+This module contains the DNS-over-HTTPS listener (RFC 8484), which answers queries at /dns-query: wire-format
+messages, base64url-encoded in the dns parameter of a GET or as the body of a POST, and also the JSON API Google and
+Cloudflare serve at the same path, a GET with name and type parameters answered with application/dns-json, so that
+scripts and dashboards can query the server with plain curl. Queries are handled like those received over TCP from
+the HTTP client. Without --doh-cert and --doh-key the listener speaks plain HTTP, for a proxy terminating TLS in front.
+*/
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// dohPath is where queries are answered
+	dohPath = "/dns-query"
+	// dohMessageType is the media type of wire-format messages
+	dohMessageType = "application/dns-message"
+	// dohJSONType is the media type of the JSON API
+	dohJSONType = "application/dns-json"
+)
+
+// dohJSON is a response in the JSON form of the Google and Cloudflare APIs
+type dohJSON struct {
+	Status     uint16
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []dohJSONQuestion
+	Answer     []dohJSONRecord `json:",omitempty"`
+	Authority  []dohJSONRecord `json:",omitempty"`
+	Additional []dohJSONRecord `json:",omitempty"`
+}
+
+// dohJSONQuestion is a question in the JSON form
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRecord is a record in the JSON form, its data in presentation format
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// listenDoH binds the DNS-over-HTTPS listener, loading its certificate if it has one so that neither needs privileges
+// later
+func listenDoH(listen ListenConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen.DoHAddr)
+	if err != nil {
+		return nil, err
+	}
+	listener = NewProxyListener(listener, listen.ProxyProtocol) // The header precedes the TLS handshake
+	if listen.DoHCert == "" {
+		return listener, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(listen.DoHCert, listen.DoHKey)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"h2", "http/1.1"}}), nil
+}
+
+// serveDoH answers queries over HTTP(S) until the listener is closed
+func serveDoH(listener net.Listener, forwarder *Forwarder) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		serveDoHQuery(w, r, forwarder)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: DefaultTCPIdleTimeout, IdleTimeout: DefaultTCPIdleTimeout}
+	fmt.Println("DNS over HTTPS listening on", listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("DNS over HTTPS listener stopped:", err)
+	}
+}
+
+// serveDoHQuery answers a single HTTP request
+func serveDoHQuery(w http.ResponseWriter, r *http.Request, forwarder *Forwarder) {
+	params := r.URL.Query()
+	var query []byte
+	var err error
+	jsonAPI := false
+	switch {
+	case r.Method == http.MethodGet && params.Has("dns"):
+		query, err = base64.RawURLEncoding.DecodeString(params.Get("dns"))
+	case r.Method == http.MethodGet && params.Has("name"):
+		query, err = dohJSONQuery(params)
+		jsonAPI = params.Get("ct") != dohMessageType
+	case r.Method == http.MethodGet:
+		http.Error(w, "expected a dns or name parameter", http.StatusBadRequest)
+		return
+	case r.Method == http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMessageType {
+			http.Error(w, "expected a body of type "+dohMessageType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if query, err = io.ReadAll(io.LimitReader(r.Body, MaxStreamMessageSize+1)); err == nil && len(query) > MaxStreamMessageSize {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoded := handleClientMessage(forwarder, query, dohSource(r), 0)
+	if encoded == nil {
+		http.Error(w, "query cannot be answered", http.StatusBadRequest)
+		return
+	}
+	var response DNSMessage
+	if err := response.Decode(bytes.NewReader(encoded)); err != nil {
+		http.Error(w, "response cannot be decoded", http.StatusInternalServerError)
+		return
+	}
+	// RFC 8484 section 5.1: HTTP caches keep the response no longer than its records
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(dohMaxAge(&response)), 10))
+	if !jsonAPI {
+		w.Header().Set("Content-Type", dohMessageType)
+		w.Write(encoded)
+		return
+	}
+	w.Header().Set("Content-Type", dohJSONType)
+	json.NewEncoder(w).Encode(newDoHJSON(&response))
+}
+
+// dohJSONQuery builds the wire-format query asked for by the parameters of the JSON API: name, type (a mnemonic or a
+// number, A by default), cd and do (1 or true to set the CD bit and to ask for DNSSEC records)
+func dohJSONQuery(params url.Values) ([]byte, error) {
+	question := DNSQuestionOptions{Name: strings.TrimSuffix(params.Get("name"), "."), Type: TypeA, Class: ClassIN}
+	if question.Name == "" {
+		return nil, fmt.Errorf("empty name")
+	}
+	if t := params.Get("type"); t != "" {
+		if number, err := strconv.ParseUint(t, 10, 16); err == nil {
+			question.Type = uint16(number)
+		} else if question.Type, err = ParseRecordType(t); err != nil {
+			return nil, err
+		}
+	}
+	query, err := NewQueryMessage(0, question)
+	if err != nil {
+		return nil, err
+	}
+	if set := params.Get("cd"); set == "1" || set == "true" {
+		query.Header.Flags |= CDMask
+	}
+	if set := params.Get("do"); set == "1" || set == "true" {
+		opt := NewOPTRecord(EDNSUDPSize)
+		opt.TTL = EDNSFlagDO
+		query.Additionals = []*DNSAnswer{{ResourceRecords: []ResourceRecord{opt}}}
+	}
+	return query.Encode()
+}
+
+// dohSource returns the address of the HTTP client, as the TCP peer the query came from
+func dohSource(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// dohMaxAge returns the lowest TTL of a response's records, or 0 if it has none
+func dohMaxAge(response *DNSMessage) uint32 {
+	maxAge := uint32(math.MaxUint32)
+	for _, section := range [][]*DNSAnswer{response.Answers, response.Authorities} {
+		for _, record := range sectionRecords(section) {
+			maxAge = min(maxAge, record.TTL)
+		}
+	}
+	if maxAge == math.MaxUint32 {
+		return 0
+	}
+	return maxAge
+}
+
+// newDoHJSON converts a response into its JSON form; OPT records are left out, being about the message
+func newDoHJSON(response *DNSMessage) dohJSON {
+	flags := response.Header.Flags
+	converted := dohJSON{
+		Status: flags & RCodeMask >> RCodeShift,
+		TC:     flags&TCMask != 0,
+		RD:     flags&RDMask != 0,
+		RA:     flags&RAMask != 0,
+		AD:     flags&ADMask != 0,
+		CD:     flags&CDMask != 0,
+	}
+	for _, question := range response.Questions {
+		converted.Question = append(converted.Question, dohJSONQuestion{Name: dohJSONName(question.Name), Type: question.Type})
+	}
+	for _, section := range []struct {
+		records []ResourceRecord
+		into    *[]dohJSONRecord
+	}{
+		{sectionRecords(response.Answers), &converted.Answer},
+		{sectionRecords(response.Authorities), &converted.Authority},
+		{sectionRecords(response.Additionals), &converted.Additional},
+	} {
+		for _, record := range section.records {
+			if record.Type == TypeOPT {
+				continue
+			}
+			*section.into = append(*section.into, dohJSONRecord{
+				Name: dohJSONName(record.Name),
+				Type: record.Type,
+				TTL:  record.TTL,
+				Data: FormatRData(record.Type, record.Data),
+			})
+		}
+	}
+	return converted
+}
+
+// dohJSONName renders a name absolute, as the JSON API does
+func dohJSONName(labels []DNSLabel) string {
+	name, err := LabelsToString(labels)
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSuffix(name, ".") + "."
+}
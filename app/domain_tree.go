@@ -0,0 +1,131 @@
+package main
+
+/*
+This module contains the DomainTree, a tree keyed by the labels of domain names in reverse order (com -> example ->
+www). Exact and longest-suffix lookups walk one node per label, so matching a name against a large zone store or
+blocklist costs O(label count) regardless of how many names are stored.
+*/
+
+// DomainTree maps domain names to values; names are matched case-insensitively
+type DomainTree[V any] struct {
+	root domainNode[V]
+	size int
+}
+
+// domainNode is a node of a DomainTree, holding a value if a name ends at it
+type domainNode[V any] struct {
+	children map[string]*domainNode[V]
+	value    V
+	set      bool
+}
+
+// NewDomainTree creates an empty DomainTree
+func NewDomainTree[V any]() *DomainTree[V] {
+	return &DomainTree[V]{}
+}
+
+// reversedLabels splits a presentation-format name into the lowercase contents of its labels, top-level label first,
+// so that escaped and plain spellings of a label match
+func reversedLabels(name string) []string {
+	labels := splitName(name)
+	for i, label := range labels {
+		if content, err := unescapeLabel(label); err == nil {
+			label = string(content)
+		}
+		labels[i] = CanonicalName(label)
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// Insert stores value under name, replacing any previous value
+func (t *DomainTree[V]) Insert(name string, value V) {
+	node := &t.root
+	for _, label := range reversedLabels(name) {
+		if node.children == nil {
+			node.children = map[string]*domainNode[V]{}
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = &domainNode[V]{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	if !node.set {
+		t.size++
+	}
+	node.value, node.set = value, true
+}
+
+// Update replaces the value stored under name with update(current, present)
+func (t *DomainTree[V]) Update(name string, update func(current V, present bool) V) {
+	current, present := t.Get(name)
+	t.Insert(name, update(current, present))
+}
+
+// Get returns the value stored under exactly name
+func (t *DomainTree[V]) Get(name string) (V, bool) {
+	node := &t.root
+	for _, label := range reversedLabels(name) {
+		if node = node.children[label]; node == nil {
+			var zero V
+			return zero, false
+		}
+	}
+	return node.value, node.set
+}
+
+// LongestSuffix returns the value stored under the longest suffix of name (including name itself) and the number of
+// labels of that suffix
+func (t *DomainTree[V]) LongestSuffix(name string) (value V, labels int, ok bool) {
+	node := &t.root
+	if node.set {
+		value, ok = node.value, true
+	}
+	for i, label := range reversedLabels(name) {
+		if node = node.children[label]; node == nil {
+			break
+		}
+		if node.set {
+			value, labels, ok = node.value, i+1, true
+		}
+	}
+	return value, labels, ok
+}
+
+// HasSubdomains reports whether any name strictly below name is stored, which distinguishes empty non-terminals
+func (t *DomainTree[V]) HasSubdomains(name string) bool {
+	node := &t.root
+	for _, label := range reversedLabels(name) {
+		if node = node.children[label]; node == nil {
+			return false
+		}
+	}
+	return len(node.children) > 0
+}
+
+// Len returns the number of names stored
+func (t *DomainTree[V]) Len() int {
+	return t.size
+}
+
+// Walk calls fn for every stored name (in presentation format with a trailing dot) and its value
+func (t *DomainTree[V]) Walk(fn func(name string, value V)) {
+	var walk func(node *domainNode[V], suffix string)
+	walk = func(node *domainNode[V], suffix string) {
+		if node.set {
+			fn(suffix+".", node.value)
+		}
+		for label, child := range node.children {
+			if suffix == "" {
+				walk(child, label)
+			} else {
+				walk(child, label+"."+suffix)
+			}
+		}
+	}
+	walk(&t.root, "")
+}
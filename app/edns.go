@@ -0,0 +1,168 @@
+package main
+
+/*
+This module contains EDNS(0) support (RFC 6891): the OPT pseudo-record carried in the additional section, its options,
+the Extended DNS Errors option (RFC 8914) used to explain failures to clients, and the Client Subnet option (RFC 7871)
+sent by the client tools and read from queries to locate their clients. The OPT record of a query only concerns the hop
+it arrived on, so clients are answered with the server's own OPT record rather than theirs, and none of their options
+are passed on.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+const (
+	// EDNSUDPSize is the UDP payload size advertised in OPT records the server sends
+	EDNSUDPSize = 1232
+	// EDNSOptionECS is the option code of EDNS Client Subnet
+	EDNSOptionECS = 8
+	// EDNSOptionEDE is the option code of Extended DNS Errors
+	EDNSOptionEDE = 15
+	// EDNSFlagDO is the DNSSEC OK flag within the TTL field of an OPT record
+	EDNSFlagDO = 1 << 15
+	// EDNSVersion is the highest EDNS version the server implements
+	EDNSVersion = 0
+	// RCodeBadVers is the extended response code answering queries of an EDNS version above EDNSVersion
+	RCodeBadVers = 16
+	// EDEOther is the Extended DNS Error info code for errors without a more specific code
+	EDEOther = 0
+	// EDENoReachableAuthority is the Extended DNS Error info code for when no upstream could be reached
+	EDENoReachableAuthority = 22
+)
+
+// EDNSOption is an option carried in the RDATA of an OPT record
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// NewOPTRecord creates an OPT pseudo-record advertising udpSize and carrying options
+func NewOPTRecord(udpSize uint16, options ...EDNSOption) ResourceRecord {
+	var data []byte
+	for _, option := range options {
+		data = binary.BigEndian.AppendUint16(data, option.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+	return ResourceRecord{
+		Name:   []DNSLabel{{Length: 0}},
+		Type:   TypeOPT,
+		Class:  udpSize, // The class field of OPT carries the requestor's UDP payload size
+		Length: uint16(len(data)),
+		Data:   data,
+	}
+}
+
+// ResponseOPT creates the OPT record answering a query that carried queryOPT: it advertises the server's payload size,
+// holds the upper bits of the extended rCode, echoes the DO flag (RFC 3225), and carries options
+func ResponseOPT(queryOPT ResourceRecord, rCode uint16, options ...EDNSOption) ResourceRecord {
+	opt := NewOPTRecord(EDNSUDPSize, options...)
+	opt.TTL = uint32(rCode>>4)<<24 | queryOPT.TTL&EDNSFlagDO
+	return opt
+}
+
+// EDNSVersionOf returns the EDNS version of an OPT record
+func EDNSVersionOf(opt ResourceRecord) uint8 {
+	return uint8(opt.TTL >> 16)
+}
+
+// ExtendedRCode returns the response code of a message, including the upper bits its OPT record may hold
+func ExtendedRCode(message *DNSMessage) uint16 {
+	rCode := message.Header.Flags & RCodeMask >> RCodeShift
+	if opt, ok := FindOPT(message); ok {
+		rCode |= uint16(opt.TTL>>24) << 4
+	}
+	return rCode
+}
+
+// ExtendedError creates an Extended DNS Error option with an info code and an explanation for humans
+func ExtendedError(infoCode uint16, text string) EDNSOption {
+	return EDNSOption{Code: EDNSOptionEDE, Data: append(binary.BigEndian.AppendUint16(nil, infoCode), text...)}
+}
+
+// ClientSubnet creates an EDNS Client Subnet option announcing prefix as the client's network
+func ClientSubnet(prefix netip.Prefix) EDNSOption {
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(prefix.Bits()), 0) // Source and scope prefix lengths
+	address := prefix.Addr().AsSlice()
+	data = append(data, address[:(prefix.Bits()+7)/8]...)
+	return EDNSOption{Code: EDNSOptionECS, Data: data}
+}
+
+// FindOPT returns the OPT pseudo-record of a message's additional section, if it has one
+func FindOPT(message *DNSMessage) (ResourceRecord, bool) {
+	for _, additional := range message.Additionals {
+		for _, record := range additional.ResourceRecords {
+			if record.Type == TypeOPT {
+				return record, true
+			}
+		}
+	}
+	return ResourceRecord{}, false
+}
+
+// FindEDNSOption returns the data of the first option with code carried by an OPT record
+func FindEDNSOption(opt ResourceRecord, code uint16) ([]byte, bool) {
+	data := opt.Data
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			break
+		}
+		if binary.BigEndian.Uint16(data) == code {
+			return data[4 : 4+length], true
+		}
+		data = data[4+length:]
+	}
+	return nil, false
+}
+
+// ParseClientSubnet parses the data of a Client Subnet option into the network it announces
+func ParseClientSubnet(data []byte) (netip.Prefix, error) {
+	if len(data) < 4 {
+		return netip.Prefix{}, fmt.Errorf("client subnet option of %d bytes", len(data))
+	}
+	family, bits, address := binary.BigEndian.Uint16(data), int(data[2]), data[4:]
+	var full []byte
+	switch family {
+	case 1:
+		full = make([]byte, 4)
+	case 2:
+		full = make([]byte, 16)
+	default:
+		return netip.Prefix{}, fmt.Errorf("unknown client subnet family %d", family)
+	}
+	if bits > len(full)*8 || len(address) != (bits+7)/8 {
+		return netip.Prefix{}, fmt.Errorf("client subnet of %d bits in %d bytes", bits, len(address))
+	}
+	copy(full, address)
+	addr, _ := netip.AddrFromSlice(full)
+	return addr.Prefix(bits)
+}
+
+// ClientNetwork returns the network a query comes from: the one announced by its Client Subnet option, which servers
+// forwarding on behalf of their clients add, or else the address of source
+func ClientNetwork(query *DNSMessage, source net.Addr) netip.Prefix {
+	if opt, ok := FindOPT(query); ok {
+		if data, ok := FindEDNSOption(opt, EDNSOptionECS); ok {
+			if prefix, err := ParseClientSubnet(data); err == nil && prefix.Bits() > 0 {
+				return prefix
+			}
+		}
+	}
+	addrPort, err := netip.ParseAddrPort(source.String())
+	if err != nil {
+		return netip.Prefix{}
+	}
+	addr := addrPort.Addr().Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
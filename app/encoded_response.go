@@ -0,0 +1,71 @@
+package main
+
+/*
+This module contains pre-encoded responses: the wire form of a single-question response to a cached RRset, built once
+when the RRset is cached, so that cache hits are answered by copying the bytes and patching the client-specific
+regions (ID, flags, the TTLs decremented by time in cache, and the spelling of the queried name) instead of re-running
+Encode.
+*/
+
+import (
+	"encoding/binary"
+)
+
+// EncodedResponse is the wire form of a single-question response along with the offsets of its patchable fields
+type EncodedResponse struct {
+	Wire        []byte
+	TTLOffsets  []int // Offsets of the 32-bit TTL field of every answer record
+	NameOffsets []int // Offsets of the question name and of the answer owner names equal to it
+}
+
+// NewEncodedResponse encodes the response carrying records as the answer to question
+func NewEncodedResponse(question *DNSQuestion, records []ResourceRecord) (*EncodedResponse, error) {
+	message := &DNSMessage{
+		Header:    &DNSHeader{},
+		Questions: []*DNSQuestion{question},
+		Answers:   []*DNSAnswer{{ResourceRecords: records}},
+	}
+	wire, err := message.Encode()
+	if err != nil {
+		return nil, err
+	}
+	encodedQuestion, err := question.Encode()
+	if err != nil {
+		return nil, err
+	}
+	// Records are encoded uncompressed, so each TTL sits after the record's full name, type, and class
+	offset := DNSHeaderSize + len(encodedQuestion)
+	ttlOffsets := make([]int, len(records))
+	nameOffsets := []int{DNSHeaderSize}
+	for i, record := range records {
+		if equalLabels(record.Name, question.Name) {
+			nameOffsets = append(nameOffsets, offset)
+		}
+		offset += nameWireLength(record.Name) + 4
+		ttlOffsets[i] = offset
+		offset += 6 + len(record.Data)
+	}
+	return &EncodedResponse{Wire: wire, TTLOffsets: ttlOffsets, NameOffsets: nameOffsets}, nil
+}
+
+// Patch returns a copy of the response carrying the given header ID and flags, with the queried name spelled as name
+// (the uncompressed wire form of a name equal to it up to case), and with every TTL decremented by age seconds and then
+// clamped into bounds
+func (r *EncodedResponse) Patch(id, flags uint16, name []byte, age uint32, bounds TTLBounds) []byte {
+	wire := make([]byte, len(r.Wire))
+	copy(wire, r.Wire)
+	binary.BigEndian.PutUint16(wire[0:2], id)
+	binary.BigEndian.PutUint16(wire[2:4], flags)
+	if end := DNSHeaderSize + len(name); end <= len(wire) && EqualNames(string(name), string(wire[DNSHeaderSize:end])) {
+		for _, offset := range r.NameOffsets {
+			copy(wire[offset:], name)
+		}
+	}
+	if age > 0 {
+		for _, offset := range r.TTLOffsets {
+			ttl := binary.BigEndian.Uint32(wire[offset:])
+			binary.BigEndian.PutUint32(wire[offset:], bounds.Clamp(ttl-min(ttl, age)))
+		}
+	}
+	return wire
+}
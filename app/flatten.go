@@ -0,0 +1,147 @@
+package main
+
+/*
+This module contains the flatten plugin, which answers A and AAAA questions for the names given with --flatten with
+the addresses at the end of their CNAME chains, as if the names held them directly: apex-style flattening, for names
+that must not be a CNAME themselves or for clients that mishandle chains. The chain is chased through the rest of the
+plugin chain, so the plugin belongs before the cache and links answered locally, from the cache, or upstream are all
+followed, up to --flatten-depth CNAMEs and as many questions. The flattened records take the lowest TTL of the chain,
+which they stand for. A chain ending in an error or in no records of the asked type is answered as its end was.
+*/
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// DefaultFlattenDepth is how many CNAMEs a flattened chain may hold by default
+const DefaultFlattenDepth = 8
+
+// FlattenOptions configures the flatten plugin
+type FlattenOptions struct {
+	Names []string // Canonical names whose CNAME chains are flattened
+	Depth int      // CNAMEs followed at most
+}
+
+// flattenPlugin answers address questions for some names with the end of their CNAME chains
+type flattenPlugin struct {
+	FlattenOptions
+}
+
+func init() {
+	RegisterPlugin("flatten", func() Plugin { return &flattenPlugin{} })
+}
+
+func (p *flattenPlugin) Name() string {
+	return "flatten"
+}
+
+func (p *flattenPlugin) Setup(config *Config, forwarder *Forwarder) error {
+	if len(config.Flatten.Names) == 0 {
+		return fmt.Errorf("flattening needs --flatten")
+	}
+	p.FlattenOptions = config.Flatten
+	if p.Depth <= 0 {
+		p.Depth = DefaultFlattenDepth
+	}
+	return nil
+}
+
+func (p *flattenPlugin) Wrap(next Handler) Handler {
+	return HandlerFunc(func(request *DNSMessage) (*DNSMessage, error) {
+		question := request.Questions[0]
+		name, err := LabelsToString(question.Name)
+		if err != nil || question.Type != TypeA && question.Type != TypeAAAA || !slices.Contains(p.Names, CanonicalName(name)) {
+			return next.ServeDNS(request)
+		}
+		return p.flatten(request, next)
+	})
+}
+
+// flatten resolves a request through next, following the CNAME chain of its answer across as many further questions
+// as the chain needs, and answers with the chain's addresses under the name that was asked
+func (p *flattenPlugin) flatten(request *DNSMessage, next Handler) (*DNSMessage, error) {
+	question := request.Questions[0]
+	target, ttl := question.Name, uint32(math.MaxUint32)
+	response, err := next.ServeDNS(request)
+	if err != nil {
+		return nil, err
+	}
+	for links, passes := 0, 0; ; passes++ {
+		records := sectionRecords(response.Answers)
+		// An error, or a chase answered with nothing at all for the target (NODATA), ends the chain without addresses
+		if response.Header.Flags&RCodeMask>>RCodeShift != RCodeNoError || passes > 0 && !slices.ContainsFunc(records, func(record ResourceRecord) bool {
+			return equalLabels(record.Name, target)
+		}) {
+			return &DNSMessage{Header: response.Header, Questions: request.Questions, Authorities: response.Authorities}, nil
+		}
+		if passes >= p.Depth {
+			debugf(ComponentPolicy, "Flattening %s gave up after %d questions", question, passes+1)
+			return p.failure(request)
+		}
+		var addresses []ResourceRecord
+		for chased := true; chased; {
+			chased = false
+			for _, record := range records {
+				if !equalLabels(record.Name, target) {
+					continue
+				}
+				if record.Type == question.Type {
+					addresses = append(addresses, record)
+				} else if record.Type == TypeCNAME && len(addresses) == 0 {
+					if links++; links > p.Depth {
+						debugf(ComponentPolicy, "Flattening %s gave up after %d CNAMEs", question, p.Depth)
+						return p.failure(request)
+					}
+					if target, err = BytesToLabels(record.Data); err != nil {
+						return nil, err
+					}
+					ttl, chased = min(ttl, record.TTL), true
+					break
+				}
+			}
+		}
+		if links == 0 {
+			return response, nil // Nothing to flatten
+		}
+		if len(addresses) > 0 {
+			flattened := make([]ResourceRecord, len(addresses))
+			for i, record := range addresses {
+				record.Name, record.TTL = question.Name, min(ttl, record.TTL)
+				flattened[i] = record
+			}
+			debugf(ComponentPolicy, "Flattened %d CNAMEs of %s", links, question)
+			header, err := response.Header.ModifyDNSHeader(ModifyAA(0)) // The records are not the name's own
+			if err != nil {
+				return nil, err
+			}
+			return &DNSMessage{Header: header, Questions: request.Questions, Answers: []*DNSAnswer{{ResourceRecords: flattened}}}, nil
+		}
+		// The answer ends in a CNAME whose target it does not resolve, so the target is asked for on its own
+		end, err := LabelsToString(target)
+		if err != nil {
+			return nil, err
+		}
+		chase, err := NewDNSQuestion(DNSQuestionOptions{Name: strings.TrimSuffix(end, "."), Type: question.Type, Class: question.Class})
+		if err != nil {
+			return nil, err
+		}
+		if response, err = next.ServeDNS(&DNSMessage{Header: request.Header, Questions: []*DNSQuestion{chase}, Client: request.Client}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// failure answers a request whose chain could not be flattened with SERVFAIL
+func (p *flattenPlugin) failure(request *DNSMessage) (*DNSMessage, error) {
+	header, err := responseHeader(request.Header)
+	if err == nil {
+		header, err = header.ModifyDNSHeader(ModifyRCode(RCodeServFail))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{Header: header, Questions: request.Questions}, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+/*
+This module contains the Forwarder, which answers questions from the cache and forwards misses to the downstream
+resolver, applying the configured caching policy to everything it returns.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// TTLBounds clamps record TTLs into [Min, Max]; a zero Max leaves TTLs unbounded from above
+type TTLBounds struct {
+	Min uint32
+	Max uint32
+}
+
+// Forwarder resolves request messages via local data, the cache, and the downstream resolver
+type Forwarder struct {
+	Cache        *Cache
+	Upstream     Upstream
+	TTLBounds    TTLBounds
+	Local        atomic.Pointer[LocalStore]     // Records answered authoritatively instead of being forwarded
+	Registry     atomic.Pointer[LocalStore]     // Records generated from service registrations, answered like local ones
+	Secondaries  *SecondaryZones                // Zones transferred from primaries, answered authoritatively; nil for none
+	Kubernetes   atomic.Pointer[KubernetesZone] // Records of a cluster's services, answering its zone authoritatively
+	Blocklist    atomic.Pointer[Blocklist]      // Domains answered with NXDOMAIN
+	Limiter      *UpstreamLimiter               // Bounds outstanding upstream queries; nil for no limit
+	Routes       *TypeRoutes                    // Upstreams of query types forwarded elsewhere, and types refused; nil for none
+	Search       *ResolvConf                    // Search list applied to short names in stub mode; nil disables it
+	Shared       *SharedCache                   // Cache shared with other instances, consulted on misses; nil for none
+	MDNS         MDNSOptions                    // How questions for local. names are answered instead of being forwarded
+	Health       *HealthChecker                 // Leaves local addresses failing their health checks out of answers; nil for none
+	Rotation     *Rotator                       // Reorders local address answers per response; nil leaves them as loaded
+	Retransmits  *RetransmitTable               // Recent client queries, whose retransmits are not resolved again; nil disables it
+	flights      flightGroup                    // Deduplicates concurrent misses for the same question
+	plugins      []Plugin                       // Configured plugins in order; set by Assemble
+	chain        Handler                        // The plugins' handlers, ending in resolveMiss; set by Assemble
+	encodedCache bool                           // Whether CachedResponse may answer ahead of the chain; set by Assemble
+}
+
+// Clamp returns ttl clamped into the bounds
+func (bounds TTLBounds) Clamp(ttl uint32) uint32 {
+	if bounds.Max > 0 && ttl > bounds.Max {
+		ttl = bounds.Max
+	}
+	return max(ttl, bounds.Min)
+}
+
+// Apply returns a copy of records with every TTL clamped into the bounds
+func (bounds TTLBounds) Apply(records []ResourceRecord) []ResourceRecord {
+	clamped := make([]ResourceRecord, len(records))
+	for i, record := range records {
+		record.TTL = bounds.Clamp(record.TTL)
+		clamped[i] = record
+	}
+	return clamped
+}
+
+// Resolve answers each of requestMessages, which hold a single question each, through the plugin chain, which ends in
+// resolveMiss for the questions no plugin answers
+func (f *Forwarder) Resolve(requestMessages []*DNSMessage) ([]*DNSMessage, error) {
+	responses := make([]*DNSMessage, len(requestMessages))
+	for i, requestMessage := range requestMessages {
+		response, err := f.chain.ServeDNS(requestMessage)
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = response
+	}
+	return responses, nil
+}
+
+// resolveMiss forwards a request that missed the cache; short names are first tried with each search domain appended,
+// and the first expansion with an answer is returned behind a CNAME from the name that was asked
+func (f *Forwarder) resolveMiss(miss *DNSMessage) (*DNSMessage, error) {
+	question := miss.Questions[0]
+	name, err := LabelsToString(question.Name)
+	if err != nil {
+		return nil, err
+	}
+	candidates := f.Search.searchNames(name)
+	for _, candidate := range candidates[:len(candidates)-1] {
+		expanded, err := NewDNSQuestion(DNSQuestionOptions{Name: candidate, Type: question.Type, Class: question.Class})
+		if err != nil {
+			return nil, err
+		}
+		request := &DNSMessage{Header: miss.Header, Questions: []*DNSQuestion{expanded}}
+		response, ok := f.answerLocally(request)
+		if !ok {
+			if records, cached := f.Cache.Get(CacheKeyFromQuestion(expanded)); cached {
+				if response, err = f.cachedResponse(request, records); err != nil {
+					return nil, err
+				}
+			} else if response, err = f.forward(request); err != nil {
+				return nil, err
+			}
+		}
+		if response.Header.Flags&RCodeMask>>RCodeShift != RCodeNoError || len(response.Answers) == 0 {
+			continue
+		}
+		debugf(ComponentForwarder, "Search list expanded %s to %s", name, candidate)
+		records := sectionRecords(response.Answers)
+		alias, err := NewResourceRecord(name, TypeCNAME, question.Class, minTTL(records), []string{candidate}, "")
+		if err != nil {
+			return nil, err
+		}
+		return &DNSMessage{
+			Header:    response.Header,
+			Questions: miss.Questions,
+			Answers:   []*DNSAnswer{{ResourceRecords: append([]ResourceRecord{alias}, records...)}},
+		}, nil
+	}
+	return f.forward(miss)
+}
+
+// forward sends a request to the upstream its type is routed to, sharing the exchange with concurrent requests for the
+// same question, and caches the answer; requests for local. names are diverted to answerMDNS, and their answers are not
+// cached, and requests of blocked types are refused
+func (f *Forwarder) forward(request *DNSMessage) (*DNSMessage, error) {
+	if name, err := LabelsToString(request.Questions[0].Name); err == nil && f.MDNS.Diverts(name) {
+		return f.answerMDNS(request)
+	}
+	upstream, blocked := f.Routes.Route(request.Questions[0].Type, f.Upstream)
+	if blocked {
+		debugf(ComponentPolicy, "Refusing %s, whose type is blocked", request.Questions[0])
+		header, err := responseHeader(request.Header)
+		if err == nil {
+			header, err = header.ModifyDNSHeader(ModifyRCode(RCodeRefused))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &DNSMessage{Header: header, Questions: request.Questions}, nil
+	}
+	key := CacheKeyFromQuestion(request.Questions[0])
+	response, err, shared := f.flights.Do(key, func() (*DNSMessage, error) {
+		if records, ok := f.Shared.Get(key); ok {
+			debugf(ComponentCache, "Shared cache hit: %s", request.Questions[0])
+			response, err := f.cachedResponse(request, records)
+			if err == nil {
+				f.store(key, response, SharedCacheSource)
+			}
+			return response, err
+		}
+		debugf(ComponentForwarder, "Forwarding %s to %s", request.Questions[0], upstream)
+		response, err := f.exchange(context.Background(), upstream, request)
+		if err != nil {
+			return nil, err
+		}
+		response.Header.Flags &^= AAMask // Forwarded answers are not authoritative, whoever they come from
+		f.share(key, f.store(key, response, upstream.String()))
+		return response, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		debugf(ComponentForwarder, "Shared in-flight upstream answer: %s", request.Questions[0])
+	}
+	return response, nil
+}
+
+// answerLocally answers a request from the blocklist, the local records, or the cluster zone if any covers its question
+func (f *Forwarder) answerLocally(requestMessage *DNSMessage) (*DNSMessage, bool) {
+	if response, ok := f.answerBlocked(requestMessage); ok {
+		return response, true
+	}
+	return f.answerLocal(requestMessage)
+}
+
+// answerBlocked answers a request for a blocked name with NXDOMAIN
+func (f *Forwarder) answerBlocked(requestMessage *DNSMessage) (*DNSMessage, bool) {
+	question := requestMessage.Questions[0]
+	name, err := LabelsToString(question.Name)
+	if err != nil || !f.Blocklist.Load().Blocked(name) {
+		return nil, false
+	}
+	debugf(ComponentPolicy, "Blocked: %s", question)
+	header, err := requestMessage.Header.ModifyDNSHeader(ModifyRCode(RCodeNXDomain))
+	if err != nil {
+		return nil, false
+	}
+	return &DNSMessage{Header: header, Questions: requestMessage.Questions}, true
+}
+
+// answerLocal answers a request from the local records, the registry, a secondary zone, or the cluster zone if any
+// covers its question
+func (f *Forwarder) answerLocal(requestMessage *DNSMessage) (*DNSMessage, bool) {
+	question := requestMessage.Questions[0]
+	name, err := LabelsToString(question.Name)
+	if err != nil {
+		return nil, false
+	}
+	records, ok := f.Local.Load().Lookup(name, question.Type, question.Class)
+	if !ok {
+		records, ok = f.Registry.Load().Lookup(name, question.Type, question.Class)
+	}
+	if !ok {
+		if response, ok := f.answerSecondary(requestMessage, name); ok {
+			return response, true
+		}
+		return f.answerKubernetes(requestMessage, name)
+	}
+	debugf(ComponentPolicy, "Local answer: %s", question)
+	records = f.Rotation.Apply(f.Health.Filter(records))
+	header, err := requestMessage.Header.ModifyDNSHeader(ModifyAA(1)) // The server is the authority for its local data
+	if err != nil {
+		return nil, false
+	}
+	return &DNSMessage{
+		Header:    header,
+		Questions: requestMessage.Questions,
+		Answers:   []*DNSAnswer{{ResourceRecords: records}},
+	}, true
+}
+
+// coversLocally reports whether answerLocal answers key, checking its sources in the same order, without building the
+// answer
+func (f *Forwarder) coversLocally(key CacheKey) bool {
+	if _, ok := f.Local.Load().Lookup(key.Name, key.Type, key.Class); ok {
+		return true
+	}
+	if _, ok := f.Registry.Load().Lookup(key.Name, key.Type, key.Class); ok {
+		return true
+	}
+	if f.Secondaries.Find(key.Name) != nil {
+		return true
+	}
+	zone := f.Kubernetes.Load()
+	return zone != nil && isSubdomain(key.Name, zone.Zone)
+}
+
+// cachedResponse builds the response to request from records cached for its question. The header is derived from the
+// request's rather than replayed from the upstream response the records came from: it keeps the request's ID, opcode,
+// and RD, sets RA, and clears AA, since cached answers are never authoritative.
+func (f *Forwarder) cachedResponse(request *DNSMessage, records []ResourceRecord) (*DNSMessage, error) {
+	header, err := responseHeader(request.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{
+		Header:    header,
+		Questions: request.Questions,
+		Answers:   []*DNSAnswer{{ResourceRecords: f.TTLBounds.Apply(records)}},
+	}, nil
+}
+
+// Refresh re-resolves a cache key via the downstream server its type is routed to and re-caches the answer; used by
+// the prefetcher
+func (f *Forwarder) Refresh(key CacheKey) error {
+	upstream, blocked := f.Routes.Route(key.Type, f.Upstream)
+	if blocked {
+		return nil
+	}
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), DNSQuestionOptions{Name: key.Name, Type: key.Type, Class: key.Class})
+	if err != nil {
+		return err
+	}
+	_, err, _ = f.flights.Do(key, func() (*DNSMessage, error) {
+		response, err := f.exchange(context.Background(), upstream, query)
+		if err != nil {
+			return nil, err
+		}
+		f.share(key, f.store(key, response, upstream.String()))
+		return response, nil
+	})
+	return err
+}
+
+// exchange forwards query to upstream once the limiter admits it
+func (f *Forwarder) exchange(ctx context.Context, upstream Upstream, query *DNSMessage) (*DNSMessage, error) {
+	release, err := f.Limiter.Acquire(ctx, upstreamWeight(upstream))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return upstream.Exchange(ctx, query)
+}
+
+// CachedResponse returns the pre-encoded response to a plain single-question query if its answer is cached, patched
+// with the query's ID and the response flags, so that cache hits skip decoding into and re-encoding a message; only the
+// query's header and question are ever decoded. Responses larger than limit are left to the slow path, which shrinks
+// them, and so is everything unless the cache plugin is configured with only plugins this path stands in for before it.
+func (f *Forwarder) CachedResponse(query *LazyMessage, limit int) ([]byte, bool) {
+	header := query.Header
+	if !f.encodedCache || header.Flags&OpCodeMask != 0 || header.QDCount != 1 || header.ANCount|header.NSCount|header.ARCount != 0 {
+		return nil, false
+	}
+	question, err := query.FirstQuestion()
+	if err != nil {
+		return nil, false
+	}
+	if questions, err := query.SectionBytes(SectionQuestion); err != nil || DNSHeaderSize+len(questions) != len(query.Raw) {
+		return nil, false // Trailing data makes the query malformed, which the slow path reports
+	}
+	key := CacheKeyFromQuestion(question)
+	if f.Blocklist.Load().Blocked(key.Name) {
+		return nil, false
+	}
+	if f.coversLocally(key) {
+		return nil, false
+	}
+	encoded, age, ok := f.Cache.GetEncoded(key)
+	if !ok || len(encoded.Wire) > limit {
+		return nil, false
+	}
+	debugf(ComponentCache, "Pre-encoded cache hit: %s %s", key.Name, TypeString(key.Type))
+	patched, err := responseHeader(&header) // As in cachedResponse, nothing of the upstream header is replayed
+	if err != nil {
+		return nil, false
+	}
+	encodedQuestion, err := question.Encode()
+	if err != nil {
+		return nil, false
+	}
+	name := encodedQuestion[:len(encodedQuestion)-4] // Without the type and class
+	return encoded.Patch(patched.ID, patched.Flags, name, age, f.TTLBounds), true
+}
+
+// store assembles a downstream response's answers into RRsets and clamps their TTLs in place, and caches them with
+// their pre-encoded response as learned from source; the cached records are returned
+func (f *Forwarder) store(key CacheKey, response *DNSMessage, source string) []ResourceRecord {
+	if len(response.Answers) == 0 {
+		return nil
+	}
+	records := sectionRecords(response.Answers)
+	if len(response.Questions) > 0 {
+		records = AssembleAnswer(response.Questions[0].Name, records)
+	}
+	records = f.TTLBounds.Apply(records)
+	response.Answers = []*DNSAnswer{{ResourceRecords: records}}
+	var encoded *EncodedResponse
+	question, err := NewDNSQuestion(DNSQuestionOptions{Name: key.Name, Type: key.Type, Class: key.Class})
+	if err == nil {
+		encoded, err = NewEncodedResponse(question, records)
+	}
+	if err != nil {
+		fmt.Printf("Failed to pre-encode response for %s: %v\n", key.Name, err)
+	}
+	f.Cache.Set(key, records, time.Duration(minTTL(records))*time.Second, encoded, source)
+	return records
+}
+
+// share writes records cached from upstream through to the shared cache, if there is one
+func (f *Forwarder) share(key CacheKey, records []ResourceRecord) {
+	f.Shared.Set(key, records, time.Duration(minTTL(records))*time.Second)
+}
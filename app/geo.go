@@ -0,0 +1,232 @@
+package main
+
+/*
+This module contains the geo plugin, which gives clients in different locations different answers for the same name.
+Clients are located with a MaxMind DB (--geoip-db) by the network their query announces with EDNS Client Subnet, or
+else by their address, as the ISO code of their country (e.g. DE) and the code of their continent (e.g. EU). Records
+given with --geo-record answer the clients of the regions listed with them, a country taking precedence over its
+continent, and --geo-upstream forwards the questions of a region's clients to an upstream of their own, whose answers
+are not cached as they are not meant for everyone. Clients of other regions, or that cannot be located, are answered by
+the rest of the plugin chain, so the plugin belongs before the cache.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// GeoOptions configures the geo plugin
+type GeoOptions struct {
+	Database  string // MaxMind DB locating clients
+	Records   []GeoRecord
+	Upstreams []GeoUpstream
+}
+
+// GeoRecord is a record answering the clients of some regions
+type GeoRecord struct {
+	Regions []string // Country ISO codes and continent codes, upper case
+	Record  ResourceRecord
+}
+
+// GeoUpstream is an upstream the questions of the clients of some regions are forwarded to
+type GeoUpstream struct {
+	Regions []string
+	Spec    string
+}
+
+// geoRRset is an RRset answering the clients of some regions
+type geoRRset struct {
+	regions []string
+	records []ResourceRecord
+}
+
+// geoPlugin answers and forwards questions depending on the location of the client
+type geoPlugin struct {
+	db        *MMDB
+	records   map[string]map[uint16][]*geoRRset // By canonical owner name and type
+	upstreams []geoUpstream
+	forwarder *Forwarder
+}
+
+// geoUpstream is a GeoUpstream once set up
+type geoUpstream struct {
+	regions  []string
+	upstream Upstream
+}
+
+func init() {
+	RegisterPlugin("geo", func() Plugin { return &geoPlugin{} })
+}
+
+// parseRegions parses a comma-separated list of region codes
+func parseRegions(list string) ([]string, error) {
+	var regions []string
+	for _, region := range strings.Split(list, ",") {
+		if region = strings.ToUpper(strings.TrimSpace(region)); region == "" {
+			return nil, fmt.Errorf("empty region in %q", list)
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// ParseGeoRecord parses a record given as "<region>[,<region>...] <record>"
+func ParseGeoRecord(line string) (GeoRecord, error) {
+	list, rest, found := strings.Cut(strings.TrimSpace(line), " ")
+	if !found {
+		return GeoRecord{}, fmt.Errorf("%q is not of the form \"<region>[,<region>...] <record>\"", line)
+	}
+	regions, err := parseRegions(list)
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	record, err := ParseResourceRecord(rest, RecordParseOptions{})
+	if err != nil {
+		return GeoRecord{}, err
+	}
+	return GeoRecord{Regions: regions, Record: record}, nil
+}
+
+// ParseGeoUpstream parses an upstream given as "<region>[,<region>...] <upstream>"
+func ParseGeoUpstream(line string) (GeoUpstream, error) {
+	list, spec, found := strings.Cut(strings.TrimSpace(line), " ")
+	if !found {
+		return GeoUpstream{}, fmt.Errorf("%q is not of the form \"<region>[,<region>...] <upstream>\"", line)
+	}
+	regions, err := parseRegions(list)
+	if err != nil {
+		return GeoUpstream{}, err
+	}
+	return GeoUpstream{Regions: regions, Spec: strings.TrimSpace(spec)}, nil
+}
+
+func (p *geoPlugin) Name() string {
+	return "geo"
+}
+
+func (p *geoPlugin) Setup(config *Config, forwarder *Forwarder) error {
+	if config.Geo.Database == "" {
+		return fmt.Errorf("locating clients needs --geoip-db")
+	}
+	db, err := OpenMMDB(config.Geo.Database)
+	if err != nil {
+		return err
+	}
+	p.db, p.forwarder = db, forwarder
+	p.records = map[string]map[uint16][]*geoRRset{}
+	for _, geoRecord := range config.Geo.Records {
+		name, err := LabelsToString(geoRecord.Record.Name)
+		if err != nil {
+			return err
+		}
+		name = CanonicalName(name)
+		if p.records[name] == nil {
+			p.records[name] = map[uint16][]*geoRRset{}
+		}
+		rrsets := p.records[name][geoRecord.Record.Type]
+		index := slices.IndexFunc(rrsets, func(rrset *geoRRset) bool { return slices.Equal(rrset.regions, geoRecord.Regions) })
+		if index < 0 {
+			rrsets = append(rrsets, &geoRRset{regions: geoRecord.Regions})
+			index = len(rrsets) - 1
+		}
+		rrsets[index].records = append(rrsets[index].records, geoRecord.Record)
+		p.records[name][geoRecord.Record.Type] = rrsets
+	}
+	for _, geo := range config.Geo.Upstreams {
+		upstream, err := NewUpstream(geo.Spec, config.Upstream)
+		if err != nil {
+			return err
+		}
+		p.upstreams = append(p.upstreams, geoUpstream{regions: geo.Regions, upstream: upstream})
+	}
+	fmt.Printf("Loaded %d geo records for %d names and %d geo upstreams\n", len(config.Geo.Records), len(p.records), len(p.upstreams))
+	return nil
+}
+
+func (p *geoPlugin) Wrap(next Handler) Handler {
+	return HandlerFunc(func(request *DNSMessage) (*DNSMessage, error) {
+		regions := p.regions(request.Client)
+		if len(regions) == 0 {
+			return next.ServeDNS(request)
+		}
+		question := request.Questions[0]
+		if records, ok := p.lookup(question, regions); ok {
+			debugf(ComponentPolicy, "Geo answer for %v: %s", regions, question)
+			header, err := request.Header.ModifyDNSHeader(ModifyAA(1))
+			if err != nil {
+				return nil, err
+			}
+			return &DNSMessage{Header: header, Questions: request.Questions, Answers: []*DNSAnswer{{ResourceRecords: records}}}, nil
+		}
+		for _, region := range regions {
+			for _, geo := range p.upstreams {
+				if slices.Contains(geo.regions, region) {
+					return p.forward(request, geo.upstream, region)
+				}
+			}
+		}
+		return next.ServeDNS(request)
+	})
+}
+
+// regions returns the codes of the country and continent of client, most specific first, or none if it cannot be
+// located
+func (p *geoPlugin) regions(client netip.Prefix) []string {
+	if !client.IsValid() {
+		return nil
+	}
+	value, ok := p.db.Lookup(client.Addr())
+	if !ok {
+		return nil
+	}
+	location, _ := value.(map[string]any)
+	var regions []string
+	for _, field := range [][2]string{{"country", "iso_code"}, {"registered_country", "iso_code"}, {"continent", "code"}} {
+		if area, ok := location[field[0]].(map[string]any); ok {
+			if code, ok := area[field[1]].(string); ok && code != "" && !slices.Contains(regions, strings.ToUpper(code)) {
+				regions = append(regions, strings.ToUpper(code))
+			}
+		}
+	}
+	return regions
+}
+
+// lookup returns the records of the question's name and type, or its CNAME, meant for the first of regions that has
+// any
+func (p *geoPlugin) lookup(question *DNSQuestion, regions []string) ([]ResourceRecord, bool) {
+	name, err := LabelsToString(question.Name)
+	if err != nil {
+		return nil, false
+	}
+	byType := p.records[CanonicalName(name)]
+	if byType == nil {
+		return nil, false
+	}
+	for _, region := range regions {
+		for _, recordType := range []uint16{question.Type, TypeCNAME} {
+			for _, rrset := range byType[recordType] {
+				if !slices.Contains(rrset.regions, region) {
+					continue
+				}
+				if records := filterClass(rrset.records, question.Class); len(records) > 0 {
+					return records, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// forward sends a request to the upstream of the client's region, bypassing the cache both ways
+func (p *geoPlugin) forward(request *DNSMessage, upstream Upstream, region string) (*DNSMessage, error) {
+	debugf(ComponentForwarder, "Forwarding %s to %s for a client in %s", request.Questions[0], upstream, region)
+	response, err := p.forwarder.exchange(context.Background(), upstream, request)
+	if err != nil {
+		return nil, err
+	}
+	response.Header.Flags &^= AAMask
+	return response, nil
+}
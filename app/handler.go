@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// handleClientPacket resolves a single client datagram and queues the response for the client. The datagram is only
+// valid for the duration of the call.
+func handleClientPacket(responses chan<- packet, forwarder *Forwarder, data []byte, source *net.UDPAddr, maxUDPSize int) {
+	if response := handleClientMessage(forwarder, data, source, maxUDPSize); response != nil {
+		responses <- packet{Data: response, Addr: source}
+	}
+}
+
+// handleClientMessage resolves a client message received over UDP, TCP, or HTTPS and returns the encoded response,
+// recording the query in the query log if one is open, for webhooks if any are configured, and in the verbose log
+// with -v
+func handleClientMessage(forwarder *Forwarder, data []byte, source net.Addr, maxUDPSize int) (response []byte) {
+	defer func() {
+		// A bug triggered by one query must not take the server down with it
+		if recovered := recover(); recovered != nil {
+			fmt.Printf("Dropping query from %s after a panic: %v\n%s", source, recovered, debug.Stack())
+			response = nil
+		}
+	}()
+	start := time.Now()
+	response = chaos.Apply(resolveClientMessage(forwarder, data, source, maxUDPSize), source)
+	if queryLog != nil || webhooks != nil || verbosity >= 1 {
+		if entry, ok := NewQueryLogEntry(start, source, data, response); ok {
+			verbosef("%s", entry)
+			if queryLog != nil {
+				queryLog.Record(entry)
+			}
+			if webhooks != nil {
+				webhooks.Notify(entry)
+			}
+		}
+	}
+	return response
+}
+
+// resolveClientMessage resolves a client message and returns the encoded response; failures are logged and answered
+// with SERVFAIL and malformed queries with FORMERR, while packets without a full header, responses, and queries that
+// cannot be answered at all yield nil, dropping them
+func resolveClientMessage(forwarder *Forwarder, data []byte, source net.Addr, maxUDPSize int) (response []byte) {
+	logPacket("client "+source.String()+" -> server", data)
+	query, err := ParseLazy(data)
+	if err != nil {
+		fmt.Println("Failed to read and process client message:", err)
+		return nil
+	}
+	if query.Header.Flags&QRMask != 0 {
+		fmt.Println("Ignoring response sent by client", source)
+		return nil // Answering it could start a loop with another server
+	}
+	// Only standard queries and NOTIFY are implemented; IQUERY, STATUS, UPDATE, and unassigned opcodes get NOTIMP
+	switch query.Header.Flags & OpCodeMask >> OpCodeShift {
+	case OpCodeQuery: // Resolved below
+	case OpCodeNotify:
+		return handleNotify(forwarder, query, source, maxUDPSize)
+	default:
+		return notImplemented(query, source, maxUDPSize)
+	}
+	if response, ok := forwarder.CachedResponse(query, responseLimit(source, nil, maxUDPSize)); ok {
+		logPacket("server -> client "+source.String()+" (cached)", response)
+		return response
+	}
+	finish, previous, retransmit := forwarder.Retransmits.Begin(query, source)
+	if retransmit {
+		debugf(ComponentPolicy, "Retransmit of query %d from %s", query.Header.ID, source)
+		return previous // Dropped while the original is in flight, whose response answers both
+	}
+	defer func() { finish(response) }()
+	clientMessage, err := query.DecodeQuery()
+	if err != nil {
+		// The header alone is enough to tell the client its query was malformed
+		fmt.Println("Failed to read and process client message:", err)
+		malformed := &DNSMessage{Header: &query.Header}
+		return serverFailure(malformed, source, RCodeFormErr, ExtendedError(EDEOther, ""), UDPMessageSize)
+	}
+	limit := responseLimit(source, clientMessage, maxUDPSize)
+	queryOPT, edns := FindOPT(clientMessage)
+	if edns && EDNSVersionOf(queryOPT) > EDNSVersion {
+		fmt.Println("Refusing query of unsupported EDNS version", EDNSVersionOf(queryOPT))
+		return serverFailure(clientMessage, source, RCodeBadVers, ExtendedError(EDEOther, ""), limit)
+	}
+	for _, question := range clientMessage.Questions {
+		if unsupportedQueryType(question.Type) {
+			fmt.Println("Refusing unsupported query:", question)
+			return serverFailure(clientMessage, source, RCodeNotImp, ExtendedError(EDEOther, ""), limit)
+		}
+	}
+
+	// Split up received message into individual requests to forward to downstream resolver
+	clientMessage.Client = ClientNetwork(clientMessage, source)
+	requestMessages := clientMessage.SplitDNSMessage()
+	downstreamResponses, err := forwarder.Resolve(requestMessages)
+	if errors.Is(err, ErrUpstreamOverloaded) {
+		fmt.Println("Shedding client request:", err)
+		return serverFailure(clientMessage, source, RCodeServFail, ExtendedError(EDEOther, err.Error()), limit)
+	}
+	if err != nil {
+		fmt.Println("Failed to forward client requests to downstream server:", err)
+		return serverFailure(clientMessage, source, RCodeServFail, ExtendedError(EDENoReachableAuthority, err.Error()), limit)
+	}
+
+	// Populate client response answers with the answers to each question and modify the client response header
+	queryHeader := clientMessage.Header
+	answers, rCode, authoritative, err := aggregateResponses(clientMessage.Questions, downstreamResponses)
+	if err == nil {
+		clientMessage.Answers = answers
+		clientMessage.Header, err = responseHeader(queryHeader)
+	}
+	if authoritative && err == nil {
+		clientMessage.Header, err = clientMessage.Header.ModifyDNSHeader(ModifyAA(1))
+	}
+	if err == nil {
+		clientMessage.Header, err = clientMessage.Header.ModifyDNSHeader(ModifyRCode(rCode))
+	}
+	if err != nil {
+		fmt.Println("Failed to modify DNS header:", err)
+		clientMessage.Header = queryHeader
+		return serverFailure(clientMessage, source, RCodeServFail, ExtendedError(EDEOther, ""), limit)
+	}
+
+	// Answer EDNS clients with the server's own OPT record instead of echoing theirs
+	clientMessage.Additionals = nil
+	if edns {
+		rCode := clientMessage.Header.Flags & RCodeMask >> RCodeShift
+		clientMessage.Additionals = []*DNSAnswer{{ResourceRecords: []ResourceRecord{ResponseOPT(queryOPT, rCode)}}}
+	}
+
+	response, err = FitResponse(clientMessage, limit)
+	if err != nil {
+		fmt.Println("Failed to encode client response message:", err)
+		clientMessage.Header = queryHeader
+		return serverFailure(clientMessage, source, RCodeServFail, ExtendedError(EDEOther, ""), limit)
+	}
+	logPacket("server -> client "+source.String(), response)
+	return response
+}
+
+// aggregateResponses combines the responses to the questions of a split query, responses[i] answering questions[i], into
+// the answers of the single response to the query: each question contributes its complete answer, assembled from whole
+// RRsets with the question's owner name echoed as asked, or nothing if it has none. The response is authoritative only
+// if every question was answered from local data. Its rCode is the first failure among the questions; NXDOMAIN only
+// counts as one if it holds for every question, as the names of the others do exist.
+func aggregateResponses(questions []*DNSQuestion, responses []*DNSMessage) ([]*DNSAnswer, uint16, bool, error) {
+	if len(responses) != len(questions) {
+		return nil, 0, false, fmt.Errorf("got %d responses to %d questions", len(responses), len(questions))
+	}
+	var answers []*DNSAnswer
+	rCode, authoritative, nonexistent := uint16(RCodeNoError), true, true
+	for i, response := range responses {
+		name := questions[i].Name
+		if records := sectionRecords(response.Answers); len(records) > 0 {
+			records = preserveCase(AssembleAnswer(name, records), name)
+			answers = append(answers, &DNSAnswer{ResourceRecords: records})
+		}
+		authoritative = authoritative && response.Header.Flags&AAMask != 0
+		switch responseRCode := response.Header.Flags & RCodeMask >> RCodeShift; responseRCode {
+		case RCodeNoError:
+			nonexistent = false
+		case RCodeNXDomain:
+		default:
+			nonexistent = false
+			if rCode == RCodeNoError {
+				rCode = responseRCode
+			}
+		}
+	}
+	if nonexistent && len(responses) > 0 {
+		rCode = RCodeNXDomain
+	}
+	return answers, rCode, authoritative, nil
+}
+
+// serverFailure encodes a response with rCode echoing the ID and questions of a query that could not be answered, so
+// that the client fails fast instead of retrying into silence; only if even that cannot be encoded is the query dropped
+func serverFailure(query *DNSMessage, source net.Addr, rCode uint16, extendedError EDNSOption, limit int) []byte {
+	response, err := errorResponse(query, rCode, extendedError, limit)
+	if err != nil {
+		fmt.Println("Failed to encode client error response:", err)
+		return nil
+	}
+	logPacket("server -> client "+source.String(), response)
+	return response
+}
+
+// responseLimit returns the largest response a client may receive: anything a length prefix can frame over TCP, and
+// over UDP 512 bytes or the payload size advertised by the query's OPT record, capped at maxUDPSize
+func responseLimit(source net.Addr, query *DNSMessage, maxUDPSize int) int {
+	if _, stream := source.(*net.TCPAddr); stream {
+		return MaxStreamMessageSize
+	}
+	limit := UDPMessageSize
+	if query != nil {
+		if opt, ok := FindOPT(query); ok {
+			limit = max(limit, int(opt.Class))
+		}
+	}
+	return min(limit, max(maxUDPSize, UDPMessageSize))
+}
+
+// errorResponse encodes a response to query that carries no records, only rCode and, for EDNS clients, the extended
+// error, fitting it into limit bytes; extended response codes need the query to carry an OPT record
+func errorResponse(query *DNSMessage, rCode uint16, extendedError EDNSOption, limit int) ([]byte, error) {
+	header, err := responseHeader(query.Header)
+	if err != nil {
+		return nil, err
+	}
+	if header, err = header.ModifyDNSHeader(ModifyRCode(rCode & RCodeMax)); err != nil {
+		return nil, err
+	}
+	response := &DNSMessage{Header: header, Questions: query.Questions}
+	if queryOPT, ok := FindOPT(query); ok {
+		response.Additionals = []*DNSAnswer{{ResourceRecords: []ResourceRecord{ResponseOPT(queryOPT, rCode, extendedError)}}}
+	}
+	return FitResponse(response, limit)
+}
+
+// responseHeader derives the header of the response to a client query from the query's header, keeping its opcode and
+// RD flag; recursion is always available, as whatever the server cannot answer itself is forwarded
+func responseHeader(queryHeader *DNSHeader) (*DNSHeader, error) {
+	return queryHeader.ModifyDNSHeader(
+		ModifyQR(1), // Mark message as a response
+		ModifyAA(0),
+		ModifyTC(0),
+		ModifyRA(1),
+		ModifyZ(0),
+		ModifyRCode(RCodeNoError),
+	)
+}
+
+// notImplemented answers a message of an opcode the server does not implement with NOTIMP, echoing its questions if
+// it decodes
+func notImplemented(query *LazyMessage, source net.Addr, maxUDPSize int) []byte {
+	fmt.Printf("Refusing %s message from %s: opcode not implemented\n", OpCodeString(query.Header.Flags&OpCodeMask>>OpCodeShift), source)
+	message, err := query.Decode()
+	if err != nil {
+		message = &DNSMessage{Header: &query.Header}
+	}
+	return serverFailure(message, source, RCodeNotImp, ExtendedError(EDEOther, ""), responseLimit(source, message, maxUDPSize))
+}
+
+// unsupportedQueryType reports whether queries of qType cannot be forwarded as a single exchange: zone transfers
+// stream many messages, and the MAILA and MAILB types are obsolete
+func unsupportedQueryType(qType uint16) bool {
+	return qType == TypeAXFR || qType == TypeIXFR || qType == TypeMAILA || qType == TypeMAILB
+}
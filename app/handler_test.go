@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandleClientMessageFailures(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5300}
+	question, err := NewDNSQuestion(DNSQuestionOptions{Name: "example.com.", Type: TypeA, Class: ClassIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &DNSMessage{Header: &DNSHeader{ID: 7, Flags: 1 << RDShift}, Questions: []*DNSQuestion{question}}
+	query, err := message.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An answer whose data no RDLENGTH can frame, so that the response cannot be encoded
+	unencodable := func(request *DNSMessage) (*DNSMessage, error) {
+		record := ResourceRecord{Name: request.Questions[0].Name, Type: TypeA, Class: ClassIN, Data: make([]byte, 1<<16)}
+		answers := []*DNSAnswer{{ResourceRecords: []ResourceRecord{record}}}
+		return &DNSMessage{Header: request.Header, Questions: request.Questions, Answers: answers}, nil
+	}
+	tests := []struct {
+		name      string
+		data      []byte
+		chain     HandlerFunc
+		wantRCode int // -1 for a dropped query
+	}{
+		{"undecodable query", query[:len(query)-2], nil, RCodeFormErr},
+		{"shorter than a header", query[:DNSHeaderSize-1], nil, -1},
+		{"upstream error", query, func(*DNSMessage) (*DNSMessage, error) {
+			return nil, errors.New("upstream unreachable")
+		}, RCodeServFail},
+		{"encode failure", query, unencodable, RCodeServFail},
+		{"panic", query, func(*DNSMessage) (*DNSMessage, error) {
+			panic("handler bug")
+		}, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarder := &Forwarder{chain: test.chain}
+			response := handleClientMessage(forwarder, test.data, source, UDPMessageSize)
+			if test.wantRCode < 0 {
+				if response != nil {
+					t.Fatalf("handleClientMessage() = %x, want the query dropped", response)
+				}
+				return
+			}
+			if len(response) < DNSHeaderSize {
+				t.Fatalf("handleClientMessage() = %x, want a response with RCODE %s", response, RCodeString(uint16(test.wantRCode)))
+			}
+			if id := int(response[0])<<8 | int(response[1]); id != 7 {
+				t.Errorf("response ID = %d, want 7", id)
+			}
+			if rCode := int(response[3] & 0x0F); rCode != test.wantRCode {
+				t.Errorf("response RCODE = %s, want %s", RCodeString(uint16(rCode)), RCodeString(uint16(test.wantRCode)))
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+/*
+This module contains health checks of local records, with which DNS-based failover works for home-lab services
+without a load balancer in front of them. A check attached to a local name probes every address of the name's A and
+AAAA records each interval, by connecting to a TCP port or by requesting an HTTP(S) URL that must answer with a 2xx or
+3xx status, and addresses whose last probe failed are left out of answers. Should every address of a name fail, all of
+them are answered anyway: a name without addresses is no better for clients than one whose addresses may be down.
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthInterval is how often addresses are probed by default
+	DefaultHealthInterval = 10 * time.Second
+	// DefaultHealthTimeout bounds each probe by default
+	DefaultHealthTimeout = 2 * time.Second
+)
+
+// HealthOptions configures the health checks of local records
+type HealthOptions struct {
+	Checks   []HealthCheck
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// HealthCheck is a probe of the addresses of a local name
+type HealthCheck struct {
+	Name   string // Canonical owner name of the checked records
+	Scheme string // tcp, http, or https
+	Port   uint16
+	Path   string // Requested by HTTP(S) probes
+}
+
+// HealthChecker probes the addresses of local names and filters failing ones out of answers; a nil HealthChecker
+// filters nothing
+type HealthChecker struct {
+	HealthOptions
+	client  *http.Client // Shared by HTTP(S) probes
+	failing sync.Map     // Names and addresses whose last probe failed, as "<name> <address>"
+}
+
+// ParseHealthCheck parses a check given as "<name> tcp:<port>" or "<name> http[s]:<port>[/path]"
+func ParseHealthCheck(line string) (HealthCheck, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return HealthCheck{}, fmt.Errorf("%q is not of the form \"<name> tcp:<port>\" or \"<name> http[s]:<port>[/path]\"", line)
+	}
+	scheme, target, _ := strings.Cut(fields[1], ":")
+	port, path, _ := strings.Cut(target, "/")
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return HealthCheck{}, fmt.Errorf("invalid port %q in %q", port, line)
+	}
+	check := HealthCheck{Name: CanonicalName(strings.TrimSuffix(fields[0], ".") + "."), Scheme: scheme, Port: uint16(number), Path: "/" + path}
+	switch scheme {
+	case "tcp":
+		if path != "" {
+			return HealthCheck{}, fmt.Errorf("TCP check %q cannot have a path", line)
+		}
+	case "http", "https":
+	default:
+		return HealthCheck{}, fmt.Errorf("unknown check type %q in %q, expected tcp, http, or https", scheme, line)
+	}
+	return check, nil
+}
+
+// String renders the check as it is given
+func (check HealthCheck) String() string {
+	if check.Scheme == "tcp" {
+		return fmt.Sprintf("tcp:%d", check.Port)
+	}
+	return fmt.Sprintf("%s:%d%s", check.Scheme, check.Port, check.Path)
+}
+
+// NewHealthChecker creates a checker for opts, or returns nil if there are no checks
+func NewHealthChecker(opts HealthOptions) *HealthChecker {
+	if len(opts.Checks) == 0 {
+		return nil
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultHealthInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHealthTimeout
+	}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		// Certificates are issued for names, not for the addresses probed, and self-signed ones abound in home labs;
+		// connections are not kept alive between probes an interval apart
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // A redirect is an answer of its own
+		},
+	}
+	return &HealthChecker{HealthOptions: opts, client: client}
+}
+
+// Run probes the addresses the local store holds for the checked names every interval; it never returns
+func (h *HealthChecker) Run(local func() *LocalStore) {
+	for ; ; time.Sleep(h.Interval) {
+		var wg sync.WaitGroup
+		for _, check := range h.Checks {
+			for _, recordType := range []uint16{TypeA, TypeAAAA} {
+				records, _ := local().Lookup(check.Name, recordType, ClassIN)
+				for _, record := range records {
+					addr, ok := netip.AddrFromSlice(record.Data)
+					if !ok || record.Type != recordType {
+						continue // A CNAME standing in for the addresses
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						h.record(check, addr.Unmap(), h.probe(check, addr.Unmap()))
+					}()
+				}
+			}
+		}
+		wg.Wait()
+	}
+}
+
+// probe checks a single address
+func (h *HealthChecker) probe(check HealthCheck, addr netip.Addr) error {
+	target := netip.AddrPortFrom(addr, check.Port).String()
+	if check.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", target, h.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	response, err := h.client.Get(check.Scheme + "://" + target + check.Path)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("answered %s", response.Status)
+	}
+	return nil
+}
+
+// record stores the outcome of a probe, logging changes
+func (h *HealthChecker) record(check HealthCheck, addr netip.Addr, err error) {
+	key := check.Name + " " + addr.String()
+	if err != nil {
+		if _, failing := h.failing.Swap(key, true); !failing {
+			fmt.Printf("Health check %s of %s at %s failed, leaving the address out: %v\n", check, check.Name, addr, err)
+		}
+	} else if _, failing := h.failing.LoadAndDelete(key); failing {
+		fmt.Printf("Health check %s of %s at %s passes again\n", check, check.Name, addr)
+	}
+}
+
+// Filter returns the records of an answer without the addresses whose checks are failing, or all of them if every
+// address is failing
+func (h *HealthChecker) Filter(records []ResourceRecord) []ResourceRecord {
+	if h == nil || len(records) == 0 || records[0].Type != TypeA && records[0].Type != TypeAAAA {
+		return records
+	}
+	name, err := LabelsToString(records[0].Name)
+	if err != nil {
+		return records
+	}
+	name = CanonicalName(name)
+	var healthy []ResourceRecord
+	for _, record := range records {
+		addr, ok := netip.AddrFromSlice(record.Data)
+		if _, failing := h.failing.Load(name + " " + addr.Unmap().String()); ok && failing {
+			continue
+		}
+		healthy = append(healthy, record)
+	}
+	if len(healthy) == 0 {
+		debugf(ComponentPolicy, "Every address of %s is failing its health check, answering all of them", name)
+		return records
+	}
+	return healthy
+}
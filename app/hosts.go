@@ -0,0 +1,87 @@
+package main
+
+/*
+This module contains the loading of hosts files (hosts(5)) into local records: every name on a line gets an A or AAAA
+record for the line's address, and every address gets a PTR record naming the first host listed for it.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultHostsPath is the system hosts file loaded unless --hosts says otherwise
+	DefaultHostsPath = "/etc/hosts"
+	// HostsTTL is the TTL of records derived from hosts files, kept short because the files are reloaded on change
+	HostsTTL = 60
+)
+
+// LoadHostsFile reads the A, AAAA, and PTR records a hosts file implies; a missing file implies none, and malformed
+// lines are skipped with a warning
+func LoadHostsFile(path string) ([]ResourceRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Hosts file %s does not exist, skipping it\n", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []ResourceRecord
+	named := map[netip.Addr]bool{} // Addresses that already have a PTR record
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		lineRecords, err := hostsLineRecords(fields, named)
+		if err != nil {
+			fmt.Printf("Skipping hosts file line %s:%d: %v\n", path, lineNumber, err)
+			continue
+		}
+		records = append(records, lineRecords...)
+	}
+	return records, scanner.Err()
+}
+
+// hostsLineRecords returns the records implied by the fields of one hosts file line, marking its address in named
+// if it gave the address its PTR record
+func hostsLineRecords(fields []string, named map[netip.Addr]bool) ([]ResourceRecord, error) {
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil || len(fields) < 2 {
+		return nil, fmt.Errorf("expected an address followed by host names")
+	}
+	addr = addr.WithZone("").Unmap()
+	recordType := uint16(TypeA)
+	if addr.Is6() {
+		recordType = TypeAAAA
+	}
+	var records []ResourceRecord
+	for _, host := range fields[1:] {
+		name := strings.ToLower(host) + "."
+		record, err := NewResourceRecord(name, recordType, ClassIN, HostsTTL, []string{addr.String()}, "")
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if !named[addr] {
+		target := strings.ToLower(fields[1]) + "."
+		record, err := NewResourceRecord(ReverseName(addr), TypePTR, ClassIN, HostsTTL, []string{target}, "")
+		if err != nil {
+			return nil, err
+		}
+		named[addr] = true
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+/*
+This module contains the conversion between internationalized (Unicode) domain names and their ASCII-compatible
+encoding (A-labels, "xn--...") using the Punycode algorithm from RFC 3492.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// ACEPrefix marks a label as Punycode-encoded
+	ACEPrefix = "xn--"
+
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// ToASCIIName converts every non-ASCII label of a domain name into its A-label form
+func ToASCIIName(name string) (string, error) {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycodeEncode(strings.ToLower(label))
+		if err != nil {
+			return "", fmt.Errorf("label %q cannot be converted to an A-label: %w", label, err)
+		}
+		labels[i] = ACEPrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicodeName converts every A-label of a domain name back into Unicode; labels that fail to decode are left as-is
+func ToUnicodeName(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if len(label) <= len(ACEPrefix) || !strings.EqualFold(label[:len(ACEPrefix)], ACEPrefix) {
+			continue
+		}
+		if decoded, err := punycodeDecode(label[len(ACEPrefix):]); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// isASCII reports whether s consists only of ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycodeAdapt is the bias adaptation function from RFC 3492 section 6.1
+func punycodeAdapt(delta, numPoints int, firstTime bool) int {
+	if firstTime {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+// punycodeThreshold clamps the digit threshold for position k
+func punycodeThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punycodeTMin
+	case k >= bias+punycodeTMax:
+		return punycodeTMax
+	default:
+		return k - bias
+	}
+}
+
+// punycodeDigit encodes a digit value as a lowercase basic code point
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycodeValue decodes a basic code point into its digit value
+func punycodeValue(c byte) (int, error) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, nil
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), nil
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), nil
+	}
+	return 0, fmt.Errorf("invalid punycode digit %q", c)
+}
+
+// punycodeEncode encodes a Unicode label per RFC 3492 section 6.3 (without the ACE prefix)
+func punycodeEncode(label string) (string, error) {
+	runes := []rune(label)
+	var out strings.Builder
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+	n, delta, bias := punycodeInitialN, 0, punycodeInitialBias
+	for handled < len(runes) {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m-n)*(handled+1) < 0 {
+			return "", fmt.Errorf("punycode overflow")
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := punycodeThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punycodeDigit(t + (q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out.WriteByte(punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String(), nil
+}
+
+// punycodeDecode decodes a Punycode label per RFC 3492 section 6.2 (without the ACE prefix)
+func punycodeDecode(encoded string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(encoded, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if encoded[i] >= utf8.RuneSelf {
+				return "", fmt.Errorf("non-basic code point in punycode %q", encoded)
+			}
+			output = append(output, rune(encoded[i]))
+		}
+		pos = b + 1
+	}
+	n, i, bias := punycodeInitialN, 0, punycodeInitialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := punycodeBase; ; k += punycodeBase {
+			if pos >= len(encoded) {
+				return "", fmt.Errorf("truncated punycode %q", encoded)
+			}
+			digit, err := punycodeValue(encoded[pos])
+			if err != nil {
+				return "", err
+			}
+			pos++
+			i += digit * w
+			t := punycodeThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punycodeBase - t
+			if i < 0 || w <= 0 {
+				return "", fmt.Errorf("punycode overflow")
+			}
+		}
+		bias = punycodeAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > utf8.MaxRune {
+			return "", fmt.Errorf("punycode code point out of range")
+		}
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
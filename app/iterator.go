@@ -0,0 +1,245 @@
+package main
+
+/*
+This module contains the iterative resolution engine, which starts at the root name servers and follows referrals
+down the delegation tree until an authoritative server answers, reporting every exchange to an observer along the way.
+*/
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultIterationTimeout bounds every exchange with an authoritative server
+	DefaultIterationTimeout = 2 * time.Second
+	// maxIterationReferrals is the number of referrals followed before a resolution is abandoned
+	maxIterationReferrals = 16
+	// maxIterationDepth is how deeply the addresses of name servers without glue may be resolved in turn
+	maxIterationDepth = 4
+)
+
+// rootHints are the root name servers and their IPv4 addresses, as published by IANA
+var rootHints = []NameServer{
+	{Name: "a.root-servers.net.", Addrs: []string{"198.41.0.4"}},
+	{Name: "b.root-servers.net.", Addrs: []string{"170.247.170.2"}},
+	{Name: "c.root-servers.net.", Addrs: []string{"192.33.4.12"}},
+	{Name: "d.root-servers.net.", Addrs: []string{"199.7.91.13"}},
+	{Name: "e.root-servers.net.", Addrs: []string{"192.203.230.10"}},
+	{Name: "f.root-servers.net.", Addrs: []string{"192.5.5.241"}},
+	{Name: "g.root-servers.net.", Addrs: []string{"192.112.36.4"}},
+	{Name: "h.root-servers.net.", Addrs: []string{"198.97.190.53"}},
+	{Name: "i.root-servers.net.", Addrs: []string{"192.36.148.17"}},
+	{Name: "j.root-servers.net.", Addrs: []string{"192.58.128.30"}},
+	{Name: "k.root-servers.net.", Addrs: []string{"193.0.14.129"}},
+	{Name: "l.root-servers.net.", Addrs: []string{"199.7.83.42"}},
+	{Name: "m.root-servers.net.", Addrs: []string{"202.12.27.33"}},
+}
+
+// NameServer is an authoritative server of a zone with the addresses it is known to listen on
+type NameServer struct {
+	Name  string
+	Addrs []string // IP addresses, empty until the name has been resolved
+}
+
+// IterationStep describes one exchange with an authoritative server
+type IterationStep struct {
+	Zone     string // Zone the server was consulted for
+	Server   string // Name of the server
+	Addr     string // Address the query was sent to, as ip:port
+	Question DNSQuestionOptions
+	Response *DNSMessage // Nil if the exchange failed
+	RTT      time.Duration
+	Err      error
+}
+
+// Iterator resolves names iteratively from the root name servers
+type Iterator struct {
+	Roots   []NameServer // Defaults to the IANA root hints
+	Port    int          // Port of every authoritative server, 53 by default
+	Timeout time.Duration
+	OnStep  func(IterationStep) // Called after every exchange, if set
+}
+
+// Resolve follows referrals from the roots for a single question and returns the response of the first server that
+// answers it authoritatively, or that returns an error or an empty non-referral
+func (it *Iterator) Resolve(question DNSQuestionOptions) (*DNSMessage, error) {
+	return it.resolve(question, 0)
+}
+
+// resolve is Resolve at a given depth of nested name server resolutions
+func (it *Iterator) resolve(question DNSQuestionOptions, depth int) (*DNSMessage, error) {
+	zone, servers := ".", it.Roots
+	if len(servers) == 0 {
+		servers = rootHints
+	}
+	for range maxIterationReferrals {
+		response, err := it.ask(zone, servers, question, depth)
+		if err != nil {
+			return nil, err
+		}
+		if response.Header.Flags&RCodeMask != 0 || response.Header.Flags&AAMask != 0 || len(response.Answers) > 0 {
+			return response, nil
+		}
+		next, nextServers := referral(response)
+		if len(nextServers) == 0 {
+			return response, nil // No data
+		}
+		if !isSubdomain(next, zone) || EqualNames(next, zone) {
+			return nil, fmt.Errorf("servers for %s referred to %s, which does not descend from it", zone, next)
+		}
+		zone, servers = next, nextServers
+	}
+	return nil, fmt.Errorf("gave up on %s after %d referrals", question.Name, maxIterationReferrals)
+}
+
+// ask sends question to the servers of zone in random order until one responds usefully, resolving the addresses of
+// servers that came without glue on demand
+func (it *Iterator) ask(zone string, servers []NameServer, question DNSQuestionOptions, depth int) (*DNSMessage, error) {
+	var lastErr error
+	for _, i := range rand.Perm(len(servers)) {
+		server := servers[i]
+		addrs := server.Addrs
+		if len(addrs) == 0 {
+			if depth >= maxIterationDepth {
+				lastErr = fmt.Errorf("name servers of %s nest too deeply to resolve", zone)
+				continue
+			}
+			var err error
+			if addrs, err = it.lookupAddrs(server.Name, depth+1); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		for _, addr := range addrs {
+			step := it.exchange(zone, server.Name, net.JoinHostPort(addr, fmt.Sprint(it.port())), question)
+			if it.OnStep != nil {
+				it.OnStep(step)
+			}
+			if step.Err != nil {
+				lastErr = step.Err
+				continue
+			}
+			rCode := step.Response.Header.Flags & RCodeMask >> RCodeShift
+			if rCode != RCodeNoError && rCode != RCodeNXDomain {
+				lastErr = fmt.Errorf("%s answered %s", step.Addr, RCodeString(rCode))
+				continue
+			}
+			return step.Response, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no servers to ask")
+	}
+	return nil, fmt.Errorf("no server for %s answered: %w", zone, lastErr)
+}
+
+// lookupAddrs resolves the IPv4 addresses of a name server that was referred to without glue
+func (it *Iterator) lookupAddrs(name string, depth int) ([]string, error) {
+	response, err := it.resolve(DNSQuestionOptions{Name: name, Type: TypeA, Class: ClassIN}, depth)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, answer := range response.Answers {
+		for _, record := range answer.ResourceRecords {
+			if addr, ok := netip.AddrFromSlice(record.Data); ok && record.Type == TypeA {
+				addrs = append(addrs, addr.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("name server %s has no address", name)
+	}
+	return addrs, nil
+}
+
+// exchange sends a non-recursive query to one server, retrying over TCP if the UDP response is truncated
+func (it *Iterator) exchange(zone, server, addr string, question DNSQuestionOptions) IterationStep {
+	step := IterationStep{Zone: zone, Server: server, Addr: addr, Question: question}
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), question)
+	if err == nil {
+		query.Header, err = query.Header.ModifyDNSHeader(ModifyRD(0))
+	}
+	if err != nil {
+		step.Err = err
+		return step
+	}
+	start := time.Now()
+	for _, scheme := range []string{"udp", "tcp"} {
+		var upstream Upstream
+		if upstream, err = NewUpstream(scheme+"://"+addr, UpstreamOptions{MaxTimeout: it.timeout()}); err != nil {
+			break
+		}
+		if step.Response, _, err = (&Client{upstream: upstream}).Exchange(query); err != nil {
+			break
+		}
+		if step.Response.Header.Flags&TCMask == 0 {
+			break
+		}
+	}
+	step.RTT, step.Err = time.Since(start), err
+	if err != nil {
+		step.Response = nil
+	}
+	return step
+}
+
+// port returns the port authoritative servers are queried on
+func (it *Iterator) port() int {
+	if it.Port == 0 {
+		return 53
+	}
+	return it.Port
+}
+
+// timeout returns the bound of every exchange
+func (it *Iterator) timeout() time.Duration {
+	if it.Timeout <= 0 {
+		return DefaultIterationTimeout
+	}
+	return it.Timeout
+}
+
+// referral extracts the delegated zone and its name servers, with any glue addresses, from a referral response
+func referral(response *DNSMessage) (string, []NameServer) {
+	var zone string
+	var servers []NameServer
+	for _, answer := range response.Authorities {
+		for _, record := range answer.ResourceRecords {
+			if record.Type != TypeNS {
+				continue
+			}
+			owner, _ := LabelsToString(record.Name)
+			if zone != "" && !EqualNames(owner, zone) {
+				continue
+			}
+			zone = owner
+			if target, _, ok := wireName(record.Data); ok {
+				servers = append(servers, NameServer{Name: target})
+			}
+		}
+	}
+	for i := range servers {
+		for _, answer := range response.Additionals {
+			for _, record := range answer.ResourceRecords {
+				owner, _ := LabelsToString(record.Name)
+				addr, ok := netip.AddrFromSlice(record.Data)
+				if ok && record.Type == TypeA && EqualNames(owner, servers[i].Name) {
+					servers[i].Addrs = append(servers[i].Addrs, addr.String())
+				}
+			}
+		}
+	}
+	return zone, servers
+}
+
+// isSubdomain reports whether name equals zone or lies beneath it; both are absolute names
+func isSubdomain(name, zone string) bool {
+	name, zone = CanonicalName(name), CanonicalName(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,350 @@
+package main
+
+/*
+This module contains the Kubernetes backend, with which the server acts as a minimal cluster DNS for small or edge
+clusters. It lists Services and EndpointSlices through the Kubernetes API, watches both, and answers the names of the
+Kubernetes DNS specification beneath the cluster zone, authoritatively and with NXDOMAIN for names it does not know:
+
+  - <service>.<namespace>.svc.<zone>: the cluster IPs of a service, the ready endpoint addresses of a headless one, or
+    a CNAME to the external name of an ExternalName one
+  - <hostname>.<service>.<namespace>.svc.<zone>: an endpoint of a headless service, named after its hostname or, if it
+    has none, its address with dashes for dots and colons
+  - _<port>._<protocol>.<service>.<namespace>.svc.<zone>: SRV records for the named ports of a service
+
+Like the registry backend, every change re-lists both resources and swaps in a fresh set of records.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// KubernetesInCluster selects the API server and credentials of the pod the server runs in
+	KubernetesInCluster = "in-cluster"
+	// DefaultKubernetesZone is the cluster domain by default
+	DefaultKubernetesZone = "cluster.local."
+	// KubernetesTTL is the TTL of the records generated from the cluster, kept short as pods come and go
+	KubernetesTTL = 5
+	// kubernetesServiceAccount holds the credentials of the pod's service account
+	kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	// kubernetesServiceNameLabel labels EndpointSlices with the name of their service
+	kubernetesServiceNameLabel = "kubernetes.io/service-name"
+)
+
+// KubernetesOptions configures the Kubernetes backend
+type KubernetesOptions struct {
+	API  string // API server URL, e.g. that of "kubectl proxy", or KubernetesInCluster; empty disables the backend
+	Zone string // Cluster domain whose names are answered
+}
+
+// KubernetesZone holds the records generated from a cluster
+type KubernetesZone struct {
+	Zone    string
+	Records *LocalStore
+}
+
+// kubernetesClient sends requests to the API server
+type kubernetesClient struct {
+	base      string
+	tokenFile string // Bearer token, re-read for every request as it is rotated; empty for none
+	http      *http.Client
+}
+
+// kubernetesObjectMeta is the metadata of the objects listed
+type kubernetesObjectMeta struct {
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+// kubernetesPort is a port of a service or an EndpointSlice
+type kubernetesPort struct {
+	Name     string
+	Protocol string
+	Port     int
+}
+
+// kubernetesService is the part of a Service the backend uses
+type kubernetesService struct {
+	Metadata kubernetesObjectMeta
+	Spec     struct {
+		Type         string
+		ClusterIPs   []string `json:"clusterIPs"`
+		ExternalName string
+		Ports        []kubernetesPort
+	}
+}
+
+// kubernetesEndpointSlice is the part of an EndpointSlice the backend uses
+type kubernetesEndpointSlice struct {
+	Metadata  kubernetesObjectMeta
+	Endpoints []struct {
+		Addresses  []string
+		Hostname   string
+		Conditions struct {
+			Ready *bool // Unknown readiness counts as ready
+		}
+	}
+	Ports []kubernetesPort
+}
+
+// kubernetesList is a list of objects of type T and the resource version to watch from
+type kubernetesList[T any] struct {
+	Metadata struct {
+		ResourceVersion string
+	}
+	Items []T
+}
+
+// Validate checks that the options are usable
+func (opts KubernetesOptions) Validate() error {
+	if opts.API == "" || opts.API == KubernetesInCluster {
+		return nil
+	}
+	if !strings.HasPrefix(opts.API, "http://") && !strings.HasPrefix(opts.API, "https://") {
+		return fmt.Errorf("API server %q is neither an http(s):// URL nor %q", opts.API, KubernetesInCluster)
+	}
+	return nil
+}
+
+// newKubernetesClient creates a client for the API server of opts
+func newKubernetesClient(opts KubernetesOptions) (*kubernetesClient, error) {
+	if opts.API != KubernetesInCluster {
+		return &kubernetesClient{base: strings.TrimSuffix(opts.API, "/"), http: &http.Client{}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	ca, err := os.ReadFile(kubernetesServiceAccount + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %sca.crt", kubernetesServiceAccount)
+	}
+	return &kubernetesClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: kubernetesServiceAccount + "token",
+		http:      &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}},
+	}, nil
+}
+
+// get sends a GET request for path and returns the response, whose body the caller must close
+func (c *kubernetesClient) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, response.Status)
+	}
+	return response, nil
+}
+
+// listKubernetes decodes the list of objects at path into into
+func listKubernetes[T any](c *kubernetesClient, path string, into *kubernetesList[T]) error {
+	ctx, cancel := context.WithTimeout(context.Background(), UpstreamTimeout)
+	defer cancel()
+	response, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(into)
+}
+
+// watch returns once an object at path changes after resourceVersion, or ctx is done
+func (c *kubernetesClient) watch(ctx context.Context, path, resourceVersion string) error {
+	response, err := c.get(ctx, path+"?watch=true&allowWatchBookmarks=false&resourceVersion="+resourceVersion)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var event json.RawMessage // Any event calls for a new list, whatever its type
+	if err := json.NewDecoder(response.Body).Decode(&event); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil // The server ended the watch; re-listing is how it resumes
+		}
+		return err
+	}
+	return nil
+}
+
+// WatchKubernetes serves the records of the cluster's services, replacing them whenever a Service or EndpointSlice
+// changes; it never returns
+func (f *Forwarder) WatchKubernetes(opts KubernetesOptions) {
+	client, err := newKubernetesClient(opts)
+	if err != nil {
+		fmt.Println("Kubernetes backend disabled:", err)
+		return
+	}
+	zone := strings.TrimSuffix(opts.Zone, ".") + "."
+	for {
+		var services kubernetesList[kubernetesService]
+		var endpointSlices kubernetesList[kubernetesEndpointSlice]
+		err := listKubernetes(client, "/api/v1/services", &services)
+		if err == nil {
+			err = listKubernetes(client, "/apis/discovery.k8s.io/v1/endpointslices", &endpointSlices)
+		}
+		if err != nil {
+			fmt.Println("Failed to list the cluster's services:", err)
+			time.Sleep(RegistryRetryDelay)
+			continue
+		}
+		store := NewLocalStore()
+		for _, record := range kubernetesRecords(zone, services.Items, endpointSlices.Items) {
+			store.Add(record)
+		}
+		f.Kubernetes.Store(&KubernetesZone{Zone: zone, Records: store})
+		fmt.Printf("Loaded %d services and %d endpoint slices from the cluster\n", len(services.Items), len(endpointSlices.Items))
+
+		// Watch both resources until either changes, then list them again
+		ctx, cancel := context.WithCancel(context.Background())
+		changed := make(chan error, 2)
+		go func() { changed <- client.watch(ctx, "/api/v1/services", services.Metadata.ResourceVersion) }()
+		go func() {
+			changed <- client.watch(ctx, "/apis/discovery.k8s.io/v1/endpointslices", endpointSlices.Metadata.ResourceVersion)
+		}()
+		if err := <-changed; err != nil {
+			fmt.Println("Failed to watch the cluster's services:", err)
+			time.Sleep(RegistryRetryDelay)
+		}
+		cancel()
+	}
+}
+
+// kubernetesRecords generates the records of services and their endpoints beneath zone, skipping and logging those that
+// cannot be represented
+func kubernetesRecords(zone string, services []kubernetesService, slices []kubernetesEndpointSlice) []ResourceRecord {
+	byService := map[string][]kubernetesEndpointSlice{}
+	for _, slice := range slices {
+		if service := slice.Metadata.Labels[kubernetesServiceNameLabel]; service != "" {
+			key := slice.Metadata.Namespace + "/" + service
+			byService[key] = append(byService[key], slice)
+		}
+	}
+	var records []ResourceRecord
+	for _, service := range services {
+		serviceName := service.Metadata.Name + "." + service.Metadata.Namespace + ".svc." + zone
+		var specs []serviceRecordSpec
+		switch {
+		case service.Spec.Type == "ExternalName":
+			specs = append(specs, serviceRecordSpec{serviceName, TypeCNAME, []string{absoluteName(service.Spec.ExternalName, "")}})
+		case len(service.Spec.ClusterIPs) > 0 && service.Spec.ClusterIPs[0] != "None":
+			for _, ip := range service.Spec.ClusterIPs {
+				specs = append(specs, addressSpec(serviceName, ip))
+			}
+			for _, port := range service.Spec.Ports {
+				specs = append(specs, portSpec(serviceName, port, serviceName))
+			}
+		default: // Headless: the service's name stands for its ready endpoints
+			for _, slice := range byService[service.Metadata.Namespace+"/"+service.Metadata.Name] {
+				for _, endpoint := range slice.Endpoints {
+					if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+						continue
+					}
+					for _, ip := range endpoint.Addresses {
+						hostname := endpoint.Hostname
+						if hostname == "" {
+							hostname = strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+						}
+						endpointName := hostname + "." + serviceName
+						specs = append(specs, addressSpec(serviceName, ip), addressSpec(endpointName, ip))
+						for _, port := range slice.Ports {
+							specs = append(specs, portSpec(serviceName, port, endpointName))
+						}
+					}
+				}
+			}
+		}
+		for _, spec := range specs {
+			if spec.recordType == 0 {
+				continue // Neither an address nor a named port
+			}
+			record, err := NewResourceRecord(spec.name, spec.recordType, ClassIN, KubernetesTTL, spec.rdata, "")
+			if err != nil {
+				fmt.Printf("Skipping record of service %s/%s: %v\n", service.Metadata.Namespace, service.Metadata.Name, err)
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// addressSpec describes the A or AAAA record of ip at name; its type is zero if ip is not an address
+func addressSpec(name, ip string) serviceRecordSpec {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return serviceRecordSpec{}
+	}
+	if addr.Is4() {
+		return serviceRecordSpec{name, TypeA, []string{ip}}
+	}
+	return serviceRecordSpec{name, TypeAAAA, []string{addr.String()}}
+}
+
+// portSpec describes the SRV record of a named port of the service at serviceName, served by target; its type is zero
+// for unnamed ports, which have no SRV name
+func portSpec(serviceName string, port kubernetesPort, target string) serviceRecordSpec {
+	if port.Name == "" {
+		return serviceRecordSpec{}
+	}
+	protocol := strings.ToLower(port.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	name := "_" + port.Name + "._" + protocol + "." + serviceName
+	return serviceRecordSpec{name, TypeSRV, []string{"0", "100", strconv.Itoa(port.Port), target}}
+}
+
+// answerKubernetes answers a request for a name beneath the cluster zone authoritatively, with NXDOMAIN if the name is
+// unknown
+func (f *Forwarder) answerKubernetes(request *DNSMessage, name string) (*DNSMessage, bool) {
+	zone := f.Kubernetes.Load()
+	if zone == nil || !isSubdomain(name, zone.Zone) {
+		return nil, false
+	}
+	question := request.Questions[0]
+	records, _ := zone.Records.Lookup(name, question.Type, question.Class)
+	rCode := uint16(RCodeNoError)
+	if !zone.Records.Exists(name) && CanonicalName(name) != CanonicalName(zone.Zone) {
+		rCode = RCodeNXDomain
+	}
+	header, err := request.Header.ModifyDNSHeader(ModifyAA(1), ModifyRCode(rCode))
+	if err != nil {
+		return nil, false
+	}
+	response := &DNSMessage{Header: header, Questions: request.Questions}
+	if len(records) > 0 {
+		response.Answers = []*DNSAnswer{{ResourceRecords: records}}
+	}
+	return response, true
+}
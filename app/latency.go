@@ -0,0 +1,59 @@
+package main
+
+/*
+This module contains the latency injected into upstream exchanges with --upstream-latency and --upstream-jitter. The
+delay is spent inside the exchange, so it counts against the adaptive timeout and the race stagger just like network
+latency would; a fixed jitter seed makes the delays of every run the same.
+*/
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// latencyInjector delays the exchanges of one upstream by a fixed latency plus a random jitter
+type latencyInjector struct {
+	latency time.Duration
+	jitter  time.Duration // Upper bound of the random part of the delay
+	mu      sync.Mutex
+	rng     *rand.Rand
+}
+
+// newLatencyInjector creates an injector for the delays of opts, or returns nil if they are zero
+func newLatencyInjector(opts UpstreamOptions) *latencyInjector {
+	var latency time.Duration
+	if len(opts.Latency) > 0 {
+		latency = opts.Latency[0]
+	}
+	if latency <= 0 && opts.Jitter <= 0 {
+		return nil
+	}
+	seed := opts.JitterSeed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &latencyInjector{latency: latency, jitter: opts.Jitter, rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Wait sleeps for the next delay or until ctx is done; a nil injector returns at once
+func (l *latencyInjector) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	delay := l.latency
+	if l.jitter > 0 {
+		l.mu.Lock()
+		delay += time.Duration(l.rng.Int64N(int64(l.jitter)))
+		l.mu.Unlock()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
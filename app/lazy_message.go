@@ -0,0 +1,138 @@
+package main
+
+/*
+This module contains the LazyMessage, a view of a received packet that decodes only the header up front and locates the
+other sections by offset into the original buffer on demand. Most queries are answered from the header and the first
+question alone, so the remaining sections are never materialized into structs for them.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoQuestion is returned when decoding a query that has no question
+var ErrNoQuestion = errors.New("query has no question")
+
+// Message sections, in wire order
+const (
+	SectionQuestion = iota
+	SectionAnswer
+	SectionAuthority
+	SectionAdditional
+	sectionEnd
+)
+
+// sectionNames names the message sections by index
+var sectionNames = [sectionEnd]string{"question", "answer", "authority", "additional"}
+
+// LazyMessage is a message whose sections are decoded only when accessed; it references the packet buffer, so it is
+// only valid for as long as the buffer is
+type LazyMessage struct {
+	Raw     []byte
+	Header  DNSHeader
+	offsets [sectionEnd + 1]int // Start of each section and of the trailing data; zero until located
+	located int                 // Number of offsets located so far
+}
+
+// ParseLazy decodes the header of raw and defers everything else
+func ParseLazy(raw []byte) (*LazyMessage, error) {
+	if len(raw) < DNSHeaderSize {
+		return nil, fmt.Errorf("message of %d bytes is shorter than a header: %w", len(raw), io.ErrUnexpectedEOF)
+	}
+	message := &LazyMessage{Raw: raw}
+	if err := message.Header.Decode(bytes.NewReader(raw[:DNSHeaderSize])); err != nil {
+		return nil, err
+	}
+	message.offsets[SectionQuestion], message.located = DNSHeaderSize, 1
+	return message, nil
+}
+
+// FirstQuestion decodes only the first question
+func (m *LazyMessage) FirstQuestion() (*DNSQuestion, error) {
+	if m.Header.QDCount == 0 {
+		return nil, fmt.Errorf("message has no question")
+	}
+	buf := bytes.NewReader(m.Raw)
+	buf.Seek(DNSHeaderSize, io.SeekStart)
+	question := &DNSQuestion{}
+	if err := question.Decode(buf); err != nil {
+		return nil, err
+	}
+	return question, nil
+}
+
+// SectionBytes returns the raw bytes of a section without decoding its records
+func (m *LazyMessage) SectionBytes(section int) ([]byte, error) {
+	if err := m.locate(section + 1); err != nil {
+		return nil, err
+	}
+	return m.Raw[m.offsets[section]:m.offsets[section+1]], nil
+}
+
+// Decode materializes the whole message
+func (m *LazyMessage) Decode() (*DNSMessage, error) {
+	message := &DNSMessage{}
+	if err := message.Decode(bytes.NewReader(m.Raw)); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// DecodeQuery materializes the whole message like Decode, but as a query, which must ask at least one question
+func (m *LazyMessage) DecodeQuery() (*DNSMessage, error) {
+	if m.Header.QDCount == 0 {
+		return nil, ErrNoQuestion
+	}
+	return m.Decode()
+}
+
+// locate finds the offsets of the sections up to and including section by skipping over the preceding ones
+func (m *LazyMessage) locate(section int) error {
+	counts := [sectionEnd]uint16{m.Header.QDCount, m.Header.ANCount, m.Header.NSCount, m.Header.ARCount}
+	for ; m.located <= section; m.located++ {
+		previous := m.located - 1
+		offset := m.offsets[previous]
+		for i := 0; i < int(counts[previous]); i++ {
+			var err error
+			if offset, err = skipName(m.Raw, offset); err != nil {
+				return err
+			}
+			if previous == SectionQuestion {
+				offset += 4 // Type and class
+			} else {
+				if offset+10 > len(m.Raw) {
+					return io.ErrUnexpectedEOF
+				}
+				offset += 10 + int(binary.BigEndian.Uint16(m.Raw[offset+8:])) // Type, class, TTL, length, and data
+			}
+			if offset > len(m.Raw) {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		m.offsets[m.located] = offset
+	}
+	return nil
+}
+
+// skipName returns the offset just past the name starting at offset, without following compression pointers
+func skipName(raw []byte, offset int) (int, error) {
+	for {
+		if offset >= len(raw) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		length := raw[offset]
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length >= 0xC0:
+			return offset + 2, nil
+		case length > 63:
+			return 0, fmt.Errorf("invalid label length %d at offset %d", length, offset)
+		}
+		offset += 1 + int(length)
+	}
+}
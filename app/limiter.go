@@ -0,0 +1,139 @@
+package main
+
+/*
+This module contains the global limit on outstanding upstream queries: a weighted semaphore with a bounded FIFO queue.
+Queries that would overflow the queue, or wait in it for too long, are shed instead of piling up goroutines and memory
+while an upstream is slow.
+*/
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxUpstreamQueries is the default limit of outstanding upstream queries
+	DefaultMaxUpstreamQueries = 1024
+	// DefaultUpstreamQueueSize is the default number of queries that may wait for the limit
+	DefaultUpstreamQueueSize = 4096
+	// DefaultUpstreamQueueTimeout is how long a query may wait for the limit by default
+	DefaultUpstreamQueueTimeout = time.Second
+)
+
+// ErrUpstreamOverloaded is returned for queries shed because the upstream limit is saturated
+var ErrUpstreamOverloaded = errors.New("upstream query limit reached")
+
+// LimiterOptions represents the options for creating a new UpstreamLimiter
+type LimiterOptions struct {
+	MaxOutstanding int64         // Total weight of queries allowed upstream at once
+	MaxQueue       int           // Queries allowed to wait for capacity
+	QueueTimeout   time.Duration // How long a query may wait for capacity
+}
+
+// UpstreamLimiter bounds the outstanding upstream queries; it is safe for concurrent use
+type UpstreamLimiter struct {
+	mu      sync.Mutex
+	opts    LimiterOptions
+	used    int64
+	waiters list.List // *limiterWaiter in arrival order
+}
+
+// limiterWaiter is a query queued for capacity
+type limiterWaiter struct {
+	weight int64
+	ready  chan struct{} // Closed once the capacity is granted
+}
+
+// NewUpstreamLimiter creates a limiter with the given options
+func NewUpstreamLimiter(opts LimiterOptions) *UpstreamLimiter {
+	if opts.MaxOutstanding <= 0 {
+		opts.MaxOutstanding = DefaultMaxUpstreamQueries
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = DefaultUpstreamQueueTimeout
+	}
+	return &UpstreamLimiter{opts: opts}
+}
+
+// Acquire reserves weight units of capacity, queueing behind earlier queries if necessary, and returns the function
+// that gives them back; it fails with ErrUpstreamOverloaded if the queue is full or the wait times out. A nil
+// limiter admits everything.
+func (l *UpstreamLimiter) Acquire(ctx context.Context, weight int64) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	weight = min(weight, l.opts.MaxOutstanding) // Oversized queries would otherwise wait forever
+	release = func() { l.release(weight) }
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && l.used+weight <= l.opts.MaxOutstanding {
+		l.used += weight
+		l.mu.Unlock()
+		return release, nil
+	}
+	if l.waiters.Len() >= l.opts.MaxQueue {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d queries already queued", ErrUpstreamOverloaded, l.opts.MaxQueue)
+	}
+	waiter := &limiterWaiter{weight: weight, ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return release, nil
+	case <-timer.C:
+		err = fmt.Errorf("%w: queued for %s", ErrUpstreamOverloaded, l.opts.QueueTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// Capacity was granted while giving up; keep it rather than hand it back
+		return release, nil
+	default:
+	}
+	front := l.waiters.Front() == element
+	l.waiters.Remove(element)
+	if front {
+		// The queries behind this one may fit now
+		l.grant()
+	}
+	return nil, err
+}
+
+// release gives back weight units of capacity
+func (l *UpstreamLimiter) release(weight int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= weight
+	l.grant()
+}
+
+// grant hands capacity to queued queries in order for as long as the next one fits; the caller must hold the lock
+func (l *UpstreamLimiter) grant() {
+	for element := l.waiters.Front(); element != nil; element = l.waiters.Front() {
+		waiter := element.Value.(*limiterWaiter)
+		if l.used+waiter.weight > l.opts.MaxOutstanding {
+			return
+		}
+		l.used += waiter.weight
+		l.waiters.Remove(element)
+		close(waiter.ready)
+	}
+}
+
+// upstreamWeight is the number of upstream queries a single exchange with upstream may have outstanding
+func upstreamWeight(upstream Upstream) int64 {
+	if race, ok := upstream.(*raceUpstream); ok {
+		return int64(len(race.upstreams))
+	}
+	return 1
+}
@@ -0,0 +1,174 @@
+package main
+
+/*
+This module contains the platform abstraction around the client-facing UDP socket. Platforms with batch datagram
+syscalls read and write several packets per syscall; everywhere else a portable single-packet implementation is used.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// PacketBatchSize is the maximum number of datagrams read or written per batch
+	PacketBatchSize = 32
+	// MaxListenerFailures is how many consecutive transient read errors the UDP listener rides out before giving up
+	MaxListenerFailures = 50
+)
+
+// listenerSleep pauses the listener after a failed read; tests replace it to skip the backoff
+var listenerSleep = time.Sleep
+
+// packet is a datagram exchanged with a client
+type packet struct {
+	Buffer *[]byte // Pooled buffer backing the datagram (nil for outgoing packets)
+	Data   []byte  // Datagram payload
+	Addr   *net.UDPAddr
+}
+
+// packetListener reads and writes client datagrams in batches
+type packetListener interface {
+	// ReadBatch fills packets[i].Data and packets[i].Addr from the preset buffers and returns the number of datagrams read
+	ReadBatch(packets []packet) (int, error)
+	// WriteBatch sends packets and returns the number of datagrams written
+	WriteBatch(packets []packet) (int, error)
+}
+
+// newPacketListener wraps conn in the batching listener where the platform has one, and the portable listener elsewhere
+func newPacketListener(conn *net.UDPConn) (packetListener, error) {
+	if listener, ok, err := newBatchPacketListener(conn); ok || err != nil {
+		return listener, err
+	}
+	return &udpPacketListener{conn: conn}, nil
+}
+
+// udpPacketListener is the portable single-datagram packetListener
+type udpPacketListener struct {
+	conn *net.UDPConn
+}
+
+// ReadBatch reads a single datagram
+func (l *udpPacketListener) ReadBatch(packets []packet) (int, error) {
+	size, source, err := l.conn.ReadFromUDP(*packets[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	packets[0].Data, packets[0].Addr = (*packets[0].Buffer)[:size], source
+	return 1, nil
+}
+
+// WriteBatch writes datagrams one at a time
+func (l *udpPacketListener) WriteBatch(packets []packet) (int, error) {
+	for i, p := range packets {
+		if _, err := l.conn.WriteToUDP(p.Data, p.Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// writeResponses drains responses and writes them to the listener in batches until the channel is closed
+func writeResponses(listener packetListener, responses <-chan packet) {
+	batch := make([]packet, 0, PacketBatchSize)
+	for response := range responses {
+		batch = append(batch[:0], response)
+	drain:
+		for len(batch) < PacketBatchSize {
+			select {
+			case response, ok := <-responses:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, response)
+			default:
+				break drain
+			}
+		}
+		for sent := 0; sent < len(batch); {
+			n, err := listener.WriteBatch(batch[sent:])
+			if err != nil {
+				fmt.Printf("Failed to send client response to %s: %v\n", batch[sent+n].Addr, err)
+				n++ // Skip the datagram that failed
+			}
+			sent += n
+		}
+	}
+}
+
+// transientReadError reports whether a read error leaves the socket usable: ECONNREFUSED reports an ICMP error for an
+// earlier datagram to a client whose port became unreachable, and the others an interrupted or momentarily starved call
+func transientReadError(err error) bool {
+	transients := []error{syscall.ECONNREFUSED, syscall.EINTR, syscall.EAGAIN, syscall.ENOBUFS, syscall.ENOMEM}
+	for _, transient := range transients {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerBackoff returns how long a listener pauses after its n-th consecutive failure, so that a persistently failing
+// socket does not spin
+func listenerBackoff(failures int) time.Duration {
+	return min(5*time.Millisecond<<min(failures-1, 8), time.Second)
+}
+
+// serveUDP reads client datagrams in batches and hands them to a worker pool until conn is closed
+func serveUDP(conn *net.UDPConn, forwarder *Forwarder, config *Config) error {
+	listener, err := newPacketListener(conn)
+	if err != nil {
+		return fmt.Errorf("failed to set up client listener: %w", err)
+	}
+	return servePackets(listener, forwarder, config)
+}
+
+// servePackets serves the datagrams of listener until it is closed. Errors of single queries never stop it, nor do
+// transient read errors unless MaxListenerFailures of them come in a row; any other read error is returned.
+func servePackets(listener packetListener, forwarder *Forwarder, config *Config) error {
+	responses := make(chan packet, PacketBatchSize)
+	defer close(responses)
+	go writeResponses(listener, responses)
+
+	pool, err := NewWorkerPool(config.Workers, func(p packet) {
+		handleClientPacket(responses, forwarder, p.Data, p.Addr, config.Listen.MaxUDPSize)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start workers: %w", err)
+	}
+	defer pool.Close()
+
+	packets := make([]packet, PacketBatchSize)
+	failures := 0 // Consecutive read errors
+	for {
+		// Read a batch of client messages into pooled buffers and hand them to the workers
+		for i := range packets {
+			packets[i].Buffer = getBuffer()
+		}
+		n, err := listener.ReadBatch(packets)
+		for _, p := range packets[n:] {
+			putBuffer(p.Buffer)
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			if !transientReadError(err) {
+				return fmt.Errorf("failed to read client messages: %w", err)
+			}
+			if failures++; failures >= MaxListenerFailures {
+				return fmt.Errorf("failed to read client messages %d times in a row: %w", failures, err)
+			}
+			fmt.Printf("Failed to read client message: %v\n", err)
+			listenerSleep(listenerBackoff(failures))
+			continue
+		}
+		failures = 0
+		for _, p := range packets[:n] {
+			pool.Submit(p)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+This module contains the recvmmsg(2)/sendmmsg(2) packetListener for 64-bit Linux. The kernel structures are mirrored
+in plain Go for the 64-bit layout, so newBatchPacketListener only picks this implementation on architectures where the
+layout matches.
+*/
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// linuxMsgDontwait is MSG_DONTWAIT on Linux
+	linuxMsgDontwait = 0x40
+	// linuxAFInet and linuxAFInet6 are the Linux address family numbers
+	linuxAFInet  = 2
+	linuxAFInet6 = 10
+	// linuxSockaddrSize is large enough for any socket address the listener can receive
+	linuxSockaddrSize = 128
+)
+
+// linuxIovec mirrors struct iovec on 64-bit Linux
+type linuxIovec struct {
+	Base unsafe.Pointer
+	Len  uint64
+}
+
+// linuxMmsghdr mirrors struct mmsghdr (embedding struct msghdr) on 64-bit Linux
+type linuxMmsghdr struct {
+	Name       unsafe.Pointer
+	Namelen    uint32
+	_          [4]byte
+	Iov        unsafe.Pointer
+	Iovlen     uint64
+	Control    unsafe.Pointer
+	Controllen uint64
+	Flags      int32
+	_          [4]byte
+	Len        uint32 // Number of bytes transmitted for this message
+	_          [4]byte
+}
+
+// mmsgSyscalls returns the recvmmsg and sendmmsg syscall numbers if this architecture supports the batch listener
+func mmsgSyscalls() (recv, send uintptr, ok bool) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 299, 307, true
+	case "arm64":
+		return 243, 269, true
+	}
+	return 0, 0, false
+}
+
+// mmsgPacketListener reads and writes datagrams with recvmmsg(2)/sendmmsg(2)
+type mmsgPacketListener struct {
+	raw        syscall.RawConn
+	inet6      bool // Whether the socket is AF_INET6, which determines the socket address layout for sends
+	recvmmsg   uintptr
+	sendmmsg   uintptr
+	recvNames  [][linuxSockaddrSize]byte
+	recvIovecs []linuxIovec
+}
+
+// newBatchPacketListener wraps conn in a recvmmsg/sendmmsg listener, reporting false if the architecture has none
+func newBatchPacketListener(conn *net.UDPConn) (packetListener, bool, error) {
+	recv, send, ok := mmsgSyscalls()
+	if !ok {
+		return nil, false, nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, false, err
+	}
+	// Wildcard and IPv6 listeners are AF_INET6 sockets; an IPv4 listener address means an AF_INET socket
+	inet6 := conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+	return &mmsgPacketListener{raw: raw, inet6: inet6, recvmmsg: recv, sendmmsg: send}, true, nil
+}
+
+// ReadBatch reads up to len(packets) datagrams with a single recvmmsg call; it must not be called concurrently
+func (l *mmsgPacketListener) ReadBatch(packets []packet) (int, error) {
+	if len(l.recvNames) < len(packets) {
+		l.recvNames = make([][linuxSockaddrSize]byte, len(packets))
+		l.recvIovecs = make([]linuxIovec, len(packets))
+	}
+	headers := make([]linuxMmsghdr, len(packets))
+	for i := range packets {
+		buffer := *packets[i].Buffer
+		l.recvIovecs[i] = linuxIovec{Base: unsafe.Pointer(&buffer[0]), Len: uint64(len(buffer))}
+		headers[i].Iov, headers[i].Iovlen = unsafe.Pointer(&l.recvIovecs[i]), 1
+		headers[i].Name, headers[i].Namelen = unsafe.Pointer(&l.recvNames[i]), linuxSockaddrSize
+	}
+	n, err := l.batch(l.raw.Read, l.recvmmsg, headers)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		packets[i].Data = (*packets[i].Buffer)[:headers[i].Len]
+		packets[i].Addr = decodeLinuxSockaddr(l.recvNames[i][:])
+	}
+	return n, nil
+}
+
+// WriteBatch sends packets with a single sendmmsg call and returns how many the kernel accepted
+func (l *mmsgPacketListener) WriteBatch(packets []packet) (int, error) {
+	headers := make([]linuxMmsghdr, len(packets))
+	iovecs := make([]linuxIovec, len(packets))
+	names := make([][linuxSockaddrSize]byte, len(packets))
+	for i, p := range packets {
+		if len(p.Data) > 0 {
+			iovecs[i] = linuxIovec{Base: unsafe.Pointer(&p.Data[0]), Len: uint64(len(p.Data))}
+		}
+		headers[i].Iov, headers[i].Iovlen = unsafe.Pointer(&iovecs[i]), 1
+		headers[i].Name, headers[i].Namelen = unsafe.Pointer(&names[i]), encodeLinuxSockaddr(p.Addr, l.inet6, names[i][:])
+	}
+	return l.batch(l.raw.Write, l.sendmmsg, headers)
+}
+
+// batch issues a non-blocking batch syscall, waiting on the runtime poller while the socket is not ready
+func (l *mmsgPacketListener) batch(wait func(func(uintptr) bool) error, trap uintptr, headers []linuxMmsghdr) (int, error) {
+	var n uintptr
+	var errno syscall.Errno
+	err := wait(func(fd uintptr) bool {
+		n, _, errno = syscall.Syscall6(trap, fd, uintptr(unsafe.Pointer(&headers[0])), uintptr(len(headers)), linuxMsgDontwait, 0, 0)
+		return errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK
+	})
+	runtime.KeepAlive(headers)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// decodeLinuxSockaddr converts a kernel sockaddr_in/sockaddr_in6 into a UDP address
+func decodeLinuxSockaddr(name []byte) *net.UDPAddr {
+	port := binary.BigEndian.Uint16(name[2:4])
+	switch binary.LittleEndian.Uint16(name[0:2]) {
+	case linuxAFInet:
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(name[4:8])), port))
+	case linuxAFInet6:
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom16([16]byte(name[8:24])).Unmap(), port))
+	}
+	return &net.UDPAddr{}
+}
+
+// encodeLinuxSockaddr encodes addr into name using the socket's address family and returns the encoded length
+func encodeLinuxSockaddr(addr *net.UDPAddr, inet6 bool, name []byte) uint32 {
+	addrPort := addr.AddrPort()
+	binary.BigEndian.PutUint16(name[2:4], addrPort.Port())
+	if inet6 {
+		binary.LittleEndian.PutUint16(name[0:2], linuxAFInet6)
+		ip := addrPort.Addr().As16()
+		copy(name[8:24], ip[:])
+		return 28
+	}
+	binary.LittleEndian.PutUint16(name[0:2], linuxAFInet)
+	ip := addrPort.Addr().Unmap().As4()
+	copy(name[4:8], ip[:])
+	return 16
+}
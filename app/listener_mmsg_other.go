@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+/*
+This module contains the stand-in for the recvmmsg(2)/sendmmsg(2) packetListener on platforms other than Linux, which
+have no batch datagram syscalls; client datagrams are read and written one at a time there.
+*/
+
+import "net"
+
+// newBatchPacketListener reports that batching is unavailable on this platform
+func newBatchPacketListener(conn *net.UDPConn) (packetListener, bool, error) {
+	return nil, false, nil
+}
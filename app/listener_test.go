@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedListener returns the results of reads from a script, one per ReadBatch
+type scriptedListener struct {
+	reads []error // nil for a read of no datagrams
+	calls int
+}
+
+func (l *scriptedListener) ReadBatch(packets []packet) (int, error) {
+	if l.calls >= len(l.reads) {
+		return 0, net.ErrClosed
+	}
+	l.calls++
+	return 0, l.reads[l.calls-1]
+}
+
+func (l *scriptedListener) WriteBatch(packets []packet) (int, error) {
+	return len(packets), nil
+}
+
+func TestServePacketsReadErrors(t *testing.T) {
+	listenerSleep = func(time.Duration) {}
+	defer func() { listenerSleep = time.Sleep }()
+	repeat := func(err error, n int) []error {
+		errs := make([]error, n)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	refused := &net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}
+	recovery := append(append(repeat(refused, MaxListenerFailures-1), nil), repeat(refused, MaxListenerFailures-1)...)
+	tests := []struct {
+		name      string
+		reads     []error
+		wantErr   bool
+		wantReads int
+	}{
+		{"transient errors then recovery", recovery, false, len(recovery)},
+		{"interrupted read", []error{syscall.EINTR}, false, 1},
+		{"transient errors without end", repeat(refused, MaxListenerFailures+1), true, MaxListenerFailures},
+		{"fatal error", []error{&net.OpError{Op: "read", Net: "udp", Err: syscall.EBADF}, nil}, true, 1},
+	}
+	config := &Config{Workers: WorkerPoolOptions{Workers: 1, Overload: OverloadDrop}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener := &scriptedListener{reads: test.reads}
+			err := servePackets(listener, nil, config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("servePackets() = %v, want error %v", err, test.wantErr)
+			}
+			if listener.calls != test.wantReads {
+				t.Fatalf("listener read %d times, want %d", listener.calls, test.wantReads)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+/*
+This module contains the LocalStore, which holds locally defined records that are served before consulting upstreams.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// LocalStore holds locally defined records indexed by name; a nil LocalStore holds no records. A store must not be
+// modified once it is shared with the forwarder; reloads build a new one instead.
+type LocalStore struct {
+	tree *DomainTree[map[uint16][]ResourceRecord]
+}
+
+// NewLocalStore creates an empty LocalStore
+func NewLocalStore() *LocalStore {
+	return &LocalStore{tree: NewDomainTree[map[uint16][]ResourceRecord]()}
+}
+
+// Add stores a record
+func (s *LocalStore) Add(record ResourceRecord) error {
+	name, err := LabelsToString(record.Name)
+	if err != nil {
+		return err
+	}
+	s.tree.Update(name, func(byType map[uint16][]ResourceRecord, present bool) map[uint16][]ResourceRecord {
+		if !present {
+			byType = map[uint16][]ResourceRecord{}
+		}
+		byType[record.Type] = append(byType[record.Type], record)
+		return byType
+	})
+	return nil
+}
+
+// Lookup returns the records of qType and qClass stored under name, or the name's CNAME if it has one
+func (s *LocalStore) Lookup(name string, qType, qClass uint16) ([]ResourceRecord, bool) {
+	if s == nil {
+		return nil, false
+	}
+	byType, ok := s.tree.Get(name)
+	if !ok {
+		return nil, false
+	}
+	records := filterClass(byType[qType], qClass)
+	if len(records) == 0 && qType != TypeCNAME {
+		records = filterClass(byType[TypeCNAME], qClass)
+	}
+	return records, len(records) > 0
+}
+
+// Exists reports whether name has records or names with records beneath it, which makes it an empty non-terminal
+func (s *LocalStore) Exists(name string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.tree.Get(name)
+	return ok || s.tree.HasSubdomains(name)
+}
+
+// Len returns the number of names with local records
+func (s *LocalStore) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.tree.Len()
+}
+
+// filterClass returns the records of class
+func filterClass(records []ResourceRecord, class uint16) []ResourceRecord {
+	var filtered []ResourceRecord
+	for _, record := range records {
+		if record.Class == class {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// LoadLocalStore builds a LocalStore from inline records, an optional records file, and any number of hosts files; it
+// returns nil if there are no sources. With autoPTR, the A and AAAA records of the first two also answer reverse lookups
+func LoadLocalStore(inline []ResourceRecord, recordsFile string, hostsFiles []string, autoPTR bool) (*LocalStore, error) {
+	if len(inline) == 0 && recordsFile == "" && len(hostsFiles) == 0 {
+		return nil, nil
+	}
+	records := slices.Clone(inline)
+	if recordsFile != "" {
+		fileRecords, err := LoadRecordsFile(recordsFile)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+	if autoPTR {
+		ptrs, err := synthesizePTRs(records)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ptrs...)
+	}
+	for _, path := range hostsFiles {
+		hostsRecords, err := LoadHostsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, hostsRecords...)
+	}
+	store := NewLocalStore()
+	for _, record := range records {
+		if err := store.Add(record); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// LoadRecordsFile reads one presentation-format record per line; blank lines and lines starting with ';' or '#' are
+// skipped
+func LoadRecordsFile(path string) ([]ResourceRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []ResourceRecord
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		record, err := ParseResourceRecord(line, RecordParseOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
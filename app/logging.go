@@ -0,0 +1,68 @@
+package main
+
+/*
+This module contains the verbosity levels and the component-scoped debug logging. By default only startup, reload, and
+failure messages are printed; -v (or --log-level info) adds a line per client query, and debug messages of a component
+(the codec, the forwarder, the cache, or the policy that answers from local data and the blocklist) appear when it is
+enabled with --debug, or for every component with -vv (or --log-level debug).
+*/
+
+import "fmt"
+
+// Log levels, in order of verbosity
+const (
+	LogLevelError = "error"
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+// logLevels lists the log levels by verbosity, which is their index
+var logLevels = []string{LogLevelError, LogLevelInfo, LogLevelDebug}
+
+// Components whose debug messages can be enabled separately
+const (
+	ComponentCodec     = "codec"
+	ComponentForwarder = "forwarder"
+	ComponentCache     = "cache"
+	ComponentPolicy    = "policy"
+)
+
+// debugComponents lists every component in the order they are documented
+var debugComponents = []string{ComponentCodec, ComponentForwarder, ComponentCache, ComponentPolicy}
+
+// verbosity and debugEnabled are set once at startup, before any packet is handled
+var (
+	verbosity    int
+	debugEnabled = map[string]bool{}
+)
+
+// configureLogging applies a verbosity level and the components whose debug messages are printed; level 2 enables all
+func configureLogging(level int, components []string) {
+	verbosity = level
+	debugEnabled = map[string]bool{}
+	if level >= 2 {
+		components = debugComponents
+	}
+	for _, component := range components {
+		debugEnabled[component] = true
+	}
+}
+
+// verbosef prints a per-query message if -v is given
+func verbosef(format string, args ...any) {
+	if verbosity >= 1 {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// debugging reports whether debug messages of component are printed, for callers that prepare costly arguments
+func debugging(component string) bool {
+	return debugEnabled[component]
+}
+
+// debugf prints a debug message of component if it is enabled
+func debugf(component, format string, args ...any) {
+	if debugEnabled[component] {
+		fmt.Printf("["+component+"] "+format+"\n", args...)
+	}
+}
@@ -1,100 +1,213 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"time"
 )
 
-func main() {
-	// Establish UDP connection with upstream client
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
-	if err != nil {
-		fmt.Println("Failed to resolve UDP address:", err)
-		return
-	}
+// subcommands maps the first command-line argument to an alternative entry point; without one the server runs
+var subcommands = map[string]func(args []string) error{
+	"bench":     runBench,
+	"cache":     runCacheDump,
+	"checkzone": runCheckZone,
+	"config":    runConfig,
+	"doctor":    runDoctor,
+	"mock":      runMock,
+	"pcap":      runPcap,
+	"query":     runQuery,
+	"replay":    runReplay,
+	"repl":      runRepl,
+	"trace":     runTrace,
+	"watch":     runWatch,
+	"zone":      runZone,
+}
 
-	clientConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Println("Failed to bind to client address:", err)
-		return
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Printf("%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	defer clientConn.Close()
 
-	// Establish UDP connection with downstream DNS server
-	resolverAddr, err := parseResolverFlag()
+	// Parse server configuration
+	config, err := parseFlags(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		fmt.Printf("Error parsing flags: %v\n", err)
 		return
 	}
+	packetBufferSize = max(config.Listen.MaxUDPSize, EDNSUDPSize)
 
-eventLoop:
-	for {
-		// Read and process client message
-		clientBytes := make([]byte, 512)
-		size, source, err := clientConn.ReadFromUDP(clientBytes)
+	// Bind the client sockets before privileges are dropped
+	var closers []io.Closer
+	var udpConn *net.UDPConn
+	if config.Listen.UDP {
+		udpAddr, err := net.ResolveUDPAddr("udp", config.Listen.Addr())
 		if err != nil {
-			fmt.Println("Failed to read client message:", err)
-			break eventLoop
+			fmt.Println("Failed to resolve UDP address:", err)
+			return
 		}
-		fmt.Printf("Received %d bytes from client at %s: %v\n", size, source, clientBytes[:size])
-		buf := bytes.NewReader(clientBytes[:size])
-		clientMessage := &DNSMessage{}
-		if err = clientMessage.Decode(buf); err != nil {
-			fmt.Println("Failed to process client message:", err)
+		if udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			fmt.Println("Failed to bind to client address:", err)
+			return
 		}
-		if err != nil {
-			fmt.Println("Failed to read and process client message:", err)
-			break eventLoop
+		defer udpConn.Close()
+		closers = append(closers, udpConn)
+	}
+	var tcpListener net.Listener
+	if config.Listen.TCP {
+		if tcpListener, err = net.Listen("tcp", config.Listen.Addr()); err != nil {
+			fmt.Println("Failed to bind to client address:", err)
+			return
 		}
-
-		// Split up received message into individual requests to forward to downstream resolver
-		requestMessages := clientMessage.SplitDNSMessage()
-		downstreamResponses, err := DNSServerHandler(resolverAddr, requestMessages)
-		if err != nil {
-			fmt.Println("Failed to forward client requests to downstream server:", err)
-			break eventLoop
+		defer tcpListener.Close()
+		closers = append(closers, tcpListener)
+		tcpListener = NewProxyListener(tcpListener, config.Listen.ProxyProtocol)
+	}
+	var dohListener net.Listener
+	if config.Listen.DoHAddr != "" {
+		if dohListener, err = listenDoH(config.Listen); err != nil {
+			fmt.Println("Failed to set up DNS over HTTPS:", err)
+			return
 		}
+		defer dohListener.Close()
+		closers = append(closers, dohListener)
+	}
 
-		// Modify the client response questions and populate client response answers
-		var answerCount uint16
-		for i, question := range clientMessage.Questions {
-			question, err = question.ModifyDNSQuestion(ModifyQType(1), ModifyClass(1))
-			if err != nil {
-				fmt.Println("Failed to modify DNS Questions:", err)
-				break eventLoop
-			}
-			clientMessage.Questions[i] = question
-			if answers := downstreamResponses[i].Answers; len(answers) > 0 {
-				clientMessage.Answers = append(clientMessage.Answers, answers[0])
-				answerCount++
-			}
+	dumpPackets = config.DumpPackets
+	strictEncoding = config.StrictEncode
+	configureLogging(config.Verbosity, config.Debug)
+	chaos = config.Chaos
+	if chaos.Enabled() {
+		fmt.Printf("Injecting faults into client responses: %+v\n", chaos)
+	}
+	if config.QueryLog != "" {
+		if queryLog, err = OpenQueryLog(config.QueryLog); err != nil {
+			fmt.Println("Failed to open query log:", err)
+			return
 		}
-
-		// Modify the client response header
-		clientMessage.Header, err = clientMessage.Header.ModifyDNSHeader(
-			ModifyANCount(answerCount), // Update answer count
-			ModifyQR(1),                // Mark message as a response
-			ModifyAA(0),
-			ModifyTC(0),
-			ModifyRA(0),
-			ModifyZ(0),
-		)
+		defer queryLog.Close()
+	}
+	cleanup, err := config.Daemon.Setup()
+	if err != nil {
+		fmt.Println("Failed to set up the process:", err)
+		return
+	}
+	defer cleanup()
+	closeOnSignal(closers...)
+	if config.Search != nil {
+		fmt.Printf("Stub mode: forwarding to %s with search list %v (ndots %d)\n", config.Resolver, config.Search.Search, config.Search.NDots)
+	}
+	upstream, err := NewRaceUpstream(strings.Split(config.Resolver, ","), config.Upstream, config.RaceStagger)
+	if err != nil {
+		fmt.Printf("Invalid resolver %q: %v\n", config.Resolver, err)
+		return
+	}
+	defer stopBootstrapRefresh()
+	routes, err := NewTypeRoutes(config.TypeRoutes, config.Upstream)
+	if err != nil {
+		fmt.Println("Invalid --route-type:", err)
+		return
+	}
+	var shared *SharedCache
+	if config.SharedCache != "" {
+		if shared, err = NewSharedCache(config.SharedCache); err != nil {
+			fmt.Printf("Invalid shared cache %q: %v\n", config.SharedCache, err)
+			return
+		}
+	}
+	forwarder := &Forwarder{
+		Cache:       NewCache(CacheOptions{Shards: config.CacheShards, MaxBytes: config.CacheMaxBytes}),
+		Upstream:    upstream,
+		TTLBounds:   config.TTLBounds,
+		Limiter:     NewUpstreamLimiter(config.Limiter),
+		Routes:      routes,
+		Secondaries: NewSecondaryZones(config.Secondaries),
+		Search:      config.Search,
+		Shared:      shared,
+		MDNS:        config.MDNS,
+		Health:      NewHealthChecker(config.Health),
+		Rotation:    NewRotator(config.Rotation),
+		Retransmits: NewRetransmitTable(config.RetransmitWindow),
+	}
+	if err := forwarder.Assemble(config); err != nil {
+		fmt.Println("Failed to set up plugins:", err)
+		return
+	}
+	if err := forwarder.ReloadLocalData(config); err != nil {
+		fmt.Println("Failed to load local data:", err)
+		return
+	}
+	if len(config.Webhooks) > 0 {
+		webhooks = StartWebhooks(config.Webhooks, config.WebhookInterval, func(name string) bool {
+			return forwarder.Blocklist.Load().Blocked(name)
+		})
+	}
+	go reloadOnHangup(forwarder, config)
+	if forwarder.Health != nil {
+		go forwarder.Health.Run(forwarder.Local.Load)
+	}
+	if config.WatchInterval > 0 {
+		go watchLocalData(forwarder, config, config.WatchInterval)
+	}
+	if config.Registry != "" {
+		registry, err := NewRegistry(config.Registry)
 		if err != nil {
-			fmt.Println("Failed to modify DNS header:", err)
-			break eventLoop
+			fmt.Printf("Invalid registry %q: %v\n", config.Registry, err)
+			return
 		}
-
-		response, err := clientMessage.Encode()
+		go forwarder.WatchRegistry(registry)
+	}
+	if forwarder.Secondaries != nil {
+		forwarder.Secondaries.Start()
+	}
+	if config.Kubernetes.API != "" {
+		go forwarder.WatchKubernetes(config.Kubernetes)
+	}
+	if config.DDNS.Name != "" {
+		go RunDDNS(config.DDNS)
+	}
+	if config.AdminAddr != "" {
+		startAdminServer(config.AdminAddr, forwarder)
+	}
+	if config.WarmFile != "" {
+		keys, err := LoadQuestionFile(config.WarmFile)
 		if err != nil {
-			fmt.Println("Failed to encode client response message:", err)
-			break eventLoop
+			fmt.Println("Failed to load warm-up list:", err)
+			return
 		}
+		go forwarder.Warm(keys)
+	}
+	if config.PrefetchHits > 0 {
+		stopPrefetcher := forwarder.Cache.StartPrefetcher(
+			PrefetchOptions{Interval: 5 * time.Second, MinHits: config.PrefetchHits, Window: 0.1},
+			forwarder.Refresh,
+		)
+		defer stopPrefetcher()
+	}
 
-		_, err = clientConn.WriteToUDP(response, source)
-		fmt.Printf("Response sent to client at %s: %v", source, response)
-		if err != nil {
-			fmt.Println("Failed to send client response:", err)
+	if dohListener != nil {
+		go serveDoH(dohListener, forwarder)
+	}
+	if tcpListener != nil {
+		handle := func(message []byte, source net.Addr) []byte {
+			return handleClientMessage(forwarder, message, source, 0)
+		}
+		if udpConn == nil {
+			serveTCP(tcpListener, handle, config.Listen.TCPIdleTimeout)
+			return
 		}
+		go serveTCP(tcpListener, handle, config.Listen.TCPIdleTimeout)
+	}
+	if err := serveUDP(udpConn, forwarder, config); err != nil {
+		fmt.Println(err)
 	}
 }
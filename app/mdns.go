@@ -0,0 +1,114 @@
+package main
+
+/*
+This module contains the handling of names under local., which RFC 6762 reserves for Multicast DNS: they only have
+meaning on the link, so they must not be sent to unicast resolvers, which at best answer NXDOMAIN after leaking the
+name. Depending on the configured mode, such questions are answered NXDOMAIN locally, resolved with one-shot multicast
+queries (RFC 6762 section 5.1) answered by the devices on the link, or, for networks whose unicast DNS serves a local.
+zone of its own despite the RFC, forwarded like any other. Local records for local. names answer before any of these.
+*/
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// MDNSNXDomain answers questions for local. names with NXDOMAIN
+	MDNSNXDomain = "nxdomain"
+	// MDNSResolve resolves questions for local. names with multicast queries
+	MDNSResolve = "resolve"
+	// MDNSForward forwards questions for local. names upstream like any other
+	MDNSForward = "forward"
+	// MDNSZone is the domain reserved for Multicast DNS
+	MDNSZone = "local."
+	// MDNSGroup is the IPv4 multicast address and port Multicast DNS queries are sent to
+	MDNSGroup = "224.0.0.251:5353"
+	// DefaultMDNSTimeout is how long a multicast query waits for a response by default
+	DefaultMDNSTimeout = time.Second
+)
+
+// MDNSOptions configures how questions for local. names are answered
+type MDNSOptions struct {
+	Mode    string        // MDNSNXDomain, MDNSResolve, or MDNSForward; empty is MDNSNXDomain
+	Timeout time.Duration // How long multicast queries wait for a response
+}
+
+// Validate checks that the options are usable
+func (opts MDNSOptions) Validate() error {
+	switch opts.Mode {
+	case "", MDNSNXDomain, MDNSResolve, MDNSForward:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, expected %q, %q, or %q", opts.Mode, MDNSNXDomain, MDNSResolve, MDNSForward)
+}
+
+// Diverts reports whether questions for name are kept from the upstream
+func (opts MDNSOptions) Diverts(name string) bool {
+	return opts.Mode != MDNSForward && isSubdomain(name, MDNSZone)
+}
+
+// answerMDNS answers a request for a local. name, via multicast or with NXDOMAIN
+func (f *Forwarder) answerMDNS(request *DNSMessage) (*DNSMessage, error) {
+	if f.MDNS.Mode == MDNSResolve {
+		response, err := exchangeMDNS(request, f.MDNS.Timeout)
+		if err == nil {
+			return response, nil
+		}
+		debugf(ComponentForwarder, "No multicast answer for %s: %v", request.Questions[0], err)
+	}
+	header, err := request.Header.ModifyDNSHeader(ModifyRCode(RCodeNXDomain))
+	if err != nil {
+		return nil, err
+	}
+	return &DNSMessage{Header: header, Questions: request.Questions}, nil
+}
+
+// exchangeMDNS sends request to the Multicast DNS group from an ephemeral port, which makes responders answer with a
+// conventional unicast response carrying its ID (RFC 6762 section 6.7), and returns the first response to it received
+// within timeout
+func exchangeMDNS(request *DNSMessage, timeout time.Duration) (*DNSMessage, error) {
+	if timeout <= 0 {
+		timeout = DefaultMDNSTimeout
+	}
+	group, err := net.ResolveUDPAddr("udp4", MDNSGroup)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	query, err := request.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, group); err != nil {
+		return nil, err
+	}
+	logPacket("server -> mdns "+MDNSGroup, query)
+	debugf(ComponentForwarder, "Multicast query: %s", request.Questions[0])
+	expected := pendingKeyOf(request, "")
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	for {
+		size, source, err := conn.ReadFrom(*buffer)
+		if err != nil {
+			return nil, err // Including the deadline passing without a response
+		}
+		logPacket("mdns "+source.String()+" -> server", (*buffer)[:size])
+		response, err := ParseLazy((*buffer)[:size])
+		if err != nil {
+			continue
+		}
+		decoded, err := response.Decode()
+		if err != nil || decoded.Header.Flags&QRMask == 0 || !expected.Matches(pendingKeyOf(decoded, "")) {
+			continue // Any device on the link may answer, so responses are matched like upstream ones
+		}
+		decoded.Header.Flags &^= AAMask
+		return decoded, nil
+	}
+}
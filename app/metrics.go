@@ -0,0 +1,90 @@
+package main
+
+/*
+This module contains the metrics plugin, which counts the questions passing through its place in the plugin chain by
+type and by the RCODE they are answered with, and serves the counts at /metrics of the admin interface in the
+Prometheus text format. Placed first it counts every question; placed after the cache, only those that missed it.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// metricsPlugin counts questions; it is safe for concurrent use
+type metricsPlugin struct {
+	mu       sync.Mutex
+	byType   map[string]uint64
+	byRCode  map[string]uint64
+	errors   uint64
+	duration time.Duration // Total time spent resolving by the rest of the chain
+}
+
+func init() {
+	RegisterPlugin("metrics", func() Plugin {
+		return &metricsPlugin{byType: map[string]uint64{}, byRCode: map[string]uint64{}}
+	})
+}
+
+func (p *metricsPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *metricsPlugin) Setup(config *Config, forwarder *Forwarder) error {
+	if config.AdminAddr == "" {
+		fmt.Println("The metrics plugin counts questions, but without --admin nothing serves them")
+	}
+	return nil
+}
+
+func (p *metricsPlugin) Wrap(next Handler) Handler {
+	return HandlerFunc(func(request *DNSMessage) (*DNSMessage, error) {
+		start := time.Now()
+		response, err := next.ServeDNS(request)
+		elapsed := time.Since(start)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.byType[TypeString(request.Questions[0].Type)]++
+		p.duration += elapsed
+		if err != nil {
+			p.errors++
+		} else {
+			p.byRCode[RCodeString(response.Header.Flags&RCodeMask>>RCodeShift)]++
+		}
+		return response, err
+	})
+}
+
+// RegisterAdmin serves the counters at /metrics
+func (p *metricsPlugin) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		fmt.Fprintln(w, "# TYPE dns_questions_total counter")
+		for _, qType := range sortedKeys(p.byType) {
+			fmt.Fprintf(w, "dns_questions_total{type=%q} %d\n", qType, p.byType[qType])
+		}
+		fmt.Fprintln(w, "# TYPE dns_responses_total counter")
+		for _, rCode := range sortedKeys(p.byRCode) {
+			fmt.Fprintf(w, "dns_responses_total{rcode=%q} %d\n", rCode, p.byRCode[rCode])
+		}
+		fmt.Fprintln(w, "# TYPE dns_resolution_errors_total counter")
+		fmt.Fprintf(w, "dns_resolution_errors_total %d\n", p.errors)
+		fmt.Fprintln(w, "# TYPE dns_resolution_seconds_total counter")
+		fmt.Fprintf(w, "dns_resolution_seconds_total %.6f\n", p.duration.Seconds())
+	})
+}
+
+// sortedKeys returns the keys of counts in order, for stable output
+func sortedKeys(counts map[string]uint64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,280 @@
+package main
+
+/*
+This module contains a reader for MaxMind DB files (.mmdb), the format of the GeoIP2 and GeoLite2 databases and of
+compatible ones such as DB-IP's. A database is a binary search tree over the bits of an address, whose leaves point
+into a data section of self-describing values, followed by a metadata map describing the tree. The whole file is read
+into memory; only the lookup of an address and the few value types the geo plugin needs are implemented in full.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the size of the zero bytes between the search tree and the data section
+const mmdbDataSeparator = 16
+
+// mmdbMaxDepth is the deepest nesting of maps and arrays decoded, so that a malformed file cannot exhaust the stack
+const mmdbMaxDepth = 64
+
+// MMDB is a MaxMind DB loaded into memory
+type MMDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint32
+	recordSize int // Bits per record, two records per node
+	ipVersion  int
+	ipv4Start  uint32 // Node at which IPv4 addresses start in an IPv6 tree
+}
+
+// OpenMMDB reads the MaxMind DB at path
+func OpenMMDB(path string) (*MMDB, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	markerAt := bytes.LastIndex(file, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB: no metadata", path)
+	}
+	metadataStart := markerAt + len(mmdbMetadataMarker)
+	value, _, err := decodeMMDBValue(file[metadataStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %w", path, err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", path)
+	}
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", path, ipVersion)
+	}
+	treeSize := int(nodeCount) * int(recordSize) / 4
+	if treeSize+mmdbDataSeparator > markerAt {
+		return nil, fmt.Errorf("%s: search tree of %d nodes exceeds the file", path, nodeCount)
+	}
+	db := &MMDB{
+		tree:       file[:treeSize],
+		data:       file[treeSize+mmdbDataSeparator : markerAt],
+		nodeCount:  uint32(nodeCount),
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Lookup returns the data recorded for the network addr belongs to, if any
+func (db *MMDB) Lookup(addr netip.Addr) (any, bool) {
+	addr = addr.Unmap()
+	node := uint32(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return nil, false
+	}
+	bits := addr.AsSlice()
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, int(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, false // Still inside the tree, or at the empty leaf
+	}
+	offset := int(node-db.nodeCount) - mmdbDataSeparator
+	if offset < 0 || offset >= len(db.data) {
+		return nil, false
+	}
+	value, _, err := decodeMMDBValue(db.data, offset)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (db *MMDB) record(node uint32, bit int) uint32 {
+	size := db.recordSize / 4 // Bytes per node
+	start := int(node) * size
+	if start+size > len(db.tree) {
+		return db.nodeCount // A truncated tree has nothing recorded
+	}
+	b := db.tree[start : start+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[bit*4:])
+	}
+}
+
+// decodeMMDBValue decodes the value at offset of section, whose offsets pointers are relative to, and returns it with
+// the offset following it. Strings, maps, and arrays decode to string, map[string]any, and []any, unsigned integers to
+// uint64, signed ones to int64, floating point numbers to float64, and bytes and 128-bit integers to []byte.
+func decodeMMDBValue(section []byte, offset int) (any, int, error) {
+	return decodeMMDBNested(section, offset, 0)
+}
+
+// decodeMMDBNested decodes the value at offset of section like decodeMMDBValue, depth maps and arrays deep
+func decodeMMDBNested(section []byte, offset, depth int) (any, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("values nested more than %d deep at offset %d", mmdbMaxDepth, offset)
+	}
+	kind, size, offset, err := mmdbControl(section, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == 1 { // Pointer, whose target is decoded in its place
+		target, next, err := mmdbPointer(section, offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if targetKind, _, _, err := mmdbControl(section, target); err == nil && targetKind == 1 {
+			return nil, 0, fmt.Errorf("pointer at offset %d to another pointer", offset-1)
+		}
+		value, _, err := decodeMMDBNested(section, target, depth)
+		return value, next, err
+	}
+	// Every value takes at least a byte, so a map or array cannot hold more than the bytes left
+	if remaining := len(section) - offset; (kind == 7 && 2*size > remaining) || (kind == 11 && size > remaining) {
+		return nil, 0, fmt.Errorf("%d entries at offset %d exceed the section", size, offset)
+	}
+	switch kind {
+	case 7: // Map
+		values := make(map[string]any, size)
+		for range size {
+			key, next, err := decodeMMDBNested(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key of type %T at offset %d", key, offset)
+			}
+			if values[name], offset, err = decodeMMDBNested(section, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case 11: // Array
+		values := make([]any, size)
+		for i := range values {
+			if values[i], offset, err = decodeMMDBNested(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case 14: // Boolean, whose value is its size
+		return size != 0, offset, nil
+	}
+	if offset+size > len(section) {
+		return nil, 0, fmt.Errorf("value of %d bytes at offset %d exceeds the section", size, offset)
+	}
+	payload := section[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(payload), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case 4, 10: // Bytes, unsigned 128-bit integer
+		return payload, offset, nil
+	case 5, 6, 9: // Unsigned 16, 32, and 64-bit integers, stored without leading zero bytes
+		var n uint64
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset, nil
+	case 8: // Signed 32-bit integer
+		var n uint32
+		for _, b := range payload {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d at offset %d", kind, offset-size)
+}
+
+// mmdbControl decodes the control byte of the value at offset, with its extended type and size bytes, and returns the
+// type, the size, and the offset of the payload
+func mmdbControl(section []byte, offset int) (kind, size, next int, err error) {
+	if offset >= len(section) {
+		return 0, 0, 0, fmt.Errorf("offset %d beyond the section", offset)
+	}
+	control := section[offset]
+	offset++
+	kind = int(control >> 5)
+	if kind == 0 { // Extended type, in the following byte
+		if offset >= len(section) {
+			return 0, 0, 0, fmt.Errorf("truncated extended type at offset %d", offset)
+		}
+		kind = 7 + int(section[offset])
+		offset++
+	}
+	size = int(control & 0x1f)
+	if kind == 1 {
+		return kind, size, offset, nil // Pointers use the size bits for themselves
+	}
+	if size >= 29 {
+		extra := size - 28 // Bytes holding the size
+		if offset+extra > len(section) {
+			return 0, 0, 0, fmt.Errorf("truncated size at offset %d", offset)
+		}
+		n := 0
+		for _, b := range section[offset : offset+extra] {
+			n = n<<8 | int(b)
+		}
+		size = []int{29, 285, 65821}[extra-1] + n
+		offset += extra
+	}
+	return kind, size, offset, nil
+}
+
+// mmdbPointer decodes a pointer from the size bits of its control byte and the bytes at offset, and returns its target
+// and the offset following it
+func mmdbPointer(section []byte, offset, sizeBits int) (target, next int, err error) {
+	length := sizeBits>>3&3 + 1
+	if offset+length > len(section) {
+		return 0, 0, fmt.Errorf("truncated pointer at offset %d", offset)
+	}
+	n := 0
+	if length < 4 {
+		n = sizeBits & 7
+	}
+	for _, b := range section[offset : offset+length] {
+		n = n<<8 | int(b)
+	}
+	target = n + []int{0, 2048, 526336, 0}[length-1]
+	return target, offset + length, nil
+}
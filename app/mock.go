@@ -0,0 +1,242 @@
+package main
+
+/*
+This module contains the "mock" subcommand, a server that answers from a JSON file of canned responses keyed by name and
+type instead of resolving anything, so that the forwarder and the client tooling can be tested without the internet.
+Fixtures can delay their response, truncate it over UDP, drop the query, or answer with any RCODE.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// mockWildcard matches any name or any type in a fixture
+const mockWildcard = "*"
+
+// MockFixture is the JSON form of a canned response; queries for Name and Type get it, where either may be "*" to match
+// anything, and more specific fixtures take precedence
+type MockFixture struct {
+	Name          string       `json:"name"`
+	Type          string       `json:"type"`
+	RCode         string       `json:"rcode"`         // NOERROR by default
+	Authoritative bool         `json:"authoritative"` // Whether the AA flag is set
+	Delay         string       `json:"delay"`         // Duration to wait before responding, e.g. "250ms"
+	Truncate      bool         `json:"truncate"`      // Whether UDP responses carry TC and no records
+	Drop          bool         `json:"drop"`          // Whether queries go unanswered
+	Answers       []JSONRecord `json:"answers"`       // Names default to the queried name and types to Type
+	Authorities   []JSONRecord `json:"authorities"`
+	Additionals   []JSONRecord `json:"additionals"`
+}
+
+// mockResponse is a fixture ready to be served
+type mockResponse struct {
+	rCode         uint16
+	authoritative bool
+	delay         time.Duration
+	truncate      bool
+	drop          bool
+	sections      [3][]JSONRecord // Answer, authority, and additional records, resolved against the queried name
+}
+
+// mockKey identifies the fixture for a lowercase absolute name or "*" and a type mnemonic or "*"
+type mockKey struct {
+	name  string
+	qType string
+}
+
+// runMock implements the "mock" subcommand
+func runMock(args []string) error {
+	flags := flag.NewFlagSet("mock", flag.ExitOnError)
+	fixturesFile := flags.String("fixtures", "", "JSON file holding an array of canned responses")
+	listen := flags.String("listen", "127.0.0.1:5300", "Address to serve the fixtures on over UDP and TCP")
+	flags.Parse(args)
+	if *fixturesFile == "" {
+		return fmt.Errorf("usage: mock --fixtures <file> [--listen ip:port]")
+	}
+	fixtures, err := loadMockFixtures(*fixturesFile)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	tcpListener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer tcpListener.Close()
+	closeOnSignal(udpConn, tcpListener)
+	fmt.Printf("Serving %d fixtures on %s\n", len(fixtures), *listen)
+
+	go serveTCP(tcpListener, func(message []byte, source net.Addr) []byte {
+		return mockAnswer(fixtures, message, false)
+	}, DefaultTCPIdleTimeout)
+	buf := make([]byte, MaxStreamMessageSize)
+	for {
+		n, source, err := udpConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		message := bytes.Clone(buf[:n])
+		go func() {
+			if response := mockAnswer(fixtures, message, true); response != nil {
+				udpConn.WriteTo(response, source)
+			}
+		}()
+	}
+}
+
+// loadMockFixtures reads a fixtures file, checking every fixture up front
+func loadMockFixtures(path string) (map[mockKey]*mockResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []MockFixture
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	fixtures := map[mockKey]*mockResponse{}
+	for i, fixture := range list {
+		key, response, err := fixture.compile()
+		if err != nil {
+			return nil, fmt.Errorf("%s: fixture %d (%s %s): %w", path, i+1, fixture.Name, fixture.Type, err)
+		}
+		fixtures[key] = response
+	}
+	return fixtures, nil
+}
+
+// compile validates a fixture and converts it to its lookup key and servable form
+func (fixture MockFixture) compile() (mockKey, *mockResponse, error) {
+	key := mockKey{name: mockWildcard, qType: mockWildcard}
+	if fixture.Name != "" && fixture.Name != mockWildcard {
+		key.name = CanonicalName(strings.TrimSuffix(fixture.Name, ".")) + "."
+	}
+	if fixture.Type != "" && fixture.Type != mockWildcard {
+		qType, err := ParseRecordType(fixture.Type)
+		if err != nil {
+			return key, nil, err
+		}
+		key.qType = TypeString(qType)
+	}
+	response := &mockResponse{authoritative: fixture.Authoritative, truncate: fixture.Truncate, drop: fixture.Drop}
+	var err error
+	if fixture.RCode != "" {
+		if response.rCode, err = ParseRCode(fixture.RCode); err != nil {
+			return key, nil, err
+		}
+	}
+	if fixture.Delay != "" {
+		if response.delay, err = time.ParseDuration(fixture.Delay); err != nil {
+			return key, nil, err
+		}
+	}
+	for i, section := range [][]JSONRecord{fixture.Answers, fixture.Authorities, fixture.Additionals} {
+		for _, record := range section {
+			if record.Type == "" {
+				if key.qType == mockWildcard {
+					return key, nil, fmt.Errorf("records of a fixture for any type need their own type")
+				}
+				record.Type = key.qType
+			}
+			// Check the record against a placeholder name; the queried name is only known when serving
+			if _, err := record.mockRecord("example."); err != nil {
+				return key, nil, err
+			}
+			response.sections[i] = append(response.sections[i], record)
+		}
+	}
+	return key, response, nil
+}
+
+// mockRecord converts a fixture record to a resource record, defaulting its name to the queried one
+func (record JSONRecord) mockRecord(queried string) (ResourceRecord, error) {
+	if record.Name == "" {
+		record.Name = "@"
+	}
+	return record.ResourceRecord(queried)
+}
+
+// mockAnswer builds the encoded response to a query from the fixtures, or returns nil if it is to go unanswered
+func mockAnswer(fixtures map[mockKey]*mockResponse, message []byte, overUDP bool) []byte {
+	query := &DNSMessage{}
+	if err := query.Decode(bytes.NewReader(message)); err != nil {
+		fmt.Println("Ignoring undecodable query:", err)
+		return nil
+	}
+	if len(query.Questions) == 0 {
+		fmt.Println("Ignoring query without a question")
+		return nil
+	}
+	question := query.Questions[0]
+	name, _ := LabelsToString(question.Name)
+	qType := TypeString(question.Type)
+	lowered := CanonicalName(name)
+	fixture := fixtures[mockKey{name: lowered, qType: qType}]
+	for _, key := range []mockKey{{name: lowered, qType: mockWildcard}, {name: mockWildcard, qType: qType}, {name: mockWildcard, qType: mockWildcard}} {
+		if fixture == nil {
+			fixture = fixtures[key]
+		}
+	}
+	if fixture == nil {
+		fixture = &mockResponse{rCode: RCodeNXDomain}
+	}
+	time.Sleep(fixture.delay)
+	if fixture.drop {
+		fmt.Printf("%s %s -> dropped\n", name, qType)
+		return nil
+	}
+	fmt.Printf("%s %s -> %s\n", name, qType, RCodeString(fixture.rCode))
+
+	truncated := fixture.truncate && overUDP
+	var aa, tc uint16
+	if fixture.authoritative {
+		aa = 1
+	}
+	if truncated {
+		tc = 1
+	}
+	header, err := query.Header.ModifyDNSHeader(ModifyQR(1), ModifyAA(aa), ModifyTC(tc), ModifyRA(1), ModifyRCode(fixture.rCode))
+	if err != nil {
+		fmt.Println("Failed to build mock response:", err)
+		return nil
+	}
+	response := &DNSMessage{Header: header, Questions: query.Questions[:1]}
+	if !truncated {
+		sections := []*[]*DNSAnswer{&response.Answers, &response.Authorities, &response.Additionals}
+		for i, records := range fixture.sections {
+			var converted []ResourceRecord
+			for _, record := range records {
+				rr, err := record.mockRecord(name)
+				if err != nil {
+					fmt.Println("Failed to build mock response:", err)
+					return nil
+				}
+				converted = append(converted, rr)
+			}
+			if len(converted) > 0 {
+				*sections[i] = []*DNSAnswer{{ResourceRecords: converted}}
+			}
+		}
+	}
+	encoded, err := response.Encode()
+	if err != nil {
+		fmt.Println("Failed to encode mock response:", err)
+		return nil
+	}
+	return encoded
+}
@@ -0,0 +1,68 @@
+package main
+
+/*
+This module contains the comparison of domain names. Following RFC 4343, names are compared with the case of ASCII
+letters folded, and only of ASCII letters: other bytes, including those of UTF-8 sequences, must match exactly. Lookups
+fold case, while responses spell names the way the client asked for them.
+*/
+
+// CanonicalName returns name with its ASCII letters lowered, the form under which names are indexed
+func CanonicalName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; 'A' <= c && c <= 'Z' {
+			lowered := []byte(name)
+			for j := i; j < len(lowered); j++ {
+				lowered[j] = foldByte(lowered[j])
+			}
+			return string(lowered)
+		}
+	}
+	return name
+}
+
+// EqualNames reports whether two names are the same up to the case of ASCII letters
+func EqualNames(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if foldByte(a[i]) != foldByte(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalLabels reports whether two names in label form are the same up to the case of ASCII letters
+func equalLabels(a, b []DNSLabel) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !EqualNames(string(a[i].Content), string(b[i].Content)) {
+			return false
+		}
+	}
+	return true
+}
+
+// foldByte lowers c if it is an ASCII letter
+func foldByte(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// preserveCase returns records with every owner name equal to name spelled exactly as name, leaving records, which may
+// be shared with the cache, untouched
+func preserveCase(records []ResourceRecord, name []DNSLabel) []ResourceRecord {
+	spelled := make([]ResourceRecord, len(records))
+	for i, record := range records {
+		if equalLabels(record.Name, name) {
+			record.Name = name
+		}
+		spelled[i] = record
+	}
+	return spelled
+}
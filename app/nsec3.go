@@ -0,0 +1,462 @@
+package main
+
+/*
+This module contains NSEC3 (RFC 5155), the hashed denial of existence of DNSSEC: the NSEC3 and NSEC3PARAM record
+types, the hashing of owner names, the closest encloser proofs with which NXDOMAIN and NODATA answers are validated,
+and the building of the NSEC3 chain of a zone from its names, which online signing would sign and serve. Iterations
+are capped as RFC 9276 advises validators to, since every one of them costs a hash per name.
+*/
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// NSEC3HashSHA1 is the only hash algorithm defined for NSEC3
+	NSEC3HashSHA1 = 1
+	// MaxNSEC3Iterations is the most iterations accepted; proofs with more are treated as failed (RFC 9276 section 3.2)
+	MaxNSEC3Iterations = 150
+)
+
+// nsec3Encoding renders hashed owner names: base32 with the extended hex alphabet, unpadded and in lower case
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC3Param holds the hashing parameters of a zone's NSEC3 chain, the data of its NSEC3PARAM record
+type NSEC3Param struct {
+	Hash       uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+}
+
+// NSEC3 is the data of an NSEC3 record: the parameters its hash was computed with, the next hashed owner name of the
+// chain, and the types of the name whose hash owns the record
+type NSEC3 struct {
+	NSEC3Param
+	NextHashed []byte
+	Types      []uint16
+}
+
+// NSEC3Hash returns the hash of name with the iterations and salt of param (RFC 5155 section 5)
+func NSEC3Hash(name string, param NSEC3Param) ([]byte, error) {
+	if param.Hash != NSEC3HashSHA1 {
+		return nil, fmt.Errorf("unsupported NSEC3 hash algorithm %d", param.Hash)
+	}
+	if param.Iterations > MaxNSEC3Iterations {
+		return nil, fmt.Errorf("%d NSEC3 iterations exceed the limit of %d", param.Iterations, MaxNSEC3Iterations)
+	}
+	wire, err := nameToWire(CanonicalName(strings.TrimSuffix(name, ".") + "."))
+	if err != nil {
+		return nil, err
+	}
+	digest := sha1.Sum(append(wire, param.Salt...))
+	for range param.Iterations {
+		digest = sha1.Sum(append(digest[:], param.Salt...))
+	}
+	return digest[:], nil
+}
+
+// NSEC3HashName returns the owner name of the NSEC3 record for name in zone
+func NSEC3HashName(name, zone string, param NSEC3Param) (string, error) {
+	hash, err := NSEC3Hash(name, param)
+	if err != nil {
+		return "", err
+	}
+	return nsec3Owner(hash, zone), nil
+}
+
+// nsec3Owner returns the owner name of the NSEC3 record for hash in zone
+func nsec3Owner(hash []byte, zone string) string {
+	label := strings.ToLower(nsec3Encoding.EncodeToString(hash))
+	if zone = strings.TrimSuffix(zone, "."); zone == "" {
+		return label + "."
+	}
+	return label + "." + zone + "."
+}
+
+// Encode returns the wire form of an NSEC3PARAM record's data
+func (param NSEC3Param) Encode() ([]byte, error) {
+	if len(param.Salt) > 255 {
+		return nil, fmt.Errorf("salt of %d bytes is longer than 255 bytes", len(param.Salt))
+	}
+	data := []byte{param.Hash, param.Flags}
+	data = binary.BigEndian.AppendUint16(data, param.Iterations)
+	data = append(data, byte(len(param.Salt)))
+	return append(data, param.Salt...), nil
+}
+
+// Encode returns the wire form of an NSEC3 record's data
+func (n NSEC3) Encode() ([]byte, error) {
+	data, err := n.NSEC3Param.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if len(n.NextHashed) == 0 || len(n.NextHashed) > 255 {
+		return nil, fmt.Errorf("next hashed owner name of %d bytes", len(n.NextHashed))
+	}
+	data = append(data, byte(len(n.NextHashed)))
+	data = append(data, n.NextHashed...)
+	return append(data, encodeTypeBitmap(n.Types)...), nil
+}
+
+// DecodeNSEC3Param reads the data of an NSEC3PARAM record
+func DecodeNSEC3Param(data []byte) (NSEC3Param, error) {
+	param, rest, err := decodeNSEC3Param(data)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("%d bytes after the salt", len(rest))
+	}
+	return param, err
+}
+
+// decodeNSEC3Param reads the parameters at the front of NSEC3 and NSEC3PARAM data, returning the rest
+func decodeNSEC3Param(data []byte) (NSEC3Param, []byte, error) {
+	if len(data) < 5 || len(data) < 5+int(data[4]) {
+		return NSEC3Param{}, nil, fmt.Errorf("NSEC3 parameters cut short")
+	}
+	param := NSEC3Param{Hash: data[0], Flags: data[1], Iterations: binary.BigEndian.Uint16(data[2:])}
+	param.Salt = slices.Clone(data[5 : 5+int(data[4])])
+	return param, data[5+int(data[4]):], nil
+}
+
+// DecodeNSEC3 reads the data of an NSEC3 record
+func DecodeNSEC3(data []byte) (NSEC3, error) {
+	param, rest, err := decodeNSEC3Param(data)
+	if err != nil {
+		return NSEC3{}, err
+	}
+	if len(rest) < 1 || int(rest[0]) == 0 || len(rest) < 1+int(rest[0]) {
+		return NSEC3{}, fmt.Errorf("NSEC3 next hashed owner name cut short")
+	}
+	n := NSEC3{NSEC3Param: param, NextHashed: slices.Clone(rest[1 : 1+int(rest[0])])}
+	n.Types, err = decodeTypeBitmap(rest[1+int(rest[0]):])
+	return n, err
+}
+
+// HasType reports whether the name the record is for has records of t
+func (n NSEC3) HasType(t uint16) bool {
+	return slices.Contains(n.Types, t)
+}
+
+// encodeTypeBitmap encodes types as the window blocks of RFC 4034 section 4.1.2
+func encodeTypeBitmap(types []uint16) []byte {
+	sorted := slices.Clone(types)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	var data []byte
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		data = append(data, byte(window), byte(length))
+		data = append(data, bitmap[:length]...)
+	}
+	return data
+}
+
+// decodeTypeBitmap decodes the window blocks of a type bitmap
+func decodeTypeBitmap(data []byte) ([]uint16, error) {
+	var types []uint16
+	for len(data) > 0 {
+		if len(data) < 2 || data[1] == 0 || data[1] > 32 || len(data) < 2+int(data[1]) {
+			return nil, fmt.Errorf("malformed type bitmap")
+		}
+		window, bitmap := uint16(data[0]), data[2:2+int(data[1])]
+		for i, b := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, window<<8|uint16(i*8+bit))
+				}
+			}
+		}
+		data = data[2+int(data[1]):]
+	}
+	return types, nil
+}
+
+// parseNSEC3Fields encodes the presentation form of NSEC3 data, "<hash> <flags> <iterations> <salt> <next hashed>
+// <type>...", or of NSEC3PARAM data, the first four fields only; a salt of "-" is empty
+func parseNSEC3Fields(recordType uint16, fields []string) ([]byte, error) {
+	if recordType == TypeNSEC3PARAM && len(fields) != 4 {
+		return nil, fmt.Errorf("expected NSEC3PARAM data of the form \"<hash> <flags> <iterations> <salt>\"")
+	}
+	if recordType == TypeNSEC3 && len(fields) < 5 {
+		return nil, fmt.Errorf("expected NSEC3 data of the form \"<hash> <flags> <iterations> <salt> <next hashed owner> <type>...\"")
+	}
+	var numbers [3]uint64
+	for i, bits := range []int{8, 8, 16} {
+		number, err := strconv.ParseUint(fields[i], 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = number
+	}
+	param := NSEC3Param{Hash: uint8(numbers[0]), Flags: uint8(numbers[1]), Iterations: uint16(numbers[2])}
+	if fields[3] != "-" {
+		salt, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt %q", fields[3])
+		}
+		param.Salt = salt
+	}
+	if recordType == TypeNSEC3PARAM {
+		return param.Encode()
+	}
+	next, err := nsec3Encoding.DecodeString(strings.ToUpper(fields[4]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid next hashed owner name %q", fields[4])
+	}
+	n := NSEC3{NSEC3Param: param, NextHashed: next}
+	for _, field := range fields[5:] {
+		t, err := ParseRecordType(field)
+		if err != nil {
+			return nil, err
+		}
+		n.Types = append(n.Types, t)
+	}
+	return n.Encode()
+}
+
+// formatNSEC3 renders NSEC3 or NSEC3PARAM data in presentation format
+func formatNSEC3(recordType uint16, data []byte) (string, bool) {
+	var param NSEC3Param
+	var fields []string
+	if recordType == TypeNSEC3PARAM {
+		var err error
+		if param, err = DecodeNSEC3Param(data); err != nil {
+			return "", false
+		}
+	} else {
+		n, err := DecodeNSEC3(data)
+		if err != nil {
+			return "", false
+		}
+		param = n.NSEC3Param
+		fields = append(fields, strings.ToLower(nsec3Encoding.EncodeToString(n.NextHashed)))
+		for _, t := range n.Types {
+			fields = append(fields, TypeString(t))
+		}
+	}
+	salt := "-"
+	if len(param.Salt) > 0 {
+		salt = strings.ToUpper(hex.EncodeToString(param.Salt))
+	}
+	fields = append([]string{strconv.Itoa(int(param.Hash)), strconv.Itoa(int(param.Flags)), strconv.Itoa(int(param.Iterations)), salt}, fields...)
+	return strings.Join(fields, " "), true
+}
+
+// nsec3Entry is an NSEC3 record of a denial, with its owner hash decoded
+type nsec3Entry struct {
+	owner []byte
+	NSEC3
+}
+
+// nsec3Denial holds the NSEC3 records of a negative answer from a zone, all with the same parameters
+type nsec3Denial struct {
+	zone    string
+	param   NSEC3Param
+	entries []nsec3Entry
+}
+
+// newNSEC3Denial collects the NSEC3 records of zone among records, the authority section of a negative answer
+func newNSEC3Denial(zone string, records []ResourceRecord) (*nsec3Denial, error) {
+	zone = CanonicalName(strings.TrimSuffix(zone, ".") + ".")
+	denial := &nsec3Denial{zone: zone}
+	for _, record := range records {
+		if record.Type != TypeNSEC3 {
+			continue
+		}
+		n, err := DecodeNSEC3(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		owner, err := LabelsToString(record.Name)
+		if err != nil {
+			return nil, err
+		}
+		labels := splitName(CanonicalName(strings.TrimSuffix(owner, ".") + "."))
+		if len(labels) == 0 || strings.Join(labels[1:], ".")+"." != zone {
+			return nil, fmt.Errorf("NSEC3 record %s is not in zone %s", owner, zone)
+		}
+		hash, err := nsec3Encoding.DecodeString(strings.ToUpper(labels[0]))
+		if err != nil {
+			return nil, fmt.Errorf("NSEC3 record %s is not owned by a hash", owner)
+		}
+		if len(denial.entries) == 0 {
+			denial.param = n.NSEC3Param
+		} else if n.Hash != denial.param.Hash || n.Iterations != denial.param.Iterations || !bytes.Equal(n.Salt, denial.param.Salt) {
+			return nil, fmt.Errorf("NSEC3 records with different parameters")
+		}
+		denial.entries = append(denial.entries, nsec3Entry{owner: hash, NSEC3: n})
+	}
+	if len(denial.entries) == 0 {
+		return nil, fmt.Errorf("no NSEC3 records for zone %s", zone)
+	}
+	return denial, nil
+}
+
+// match returns the record owned by the hash of name, if there is one
+func (d *nsec3Denial) match(name string) (*nsec3Entry, error) {
+	hash, err := NSEC3Hash(name, d.param)
+	if err != nil {
+		return nil, err
+	}
+	for i := range d.entries {
+		if bytes.Equal(d.entries[i].owner, hash) {
+			return &d.entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// cover returns the record whose span, from its owner to its next hashed owner, holds the hash of name strictly
+// inside it, if there is one; the last record of the chain wraps around to the first
+func (d *nsec3Denial) cover(name string) (*nsec3Entry, error) {
+	hash, err := NSEC3Hash(name, d.param)
+	if err != nil {
+		return nil, err
+	}
+	for i := range d.entries {
+		owner, next := d.entries[i].owner, d.entries[i].NextHashed
+		after, before := bytes.Compare(hash, owner) > 0, bytes.Compare(hash, next) < 0
+		if bytes.Compare(owner, next) < 0 && after && before || bytes.Compare(owner, next) >= 0 && (after || before) {
+			return &d.entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// closestEncloser finds the closest provable encloser of name (RFC 5155 section 8.3): its longest ancestor, the zone
+// at the shortest, whose hash owns a record, where the next closer name, one label longer, is covered by one
+func (d *nsec3Denial) closestEncloser(name string) (closest, nextCloser string, err error) {
+	labels := splitName(CanonicalName(strings.TrimSuffix(name, ".") + "."))
+	zoneLabels := len(splitName(d.zone))
+	for i := 1; len(labels)-i >= zoneLabels; i++ {
+		candidate := strings.Join(labels[i:], ".") + "."
+		matched, err := d.match(candidate)
+		if err != nil {
+			return "", "", err
+		}
+		if matched == nil {
+			continue
+		}
+		nextCloser = strings.Join(labels[i-1:], ".") + "."
+		covered, err := d.cover(nextCloser)
+		if err != nil {
+			return "", "", err
+		}
+		if covered == nil {
+			return "", "", fmt.Errorf("no NSEC3 record covers the next closer name %s", nextCloser)
+		}
+		return candidate, nextCloser, nil
+	}
+	return "", "", fmt.Errorf("no closest encloser of %s in zone %s is proven", name, d.zone)
+}
+
+// VerifyNSEC3NXDomain checks that the NSEC3 records among the authority records of a response from zone prove that
+// name does not exist: the closest encloser proof, and a record covering the wildcard at the closest encloser
+func VerifyNSEC3NXDomain(name, zone string, authority []ResourceRecord) error {
+	denial, err := newNSEC3Denial(zone, authority)
+	if err != nil {
+		return err
+	}
+	closest, _, err := denial.closestEncloser(name)
+	if err != nil {
+		return err
+	}
+	wildcard := "*." + closest
+	if closest == "." {
+		wildcard = "*."
+	}
+	covered, err := denial.cover(wildcard)
+	if err != nil {
+		return err
+	}
+	if covered == nil {
+		return fmt.Errorf("no NSEC3 record covers the wildcard %s", wildcard)
+	}
+	return nil
+}
+
+// VerifyNSEC3NoData checks that the NSEC3 records among the authority records of a response from zone prove that
+// name has no records of qType: a record owned by its hash listing neither qType nor CNAME (RFC 5155 section 8.5)
+func VerifyNSEC3NoData(name string, qType uint16, zone string, authority []ResourceRecord) error {
+	denial, err := newNSEC3Denial(zone, authority)
+	if err != nil {
+		return err
+	}
+	matched, err := denial.match(name)
+	if err != nil {
+		return err
+	}
+	if matched == nil {
+		return fmt.Errorf("no NSEC3 record matches %s", name)
+	}
+	for _, t := range []uint16{qType, TypeCNAME} {
+		if matched.HasType(t) {
+			return fmt.Errorf("the NSEC3 record of %s lists %s", name, TypeString(t))
+		}
+	}
+	return nil
+}
+
+// NSEC3Chain builds the NSEC3 records of a zone from the types of its names, which must all be in the zone, hashed
+// with param and given ttl (the SOA minimum, by RFC 5155 section 3). Empty non-terminals, the ancestors of names that
+// have no records of their own, get records without types, as the closest encloser proofs need them.
+func NSEC3Chain(zone string, names map[string][]uint16, param NSEC3Param, ttl uint32) ([]ResourceRecord, error) {
+	zone = CanonicalName(strings.TrimSuffix(zone, ".") + ".")
+	zoneLabels := len(splitName(zone))
+	typesByName := map[string][]uint16{}
+	for name, types := range names {
+		name = CanonicalName(strings.TrimSuffix(name, ".") + ".")
+		if !isSubdomain(name, zone) {
+			return nil, fmt.Errorf("%s is not in zone %s", name, zone)
+		}
+		typesByName[name] = append(typesByName[name], types...)
+		labels := splitName(name)
+		for i := 1; len(labels)-i > zoneLabels; i++ {
+			ancestor := strings.Join(labels[i:], ".") + "."
+			if _, ok := typesByName[ancestor]; !ok {
+				typesByName[ancestor] = nil
+			}
+		}
+	}
+	type hashed struct {
+		hash  []byte
+		types []uint16
+	}
+	var chain []hashed
+	for name, types := range typesByName {
+		hash, err := NSEC3Hash(name, param)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, hashed{hash: hash, types: types})
+	}
+	slices.SortFunc(chain, func(a, b hashed) int { return bytes.Compare(a.hash, b.hash) })
+	records := make([]ResourceRecord, 0, len(chain))
+	for i, entry := range chain {
+		data, err := NSEC3{NSEC3Param: param, NextHashed: chain[(i+1)%len(chain)].hash, Types: entry.types}.Encode()
+		if err != nil {
+			return nil, err
+		}
+		owner, err := StringToLabels(nsec3Owner(entry.hash, zone))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ResourceRecord{Name: owner, Type: TypeNSEC3, Class: ClassIN, TTL: ttl, Length: uint16(len(data)), Data: data})
+	}
+	return records, nil
+}
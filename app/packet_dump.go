@@ -0,0 +1,130 @@
+package main
+
+/*
+This module contains the packet dumper enabled with --dump-packets. Every message the server receives or sends is
+printed as a hexdump split at the header, question, and record boundaries, with each part followed by its decoded
+form, so that what went over the wire can be read without a separate decoder.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpPackets enables packet dumps; it is set once at startup, before any packet is handled
+var dumpPackets bool
+
+// dumpSegment is a span of a message together with its decoded form
+type dumpSegment struct {
+	start, end int
+	section    string // Set on the first segment of each section
+	decoded    string
+}
+
+// logPacket dumps a message travelling in direction ("client -> server" and the like), if packet dumps are enabled
+func logPacket(direction string, data []byte) {
+	if !dumpPackets {
+		return
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, ";; %s, %d bytes\n", direction, len(data))
+	segments, err := dumpSegments(data)
+	covered := 0
+	for _, segment := range segments {
+		if segment.section != "" {
+			fmt.Fprintf(&out, ";; %s\n", segment.section)
+		}
+		writeHexRows(&out, data, segment.start, segment.end)
+		fmt.Fprintf(&out, "      ; %s\n", segment.decoded)
+		covered = segment.end
+	}
+	if err != nil {
+		fmt.Fprintf(&out, ";; UNDECODABLE (%v)\n", err)
+	}
+	if covered < len(data) {
+		if err == nil {
+			out.WriteString(";; TRAILING DATA\n")
+		}
+		writeHexRows(&out, data, covered, len(data))
+	}
+	fmt.Print(out.String())
+}
+
+// dumpSegments splits a message into its header, questions, and records, decoding each; the segments that could be
+// decoded are returned along with the error that stopped the walk, if any
+func dumpSegments(data []byte) ([]dumpSegment, error) {
+	lazy, err := ParseLazy(data)
+	if err != nil {
+		return nil, err
+	}
+	header := lazy.Header
+	segments := []dumpSegment{{start: 0, end: DNSHeaderSize, section: "HEADER", decoded: describeHeader(&header)}}
+	buf := bytes.NewReader(data)
+	buf.Seek(DNSHeaderSize, io.SeekStart)
+	counts := []uint16{header.QDCount, header.ANCount, header.NSCount, header.ARCount}
+	names := []string{"QUESTION", "ANSWER", "AUTHORITY", "ADDITIONAL"}
+	for section, count := range counts {
+		for i := 0; i < int(count); i++ {
+			start := int(buf.Size()) - buf.Len()
+			segment := dumpSegment{start: start}
+			if i == 0 {
+				segment.section = names[section]
+			}
+			if section == SectionQuestion {
+				question := &DNSQuestion{}
+				if err := question.Decode(buf); err != nil {
+					return segments, err
+				}
+				name, _ := LabelsToString(question.Name)
+				segment.decoded = fmt.Sprintf("%s %s %s", name, ClassString(question.Class), TypeString(question.Type))
+			} else {
+				record := &ResourceRecord{}
+				if err := record.Decode(buf); err != nil {
+					return segments, err
+				}
+				segment.decoded = describeRecord(record)
+			}
+			segment.end = int(buf.Size()) - buf.Len()
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+// describeHeader renders the fields of a header
+func describeHeader(header *DNSHeader) string {
+	return fmt.Sprintf("id %d, opcode %s, rcode %s, flags [%s], qd %d, an %d, ns %d, ar %d",
+		header.ID, OpCodeString(header.Flags&OpCodeMask>>OpCodeShift), RCodeString(header.Flags&RCodeMask>>RCodeShift),
+		FlagsString(header.Flags), header.QDCount, header.ANCount, header.NSCount, header.ARCount)
+}
+
+// describeRecord renders a record in presentation format, or the fields of an OPT pseudo-record
+func describeRecord(record *ResourceRecord) string {
+	if record.Type != TypeOPT {
+		return FormatRecord(*record)
+	}
+	flags := ""
+	if record.TTL&EDNSFlagDO != 0 {
+		flags = "do"
+	}
+	options := []string{}
+	for data := record.Data; len(data) >= 4; {
+		code, length := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		value := data[4:min(4+length, len(data))]
+		options = append(options, fmt.Sprintf("%d=%x", code, value))
+		data = data[4+len(value):]
+	}
+	return fmt.Sprintf("OPT udp %d, version %d, flags [%s], options [%s]",
+		record.Class, record.TTL>>16&0xFF, flags, strings.Join(options, " "))
+}
+
+// writeHexRows writes data[start:end] as rows of up to 16 bytes prefixed with their offset in the message
+func writeHexRows(out *strings.Builder, data []byte, start, end int) {
+	for row := start; row < end; row += 16 {
+		rowEnd := min(row+16, end)
+		fmt.Fprintf(out, "  %04x  % x\n", row, data[row:rowEnd])
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+/*
+This module contains the "pcap" subcommand, which extracts DNS messages from a packet capture in the classic libpcap
+format and prints them decoded. UDP datagrams and TCP segments to or from the DNS port are considered; TCP streams are
+not reassembled, so only messages contained whole in a single segment are shown.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// Link-layer header types of the captures that can be read
+	pcapLinkNull     = 0
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101
+	pcapLinkLinuxSLL = 113
+	// pcapMaxSnaplen bounds the packet records read, guarding against corrupt lengths
+	pcapMaxSnaplen = 1 << 18
+)
+
+// capturedPacket is a transport payload extracted from a capture
+type capturedPacket struct {
+	Time      time.Time
+	Transport string
+	Source    string
+	Dest      string
+	Payload   []byte
+}
+
+// runPcap implements the "pcap" subcommand
+func runPcap(args []string) error {
+	flags := flag.NewFlagSet("pcap", flag.ExitOnError)
+	port := flags.Uint("port", 53, "DNS port whose traffic is decoded")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: pcap [--port 53] <file.pcap>")
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	messages := 0
+	err = readPcap(file, uint16(*port), func(p capturedPacket) {
+		payloads := [][]byte{p.Payload}
+		if p.Transport == "tcp" {
+			payloads = splitStreamMessages(p.Payload)
+		}
+		for _, payload := range payloads {
+			message := &DNSMessage{}
+			fmt.Printf(";; %s %s %s -> %s, %d bytes\n", p.Time.Format("2006-01-02 15:04:05.000000"), p.Transport, p.Source, p.Dest, len(payload))
+			if err := message.Decode(bytes.NewReader(payload)); err != nil {
+				fmt.Printf(";; undecodable message: %v\n\n", err)
+				continue
+			}
+			printMessage(message)
+			messages++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf(";; %d DNS messages decoded\n", messages)
+	return nil
+}
+
+// readPcap calls fn for every UDP or TCP payload to or from port in a classic pcap stream
+func readPcap(r io.Reader, port uint16, fn func(capturedPacket)) error {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("failed to read pcap header: %w", err)
+	}
+	var order binary.ByteOrder
+	nanos := false
+	switch binary.LittleEndian.Uint32(header[:4]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	default:
+		return fmt.Errorf("not a classic pcap file (pcapng captures can be converted with editcap -F pcap)")
+	}
+	linkType := order.Uint32(header[20:24]) & 0xFFFF
+	for {
+		var record [16]byte
+		if _, err := io.ReadFull(r, record[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("truncated pcap record: %w", err)
+		}
+		seconds, fraction := order.Uint32(record[0:4]), order.Uint32(record[4:8])
+		length := order.Uint32(record[8:12])
+		if length > pcapMaxSnaplen {
+			return fmt.Errorf("pcap record of %d bytes is too large", length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("truncated pcap record: %w", err)
+		}
+		timestamp := time.Unix(int64(seconds), int64(fraction)*1000)
+		if nanos {
+			timestamp = time.Unix(int64(seconds), int64(fraction))
+		}
+		if p, ok := decodeLinkLayer(linkType, data); ok && (p.srcPort == port || p.dstPort == port) {
+			fn(capturedPacket{
+				Time:      timestamp,
+				Transport: p.transport,
+				Source:    net.JoinHostPort(p.src.String(), fmt.Sprint(p.srcPort)),
+				Dest:      net.JoinHostPort(p.dst.String(), fmt.Sprint(p.dstPort)),
+				Payload:   p.payload,
+			})
+		}
+	}
+}
+
+// transportPacket is the transport-layer view of a captured frame
+type transportPacket struct {
+	transport        string
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	payload          []byte
+}
+
+// decodeLinkLayer strips the link-layer header and decodes the IP packet inside
+func decodeLinkLayer(linkType uint32, data []byte) (transportPacket, bool) {
+	var etherType uint16
+	switch linkType {
+	case pcapLinkEthernet:
+		if len(data) < 14 {
+			return transportPacket{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		if etherType == 0x8100 && len(data) >= 4 { // 802.1Q VLAN tag
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case pcapLinkLinuxSLL:
+		if len(data) < 16 {
+			return transportPacket{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case pcapLinkNull:
+		if len(data) < 4 {
+			return transportPacket{}, false
+		}
+		data = data[4:]
+	case pcapLinkRaw:
+	default:
+		return transportPacket{}, false
+	}
+	if len(data) == 0 {
+		return transportPacket{}, false
+	}
+	switch {
+	case etherType == 0x0800 || etherType == 0 && data[0]>>4 == 4:
+		return decodeIPv4(data)
+	case etherType == 0x86DD || etherType == 0 && data[0]>>4 == 6:
+		return decodeIPv6(data)
+	}
+	return transportPacket{}, false
+}
+
+// decodeIPv4 decodes an unfragmented IPv4 packet
+func decodeIPv4(data []byte) (transportPacket, bool) {
+	if len(data) < 20 {
+		return transportPacket{}, false
+	}
+	headerLength := int(data[0]&0x0F) * 4
+	totalLength := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLength < 20 || totalLength < headerLength || totalLength > len(data) {
+		return transportPacket{}, false
+	}
+	if binary.BigEndian.Uint16(data[6:8])&0x3FFF != 0 { // More fragments or a fragment offset
+		return transportPacket{}, false
+	}
+	return decodeTransport(data[9], net.IP(data[12:16]), net.IP(data[16:20]), data[headerLength:totalLength])
+}
+
+// decodeIPv6 decodes an IPv6 packet whose transport header directly follows the fixed header
+func decodeIPv6(data []byte) (transportPacket, bool) {
+	if len(data) < 40 {
+		return transportPacket{}, false
+	}
+	payloadLength := int(binary.BigEndian.Uint16(data[4:6]))
+	if 40+payloadLength > len(data) {
+		return transportPacket{}, false
+	}
+	return decodeTransport(data[6], net.IP(data[8:24]), net.IP(data[24:40]), data[40:40+payloadLength])
+}
+
+// decodeTransport decodes a UDP datagram or TCP segment
+func decodeTransport(protocol byte, src, dst net.IP, data []byte) (transportPacket, bool) {
+	p := transportPacket{src: src, dst: dst}
+	switch protocol {
+	case 17:
+		if len(data) < 8 {
+			return p, false
+		}
+		p.transport, p.payload = "udp", data[8:]
+	case 6:
+		if len(data) < 20 || int(data[12]>>4)*4 > len(data) {
+			return p, false
+		}
+		p.transport, p.payload = "tcp", data[int(data[12]>>4)*4:]
+		if len(p.payload) == 0 {
+			return p, false // Handshakes and bare acknowledgements
+		}
+	default:
+		return p, false
+	}
+	p.srcPort, p.dstPort = binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4])
+	return p, true
+}
+
+// splitStreamMessages splits a TCP payload into the length-prefixed messages it contains whole
+func splitStreamMessages(payload []byte) [][]byte {
+	var messages [][]byte
+	for len(payload) >= 2 {
+		length := int(binary.BigEndian.Uint16(payload))
+		if 2+length > len(payload) {
+			break
+		}
+		messages = append(messages, payload[2:2+length])
+		payload = payload[2+length:]
+	}
+	return messages
+}
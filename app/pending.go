@@ -0,0 +1,146 @@
+package main
+
+/*
+This module contains the table of queries awaiting an upstream response. A response is only accepted by the query that
+matches its ID, its question (compared case-insensitively), and the address it came from, as RFC 5452 requires;
+responses matching no outstanding query, late ones included, are discarded rather than handed to whichever query happens
+to be waiting. Responses without a question, as FORMERR and NOTIMP ones may be, are matched on the rest alone, so IDs
+are kept unique per upstream.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pendingKey identifies an outstanding upstream query
+type pendingKey struct {
+	id       uint16
+	question CacheKey // Zero for messages without a question
+	upstream string   // Address the response must come from
+}
+
+// Matches reports whether a response with key answers the query with the expected key: the IDs and upstreams must be
+// equal, and the questions too unless the response has none
+func (expected pendingKey) Matches(key pendingKey) bool {
+	if key.id != expected.id || key.upstream != expected.upstream {
+		return false
+	}
+	return key.question == CacheKey{} || key.question == expected.question
+}
+
+// route returns the key without its question, under which the query is pending
+func (key pendingKey) route() pendingKey {
+	key.question = CacheKey{}
+	return key
+}
+
+// pendingKeyOf returns the key of a query sent to, or a response received from, upstream
+func pendingKeyOf(message *DNSMessage, upstream string) pendingKey {
+	key := pendingKey{id: message.Header.ID, upstream: upstream}
+	if len(message.Questions) > 0 {
+		key.question = CacheKeyFromQuestion(message.Questions[0])
+	}
+	return key
+}
+
+// pendingQuery is a query awaiting its response
+type pendingQuery struct {
+	key        pendingKey
+	responseCh chan *DNSMessage
+}
+
+// pendingTable matches upstream responses to the queries awaiting them; it is safe for concurrent use
+type pendingTable struct {
+	mu      sync.Mutex
+	pending map[pendingKey]pendingQuery // Keyed by route
+}
+
+// newPendingTable creates an empty pendingTable
+func newPendingTable() *pendingTable {
+	return &pendingTable{pending: map[pendingKey]pendingQuery{}}
+}
+
+// Register records a query awaiting the response with key, failing if another query with the same ID already awaits a
+// response from the same upstream
+func (t *pendingTable) Register(key pendingKey) (chan *DNSMessage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, taken := t.pending[key.route()]; taken {
+		return nil, fmt.Errorf("a query with ID %d is already pending on %s", key.id, key.upstream)
+	}
+	responseCh := make(chan *DNSMessage, 1)
+	t.pending[key.route()] = pendingQuery{key: key, responseCh: responseCh}
+	return responseCh, nil
+}
+
+// Taken reports whether a query with the ID of key awaits a response from its upstream
+func (t *pendingTable) Taken(key pendingKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, taken := t.pending[key.route()]
+	return taken
+}
+
+// Deliver hands a response received from upstream to the query awaiting it, reporting false if there is none
+func (t *pendingTable) Deliver(response *DNSMessage, upstream string) bool {
+	key := pendingKeyOf(response, upstream)
+	t.mu.Lock()
+	query, ok := t.pending[key.route()]
+	if ok = ok && query.key.Matches(key); ok {
+		delete(t.pending, key.route())
+	}
+	t.mu.Unlock()
+	if ok {
+		query.responseCh <- response
+	}
+	return ok
+}
+
+// Await waits up to timeout for the response to the query registered under key, then forgets the query; a closed
+// channel, which Fail leaves behind, yields failure
+func (t *pendingTable) Await(ctx context.Context, key pendingKey, responseCh chan *DNSMessage, timeout time.Duration,
+	failure func() error) (*DNSMessage, error) {
+	defer t.Cancel(key, responseCh)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-responseCh:
+		if !ok {
+			return nil, failure()
+		}
+		return response, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for %s", key.upstream)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel forgets the query awaiting responseCh under key, so that a late response to it is discarded
+func (t *pendingTable) Cancel(key pendingKey, responseCh chan *DNSMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[key.route()].responseCh == responseCh {
+		delete(t.pending, key.route())
+	}
+}
+
+// Fail wakes and forgets every query, whose responses will never arrive
+func (t *pendingTable) Fail() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, query := range t.pending {
+		close(query.responseCh)
+		delete(t.pending, key)
+	}
+}
+
+// Len returns the number of queries awaiting a response
+func (t *pendingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
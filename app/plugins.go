@@ -0,0 +1,178 @@
+package main
+
+/*
+This module contains the plugin architecture. Resolving a question runs it through a chain of handlers, each plugin
+wrapping the next and either answering the question itself or passing it on; the chain ends in resolveMiss, which
+forwards whatever no plugin answered. Which plugins run, and in which order, is configured with --plugins.
+
+Plugins register a factory under their name from an init function, so adding one to the build is a matter of adding
+its file: nothing else needs to know about it. The built-in plugins are:
+
+  - blocklist: answers blocked names with NXDOMAIN
+  - local: answers from local records, the service registry, and the cluster zone
+  - class: answers questions of classes that are not forwarded, or refuses them
+  - cache: answers from the in-memory cache
+  - flatten: answers address questions for some names with the end of their CNAME chains
+  - geo: answers and forwards questions depending on the location of the client
+  - rewrite: resolves questions for other names and replaces addresses in answers
+  - metrics: counts the questions passing through it, served by the admin interface at /metrics
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// DefaultPlugins is the plugin chain by default, which resolves questions the way the server always has
+const DefaultPlugins = "blocklist,local,class,cache"
+
+// encodedCachePlugins are the plugins whose part CachedResponse plays itself, so that they may precede the cache plugin
+// without disabling its pre-encoded fast path
+var encodedCachePlugins = []string{"blocklist", "local", "class"}
+
+// Handler resolves a request holding a single question
+type Handler interface {
+	ServeDNS(request *DNSMessage) (*DNSMessage, error)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(request *DNSMessage) (*DNSMessage, error)
+
+// ServeDNS calls fn
+func (fn HandlerFunc) ServeDNS(request *DNSMessage) (*DNSMessage, error) {
+	return fn(request)
+}
+
+// Plugin is a stage of the chain questions are resolved through
+type Plugin interface {
+	// Name is the name the plugin is registered and configured under
+	Name() string
+	// Setup prepares the plugin for the configuration and forwarder it serves, before any question is resolved
+	Setup(config *Config, forwarder *Forwarder) error
+	// Wrap returns a handler that answers what the plugin answers and passes everything else to next
+	Wrap(next Handler) Handler
+}
+
+// AdminPlugin is a plugin that also serves endpoints of the admin interface
+type AdminPlugin interface {
+	Plugin
+	RegisterAdmin(mux *http.ServeMux)
+}
+
+// pluginFactories holds the registered plugins by name
+var pluginFactories = map[string]func() Plugin{}
+
+// RegisterPlugin makes a plugin available under name; it is meant to be called from init functions
+func RegisterPlugin(name string, factory func() Plugin) {
+	if _, exists := pluginFactories[name]; exists {
+		panic("plugin " + name + " registered twice")
+	}
+	pluginFactories[name] = factory
+}
+
+// RegisteredPlugins returns the names of the registered plugins in alphabetical order
+func RegisteredPlugins() []string {
+	names := make([]string, 0, len(pluginFactories))
+	for name := range pluginFactories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Assemble sets up the plugins named in config, in order, and chains them in front of resolveMiss
+func (f *Forwarder) Assemble(config *Config) error {
+	var plugins []Plugin
+	for _, name := range config.Plugins {
+		factory, ok := pluginFactories[name]
+		if !ok {
+			return fmt.Errorf("unknown plugin %q, expected one of %s", name, strings.Join(RegisteredPlugins(), ", "))
+		}
+		if slices.ContainsFunc(plugins, func(plugin Plugin) bool { return plugin.Name() == name }) {
+			return fmt.Errorf("plugin %q is configured twice", name)
+		}
+		plugin := factory()
+		if err := plugin.Setup(config, f); err != nil {
+			return fmt.Errorf("plugin %s: %w", name, err)
+		}
+		plugins = append(plugins, plugin)
+	}
+	var chain Handler = HandlerFunc(f.resolveMiss)
+	for i := len(plugins) - 1; i >= 0; i-- {
+		chain = plugins[i].Wrap(chain)
+	}
+	f.plugins, f.chain = plugins, chain
+	f.encodedCache = false
+	for _, name := range config.Plugins {
+		if name == "cache" {
+			f.encodedCache = true
+			break
+		}
+		if !slices.Contains(encodedCachePlugins, name) {
+			break
+		}
+	}
+	return nil
+}
+
+// answerPlugin is a built-in plugin answering from the forwarder's own data; answer returns a nil response for
+// questions it leaves to the next handler
+type answerPlugin struct {
+	name      string
+	answer    func(f *Forwarder, request *DNSMessage) (*DNSMessage, error)
+	forwarder *Forwarder
+}
+
+func (p *answerPlugin) Name() string {
+	return p.name
+}
+
+func (p *answerPlugin) Setup(config *Config, forwarder *Forwarder) error {
+	p.forwarder = forwarder
+	return nil
+}
+
+func (p *answerPlugin) Wrap(next Handler) Handler {
+	return HandlerFunc(func(request *DNSMessage) (*DNSMessage, error) {
+		response, err := p.answer(p.forwarder, request)
+		if err != nil || response != nil {
+			return response, err
+		}
+		return next.ServeDNS(request)
+	})
+}
+
+func init() {
+	RegisterPlugin("blocklist", func() Plugin {
+		return &answerPlugin{name: "blocklist", answer: func(f *Forwarder, request *DNSMessage) (*DNSMessage, error) {
+			response, _ := f.answerBlocked(request)
+			return response, nil
+		}}
+	})
+	RegisterPlugin("local", func() Plugin {
+		return &answerPlugin{name: "local", answer: func(f *Forwarder, request *DNSMessage) (*DNSMessage, error) {
+			response, _ := f.answerLocal(request)
+			return response, nil
+		}}
+	})
+	RegisterPlugin("class", func() Plugin {
+		return &answerPlugin{name: "class", answer: func(f *Forwarder, request *DNSMessage) (*DNSMessage, error) {
+			if Forwardable(request.Questions[0].Class) {
+				return nil, nil
+			}
+			return f.answerClass(request)
+		}}
+	})
+	RegisterPlugin("cache", func() Plugin {
+		return &answerPlugin{name: "cache", answer: func(f *Forwarder, request *DNSMessage) (*DNSMessage, error) {
+			records, ok := f.Cache.Get(CacheKeyFromQuestion(request.Questions[0]))
+			if !ok {
+				return nil, nil
+			}
+			debugf(ComponentCache, "Cache hit: %s", request.Questions[0])
+			return f.cachedResponse(request, records)
+		}}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+/*
+This module contains support for the PROXY protocol of HAProxy (versions 1 and 2), with which a TCP load balancer in
+front of the server passes on the address of each client: it sends a header ahead of the connection's data, and the
+server takes the client address from it in place of the balancer's own, for the query log, webhooks, and answers that
+depend on the client. Only connections from the networks given with --proxy-protocol are expected to carry a header,
+which they must; anyone else could claim any address.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a balancer may take to send the header
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is the longest version 1 header, including its CRLF
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature starts every version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections whose client address is given by a PROXY protocol header if they come from a
+// trusted network
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// proxyConn is a connection from a balancer, whose header is read by the first Read or RemoteAddr
+type proxyConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	once     sync.Once
+	remote   net.Addr
+	err      error
+	mu       sync.Mutex
+	deadline time.Time // Read deadline set by the caller, applied once the header is read
+	reading  bool      // Whether the header is being read, under its own deadline
+}
+
+// NewProxyListener returns a listener reading PROXY protocol headers from the connections of trusted networks, or
+// listener itself if there are none
+func NewProxyListener(listener net.Listener, trusted []netip.Prefix) net.Listener {
+	if len(trusted) == 0 {
+		return listener
+	}
+	return &proxyListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || !slices.ContainsFunc(l.trusted, func(network netip.Prefix) bool { return network.Contains(peer.Addr().Unmap()) }) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReaderSize(conn, 512)}, nil
+}
+
+// header reads the PROXY protocol header once; a connection without a valid one is closed
+func (c *proxyConn) header() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.mu.Lock()
+		c.reading = true
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.reading = false
+			c.Conn.SetReadDeadline(c.deadline)
+		}()
+		var client net.Addr
+		if client, c.err = readProxyHeader(c.reader); c.err != nil {
+			fmt.Printf("Closing connection from %s without a valid PROXY protocol header: %v\n", c.remote, c.err)
+			c.Conn.Close()
+			return
+		}
+		if client != nil {
+			c.remote = client
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.header(); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.header()
+	return c.remote
+}
+
+// SetReadDeadline sets the read deadline, which waits for the header to be read if it is being read
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	if c.reading {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// readProxyHeader reads a version 1 or 2 header and returns the client address it gives, or nil if it gives none
+// (for the balancer's own health checks, say)
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(reader)
+	}
+	return nil, fmt.Errorf("no header")
+}
+
+// readProxyV1 reads a header of the form "PROXY TCP4|TCP6 <client> <server> <client port> <server port>\r\n" or
+// "PROXY UNKNOWN ...\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, b); len(line) > proxyV1MaxLength {
+			return nil, fmt.Errorf("version 1 header longer than %d bytes", proxyV1MaxLength)
+		}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid client address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header: the signature, version and command, address family and protocol, the length of
+// the rest, and the addresses followed by optional TLVs, which are skipped
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0: // LOCAL: the balancer speaking for itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+	var size int
+	switch family >> 4 {
+	case 1: // IPv4
+		size = 4
+	case 2: // IPv6
+		size = 16
+	default: // Unspecified or a Unix socket, which have no client address to give
+		return nil, nil
+	}
+	if len(rest) < 2*size+4 {
+		return nil, fmt.Errorf("address block of %d bytes is too short", len(rest))
+	}
+	addr, _ := netip.AddrFromSlice(rest[:size])
+	port := binary.BigEndian.Uint16(rest[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), port)), nil
+}
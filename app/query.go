@@ -0,0 +1,249 @@
+package main
+
+/*
+This module contains the "query" subcommand, a dig-like client that sends a single query and prints the response in
+dig's layout. Arguments may come in any order: a name, a type, a class, "@server", and "+option" toggles;
+"-x address" asks for the PTR record of an address.
+*/
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DefaultQueryServer is the server queried when no "@server" argument is given
+const DefaultQueryServer = "127.0.0.1:53"
+
+// queryOptions are the settings of a "query" invocation
+type queryOptions struct {
+	question  DNSQuestionOptions
+	server    string
+	transport string // udp, tcp, or tls
+	dnssec    bool
+	recurse   bool
+	subnet    netip.Prefix // EDNS Client Subnet to announce, if valid
+	short     bool
+	hex       bool // Whether hex dumps of the query and response are printed
+}
+
+// runQuery implements the "query" subcommand
+func runQuery(args []string) error {
+	opts, err := parseQueryArgs(args)
+	if err != nil {
+		return err
+	}
+	client, err := NewClient(opts.transport + "://" + opts.server)
+	if err != nil {
+		return err
+	}
+	return opts.run(client, strings.Join(args, " "))
+}
+
+// run sends the query described by opts through client and prints the response; command is echoed in the banner
+func (opts *queryOptions) run(client *Client, command string) error {
+	query, err := opts.message()
+	if err != nil {
+		return err
+	}
+	response, rtt, err := client.Exchange(query)
+	if err != nil {
+		return err
+	}
+	if opts.hex {
+		printHex("QUERY", query)
+		printHex("RESPONSE, re-encoded", response)
+	}
+	if opts.short {
+		for _, answer := range response.Answers {
+			for _, record := range answer.ResourceRecords {
+				fmt.Println(FormatRData(record.Type, record.Data))
+			}
+		}
+		return nil
+	}
+	fmt.Printf("; <<>> dns query <<>> %s\n", command)
+	printMessage(response)
+	fmt.Printf(";; Query time: %d msec\n", rtt.Milliseconds())
+	fmt.Printf(";; SERVER: %s(%s)\n", opts.server, opts.transport)
+	fmt.Printf(";; WHEN: %s\n", time.Now().Format(time.RFC1123))
+	return nil
+}
+
+// message builds the query message described by opts
+func (opts *queryOptions) message() (*DNSMessage, error) {
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), opts.question)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.recurse {
+		if query.Header, err = query.Header.ModifyDNSHeader(ModifyRD(0)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.dnssec || opts.subnet.IsValid() {
+		var options []EDNSOption
+		if opts.subnet.IsValid() {
+			options = append(options, ClientSubnet(opts.subnet))
+		}
+		opt := NewOPTRecord(EDNSUDPSize, options...)
+		if opts.dnssec {
+			opt.TTL = EDNSFlagDO
+		}
+		query.Additionals = []*DNSAnswer{{ResourceRecords: []ResourceRecord{opt}}}
+	}
+	return query, nil
+}
+
+// printHex prints the wire form of a message as a hex dump; decoded messages are re-encoded without compression
+func printHex(label string, message *DNSMessage) {
+	encoded, err := message.Encode()
+	if err != nil {
+		fmt.Printf(";; %s could not be encoded: %v\n", label, err)
+		return
+	}
+	fmt.Printf(";; %s (%d bytes):\n%s\n", label, len(encoded), hex.Dump(encoded))
+}
+
+// parseQueryArgs interprets dig-style arguments
+func parseQueryArgs(args []string) (queryOptions, error) {
+	opts := defaultQueryOptions()
+	if err := opts.apply(args); err != nil {
+		return opts, err
+	}
+	if opts.question.Name == "" {
+		return opts, fmt.Errorf("usage: query <name> | -x <address> [type] [class] [@server] [+tcp] [+tls] [+dnssec] [+subnet=prefix] [+norec] [+short] [+hex]")
+	}
+	return opts, nil
+}
+
+// defaultQueryOptions returns the settings used before any argument is applied
+func defaultQueryOptions() queryOptions {
+	return queryOptions{
+		question:  DNSQuestionOptions{Type: TypeA, Class: ClassIN},
+		server:    DefaultQueryServer,
+		transport: "udp",
+		recurse:   true,
+	}
+}
+
+// apply interprets dig-style arguments on top of the current settings
+func (opts *queryOptions) apply(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-x":
+			if i++; i == len(args) {
+				return fmt.Errorf("-x needs an address")
+			}
+			addr, err := netip.ParseAddr(args[i])
+			if err != nil {
+				return fmt.Errorf("invalid -x address: %w", err)
+			}
+			opts.question.Name, opts.question.Type = ReverseName(addr), TypePTR
+		case strings.HasPrefix(arg, "@"):
+			opts.server = arg[1:]
+			if _, _, err := net.SplitHostPort(opts.server); err != nil {
+				opts.server = net.JoinHostPort(opts.server, "53")
+			}
+		case strings.HasPrefix(arg, "+"):
+			if err := opts.toggle(arg[1:]); err != nil {
+				return err
+			}
+		default:
+			if t, err := ParseRecordType(arg); err == nil && opts.question.Name != "" {
+				opts.question.Type = t
+			} else if c, err := ParseRecordClass(arg); err == nil && opts.question.Name != "" {
+				opts.question.Class = c
+			} else if opts.question.Name == "" {
+				opts.question.Name = arg
+			} else {
+				return fmt.Errorf("unexpected argument %q", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// toggle applies a "+option" argument
+func (opts *queryOptions) toggle(option string) error {
+	switch option {
+	case "tcp", "tls":
+		opts.transport = option
+	case "notcp":
+		opts.transport = "udp"
+	case "dnssec":
+		opts.dnssec = true
+	case "nodnssec":
+		opts.dnssec = false
+	case "rec", "recurse":
+		opts.recurse = true
+	case "norec", "norecurse":
+		opts.recurse = false
+	case "nosubnet":
+		opts.subnet = netip.Prefix{}
+	case "hex":
+		opts.hex = true
+	case "nohex":
+		opts.hex = false
+	case "short":
+		opts.short = true
+	case "noshort":
+		opts.short = false
+	default:
+		if value, ok := strings.CutPrefix(option, "subnet="); ok {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return fmt.Errorf("invalid +subnet: %w", err)
+			}
+			opts.subnet = prefix
+			return nil
+		}
+		return fmt.Errorf("unknown option +%s", option)
+	}
+	return nil
+}
+
+// printMessage prints a message in dig's layout
+func printMessage(message *DNSMessage) {
+	header := message.Header
+	fmt.Printf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n",
+		OpCodeString(header.Flags&OpCodeMask>>OpCodeShift), RCodeString(ExtendedRCode(message)), header.ID)
+	fmt.Printf(";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		FlagsString(header.Flags), header.QDCount, header.ANCount, header.NSCount, header.ARCount)
+
+	if opt, ok := FindOPT(message); ok {
+		fmt.Println("\n;; OPT PSEUDOSECTION:")
+		ednsFlags := ""
+		if opt.TTL&EDNSFlagDO != 0 {
+			ednsFlags = " do"
+		}
+		fmt.Printf("; EDNS: version: %d, flags:%s; udp: %d\n", opt.TTL>>16&0xFF, ednsFlags, opt.Class)
+	}
+	fmt.Println("\n;; QUESTION SECTION:")
+	for _, question := range message.Questions {
+		name, _ := LabelsToString(question.Name)
+		fmt.Printf(";%s\t\t%s\t%s\n", name, ClassString(question.Class), TypeString(question.Type))
+	}
+	for _, section := range []struct {
+		name    string
+		answers []*DNSAnswer
+	}{{"ANSWER", message.Answers}, {"AUTHORITY", message.Authorities}, {"ADDITIONAL", message.Additionals}} {
+		var lines []string
+		for _, answer := range section.answers {
+			for _, record := range answer.ResourceRecords {
+				if record.Type != TypeOPT {
+					lines = append(lines, strings.Replace(FormatRecord(record), " ", "\t", 4))
+				}
+			}
+		}
+		if len(lines) > 0 {
+			fmt.Printf("\n;; %s SECTION:\n%s\n", section.name, strings.Join(lines, "\n"))
+		}
+	}
+	fmt.Println()
+}
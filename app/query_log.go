@@ -0,0 +1,218 @@
+package main
+
+/*
+This module contains the query log, which appends one JSON object per answered client query to a file (JSON Lines), and
+the "replay" subcommand, which sends the logged queries to a server again at their original or accelerated pace.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLog receives an entry for every client query if set; it is set once at startup, before any packet is handled
+var queryLog *QueryLog
+
+// QueryLogEntry is one line of the query log
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Protocol string    `json:"protocol"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Class    string    `json:"class"`
+	RCode    string    `json:"rcode,omitempty"` // Empty if the query was dropped
+	Duration float64   `json:"duration_ms"`
+}
+
+// QueryLog appends entries to a file; it is safe for concurrent use
+type QueryLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	ticker *time.Ticker
+	stop   chan struct{} // Closed by Close to end the flushing goroutine
+	done   chan struct{} // Closed once the flushing goroutine has ended
+}
+
+// OpenQueryLog opens path for appending and flushes buffered entries every second
+func OpenQueryLog(path string) (*QueryLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	log := &QueryLog{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		ticker: time.NewTicker(time.Second),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(log.done)
+		for {
+			select {
+			case <-log.stop:
+				return
+			case <-log.ticker.C:
+				log.mu.Lock()
+				log.writer.Flush()
+				log.mu.Unlock()
+			}
+		}
+	}()
+	return log, nil
+}
+
+// NewQueryLogEntry describes the client query in data, received at start, together with the outcome of its encoded
+// response; it fails if the query has no readable question
+func NewQueryLogEntry(start time.Time, source net.Addr, data, response []byte) (QueryLogEntry, bool) {
+	query, err := ParseLazy(data)
+	if err != nil {
+		return QueryLogEntry{}, false
+	}
+	question, err := query.FirstQuestion()
+	if err != nil {
+		return QueryLogEntry{}, false
+	}
+	name, _ := LabelsToString(question.Name)
+	entry := QueryLogEntry{
+		Time:     start.UTC(),
+		Client:   source.String(),
+		Protocol: source.Network(),
+		Name:     name,
+		Type:     TypeString(question.Type),
+		Class:    ClassString(question.Class),
+		Duration: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if len(response) >= DNSHeaderSize {
+		entry.RCode = RCodeString(uint16(response[3] & 0x0F))
+	}
+	return entry, true
+}
+
+// String renders the entry as a line of the verbose log
+func (entry QueryLogEntry) String() string {
+	rCode := entry.RCode
+	if rCode == "" {
+		rCode = "dropped"
+	}
+	return fmt.Sprintf("%s/%s %s %s %s -> %s in %.3fms",
+		entry.Client, entry.Protocol, entry.Name, entry.Class, entry.Type, rCode, entry.Duration)
+}
+
+// Record appends an entry to the log
+func (l *QueryLog) Record(entry QueryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writer.Write(append(line, '\n'))
+}
+
+// Close stops the periodic flushing, flushes buffered entries, and closes the file
+func (l *QueryLog) Close() error {
+	l.ticker.Stop()
+	close(l.stop)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// LoadQueryLog reads the entries of a query log, skipping blank lines
+func LoadQueryLog(path string) ([]QueryLogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []QueryLogEntry
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// runReplay implements the "replay" subcommand
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:2053", "Server to replay to in the form [udp://|tcp://|tls://]ip:port")
+	speed := flags.Float64("speed", 1, "Factor by which the original pace is accelerated; 0 sends every query at once")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: replay [flags] <query log>")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("--speed must not be negative")
+	}
+	entries, err := LoadQueryLog(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s holds no queries", flags.Arg(0))
+	}
+	client, err := NewClient(*target)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var results []benchResult
+	changed := 0 // Queries whose RCODE differs from the logged one
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, entry := range entries {
+		if *speed > 0 {
+			offset := time.Duration(float64(entry.Time.Sub(entries[0].Time)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		question := DNSQuestionOptions{Name: entry.Name}
+		if question.Type, err = ParseRecordType(entry.Type); err != nil {
+			return err
+		}
+		if question.Class, err = ParseRecordClass(entry.Class); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, latency, err := client.Query(question)
+			result := benchResult{latency: latency, err: err}
+			if err == nil {
+				result.rCode = response.Header.Flags & RCodeMask >> RCodeShift
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, result)
+			if err == nil && entry.RCode != "" && RCodeString(result.rCode) != entry.RCode {
+				changed++
+			}
+		}()
+	}
+	wg.Wait()
+	printBenchReport(results, time.Since(start))
+	fmt.Printf("Changed:   %d responses differ in RCODE from the log\n", changed)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+/*
+This module contains speculative racing across upstreams: a query goes to the first upstream, then to the next one
+after every stagger delay without an answer (or immediately once an attempt fails), and the first valid answer wins.
+The losing exchanges are cancelled, which releases their IDs from the pipelined connections' pending tables so that
+late answers are discarded.
+*/
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultRaceStagger is how long a raced query waits for an answer before also asking the next upstream
+const DefaultRaceStagger = 100 * time.Millisecond
+
+// raceUpstream races queries across several upstreams
+type raceUpstream struct {
+	upstreams []Upstream
+	stagger   time.Duration
+}
+
+// raceResult is the outcome of one attempt of a race
+type raceResult struct {
+	response *DNSMessage
+	err      error
+	upstream Upstream
+}
+
+// NewRaceUpstream creates an upstream racing queries across the upstreams given by specs, in order of preference; a
+// single spec yields a plain upstream
+func NewRaceUpstream(specs []string, opts UpstreamOptions, stagger time.Duration) (Upstream, error) {
+	if len(opts.Latency) > 1 && len(opts.Latency) != len(specs) {
+		return nil, fmt.Errorf("%d injected latencies given for %d upstreams", len(opts.Latency), len(specs))
+	}
+	var upstreams []Upstream
+	for i, spec := range specs {
+		upstreamOpts := opts
+		if len(opts.Latency) > 1 {
+			upstreamOpts.Latency = opts.Latency[i : i+1]
+		}
+		upstream, err := NewUpstream(strings.TrimSpace(spec), upstreamOpts)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	switch len(upstreams) {
+	case 0:
+		return nil, fmt.Errorf("no upstreams given")
+	case 1:
+		return upstreams[0], nil
+	}
+	return &raceUpstream{upstreams: upstreams, stagger: stagger}, nil
+}
+
+// Exchange races query across the upstreams and returns the first valid answer, or the last answer or error if no
+// upstream gave a valid one
+func (r *raceUpstream) Exchange(ctx context.Context, query *DNSMessage) (*DNSMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Cancels the attempts still in flight once a winner is found
+	results := make(chan raceResult, len(r.upstreams))
+	next := 0
+	launch := func() {
+		upstream := r.upstreams[next]
+		attempt := *query // Upstreams may rewrite the header of their own copy
+		next++
+		go func() {
+			response, err := upstream.Exchange(ctx, &attempt)
+			results <- raceResult{response: response, err: err, upstream: upstream}
+		}()
+	}
+	launch()
+	timer := time.NewTimer(r.stagger)
+	defer timer.Stop()
+	var last raceResult
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if next < len(r.upstreams) {
+				launch()
+				pending++
+				timer.Reset(r.stagger)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil && validRaceAnswer(result.response) {
+				return result.response, nil
+			}
+			last = result
+			if next < len(r.upstreams) {
+				launch()
+				pending++
+				timer.Reset(r.stagger)
+			}
+		}
+	}
+	if last.err != nil {
+		return nil, fmt.Errorf("all upstreams failed, last %s: %w", last.upstream, last.err)
+	}
+	return last.response, nil
+}
+
+func (r *raceUpstream) String() string {
+	names := make([]string, len(r.upstreams))
+	for i, upstream := range r.upstreams {
+		names[i] = upstream.String()
+	}
+	return "race(" + strings.Join(names, ",") + ")"
+}
+
+// validRaceAnswer reports whether a response settles a race; server failures and refusals let other upstreams try
+func validRaceAnswer(response *DNSMessage) bool {
+	rCode := response.Header.Flags & RCodeMask >> RCodeShift
+	return rCode != RCodeServFail && rCode != RCodeRefused
+}
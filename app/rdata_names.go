@@ -0,0 +1,115 @@
+package main
+
+/*
+This module contains the handling of domain names embedded in RDATA. Upstreams may compress the names inside the RDATA
+of the types defined in RFC 1035 with pointers into their own message, which mean nothing once the RDATA is copied into
+another message. Such names are therefore expanded when a record is decoded, and only compressed again, against the
+message being written, for the types RFC 3597 allows it for.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// rdataLayout describes RDATA holding domain names: fixed-size fields before the names, the number of consecutive
+// names, and fixed-size fields after them
+type rdataLayout struct {
+	prefix     int
+	names      int
+	suffix     int
+	compressed bool // Whether the names may be compressed when written (RFC 3597 section 4)
+}
+
+// rdataLayouts lists the layouts of the supported record types that hold domain names
+var rdataLayouts = map[uint16]rdataLayout{
+	TypeNS:    {names: 1, compressed: true},
+	TypeCNAME: {names: 1, compressed: true},
+	TypePTR:   {names: 1, compressed: true},
+	TypeMX:    {prefix: 2, names: 1, compressed: true},
+	TypeSOA:   {names: 2, suffix: 20, compressed: true},
+	TypeSRV:   {prefix: 6, names: 1}, // RFC 2782 forbids compressing the target
+}
+
+// expandRData re-reads the RDATA of a record of recordType that starts at offset start of the message read by buf,
+// returning it with every embedded name expanded; RDATA of other types is returned as data. The reader is left at the
+// end of the RDATA.
+func expandRData(buf *bytes.Reader, recordType uint16, start int64, data []byte) ([]byte, error) {
+	layout, ok := rdataLayouts[recordType]
+	if !ok {
+		return data, nil
+	}
+	end, err := buf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Seek(end, io.SeekStart)
+	if _, err := buf.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	expanded := make([]byte, layout.prefix, len(data)+64)
+	if _, err := io.ReadFull(buf, expanded); err != nil {
+		return nil, err
+	}
+	for range layout.names {
+		name, err := ReadQName(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name in %s data: %w", TypeString(recordType), err)
+		}
+		expanded = append(expanded, name...)
+	}
+	suffix := make([]byte, layout.suffix)
+	if _, err := io.ReadFull(buf, suffix); err != nil {
+		return nil, err
+	}
+	if read, _ := buf.Seek(0, io.SeekCurrent); read != end {
+		return nil, fmt.Errorf("%s data is %d bytes long but its fields take %d", TypeString(recordType), end-start, read-start)
+	}
+	return append(expanded, suffix...), nil
+}
+
+// writeRData writes the RDATA of record preceded by its length, compressing the names it embeds against offsets if
+// its type allows it; RDATA that does not match the layout of its type is written verbatim
+func writeRData(buf *bytes.Buffer, record ResourceRecord, offsets map[string]int) {
+	layout, ok := rdataLayouts[record.Type]
+	if !ok || !layout.compressed || len(record.Data) < layout.prefix {
+		binary.Write(buf, binary.BigEndian, uint16(len(record.Data)))
+		buf.Write(record.Data)
+		return
+	}
+	rest := record.Data[layout.prefix:]
+	names := make([][]DNSLabel, layout.names)
+	for i := range names {
+		length, ok := uncompressedNameLength(rest)
+		if !ok {
+			binary.Write(buf, binary.BigEndian, uint16(len(record.Data)))
+			buf.Write(record.Data)
+			return
+		}
+		names[i], _ = BytesToLabels(rest[:length])
+		rest = rest[length:]
+	}
+	lengthOffset := buf.Len()
+	buf.Write([]byte{0, 0})
+	buf.Write(record.Data[:layout.prefix])
+	for _, name := range names {
+		writeCompressedName(buf, name, offsets)
+	}
+	buf.Write(rest)
+	binary.BigEndian.PutUint16(buf.Bytes()[lengthOffset:], uint16(buf.Len()-lengthOffset-2))
+}
+
+// uncompressedNameLength returns the length of the uncompressed name that data starts with
+func uncompressedNameLength(data []byte) (int, bool) {
+	for i := 0; i < len(data); i += 1 + int(data[i]) {
+		if data[i] == 0 {
+			return i + 1, true
+		}
+		if data[i] > 63 {
+			return 0, false
+		}
+	}
+	return 0, false
+}
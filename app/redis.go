@@ -0,0 +1,193 @@
+package main
+
+/*
+This module contains a minimal client for Redis and servers speaking its protocol (RESP2), enough for the shared cache:
+commands are sent as arrays of bulk strings over a small pool of connections, each used by one command at a time.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RedisTimeout bounds every Redis command, so that a slow server delays queries by little more than a miss
+	RedisTimeout = 250 * time.Millisecond
+	// redisPoolSize is the number of idle connections kept per server
+	redisPoolSize = 8
+)
+
+// errRedisNil is the reply to commands about keys that do not exist
+var errRedisNil = errors.New("redis: nil reply")
+
+// RedisClient sends commands to a Redis server; it is safe for concurrent use
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// redisConn is a connection to a Redis server
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient creates a client for a server given as redis://[:password@]host:port[/db]; connections are dialed
+// lazily
+func NewRedisClient(spec string) (*RedisClient, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not of the form redis://[:password@]host:port[/db]", spec)
+	}
+	client := &RedisClient{addr: u.Host, idle: make(chan *redisConn, redisPoolSize)}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		client.addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		client.password = password
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q in %q", db, spec)
+		}
+	}
+	return client, nil
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk strings, an int64 for integers, and a []any
+// for arrays; error replies and nil replies are returned as errors, the latter as errRedisNil
+func (c *RedisClient) Do(args ...string) (any, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	var replyErr redisError
+	if err == nil || errors.Is(err, errRedisNil) || errors.As(err, &replyErr) {
+		c.release(conn) // The connection is still in step with the server
+	} else {
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+// acquire returns an idle connection, or dials, authenticates, and selects the database on a new one
+func (c *RedisClient) acquire() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", c.addr, RedisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// release returns a connection to the pool, closing it if the pool is full
+func (c *RedisClient) release(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends a command on the connection and reads its reply
+func (conn *redisConn) do(args ...string) (any, error) {
+	conn.conn.SetDeadline(time.Now().Add(RedisTimeout))
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// readReply reads one reply
+func (conn *redisConn) readReply() (any, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply line")
+	}
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, length+2) // With the trailing CRLF
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, count)
+		for i := range items {
+			var replyErr redisError
+			if items[i], err = conn.readReply(); errors.Is(err, errRedisNil) || errors.As(err, &replyErr) {
+				items[i] = err // Kept in place, so that the rest of the array is read
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
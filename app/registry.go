@@ -0,0 +1,328 @@
+package main
+
+/*
+This module contains the registry backend, which serves records generated from service registrations kept under a key
+prefix in Consul's key/value store or in etcd, making the server a lightweight service discovery DNS. Registrations use
+the layout SkyDNS and CoreDNS's etcd plugin use: the key path below the prefix, reversed, is the name, so that
+/skydns/local/svc/web/web-1 is web-1.web.svc.local., and the value is a JSON object such as
+{"host": "10.0.0.7", "port": 8080, "ttl": 30}. Each registration answers at its own name and at its parent's, which
+thereby lists every instance of the service: addresses if the host is one, and an SRV record if a port is given. A host
+name given without a port is a CNAME at the registration's own name instead, as a CNAME cannot share its owner.
+
+The prefix is watched with Consul's blocking queries or etcd's watch API, and every change re-reads it and swaps in a
+fresh set of records, the way reloads of local data do.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegistryPrefix is the key prefix watched if the registry URL has no path
+	DefaultRegistryPrefix = "/skydns"
+	// DefaultRegistryTTL is the TTL of records generated from registrations that do not set one
+	DefaultRegistryTTL = 30
+	// RegistryRetryDelay is how long to wait before reading the registry again after a failure
+	RegistryRetryDelay = 5 * time.Second
+	// registryWait is how long a Consul blocking query waits for a change before returning unchanged
+	registryWait = 5 * time.Minute
+)
+
+// registryEntry is a key and its value, as read from a registry
+type registryEntry struct {
+	Key   string
+	Value []byte
+}
+
+// registryBackend reads the entries under a key prefix
+type registryBackend interface {
+	// fetch returns the entries once their version differs from version, immediately for version zero, along with
+	// their new version
+	fetch(version uint64) ([]registryEntry, uint64, error)
+}
+
+// Registry is a key prefix in Consul or etcd holding service registrations
+type Registry struct {
+	Spec    string
+	Prefix  string // Without surrounding slashes
+	backend registryBackend
+}
+
+// Registration is the JSON value registering a service instance
+type Registration struct {
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	TTL      uint32 `json:"ttl"`
+}
+
+// NewRegistry creates a registry given as consul://host:port[/prefix] or etcd://host:port[/prefix]
+func NewRegistry(spec string) (*Registry, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q is not of the form consul://host:port[/prefix] or etcd://host:port[/prefix]", spec)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = strings.Trim(DefaultRegistryPrefix, "/")
+	}
+	registry := &Registry{Spec: spec, Prefix: prefix}
+	switch u.Scheme {
+	case "consul":
+		registry.backend = &consulBackend{base: "http://" + u.Host, prefix: prefix + "/"}
+	case "etcd":
+		registry.backend = &etcdBackend{base: "http://" + u.Host, prefix: "/" + prefix + "/"}
+	default:
+		return nil, fmt.Errorf("unsupported registry %q, expected consul:// or etcd://", u.Scheme)
+	}
+	return registry, nil
+}
+
+// WatchRegistry serves the records of the registry's registrations, replacing them whenever the registry changes; it
+// never returns
+func (f *Forwarder) WatchRegistry(registry *Registry) {
+	var version uint64
+	for {
+		entries, current, err := registry.backend.fetch(version)
+		if err != nil {
+			fmt.Printf("Failed to read registry %s: %v\n", registry.Spec, err)
+			version = 0
+			time.Sleep(RegistryRetryDelay)
+			continue
+		}
+		if version != 0 && current == version {
+			continue // A blocking query that timed out
+		}
+		version = current
+		store := NewLocalStore()
+		for _, record := range registry.Records(entries) {
+			store.Add(record)
+		}
+		f.Registry.Store(store)
+		fmt.Printf("Loaded %d registrations for %d names from registry %s\n", len(entries), store.Len(), registry.Spec)
+	}
+}
+
+// Records generates the records of the registrations among entries, skipping and logging invalid ones
+func (registry *Registry) Records(entries []registryEntry) []ResourceRecord {
+	var records []ResourceRecord
+	for _, entry := range entries {
+		generated, err := registry.registrationRecords(entry)
+		if err != nil {
+			fmt.Printf("Skipping registration %s: %v\n", entry.Key, err)
+			continue
+		}
+		records = append(records, generated...)
+	}
+	return records
+}
+
+// registrationRecords generates the records of a registration at its name and its parent's
+func (registry *Registry) registrationRecords(entry registryEntry) ([]ResourceRecord, error) {
+	path := strings.TrimPrefix(strings.Trim(entry.Key, "/"), registry.Prefix+"/")
+	var registration Registration
+	if err := json.Unmarshal(entry.Value, &registration); err != nil {
+		return nil, err
+	}
+	if registration.Host == "" {
+		return nil, fmt.Errorf("no host")
+	}
+	if registration.TTL == 0 {
+		registration.TTL = DefaultRegistryTTL
+	}
+	segments := strings.Split(path, "/")
+	slices.Reverse(segments)
+	name := strings.Join(segments, ".") + "."
+	names := []string{name}
+	if len(segments) > 1 {
+		names = append(names, strings.Join(segments[1:], ".")+".")
+	}
+	target := absoluteName(registration.Host, "")
+	var specs []serviceRecordSpec
+	if addr, err := netip.ParseAddr(registration.Host); err == nil {
+		recordType := uint16(TypeA)
+		if addr.Unmap().Is6() {
+			recordType = TypeAAAA
+		}
+		for _, owner := range names {
+			specs = append(specs, serviceRecordSpec{owner, recordType, []string{addr.Unmap().String()}})
+		}
+		target = name // The instance's own name holds its address
+	} else if registration.Port == 0 {
+		// Not at the parent, which may have others, nor beside an SRV record, as a CNAME cannot share its owner
+		specs = append(specs, serviceRecordSpec{name, TypeCNAME, []string{target}})
+	}
+	if registration.Port != 0 {
+		rdata := []string{strconv.Itoa(int(registration.Priority)), strconv.Itoa(int(registration.Weight)), strconv.Itoa(int(registration.Port)), target}
+		for _, owner := range names {
+			specs = append(specs, serviceRecordSpec{owner, TypeSRV, rdata})
+		}
+	}
+	var records []ResourceRecord
+	for _, spec := range specs {
+		record, err := NewResourceRecord(spec.name, spec.recordType, ClassIN, registration.TTL, spec.rdata, "")
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// consulBackend reads a key prefix from Consul's key/value store
+type consulBackend struct {
+	base   string
+	prefix string
+}
+
+// fetch reads the prefix with a blocking query, which Consul answers once the prefix's index moves past version
+func (b *consulBackend) fetch(version uint64) ([]registryEntry, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if version != 0 {
+		query.Set("index", strconv.FormatUint(version, 10))
+		query.Set("wait", registryWait.String())
+	}
+	client := http.Client{Timeout: registryWait + UpstreamTimeout}
+	response, err := client.Get(b.base + "/v1/kv/" + b.prefix + "?" + query.Encode())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	index, _ := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound: // Nothing is registered yet
+		return nil, index, nil
+	default:
+		return nil, 0, fmt.Errorf("consul answered %s", response.Status)
+	}
+	var pairs []struct {
+		Key   string
+		Value []byte // Base64 in the JSON, decoded by encoding/json
+	}
+	if err := json.NewDecoder(response.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]registryEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		if !strings.HasSuffix(pair.Key, "/") { // Folders have no registration
+			entries = append(entries, registryEntry{Key: pair.Key, Value: pair.Value})
+		}
+	}
+	return entries, index, nil
+}
+
+// etcdBackend reads a key prefix from etcd through its JSON gateway to the v3 API
+type etcdBackend struct {
+	base   string
+	prefix string
+}
+
+// fetch waits for a change to the prefix after revision version, if not zero, then reads it
+func (b *etcdBackend) fetch(version uint64) ([]registryEntry, uint64, error) {
+	if version != 0 {
+		if err := b.watch(version + 1); err != nil {
+			return nil, 0, err
+		}
+	}
+	var reply struct {
+		Header struct {
+			Revision uint64 `json:",string"`
+		}
+		KVs []struct {
+			Key   []byte
+			Value []byte
+		}
+	}
+	if err := b.post("/v3/kv/range", b.rangeRequest(), &reply); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]registryEntry, len(reply.KVs))
+	for i, kv := range reply.KVs {
+		entries[i] = registryEntry{Key: string(kv.Key), Value: kv.Value}
+	}
+	return entries, reply.Header.Revision, nil
+}
+
+// watch returns once a key under the prefix changes at or after revision
+func (b *etcdBackend) watch(revision uint64) error {
+	request := b.rangeRequest()
+	request["start_revision"] = strconv.FormatUint(revision, 10)
+	body, err := json.Marshal(map[string]any{"create_request": request})
+	if err != nil {
+		return err
+	}
+	response, err := http.Post(b.base+"/v3/watch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd answered %s", response.Status)
+	}
+	// The watch streams one JSON object per update, the first confirming its creation
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var update struct {
+			Result struct {
+				Canceled bool
+				Events   []json.RawMessage
+			}
+		}
+		if err := decoder.Decode(&update); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("etcd ended the watch")
+			}
+			return err
+		}
+		if update.Result.Canceled {
+			return fmt.Errorf("etcd canceled the watch")
+		}
+		if len(update.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// rangeRequest returns the key range covering the prefix, in the form of etcd's JSON gateway
+func (b *etcdBackend) rangeRequest() map[string]any {
+	end := []byte(b.prefix)
+	end[len(end)-1]++ // The prefix ends with '/', which has a successor
+	return map[string]any{
+		"key":       base64.StdEncoding.EncodeToString([]byte(b.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+}
+
+// post sends a JSON request to the gateway and decodes its reply into reply
+func (b *etcdBackend) post(path string, request any, reply any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: UpstreamTimeout}
+	response, err := client.Post(b.base+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd answered %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(reply)
+}
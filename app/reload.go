@@ -0,0 +1,86 @@
+package main
+
+/*
+This module contains the reloading of local records and blocklists, on SIGHUP or when one of their files changes.
+Replacements are built off to the side and published with a single atomic pointer swap, so queries never wait for a
+reload and never observe a partially loaded store; queries already in progress finish against the store they started
+with.
+*/
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often local data files are checked for changes by default
+const DefaultWatchInterval = 5 * time.Second
+
+// ReloadLocalData loads the configured records file, hosts files, and blocklist and swaps them in; on error nothing is
+// replaced
+func (f *Forwarder) ReloadLocalData(config *Config) error {
+	var blocklist *Blocklist
+	local, err := LoadLocalStore(config.Records, config.RecordsFile, config.HostsFiles, config.AutoPTR)
+	if err != nil {
+		return fmt.Errorf("failed to load local records: %w", err)
+	}
+	if config.BlocklistFile != "" {
+		if blocklist, err = LoadBlocklist(config.BlocklistFile); err != nil {
+			return fmt.Errorf("failed to load blocklist: %w", err)
+		}
+	}
+	f.Local.Store(local)
+	f.Blocklist.Store(blocklist)
+	fmt.Printf("Loaded local records for %d names and %d blocked domains\n", local.Len(), blocklist.Len())
+	return nil
+}
+
+// reloadOnHangup reloads the local data every time the process receives SIGHUP, keeping the current data if a reload
+// fails
+func reloadOnHangup(forwarder *Forwarder, config *Config) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := forwarder.ReloadLocalData(config); err != nil {
+			fmt.Println("Reload failed, keeping previous local data:", err)
+		}
+	}
+}
+
+// watchLocalData polls the files local data is loaded from every interval and reloads it when any of them changes,
+// keeping the current data if a reload fails
+func watchLocalData(forwarder *Forwarder, config *Config, interval time.Duration) {
+	paths := append([]string{config.RecordsFile, config.BlocklistFile}, config.HostsFiles...)
+	previous := localDataVersions(paths)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current := localDataVersions(paths)
+		if slices.Equal(current, previous) {
+			continue
+		}
+		previous = current
+		fmt.Println("Local data files changed, reloading")
+		if err := forwarder.ReloadLocalData(config); err != nil {
+			fmt.Println("Reload failed, keeping previous local data:", err)
+		}
+	}
+}
+
+// localDataVersions identifies the current version of each file by its modification time and size; missing files and
+// empty paths have the zero version
+func localDataVersions(paths []string) []string {
+	versions := make([]string, len(paths))
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			versions[i] = fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return versions
+}
@@ -0,0 +1,83 @@
+package main
+
+/*
+This module contains the "repl" subcommand, an interactive version of "query". Each line takes the same arguments as
+"query"; the server and "+option" toggles persist for the rest of the session, while the name, type, and class apply
+to that line's query only. A line without a name just changes the settings.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// replHelp describes the commands understood by the REPL
+const replHelp = `<name> [type] [class] [@server] [+option...]   send a query; @server and +options persist
+@server | +option...                         change the settings without querying
+show                                         print the current settings
+help                                         print this help
+quit                                         leave the REPL
+Options: +tcp +tls +notcp +dnssec +nodnssec +subnet=<prefix> +nosubnet +rec +norec +short +noshort +hex +nohex`
+
+// runRepl implements the "repl" subcommand; its arguments set the initial settings
+func runRepl(args []string) error {
+	session := defaultQueryOptions()
+	if err := session.apply(args); err != nil {
+		return err
+	}
+	clients := map[string]*Client{} // By transport and server, so stream connections are reused across queries
+	scanner := bufio.NewScanner(os.Stdin)
+	for fmt.Print("dns> "); scanner.Scan(); fmt.Print("dns> ") {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "quit", "exit":
+			return nil
+		case "help", "?":
+			fmt.Println(replHelp)
+			continue
+		case "show":
+			session.print()
+			continue
+		}
+		opts := session
+		opts.question = DNSQuestionOptions{Type: TypeA, Class: ClassIN}
+		if err := opts.apply(fields); err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		session = opts
+		if opts.question.Name == "" {
+			continue
+		}
+		target := opts.transport + "://" + opts.server
+		client, ok := clients[target]
+		if !ok {
+			var err error
+			if client, err = NewClient(target); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			clients[target] = client
+		}
+		if err := opts.run(client, scanner.Text()); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+	fmt.Println()
+	return scanner.Err()
+}
+
+// print describes the session settings
+func (opts *queryOptions) print() {
+	subnet := "none"
+	if opts.subnet.IsValid() {
+		subnet = opts.subnet.String()
+	}
+	fmt.Printf("server %s (%s), dnssec %t, recurse %t, subnet %s, short %t, hex %t\n",
+		opts.server, opts.transport, opts.dnssec, opts.recurse, subnet, opts.short, opts.hex)
+}
@@ -0,0 +1,104 @@
+package main
+
+/*
+This module contains stub mode: when no resolver is configured, the nameservers of the system's resolv.conf become the
+upstreams, and its search list is applied to client queries for short names the way the system's own stub resolver
+would apply it.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultResolvConfPath is where the system resolver configuration is read from
+	DefaultResolvConfPath = "/etc/resolv.conf"
+	// defaultNDots is the ndots value resolv.conf implies when it sets none
+	defaultNDots = 1
+)
+
+// ResolvConf is the subset of resolv.conf(5) that stub mode uses
+type ResolvConf struct {
+	Nameservers []string // Addresses in ip:port form
+	Search      []string // Absolute domains, in order
+	NDots       int      // Names with fewer dots are tried with the search domains first
+}
+
+// LoadResolvConf reads the nameserver, search, domain, and "options ndots" lines of a resolv.conf file
+func LoadResolvConf(path string) (*ResolvConf, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	conf := &ResolvConf{NDots: defaultNDots}
+	var domain []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || net.ParseIP(strings.Split(fields[1], "%")[0]) == nil {
+				return nil, fmt.Errorf("%s:%d: invalid nameserver line", path, line)
+			}
+			conf.Nameservers = append(conf.Nameservers, net.JoinHostPort(fields[1], "53"))
+		case "search":
+			conf.Search = absoluteNames(fields[1:]) // The last search or domain line wins
+			domain = nil
+		case "domain":
+			domain, conf.Search = absoluteNames(fields[1:2]), nil
+		case "options":
+			for _, option := range fields[1:] {
+				if value, ok := strings.CutPrefix(option, "ndots:"); ok {
+					if conf.NDots, err = strconv.Atoi(value); err != nil || conf.NDots < 0 {
+						return nil, fmt.Errorf("%s:%d: invalid option %q", path, line, option)
+					}
+					conf.NDots = min(conf.NDots, 15) // The limit the system resolver applies
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if conf.Search == nil {
+		conf.Search = domain
+	}
+	if len(conf.Nameservers) == 0 {
+		return nil, fmt.Errorf("%s lists no nameservers", path)
+	}
+	return conf, nil
+}
+
+// absoluteNames lowercases domains and gives them a trailing dot, skipping the root
+func absoluteNames(domains []string) []string {
+	var names []string
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSuffix(domain, ".")); domain != "" {
+			names = append(names, domain+".")
+		}
+	}
+	return names
+}
+
+// searchNames returns the names to try for name, which must be absolute, in order: with the search domains appended
+// first if it has fewer than ndots dots, and as given last; names with enough dots are only tried as given
+func (conf *ResolvConf) searchNames(name string) []string {
+	relative := strings.TrimSuffix(name, ".")
+	if conf == nil || len(conf.Search) == 0 || relative == "" || strings.Count(relative, ".") >= conf.NDots {
+		return []string{name}
+	}
+	names := make([]string, 0, len(conf.Search)+1)
+	for _, domain := range conf.Search {
+		names = append(names, relative+"."+domain)
+	}
+	return append(names, name)
+}
@@ -0,0 +1,156 @@
+package main
+
+/*
+This module contains the fitting of responses into the client's size limit. Oversized responses go through an ordered
+shrink pipeline, re-encoding after every step: name compression first, then dropping the additional section (except
+the OPT pseudo-record), then the authority section, and only then truncating answers and setting TC.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// shrinkStep is a stage of the shrink pipeline; apply reports whether it changed the message
+type shrinkStep struct {
+	name  string
+	apply func(message *DNSMessage) bool
+}
+
+// shrinkSteps are tried in order until the response fits, before answers are truncated
+var shrinkSteps = []shrinkStep{
+	{"compress names", func(*DNSMessage) bool { return true }},
+	{"drop additional section", dropAdditionals},
+	{"drop authority section", dropAuthorities},
+}
+
+// FitResponse encodes message into at most limit bytes, shrinking a copy of it as little as needed; the message
+// itself is left untouched
+func FitResponse(message *DNSMessage, limit int) ([]byte, error) {
+	encoded, err := message.Encode()
+	if err != nil || len(encoded) <= limit {
+		return encoded, err
+	}
+	fitted := *message
+	for _, step := range shrinkSteps {
+		if !step.apply(&fitted) {
+			continue
+		}
+		if encoded, err = fitted.EncodeCompressed(); err != nil || len(encoded) <= limit {
+			return encoded, err
+		}
+	}
+	return truncateAnswers(&fitted, limit)
+}
+
+// truncateAnswers drops answer records from the end until the message fits and marks it truncated
+func truncateAnswers(message *DNSMessage, limit int) ([]byte, error) {
+	var err error
+	if message.Header, err = message.Header.ModifyDNSHeader(ModifyTC(1)); err != nil {
+		return nil, err
+	}
+	records := sectionRecords(message.Answers)
+	for kept := len(records) - 1; ; kept-- {
+		message.Answers = nil
+		if kept > 0 {
+			message.Answers = []*DNSAnswer{{ResourceRecords: records[:kept]}}
+		}
+		encoded, err := message.EncodeCompressed()
+		if err != nil || len(encoded) <= limit || kept <= 0 {
+			return encoded, err
+		}
+	}
+}
+
+// dropAdditionals removes the additional section apart from OPT pseudo-records, which carry the EDNS state
+func dropAdditionals(message *DNSMessage) bool {
+	var opt []ResourceRecord
+	dropped := false
+	for _, additional := range message.Additionals {
+		for _, record := range additional.ResourceRecords {
+			if record.Type == TypeOPT {
+				opt = append(opt, record)
+			} else {
+				dropped = true
+			}
+		}
+	}
+	message.Additionals = nil
+	if len(opt) > 0 {
+		message.Additionals = []*DNSAnswer{{ResourceRecords: opt}}
+	}
+	return dropped
+}
+
+// dropAuthorities removes the authority section
+func dropAuthorities(message *DNSMessage) bool {
+	dropped := len(sectionRecords(message.Authorities)) > 0
+	message.Authorities = nil
+	return dropped
+}
+
+// EncodeCompressed serializes the message like Encode, but replaces repeated question and owner names, or repeated
+// suffixes of them, with pointers to their first occurrence (RFC 1035 section 4.1.4); so are the names inside the RDATA
+// of the types that allow it
+func (message *DNSMessage) EncodeCompressed() ([]byte, error) {
+	messageHeader, err := message.encodedHeader()
+	if err != nil {
+		return nil, err
+	}
+	header, err := messageHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(header)
+	offsets := map[string]int{}
+	for _, question := range message.Questions {
+		writeCompressedName(buf, question.Name, offsets)
+		binary.Write(buf, binary.BigEndian, [2]uint16{question.Type, question.Class})
+	}
+	for _, section := range [][]*DNSAnswer{message.Answers, message.Authorities, message.Additionals} {
+		for _, answer := range section {
+			for _, record := range answer.ResourceRecords {
+				writeCompressedName(buf, record.Name, offsets)
+				binary.Write(buf, binary.BigEndian, record.Type)
+				binary.Write(buf, binary.BigEndian, record.Class)
+				binary.Write(buf, binary.BigEndian, record.TTL)
+				writeRData(buf, record, offsets)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCompressedName writes name, pointing to the earliest recorded occurrence of its longest known suffix and
+// recording the offsets of the suffixes it writes out; suffixes are matched byte-exactly to preserve the case of names
+func writeCompressedName(buf *bytes.Buffer, name []DNSLabel, offsets map[string]int) {
+	for i, label := range name {
+		if len(label.Content) == 0 {
+			break
+		}
+		suffix := labelsWireKey(name[i:])
+		if offset, ok := offsets[suffix]; ok {
+			binary.Write(buf, binary.BigEndian, uint16(0xC000|offset))
+			return
+		}
+		if buf.Len() < 0x4000 { // Pointers have 14 bits of offset
+			offsets[suffix] = buf.Len()
+		}
+		buf.WriteByte(byte(len(label.Content)))
+		buf.Write(label.Content)
+	}
+	buf.WriteByte(0)
+}
+
+// labelsWireKey returns the uncompressed wire form of labels for use as a map key
+func labelsWireKey(labels []DNSLabel) string {
+	var key []byte
+	for _, label := range labels {
+		if len(label.Content) == 0 {
+			break
+		}
+		key = append(key, byte(len(label.Content)))
+		key = append(key, label.Content...)
+	}
+	return string(key)
+}
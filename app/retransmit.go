@@ -0,0 +1,90 @@
+package main
+
+/*
+This module contains the suppression of client retransmits. Stub resolvers resend a query they have not had an answer
+to within a second or so, under the same ID; each copy would otherwise be resolved anew. Queries are remembered by
+client, ID, and question for a short window: a copy arriving while the original is still being resolved is dropped, as
+the original's response answers it too, and a copy arriving after it is answered with the same response.
+*/
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRetransmitWindow is how long a query is remembered by default
+const DefaultRetransmitWindow = 2 * time.Second
+
+// retransmitKey identifies a query along with its retransmits
+type retransmitKey struct {
+	client   string
+	id       uint16
+	question CacheKey
+}
+
+// retransmitEntry is a recent query, whose response is nil while it is in flight
+type retransmitEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+// RetransmitTable remembers recent client queries; a nil RetransmitTable remembers nothing. It is safe for concurrent
+// use.
+type RetransmitTable struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[retransmitKey]*retransmitEntry
+	pruned  time.Time
+}
+
+// NewRetransmitTable creates a table remembering queries for window, or nil if window is not positive
+func NewRetransmitTable(window time.Duration) *RetransmitTable {
+	if window <= 0 {
+		return nil
+	}
+	return &RetransmitTable{window: window, entries: map[retransmitKey]*retransmitEntry{}}
+}
+
+// Begin looks query from source up. A retransmit reports duplicate along with the response to give it, nil to drop it
+// while the original is in flight. Otherwise the query is recorded as in flight, and finish must be called with its
+// response, nil included, once it is answered; a query never finished is forgotten after the window all the same.
+func (t *RetransmitTable) Begin(query *LazyMessage, source net.Addr) (
+	finish func(response []byte), response []byte, duplicate bool) {
+	finish = func([]byte) {}
+	if t == nil {
+		return finish, nil, false
+	}
+	question, err := query.FirstQuestion()
+	if err != nil {
+		return finish, nil, false
+	}
+	key := retransmitKey{client: source.String(), id: query.Header.ID, question: CacheKeyFromQuestion(question)}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	if entry, ok := t.entries[key]; ok && now.Before(entry.expires) {
+		return finish, entry.response, true
+	}
+	entry := &retransmitEntry{expires: now.Add(t.window)}
+	t.entries[key] = entry
+	return func(response []byte) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		entry.response, entry.expires = response, time.Now().Add(t.window)
+	}, nil, false
+}
+
+// prune forgets expired queries, at most once per window; t.mu must be held
+func (t *RetransmitTable) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.window {
+		return
+	}
+	t.pruned = now
+	for key, entry := range t.entries {
+		if !now.Before(entry.expires) {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+/*
+This module contains the mapping of IP addresses to the in-addr.arpa and ip6.arpa names (RFC 1035 section 3.5,
+RFC 3596 section 2.5) that reverse lookups query, and the synthesis of PTR records for locally defined addresses.
+*/
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name under which PTR records for addr are published
+func ReverseName(addr netip.Addr) string {
+	var labels []string
+	if addr.Is4() {
+		octets := addr.As4()
+		for i := len(octets) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(octets[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa."
+	}
+	octets := addr.As16()
+	for i := len(octets) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", octets[i]&0x0F), fmt.Sprintf("%x", octets[i]>>4))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa."
+}
+
+// synthesizePTRs returns PTR records pointing the reverse name of every A and AAAA record at its owner, skipping
+// addresses whose reverse name already has a PTR record; the first owner of an address wins
+func synthesizePTRs(records []ResourceRecord) ([]ResourceRecord, error) {
+	named := map[string]bool{}
+	for _, record := range records {
+		if record.Type == TypePTR {
+			name, _ := LabelsToString(record.Name)
+			named[CanonicalName(name)] = true
+		}
+	}
+	var ptrs []ResourceRecord
+	for _, record := range records {
+		if record.Type != TypeA && record.Type != TypeAAAA {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(record.Data)
+		if !ok {
+			continue
+		}
+		reverse := ReverseName(addr)
+		if named[reverse] {
+			continue
+		}
+		named[reverse] = true
+		owner, _ := LabelsToString(record.Name)
+		ptr, err := NewResourceRecord(reverse, TypePTR, record.Class, record.TTL, []string{owner}, "")
+		if err != nil {
+			return nil, err
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	return ptrs, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+/*
+This module contains the rewrite plugin, which applies the rules given with --rewrite to questions and answers:
+
+  - name rules resolve a question for another name, matched exactly, by domain suffix, or by a regular expression
+    against the name without its trailing dot, and give the answer back under the name that was asked
+  - answer rules replace an address in A and AAAA answers with another, e.g. a public address with the internal one
+    of the same host for clients behind a NAT without hairpinning
+
+The first name rule matching a question applies, and every answer rule. How often each rule applied is served at
+/rewrite of the admin interface in the Prometheus text format. Answers are rewritten on their way out of the plugin,
+so it belongs before the cache, which otherwise keeps and serves them as they were.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// RewriteExact rewrites a name equal to the rule's
+	RewriteExact = "exact"
+	// RewriteSuffix rewrites the names in the rule's domain, replacing it
+	RewriteSuffix = "suffix"
+	// RewriteRegex rewrites names matching the rule's regular expression with its replacement
+	RewriteRegex = "regex"
+	// RewriteAnswer replaces an address in answers
+	RewriteAnswer = "answer"
+)
+
+// RewriteRule is a rule of the rewrite plugin
+type RewriteRule struct {
+	Line  string // As given, labelling the rule's metric
+	Match string // RewriteExact, RewriteSuffix, RewriteRegex, or RewriteAnswer
+	From  string // Canonical name or domain without the trailing dot, for exact and suffix rules
+	To    string
+	regex *regexp.Regexp
+	addrs [2]netip.Addr // The address replaced and its replacement, for answer rules
+}
+
+// rewritePlugin applies rewrite rules, counting how often each did
+type rewritePlugin struct {
+	names   []*RewriteRule
+	answers []*RewriteRule
+	counts  map[*RewriteRule]*atomic.Uint64
+	rules   []*RewriteRule // In the order given
+}
+
+func init() {
+	RegisterPlugin("rewrite", func() Plugin { return &rewritePlugin{} })
+}
+
+// ParseRewriteRule parses a rule given as "name exact|suffix|regex <from> <to>" or "answer <address> <address>"
+func ParseRewriteRule(line string) (*RewriteRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 3 && fields[0] == RewriteAnswer {
+		from, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		to, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if from.Unmap().Is4() != to.Unmap().Is4() {
+			return nil, fmt.Errorf("%s and %s are of different address families", from, to)
+		}
+		return &RewriteRule{Line: line, Match: RewriteAnswer, addrs: [2]netip.Addr{from.Unmap(), to.Unmap()}}, nil
+	}
+	if len(fields) != 4 || fields[0] != "name" {
+		return nil, fmt.Errorf("%q is not of the form \"name exact|suffix|regex <from> <to>\" or \"answer <address> <address>\"", line)
+	}
+	rule := &RewriteRule{Line: line, Match: fields[1], From: fields[2], To: fields[3]}
+	switch rule.Match {
+	case RewriteExact, RewriteSuffix:
+		rule.From = CanonicalName(strings.Trim(rule.From, "."))
+		rule.To = strings.Trim(rule.To, ".")
+	case RewriteRegex:
+		regex, err := regexp.Compile(rule.From)
+		if err != nil {
+			return nil, err
+		}
+		rule.regex = regex
+	default:
+		return nil, fmt.Errorf("unknown match %q in %q, expected exact, suffix, or regex", rule.Match, line)
+	}
+	return rule, nil
+}
+
+// rewriteName returns the name a name rule rewrites name, canonical and without its trailing dot, to
+func (rule *RewriteRule) rewriteName(name string) (string, bool) {
+	switch rule.Match {
+	case RewriteExact:
+		if name == rule.From {
+			return rule.To, true
+		}
+	case RewriteSuffix:
+		if name == rule.From {
+			return rule.To, true
+		}
+		if prefix, ok := strings.CutSuffix(name, "."+rule.From); ok {
+			return strings.TrimPrefix(prefix+"."+rule.To, "."), true
+		}
+	case RewriteRegex:
+		if rule.regex.MatchString(name) {
+			return strings.Trim(rule.regex.ReplaceAllString(name, rule.To), "."), true
+		}
+	}
+	return "", false
+}
+
+func (p *rewritePlugin) Name() string {
+	return "rewrite"
+}
+
+func (p *rewritePlugin) Setup(config *Config, forwarder *Forwarder) error {
+	if len(config.Rewrites) == 0 {
+		return fmt.Errorf("rewriting needs --rewrite")
+	}
+	p.counts = map[*RewriteRule]*atomic.Uint64{}
+	for _, rule := range config.Rewrites {
+		if rule.Match == RewriteAnswer {
+			p.answers = append(p.answers, rule)
+		} else {
+			p.names = append(p.names, rule)
+		}
+		p.counts[rule] = new(atomic.Uint64)
+		p.rules = append(p.rules, rule)
+	}
+	return nil
+}
+
+func (p *rewritePlugin) Wrap(next Handler) Handler {
+	return HandlerFunc(func(request *DNSMessage) (*DNSMessage, error) {
+		question := request.Questions[0]
+		name, err := LabelsToString(question.Name)
+		if err != nil {
+			return next.ServeDNS(request)
+		}
+		name = CanonicalName(strings.TrimSuffix(name, "."))
+		var rewritten *DNSQuestion
+		for _, rule := range p.names {
+			target, ok := rule.rewriteName(name)
+			if !ok || target == name {
+				continue
+			}
+			if rewritten, err = NewDNSQuestion(DNSQuestionOptions{Name: target, Type: question.Type, Class: question.Class}); err != nil {
+				return nil, fmt.Errorf("rewriting %s with %q: %w", name, rule.Line, err)
+			}
+			debugf(ComponentPolicy, "Rewrote %s to %s", question, target)
+			p.counts[rule].Add(1)
+			break
+		}
+		if rewritten == nil && len(p.answers) == 0 {
+			return next.ServeDNS(request)
+		}
+		forwarded := request
+		if rewritten != nil {
+			forwarded = &DNSMessage{Header: request.Header, Questions: []*DNSQuestion{rewritten}, Client: request.Client}
+		}
+		response, err := next.ServeDNS(forwarded)
+		if err != nil {
+			return nil, err
+		}
+		return p.rewriteResponse(request, rewritten, response), nil
+	})
+}
+
+// rewriteResponse gives a response back under the question of request and applies the answer rules to it; the
+// response's records are copied rather than modified, as they may be shared with the cache
+func (p *rewritePlugin) rewriteResponse(request *DNSMessage, rewritten *DNSQuestion, response *DNSMessage) *DNSMessage {
+	records := sectionRecords(response.Answers)
+	for i, record := range records {
+		if rewritten != nil && equalLabels(record.Name, rewritten.Name) {
+			records[i].Name = request.Questions[0].Name
+		}
+		if record.Type != TypeA && record.Type != TypeAAAA {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(record.Data)
+		if !ok {
+			continue
+		}
+		for _, rule := range p.answers {
+			if addr.Unmap() == rule.addrs[0] {
+				if record.Type == TypeA {
+					records[i].Data = rule.addrs[1].AsSlice()
+				} else {
+					to := rule.addrs[1].As16()
+					records[i].Data = to[:]
+				}
+				p.counts[rule].Add(1)
+				break
+			}
+		}
+	}
+	rewrittenResponse := *response
+	rewrittenResponse.Questions = request.Questions
+	if len(records) > 0 {
+		rewrittenResponse.Answers = []*DNSAnswer{{ResourceRecords: records}}
+	}
+	return &rewrittenResponse
+}
+
+// RegisterAdmin serves how often each rule applied at /rewrite
+func (p *rewritePlugin) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /rewrite", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# TYPE dns_rewrites_total counter")
+		for _, rule := range p.rules {
+			fmt.Fprintf(w, "dns_rewrites_total{rule=%q} %d\n", rule.Line, p.counts[rule].Load())
+		}
+	})
+}
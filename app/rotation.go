@@ -0,0 +1,132 @@
+package main
+
+/*
+This module contains the rotation of local answers, a basic form of DNS load balancing for self-hosted services: when
+a local name has several A or AAAA records, their order changes from one response to the next, and since most clients
+connect to the first address they get, the load spreads across them. The strategies are:
+
+  - round-robin: each response starts one record further down the RRset than the previous one
+  - random: each response shuffles the RRset
+  - weighted: each response shuffles the RRset so that a record comes first with a probability proportional to its
+    weight, given with --record-weight (1 by default)
+*/
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// RotateNone leaves local answers in the order their records were loaded
+	RotateNone = "none"
+	// RotateRoundRobin starts each response one record further down
+	RotateRoundRobin = "round-robin"
+	// RotateRandom shuffles each response
+	RotateRandom = "random"
+	// RotateWeighted shuffles each response by record weight
+	RotateWeighted = "weighted"
+)
+
+// RotationOptions configures the rotation of local answers
+type RotationOptions struct {
+	Strategy string
+	Weights  map[string]map[netip.Addr]float64 // By canonical owner name and address; missing weights are 1
+}
+
+// Rotator reorders the address RRsets of local answers; a nil Rotator leaves them as they are
+type Rotator struct {
+	RotationOptions
+	turns sync.Map // Round-robin turns by owner name and type, as *atomic.Uint64
+}
+
+// NewRotator creates a rotator applying opts, or returns nil if they rotate nothing
+func NewRotator(opts RotationOptions) *Rotator {
+	if opts.Strategy == "" || opts.Strategy == RotateNone {
+		return nil
+	}
+	return &Rotator{RotationOptions: opts}
+}
+
+// Validate checks that the options are usable
+func (opts RotationOptions) Validate() error {
+	switch opts.Strategy {
+	case "", RotateNone, RotateRoundRobin, RotateRandom, RotateWeighted:
+	default:
+		return fmt.Errorf("unknown rotation strategy %q", opts.Strategy)
+	}
+	if len(opts.Weights) > 0 && opts.Strategy != RotateWeighted {
+		return fmt.Errorf("record weights only apply to the %s strategy", RotateWeighted)
+	}
+	return nil
+}
+
+// ParseRecordWeight parses a weight given as "<name> <address> <weight>" into weights
+func ParseRecordWeight(line string, weights map[string]map[netip.Addr]float64) error {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return fmt.Errorf("%q is not of the form \"<name> <address> <weight>\"", line)
+	}
+	addr, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		return err
+	}
+	weight, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+		return fmt.Errorf("invalid weight %q, expected a positive number", fields[2])
+	}
+	name := CanonicalName(strings.TrimSuffix(fields[0], ".") + ".")
+	if weights[name] == nil {
+		weights[name] = map[netip.Addr]float64{}
+	}
+	weights[name][addr.Unmap()] = weight
+	return nil
+}
+
+// Apply returns records in the order of the next response: rotated if they form an A or AAAA RRset of more than one
+// record, as they are otherwise
+func (r *Rotator) Apply(records []ResourceRecord) []ResourceRecord {
+	if r == nil || len(records) < 2 || records[0].Type != TypeA && records[0].Type != TypeAAAA {
+		return records
+	}
+	rotated := slices.Clone(records) // The store's slice is shared by every response
+	switch r.Strategy {
+	case RotateRoundRobin:
+		name, _ := LabelsToString(records[0].Name)
+		key := CanonicalName(name) + "/" + TypeString(records[0].Type)
+		turns, _ := r.turns.LoadOrStore(key, new(atomic.Uint64))
+		start := int((turns.(*atomic.Uint64).Add(1) - 1) % uint64(len(records)))
+		copy(rotated, records[start:])
+		copy(rotated[len(records)-start:], records[:start])
+	case RotateRandom:
+		rand.Shuffle(len(rotated), func(i, j int) { rotated[i], rotated[j] = rotated[j], rotated[i] })
+	case RotateWeighted:
+		// A weighted shuffle: each record draws u^(1/weight) for a uniform u, and the highest draws come first
+		// (Efraimidis and Spirakis), which puts a record first with a probability proportional to its weight
+		name, _ := LabelsToString(records[0].Name)
+		weights := r.Weights[CanonicalName(name)]
+		draws := make([]float64, len(records))
+		order := make([]int, len(records))
+		for i, record := range records {
+			weight := 1.0
+			if addr, ok := netip.AddrFromSlice(record.Data); ok {
+				if w, ok := weights[addr.Unmap()]; ok {
+					weight = w
+				}
+			}
+			draws[i], order[i] = math.Pow(rand.Float64(), 1/weight), i
+		}
+		slices.SortFunc(order, func(a, b int) int { return cmp.Compare(draws[b], draws[a]) })
+		for i, index := range order {
+			rotated[i] = records[index]
+		}
+	}
+	return rotated
+}
@@ -0,0 +1,162 @@
+package main
+
+/*
+This module contains the rendering of resource records in presentation format, the inverse of rr_parser.go. RDATA of
+types without a known layout is rendered in the generic "\# <length> <hex>" form from RFC 3597.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rCodeNames maps response codes to their mnemonics
+var rCodeNames = map[uint16]string{
+	RCodeNoError: "NOERROR", RCodeFormErr: "FORMERR", RCodeServFail: "SERVFAIL", RCodeNXDomain: "NXDOMAIN",
+	RCodeNotImp: "NOTIMP", RCodeRefused: "REFUSED", RCodeBadVers: "BADVERS",
+}
+
+// opCodeNames maps opcodes to their mnemonics
+var opCodeNames = map[uint16]string{
+	OpCodeQuery: "QUERY", OpCodeIQuery: "IQUERY", OpCodeStatus: "STATUS", OpCodeNotify: "NOTIFY", OpCodeUpdate: "UPDATE",
+}
+
+// RCodeString renders a response code as its mnemonic, or RCODEnn if it has none
+func RCodeString(rCode uint16) string {
+	if name, ok := rCodeNames[rCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rCode)
+}
+
+// ParseRCode parses a response code mnemonic, case-insensitively
+func ParseRCode(name string) (uint16, error) {
+	for rCode, mnemonic := range rCodeNames {
+		if strings.EqualFold(name, mnemonic) {
+			return rCode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown response code %q", name)
+}
+
+// OpCodeString renders an opcode as its mnemonic, or OPCODEnn if it has none
+func OpCodeString(opCode uint16) string {
+	if name, ok := opCodeNames[opCode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPCODE%d", opCode)
+}
+
+// FlagsString renders the header flags that are set as dig's space-separated mnemonics
+func FlagsString(flags uint16) string {
+	var names []string
+	for _, flag := range []struct {
+		name string
+		mask uint16
+	}{{"qr", QRMask}, {"aa", AAMask}, {"tc", TCMask}, {"rd", RDMask}, {"ra", RAMask}} {
+		if flags&flag.mask != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// FormatRecord renders a record as "<name> <ttl> <class> <type> <rdata>"
+func FormatRecord(record ResourceRecord) string {
+	name, err := LabelsToString(record.Name)
+	if err != nil {
+		name = "?"
+	}
+	return fmt.Sprintf("%s %d %s %s %s", name, record.TTL, ClassString(record.Class), TypeString(record.Type), FormatRData(record.Type, record.Data))
+}
+
+// FormatRData renders wire-format RDATA of recordType in presentation format
+func FormatRData(recordType uint16, data []byte) string {
+	if formatted, ok := formatKnownRData(recordType, data); ok {
+		return formatted
+	}
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
+
+// formatKnownRData renders RDATA whose layout is known, reporting false if the type is unknown or the data malformed
+func formatKnownRData(recordType uint16, data []byte) (string, bool) {
+	switch recordType {
+	case TypeA:
+		if len(data) == net.IPv4len {
+			return net.IP(data).String(), true
+		}
+	case TypeAAAA:
+		if len(data) == net.IPv6len {
+			return net.IP(data).String(), true
+		}
+	case TypeNS, TypeCNAME, TypePTR:
+		if name, rest, ok := wireName(data); ok && len(rest) == 0 {
+			return name, true
+		}
+	case TypeMX:
+		if len(data) > 2 {
+			if name, rest, ok := wireName(data[2:]); ok && len(rest) == 0 {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(data), name), true
+			}
+		}
+	case TypeSRV:
+		if len(data) > 6 {
+			if name, rest, ok := wireName(data[6:]); ok && len(rest) == 0 {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]),
+					binary.BigEndian.Uint16(data[4:]), name), true
+			}
+		}
+	case TypeSOA:
+		mname, rest, ok := wireName(data)
+		if !ok {
+			break
+		}
+		rname, rest, ok := wireName(rest)
+		if !ok || len(rest) != 20 {
+			break
+		}
+		fields := []string{mname, rname}
+		for i := 0; i < 20; i += 4 {
+			fields = append(fields, strconv.FormatUint(uint64(binary.BigEndian.Uint32(rest[i:])), 10))
+		}
+		return strings.Join(fields, " "), true
+	case TypeTXT:
+		var strs []string
+		for len(data) > 0 {
+			length := int(data[0])
+			if 1+length > len(data) {
+				return "", false
+			}
+			strs = append(strs, `"`+escapeText(data[1:1+length])+`"`)
+			data = data[1+length:]
+		}
+		return strings.Join(strs, " "), len(strs) > 0
+	case TypeNSEC3, TypeNSEC3PARAM:
+		return formatNSEC3(recordType, data)
+	}
+	return "", false
+}
+
+// wireName reads an uncompressed wire-format name from the front of data, returning it with a trailing dot along
+// with the remaining bytes
+func wireName(data []byte) (string, []byte, bool) {
+	var labels []string
+	for {
+		if len(data) == 0 {
+			return "", nil, false
+		}
+		length := int(data[0])
+		if length == 0 {
+			return strings.Join(labels, ".") + ".", data[1:], true
+		}
+		if length > 63 || 1+length > len(data) {
+			return "", nil, false // Compression pointers and truncated labels cannot be resolved without the message
+		}
+		labels = append(labels, escapeLabel(data[1:1+length]))
+		data = data[1+length:]
+	}
+}
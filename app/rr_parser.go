@@ -0,0 +1,330 @@
+package main
+
+/*
+This module contains the parsing of resource records from presentation format (the single-line form used by master
+files, e.g. "nas.home. 300 IN A 192.168.1.10") into ResourceRecords with wire-format RDATA.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultRecordTTL is the TTL given to records that do not specify one
+const DefaultRecordTTL = 3600
+
+// RecordTypeNames maps record types to their mnemonics
+var RecordTypeNames = map[uint16]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR", TypeMX: "MX", TypeTXT: "TXT",
+	TypeAAAA: "AAAA", TypeSRV: "SRV", TypeOPT: "OPT", TypeRRSIG: "RRSIG", TypeDNSKEY: "DNSKEY", TypeTSIG: "TSIG",
+	TypeNSEC3: "NSEC3", TypeNSEC3PARAM: "NSEC3PARAM", TypeIXFR: "IXFR", TypeAXFR: "AXFR", TypeMAILB: "MAILB",
+	TypeMAILA: "MAILA", TypeANY: "ANY",
+}
+
+// RecordClassNames maps record classes to their mnemonics
+var RecordClassNames = map[uint16]string{ClassIN: "IN", ClassCH: "CH", ClassHS: "HS", ClassNONE: "NONE", ClassANY: "ANY"}
+
+// ParseRecordType parses a type mnemonic or the generic TYPEnnn form
+func ParseRecordType(s string) (uint16, error) {
+	upper := strings.ToUpper(s)
+	for t, name := range RecordTypeNames {
+		if name == upper {
+			return t, nil
+		}
+	}
+	if number, ok := strings.CutPrefix(upper, "TYPE"); ok {
+		if t, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return uint16(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+// ParseRecordClass parses a class mnemonic or the generic CLASSnnn form
+func ParseRecordClass(s string) (uint16, error) {
+	upper := strings.ToUpper(s)
+	for c, name := range RecordClassNames {
+		if name == upper {
+			return c, nil
+		}
+	}
+	if number, ok := strings.CutPrefix(upper, "CLASS"); ok {
+		if c, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return uint16(c), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record class %q", s)
+}
+
+// TypeString renders a record type as its mnemonic, or TYPEnnn if it has none
+func TypeString(t uint16) string {
+	if name, ok := RecordTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// ClassString renders a record class as its mnemonic, or CLASSnnn if it has none
+func ClassString(c uint16) string {
+	if name, ok := RecordClassNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", c)
+}
+
+// RecordParseOptions represents the context that relative names and omitted fields are resolved against
+type RecordParseOptions struct {
+	Origin string // Appended to relative names; "@" stands for the origin itself
+	TTL    uint32 // TTL for records that omit it
+}
+
+// ParseResourceRecord parses a record given as "<name> [<ttl>] [<class>] <type> <rdata...>"
+func ParseResourceRecord(line string, opts RecordParseOptions) (ResourceRecord, error) {
+	fields, err := tokenizeRecord(line)
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	return parseRecordFields(fields, opts)
+}
+
+// parseRecordFields parses the tokenized fields of a record
+func parseRecordFields(fields []string, opts RecordParseOptions) (ResourceRecord, error) {
+	if len(fields) < 3 {
+		return ResourceRecord{}, fmt.Errorf("record %q needs at least a name, a type, and data", strings.Join(fields, " "))
+	}
+	name := fields[0]
+	ttl, class := opts.TTL, uint16(ClassIN)
+	if ttl == 0 {
+		ttl = DefaultRecordTTL
+	}
+	rest := fields[1:]
+	// TTL and class may appear in either order before the type
+	for range 2 {
+		if value, err := parseTTL(rest[0]); err == nil {
+			ttl, rest = value, rest[1:]
+		} else if value, err := ParseRecordClass(rest[0]); err == nil {
+			class, rest = value, rest[1:]
+		}
+		if len(rest) < 2 {
+			return ResourceRecord{}, fmt.Errorf("record %q is missing its type or data", strings.Join(fields, " "))
+		}
+	}
+	recordType, err := ParseRecordType(rest[0])
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	return NewResourceRecord(name, recordType, class, ttl, rest[1:], opts.Origin)
+}
+
+// NewResourceRecord builds a record from presentation-format RDATA fields
+func NewResourceRecord(name string, recordType, class uint16, ttl uint32, rdata []string, origin string) (ResourceRecord, error) {
+	labels, err := StringToLabels(absoluteName(name, origin))
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	data, err := encodeRData(recordType, rdata, origin)
+	if err != nil {
+		return ResourceRecord{}, fmt.Errorf("invalid %s data for %s: %w", TypeString(recordType), name, err)
+	}
+	if len(data) > 0xFFFF {
+		return ResourceRecord{}, fmt.Errorf("data for %s is too long", name)
+	}
+	return ResourceRecord{Name: labels, Type: recordType, Class: class, TTL: ttl, Length: uint16(len(data)), Data: data}, nil
+}
+
+// absoluteName resolves a possibly relative presentation-format name against origin
+func absoluteName(name, origin string) string {
+	if name == "@" {
+		name = origin
+	} else if !strings.HasSuffix(name, ".") && origin != "" {
+		name = name + "." + strings.TrimSuffix(origin, ".") + "."
+	}
+	if name == "" || name == "." {
+		return "."
+	}
+	return name
+}
+
+// nameToWire encodes a presentation-format name as uncompressed wire-format labels
+func nameToWire(name string) ([]byte, error) {
+	labels, err := StringToLabels(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := writeName(buf, labels); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeRData encodes presentation-format RDATA fields into wire format
+func encodeRData(recordType uint16, fields []string, origin string) ([]byte, error) {
+	need := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("expected %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	writeName := func(name string) error {
+		wire, err := nameToWire(absoluteName(name, origin))
+		buf.Write(wire)
+		return err
+	}
+	writeUint := func(s string, bits int) error {
+		value, err := strconv.ParseUint(s, 10, bits)
+		if err != nil {
+			return err
+		}
+		if bits == 16 {
+			return binary.Write(buf, binary.BigEndian, uint16(value))
+		}
+		return binary.Write(buf, binary.BigEndian, uint32(value))
+	}
+	// The generic form "\# <length> <hex>" of RFC 3597 is accepted for every type
+	if len(fields) >= 2 && fields[0] == `\#` && recordType != TypeTXT {
+		return decodeGenericRData(fields[1], strings.Join(fields[2:], ""))
+	}
+	switch recordType {
+	case TypeA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		return ip, nil
+	case TypeAAAA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		return ip.To16(), nil
+	case TypeNS, TypeCNAME, TypePTR:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		err := writeName(fields[0])
+		return buf.Bytes(), err
+	case TypeMX:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		if err := writeUint(fields[0], 16); err != nil {
+			return nil, err
+		}
+		err := writeName(fields[1])
+		return buf.Bytes(), err
+	case TypeSRV:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[:3] {
+			if err := writeUint(field, 16); err != nil {
+				return nil, err
+			}
+		}
+		err := writeName(fields[3])
+		return buf.Bytes(), err
+	case TypeSOA:
+		if err := need(7); err != nil {
+			return nil, err
+		}
+		for _, name := range fields[:2] {
+			if err := writeName(name); err != nil {
+				return nil, err
+			}
+		}
+		for _, field := range fields[2:] {
+			if err := writeUint(field, 32); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	case TypeTXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("expected at least one string")
+		}
+		for _, field := range fields {
+			text, err := unescapeLabel(field)
+			if err != nil {
+				return nil, err
+			}
+			if len(text) > 255 {
+				return nil, fmt.Errorf("string %q is longer than 255 bytes", field)
+			}
+			buf.WriteByte(byte(len(text)))
+			buf.Write(text)
+		}
+		return buf.Bytes(), nil
+	case TypeNSEC3, TypeNSEC3PARAM:
+		return parseNSEC3Fields(recordType, fields)
+	}
+	return nil, fmt.Errorf("record type %s is not supported in presentation format", TypeString(recordType))
+}
+
+// decodeGenericRData decodes the length and hex fields of generic RDATA
+func decodeGenericRData(length, hexData string) ([]byte, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA length %q", length)
+	}
+	data, err := hex.DecodeString(hexData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA: %w", err)
+	}
+	if len(data) != n {
+		return nil, fmt.Errorf("generic RDATA holds %d bytes, not %d", len(data), n)
+	}
+	return data, nil
+}
+
+// tokenizeRecord splits a presentation-format record into fields, keeping quoted strings together and dropping
+// comments
+func tokenizeRecord(line string) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	inQuotes, inField := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			inQuotes, inField = !inQuotes, true
+		case c == '\\' && i+1 < len(line):
+			// Escapes are kept for the names and strings they belong to, which unescape them as a whole
+			current.WriteString(line[i : i+2])
+			i++
+			inField = true
+		case inQuotes:
+			current.WriteByte(c)
+		case c == ';':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteByte(c)
+			inField = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted string in %q", line)
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	return fields, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+/*
+This module contains RRsets, the sets of records sharing an owner name, class, and type, which DNS treats as a unit
+(RFC 2181 section 5). Answers are assembled from RRsets rather than raw records, so that whatever mix of local data,
+cache, and upstream answers they come from, duplicate records appear once, the records of an RRset are contiguous and
+share one TTL, and the CNAMEs leading from the question to the answer come before the records they point to. RRsets
+also have the canonical form of RFC 4034 section 6, the bytes DNSSEC signatures are computed over.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// RRset is a set of records sharing an owner name, class, and type
+type RRset struct {
+	Name    []DNSLabel
+	Type    uint16
+	Class   uint16
+	Records []ResourceRecord
+}
+
+// Holds reports whether record belongs to the RRset
+func (set *RRset) Holds(record ResourceRecord) bool {
+	return record.Type == set.Type && record.Class == set.Class && equalLabels(record.Name, set.Name)
+}
+
+// Add adds record to the RRset unless it already holds the same data; every record then takes the lowest TTL of the
+// RRset (RFC 2181 section 5.2)
+func (set *RRset) Add(record ResourceRecord) {
+	duplicate := false
+	for _, held := range set.Records {
+		duplicate = duplicate || bytes.Equal(held.Data, record.Data)
+	}
+	if !duplicate {
+		set.Records = append(set.Records, record)
+	}
+	ttl := min(minTTL(set.Records), record.TTL)
+	for i := range set.Records {
+		set.Records[i].TTL = ttl
+	}
+}
+
+// GroupRRsets groups records into RRsets in the order their first records appear, dropping duplicates
+func GroupRRsets(records []ResourceRecord) []*RRset {
+	var sets []*RRset
+	for _, record := range records {
+		found := false
+		for _, set := range sets {
+			if found = set.Holds(record); found {
+				set.Add(record)
+				break
+			}
+		}
+		if !found {
+			sets = append(sets, &RRset{Name: record.Name, Type: record.Type, Class: record.Class, Records: []ResourceRecord{record}})
+		}
+	}
+	return sets
+}
+
+// AssembleAnswer returns the records answering a question for name as whole RRsets without duplicates, the CNAME chain
+// starting at name first and in order, followed by the other RRsets in the order they first appear
+func AssembleAnswer(name []DNSLabel, records []ResourceRecord) []ResourceRecord {
+	sets := GroupRRsets(records)
+	placed := make([]bool, len(sets))
+	assembled := make([]ResourceRecord, 0, len(records))
+	for range sets { // A chain cannot be longer than the number of RRsets
+		next := -1
+		for i, set := range sets {
+			if !placed[i] && set.Type == TypeCNAME && equalLabels(set.Name, name) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		placed[next] = true
+		assembled = append(assembled, sets[next].Records...)
+		target, err := BytesToLabels(sets[next].Records[0].Data)
+		if err != nil {
+			break
+		}
+		name = target
+	}
+	for i, set := range sets {
+		if !placed[i] {
+			assembled = append(assembled, set.Records...)
+		}
+	}
+	return assembled
+}
+
+// CanonicalBytes returns the RRset in canonical form (RFC 4034 sections 6.2 and 6.3): the wire form of each record,
+// with the owner name and the names in the data uncompressed and lowercased, sorted by data with duplicates dropped.
+// Every record takes the TTL of the first; validators set it to the original TTL of the signature beforehand.
+func (set *RRset) CanonicalBytes() ([]byte, error) {
+	if len(set.Records) == 0 {
+		return nil, nil
+	}
+	rdatas := make([][]byte, len(set.Records))
+	for i, record := range set.Records {
+		rdata, err := canonicalRData(set.Type, record.Data)
+		if err != nil {
+			return nil, err
+		}
+		rdatas[i] = rdata
+	}
+	// RDATA compares as a left-justified unsigned octet sequence, a shorter one first if it is a prefix of a longer
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+	owner := new(bytes.Buffer)
+	if err := writeName(owner, set.Name); err != nil {
+		return nil, err
+	}
+	foldWireName(owner.Bytes())
+	fixed := binary.BigEndian.AppendUint16(nil, set.Type)
+	fixed = binary.BigEndian.AppendUint16(fixed, set.Class)
+	fixed = binary.BigEndian.AppendUint32(fixed, set.Records[0].TTL)
+	var canonical []byte
+	for _, rdata := range rdatas {
+		if len(rdata) > 0xFFFF {
+			return nil, fmt.Errorf("data of %d bytes is too long for a record", len(rdata))
+		}
+		canonical = append(canonical, owner.Bytes()...)
+		canonical = append(canonical, fixed...)
+		canonical = binary.BigEndian.AppendUint16(canonical, uint16(len(rdata)))
+		canonical = append(canonical, rdata...)
+	}
+	return canonical, nil
+}
+
+// canonicalRData returns a copy of the data of a record of recordType with its embedded names lowercased. Decoded data
+// holds its names uncompressed already; only the types of rdataLayouts are known to hold names, which covers those of
+// the types RFC 4034 section 6.2 lists that the server handles.
+func canonicalRData(recordType uint16, data []byte) ([]byte, error) {
+	canonical := slices.Clone(data)
+	layout, ok := rdataLayouts[recordType]
+	if !ok {
+		return canonical, nil
+	}
+	offset := layout.prefix
+	for range layout.names {
+		end, err := skipName(canonical, offset)
+		if err != nil || end > len(canonical) || canonical[end-1] != 0 { // A name ending in a pointer is compressed
+			return nil, fmt.Errorf("invalid name in %s data", TypeString(recordType))
+		}
+		foldWireName(canonical[offset:end])
+		offset = end
+	}
+	return canonical, nil
+}
+
+// foldWireName lowers the ASCII letters of an uncompressed wire-format name in place; length bytes are never above 63,
+// so they are below 'A' and left alone
+func foldWireName(name []byte) {
+	for i, c := range name {
+		name[i] = foldByte(c)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+/*
+This module contains the per-upstream RTT estimator that adaptive timeouts are derived from. The smoothed RTT is an
+exponentially weighted moving average (as in TCP's SRTT, RFC 6298), and every exchange is given a small multiple of it,
+bounded by the configured minimum and maximum, so that a fast upstream's lost packets are retried early while a slow
+upstream is not cut off prematurely.
+*/
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstreamMinTimeout is the default lower bound of adaptive upstream timeouts
+	DefaultUpstreamMinTimeout = 100 * time.Millisecond
+	// rttTimeoutFactor is the multiple of the smoothed RTT an exchange may take
+	rttTimeoutFactor = 3
+	// rttSmoothingShift sets the EWMA weight of a new sample to 1/8
+	rttSmoothingShift = 3
+)
+
+// rttEstimator tracks the smoothed RTT of an upstream; it is safe for concurrent use
+type rttEstimator struct {
+	mu   sync.Mutex
+	srtt time.Duration // Zero until the first sample
+	min  time.Duration
+	max  time.Duration
+}
+
+// newRTTEstimator creates an estimator whose timeouts stay within [minTimeout, maxTimeout]
+func newRTTEstimator(minTimeout, maxTimeout time.Duration) *rttEstimator {
+	if minTimeout <= 0 {
+		minTimeout = DefaultUpstreamMinTimeout
+	}
+	if maxTimeout <= 0 {
+		maxTimeout = UpstreamTimeout
+	}
+	return &rttEstimator{min: minTimeout, max: max(minTimeout, maxTimeout)}
+}
+
+// Timeout returns the timeout for the next exchange; without samples it is the maximum
+func (e *rttEstimator) Timeout() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.srtt == 0 {
+		return e.max
+	}
+	return min(max(rttTimeoutFactor*e.srtt, e.min), e.max)
+}
+
+// SmoothedRTT returns the current RTT estimate, or zero without samples
+func (e *rttEstimator) SmoothedRTT() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt
+}
+
+// Observe folds an RTT sample into the estimate
+func (e *rttEstimator) Observe(rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.srtt == 0 {
+		e.srtt = rtt
+		return
+	}
+	e.srtt += (rtt - e.srtt) >> rttSmoothingShift
+}
+
+// Exchange runs exchange under the current timeout and feeds its outcome back into the estimate: answers contribute
+// their RTT, and timeouts contribute the timeout itself so that the estimate backs off from an upstream that slowed down
+func (e *rttEstimator) Exchange(ctx context.Context, exchange func(ctx context.Context) (*DNSMessage, error)) (*DNSMessage, error) {
+	timeout := e.Timeout()
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	response, err := exchange(attemptCtx)
+	switch {
+	case err == nil:
+		e.Observe(time.Since(start))
+	case ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded:
+		e.Observe(timeout)
+	}
+	return response, err
+}
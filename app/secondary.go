@@ -0,0 +1,517 @@
+package main
+
+/*
+This module contains secondary zones, copies of zones the server keeps by zone transfer from their primary servers
+and answers authoritatively. A zone is checked when the server starts, every refresh interval of its SOA record, and
+whenever its primary announces a change with a NOTIFY message (RFC 1996): its SOA serial is asked for first, and only
+if the serial grew is the zone transferred, incrementally (IXFR, RFC 1995) if the primary can, and in full (AXFR, RFC
+5936) otherwise. A failed check is retried every retry interval; once checks have failed for the expire interval the
+copy is too stale to answer from, and the zone is answered with SERVFAIL, as it is until its first transfer. NOTIFY
+messages are accepted from the primary's address or, for zones with a TSIG key, when signed by the key, which then also
+signs the transfers.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SecondaryTimeout bounds the exchanges with primaries, a whole transfer included
+	SecondaryTimeout = 30 * time.Second
+	// SecondaryInitialRetry is how often a zone is retried until its first transfer, before it has SOA timers
+	SecondaryInitialRetry = time.Minute
+	// secondaryMinInterval keeps SOA records with tiny timers from having the primary polled in a busy loop
+	secondaryMinInterval = 5 * time.Second
+)
+
+// SecondaryOptions configures a secondary zone
+type SecondaryOptions struct {
+	Zone    string         // Canonical and absolute
+	Primary netip.AddrPort // Server the zone is transferred from
+	Key     *TSIGKey       // Signs transfers and the primary's NOTIFY messages; nil for none
+	Catalog bool           // Whether the zone is a catalog of member zones to keep rather than one to answer
+}
+
+// SecondaryZone is a secondary zone and its copy of the records
+type SecondaryZone struct {
+	SecondaryOptions
+	copy    atomic.Pointer[secondaryCopy] // nil until the first transfer
+	expires atomic.Int64                  // Unix time in nanoseconds past which the copy is too stale to answer from
+	notify  chan struct{}                 // Signalled by NOTIFY messages
+	stop    chan struct{}                 // Closed when the zone is deprovisioned
+	zones   *SecondaryZones               // The zones the zone is one of
+	catalog *SecondaryZone                // The catalog zone the zone is a member of; nil for zones configured
+}
+
+// secondaryCopy is a version of a secondary zone
+type secondaryCopy struct {
+	soa     ResourceRecord
+	records []ResourceRecord // Every record but the SOA, as transferred
+	store   *LocalStore      // The records, the SOA included, for lookups
+}
+
+// soaFields are the numbers of an SOA record's data
+type soaFields struct {
+	serial, refresh, retry, expire, minimum uint32
+}
+
+// SecondaryZones holds the secondary zones by name; a nil SecondaryZones holds none
+type SecondaryZones struct {
+	mu    sync.RWMutex
+	zones map[string]*SecondaryZone
+}
+
+// ParseSecondary parses a zone given as "<zone> <primary>[ <key name>:<base64 secret>]", the primary being an IP
+// address with an optional port
+func ParseSecondary(line string) (SecondaryOptions, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return SecondaryOptions{}, fmt.Errorf("%q is not of the form \"<zone> <primary>[ <key name>:<secret>]\"", line)
+	}
+	opts := SecondaryOptions{Zone: CanonicalName(strings.TrimSuffix(fields[0], ".") + ".")}
+	primary, err := parseServerAddr(fields[1])
+	if err != nil {
+		return SecondaryOptions{}, err
+	}
+	opts.Primary = primary
+	if len(fields) == 3 {
+		if opts.Key, err = ParseTSIGKey(fields[2]); err != nil {
+			return SecondaryOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// parseServerAddr parses an IP address with an optional port, 53 by default
+func parseServerAddr(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%q is not an IP address with an optional port", s)
+	}
+	return addrPort, nil
+}
+
+// NewSecondaryZones creates the zones of opts, or returns nil if there are none
+func NewSecondaryZones(opts []SecondaryOptions) *SecondaryZones {
+	if len(opts) == 0 {
+		return nil
+	}
+	zones := &SecondaryZones{zones: map[string]*SecondaryZone{}}
+	for _, zone := range opts {
+		zones.zones[zone.Zone] = zones.newZone(zone, nil)
+	}
+	return zones
+}
+
+// newZone creates a zone of z, a member of catalog if that is not nil
+func (z *SecondaryZones) newZone(opts SecondaryOptions, catalog *SecondaryZone) *SecondaryZone {
+	return &SecondaryZone{SecondaryOptions: opts, notify: make(chan struct{}, 1), stop: make(chan struct{}), zones: z, catalog: catalog}
+}
+
+// Start keeps every zone up to date in the background
+func (z *SecondaryZones) Start() {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for _, zone := range z.zones {
+		go zone.maintain()
+	}
+}
+
+// Zone returns the zone named name, or nil if there is none
+func (z *SecondaryZones) Zone(name string) *SecondaryZone {
+	if z == nil {
+		return nil
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.zones[CanonicalName(strings.TrimSuffix(name, ".")+".")]
+}
+
+// Find returns the closest zone name is in, or nil if it is in none; catalog zones are not answered from, so they are
+// passed over
+func (z *SecondaryZones) Find(name string) *SecondaryZone {
+	if z == nil {
+		return nil
+	}
+	labels := splitName(CanonicalName(name))
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for i := range labels {
+		if zone, ok := z.zones[strings.Join(labels[i:], ".")+"."]; ok && !zone.Catalog {
+			return zone
+		}
+	}
+	if zone, ok := z.zones["."]; ok && !zone.Catalog {
+		return zone
+	}
+	return nil
+}
+
+// Notify has the zone check its primary for changes
+func (zone *SecondaryZone) Notify() {
+	select {
+	case zone.notify <- struct{}{}:
+	default: // A check is pending already
+	}
+}
+
+// maintain refreshes the zone at startup, every refresh interval, and on every NOTIFY, retrying failed refreshes every
+// retry interval, until the zone is deprovisioned
+func (zone *SecondaryZone) maintain() {
+	for {
+		wait := SecondaryInitialRetry
+		err := zone.refresh()
+		if current := zone.copy.Load(); current != nil {
+			timers := parseSOA(current.soa)
+			wait = time.Duration(timers.retry) * time.Second
+			if err == nil {
+				wait = time.Duration(timers.refresh) * time.Second
+				zone.expires.Store(time.Now().Add(time.Duration(timers.expire) * time.Second).UnixNano())
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to refresh secondary zone %s from %s, retrying in %s: %v\n", zone.Zone, zone.Primary, wait, err)
+		}
+		select {
+		case <-zone.notify:
+		case <-time.After(max(wait, secondaryMinInterval)):
+		case <-zone.stop:
+			return
+		}
+	}
+}
+
+// current returns the copy of the zone to answer from, or nil if there is none or it has expired
+func (zone *SecondaryZone) current() *secondaryCopy {
+	if time.Now().UnixNano() > zone.expires.Load() {
+		return nil
+	}
+	return zone.copy.Load()
+}
+
+// refresh transfers the zone if the primary's serial is newer than the copy's, or if there is no copy yet
+func (zone *SecondaryZone) refresh() error {
+	current := zone.copy.Load()
+	if current != nil {
+		serial, err := zone.primarySerial()
+		if err != nil {
+			return err
+		}
+		if !serialNewer(serial, parseSOA(current.soa).serial) {
+			debugf(ComponentForwarder, "Secondary zone %s is up to date at serial %d", zone.Zone, serial)
+			return nil
+		}
+	}
+	kind := "AXFR"
+	next, err := zone.incrementalTransfer(current)
+	if err == nil && next != nil {
+		kind = "IXFR"
+	} else {
+		if err != nil {
+			debugf(ComponentForwarder, "Incremental transfer of secondary zone %s failed, falling back to AXFR: %v", zone.Zone, err)
+		}
+		if next, err = zone.transfer(); err != nil {
+			return err
+		}
+	}
+	zone.copy.Store(next)
+	fmt.Printf("Transferred secondary zone %s at serial %d from %s by %s: %d records\n", zone.Zone, parseSOA(next.soa).serial, zone.Primary, kind, len(next.records)+1)
+	if zone.Catalog {
+		return zone.zones.provision(zone, next)
+	}
+	return nil
+}
+
+// newSecondaryCopy indexes the records of a version of the zone
+func newSecondaryCopy(soa ResourceRecord, records []ResourceRecord) (*secondaryCopy, error) {
+	store := NewLocalStore()
+	for _, record := range append([]ResourceRecord{soa}, records...) {
+		if err := store.Add(record); err != nil {
+			return nil, err
+		}
+	}
+	return &secondaryCopy{soa: soa, records: records, store: store}, nil
+}
+
+// primarySerial asks the primary for the serial of the zone
+func (zone *SecondaryZone) primarySerial() (uint32, error) {
+	var serial uint32
+	err := zone.exchange(TypeSOA, nil, func(response *DNSMessage) (bool, error) {
+		for _, record := range sectionRecords(response.Answers) {
+			if record.Type == TypeSOA {
+				serial = parseSOA(record).serial
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("the primary has no SOA record for the zone")
+	})
+	return serial, err
+}
+
+// transfer fetches the whole zone from the primary with AXFR
+func (zone *SecondaryZone) transfer() (*secondaryCopy, error) {
+	var records []ResourceRecord
+	err := zone.exchange(TypeAXFR, nil, func(response *DNSMessage) (bool, error) {
+		for _, record := range sectionRecords(response.Answers) {
+			if len(records) == 0 && record.Type != TypeSOA {
+				return false, fmt.Errorf("transfer does not start with the SOA record")
+			}
+			records = append(records, record)
+			if len(records) > 1 && record.Type == TypeSOA {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newSecondaryCopy(records[0], records[1:len(records)-1]) // The closing SOA repeats the opening one
+}
+
+// incrementalTransfer fetches the changes since the current copy from the primary with IXFR and applies them. A
+// primary without the history to answer incrementally sends the whole zone instead, as with AXFR, which is taken as it
+// is. It returns nil if there is no copy to change yet.
+func (zone *SecondaryZone) incrementalTransfer(current *secondaryCopy) (*secondaryCopy, error) {
+	if current == nil {
+		return nil, nil
+	}
+	// The answer is the new SOA, followed either by the whole zone, or by a difference sequence per version: the old
+	// SOA and the records deleted from it, the new SOA and the records added; the new SOA closes it either way
+	var newSOA ResourceRecord
+	var records []ResourceRecord
+	full, adding := false, false
+	count := 0
+	err := zone.exchange(TypeIXFR, &current.soa, func(response *DNSMessage) (bool, error) {
+		answers := sectionRecords(response.Answers)
+		for i, record := range answers {
+			count++
+			switch {
+			case count == 1:
+				if record.Type != TypeSOA {
+					return false, fmt.Errorf("transfer does not start with the SOA record")
+				}
+				newSOA = record
+				if len(answers) == 1 && !serialNewer(parseSOA(record).serial, parseSOA(current.soa).serial) {
+					return true, nil // Nothing changed after all
+				}
+			case count == 2:
+				if full = record.Type != TypeSOA; full {
+					records = append(records, record)
+				} else {
+					records = slices.Clone(current.records)
+				}
+			case record.Type == TypeSOA && (full || adding && parseSOA(record).serial == parseSOA(newSOA).serial):
+				if i != len(answers)-1 {
+					return false, fmt.Errorf("records after the closing SOA record")
+				}
+				return true, nil
+			case record.Type == TypeSOA:
+				adding = !adding
+			case full || adding:
+				records = append(records, record)
+			default:
+				records = slices.DeleteFunc(records, func(kept ResourceRecord) bool { return sameRecord(kept, record) })
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 1 {
+		return current, nil
+	}
+	return newSecondaryCopy(newSOA, records)
+}
+
+// sameRecord reports whether a and b are the same record, their TTLs aside
+func sameRecord(a, b ResourceRecord) bool {
+	return a.Type == b.Type && a.Class == b.Class && equalLabels(a.Name, b.Name) && bytes.Equal(a.Data, b.Data)
+}
+
+// exchange sends the primary a question of qType for the zone over TCP, with soa in the authority section if given,
+// and passes each response message to handle until it reports the exchange done
+func (zone *SecondaryZone) exchange(qType uint16, soa *ResourceRecord, handle func(response *DNSMessage) (bool, error)) error {
+	query, err := NewQueryMessage(uint16(rand.IntN(1<<16)), DNSQuestionOptions{Name: zone.Zone, Type: qType, Class: ClassIN})
+	if err != nil {
+		return err
+	}
+	if query.Header, err = query.Header.ModifyDNSHeader(ModifyRD(0)); err != nil {
+		return err
+	}
+	if soa != nil {
+		query.Authorities = []*DNSAnswer{{ResourceRecords: []ResourceRecord{*soa}}}
+	}
+	if zone.Key != nil {
+		if query, err = zone.Key.Sign(query, time.Now()); err != nil {
+			return err
+		}
+	}
+	wire, err := query.Encode()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", zone.Primary.String(), SecondaryTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SecondaryTimeout))
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(wire))), wire...)); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		raw, err := readStreamMessage(reader)
+		if err != nil {
+			return err
+		}
+		lazy, err := ParseLazy(raw)
+		if err != nil {
+			return err
+		}
+		response, err := lazy.Decode()
+		if err != nil {
+			return err
+		}
+		if response.Header.ID != query.Header.ID {
+			return fmt.Errorf("response ID %d does not match query ID %d", response.Header.ID, query.Header.ID)
+		}
+		if rCode := response.Header.Flags & RCodeMask >> RCodeShift; rCode != RCodeNoError {
+			return fmt.Errorf("the primary answered %s with %s", TypeString(qType), RCodeString(rCode))
+		}
+		if done, err := handle(response); done || err != nil {
+			return err
+		}
+	}
+}
+
+// parseSOA returns the numbers of an SOA record, whose names are uncompressed once decoded; they are zero if the data
+// is malformed
+func parseSOA(record ResourceRecord) soaFields {
+	_, rest, ok := wireName(record.Data) // Primary server
+	if ok {
+		_, rest, ok = wireName(rest) // Responsible mailbox
+	}
+	if !ok || len(rest) < 20 {
+		return soaFields{}
+	}
+	return soaFields{
+		serial:  binary.BigEndian.Uint32(rest),
+		refresh: binary.BigEndian.Uint32(rest[4:]),
+		retry:   binary.BigEndian.Uint32(rest[8:]),
+		expire:  binary.BigEndian.Uint32(rest[12:]),
+		minimum: binary.BigEndian.Uint32(rest[16:]),
+	}
+}
+
+// serialNewer reports whether serial a is newer than b in serial number arithmetic (RFC 1982)
+func serialNewer(a, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+// answerSecondary answers a request for a name in a secondary zone authoritatively: with the name's records, with
+// NXDOMAIN if the name does not exist, and with the zone's SOA record in the authority section if there are no records
+// to answer with, for negative caching (RFC 2308)
+func (f *Forwarder) answerSecondary(request *DNSMessage, name string) (*DNSMessage, bool) {
+	zone := f.Secondaries.Find(name)
+	if zone == nil {
+		return nil, false
+	}
+	current := zone.current()
+	if current == nil {
+		debugf(ComponentPolicy, "Secondary zone %s is not transferred yet or has expired: %s", zone.Zone, request.Questions[0])
+		header, err := responseHeader(request.Header)
+		if err == nil {
+			header, err = header.ModifyDNSHeader(ModifyRCode(RCodeServFail))
+		}
+		if err != nil {
+			return nil, false
+		}
+		return &DNSMessage{Header: header, Questions: request.Questions}, true
+	}
+	store := current.store
+	question := request.Questions[0]
+	records, _ := store.Lookup(name, question.Type, question.Class)
+	rCode := uint16(RCodeNoError)
+	if !store.Exists(name) {
+		rCode = RCodeNXDomain
+	}
+	header, err := request.Header.ModifyDNSHeader(ModifyAA(1), ModifyRCode(rCode))
+	if err != nil {
+		return nil, false
+	}
+	response := &DNSMessage{Header: header, Questions: request.Questions}
+	if len(records) > 0 {
+		response.Answers = []*DNSAnswer{{ResourceRecords: records}}
+	} else {
+		response.Authorities = []*DNSAnswer{{ResourceRecords: []ResourceRecord{current.soa}}}
+	}
+	return response, true
+}
+
+// handleNotify answers a NOTIFY message for a secondary zone, having the zone check its primary for changes if the
+// message comes from the primary; NOTIFY messages for other zones, or from anyone else, are refused
+func handleNotify(forwarder *Forwarder, query *LazyMessage, source net.Addr, maxUDPSize int) []byte {
+	message, err := query.DecodeQuery()
+	if err != nil {
+		fmt.Println("Failed to read NOTIFY message:", err)
+		return serverFailure(&DNSMessage{Header: &query.Header}, source, RCodeFormErr, ExtendedError(EDEOther, ""), UDPMessageSize)
+	}
+	limit := responseLimit(source, message, maxUDPSize)
+	name, err := LabelsToString(message.Questions[0].Name)
+	zone := forwarder.Secondaries.Zone(name)
+	if err != nil || zone == nil {
+		fmt.Printf("Refusing NOTIFY for %s from %s: not a secondary zone\n", message.Questions[0], source)
+		return serverFailure(message, source, RCodeRefused, ExtendedError(EDEOther, ""), limit)
+	}
+	var requestMAC []byte
+	if zone.Key != nil {
+		requestMAC, err = zone.Key.Verify(query.Raw, time.Now())
+	} else if peer, parseErr := netip.ParseAddrPort(source.String()); parseErr != nil || peer.Addr().Unmap() != zone.Primary.Addr().Unmap() {
+		err = fmt.Errorf("not the primary %s", zone.Primary.Addr())
+	}
+	if err != nil {
+		fmt.Printf("Refusing NOTIFY for %s from %s: %v\n", zone.Zone, source, err)
+		return serverFailure(message, source, RCodeRefused, ExtendedError(EDEOther, ""), limit)
+	}
+	debugf(ComponentPolicy, "NOTIFY for %s from %s", zone.Zone, source)
+	zone.Notify()
+	header, err := responseHeader(message.Header)
+	if err == nil {
+		header, err = header.ModifyDNSHeader(ModifyAA(1), ModifyRA(0))
+	}
+	if err != nil {
+		fmt.Println("Failed to answer NOTIFY message:", err)
+		return nil
+	}
+	response := &DNSMessage{Header: header, Questions: message.Questions}
+	if zone.Key != nil {
+		if response, err = zone.Key.SignResponse(response, requestMAC, time.Now()); err != nil {
+			fmt.Println("Failed to sign NOTIFY response:", err)
+			return nil
+		}
+	}
+	encoded, err := response.Encode()
+	if err != nil {
+		fmt.Println("Failed to encode NOTIFY response:", err)
+		return nil
+	}
+	logPacket("server -> client "+source.String(), encoded)
+	return encoded
+}
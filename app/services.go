@@ -0,0 +1,89 @@
+package main
+
+/*
+This module contains DNS-SD services (RFC 6763) defined with --service, which let clients doing unicast DNS-SD lookups
+browse the printers, media servers, and the like on the network. Each service instance becomes the records browsing
+and resolving it takes: a PTR record from the service type to the instance, the instance's SRV and TXT records, and a
+PTR record from the domain's service type enumeration name (_services._dns-sd._udp) to the service type.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ServiceTTL is the TTL of the records of configured services, as recommended for records other than host addresses
+// (RFC 6762 section 10)
+const ServiceTTL = 4500
+
+// serviceRecordSpec describes one of the records advertising a service
+type serviceRecordSpec struct {
+	name       string
+	recordType uint16
+	rdata      []string
+}
+
+// ParseServices builds the records advertising the services given as
+// "<instance> <_service._proto> <domain> <target> <port> [<key=value>...]", the instance name being quoted if it holds
+// spaces and the trailing strings making up its TXT record
+func ParseServices(lines []string) ([]ResourceRecord, error) {
+	var records []ResourceRecord
+	enumerated := map[string]bool{}
+	for _, line := range lines {
+		fields, err := tokenizeRecord(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("service %q needs an instance name, a service type, a domain, a target, and a port", line)
+		}
+		instance, serviceType, domain, target, port := fields[0], fields[1], fields[2], fields[3], fields[4]
+		if err := validateServiceType(serviceType); err != nil {
+			return nil, fmt.Errorf("service %q: %w", line, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("service %q: invalid port %q", line, port)
+		}
+		instanceLabel, err := unescapeLabel(instance)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", line, err)
+		}
+		if !strings.HasSuffix(domain, ".") {
+			domain += "."
+		}
+		domain = strings.TrimPrefix(domain, ".") // The root domain adds nothing to the names beneath it
+		typeName := serviceType + "." + domain
+		instanceName := escapeLabel(instanceLabel) + "." + typeName
+		txt := fields[5:]
+		if len(txt) == 0 {
+			txt = []string{""} // A TXT record holds at least one string, empty if there is nothing to say
+		}
+		specs := []serviceRecordSpec{
+			{typeName, TypePTR, []string{instanceName}},
+			{instanceName, TypeSRV, []string{"0", "0", port, target}},
+			{instanceName, TypeTXT, txt},
+		}
+		if !enumerated[CanonicalName(typeName)] {
+			enumerated[CanonicalName(typeName)] = true
+			specs = append(specs, serviceRecordSpec{"_services._dns-sd._udp." + domain, TypePTR, []string{typeName}})
+		}
+		for _, spec := range specs {
+			record, err := NewResourceRecord(spec.name, spec.recordType, ClassIN, ServiceTTL, spec.rdata, "")
+			if err != nil {
+				return nil, fmt.Errorf("service %q: %w", line, err)
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// validateServiceType checks that serviceType has the form _service._tcp or _service._udp (RFC 6763 section 7)
+func validateServiceType(serviceType string) error {
+	service, proto, found := strings.Cut(serviceType, ".")
+	if !found || len(service) < 2 || service[0] != '_' || (proto != "_tcp" && proto != "_udp") {
+		return fmt.Errorf("service type %q is not of the form _service._tcp or _service._udp", serviceType)
+	}
+	return nil
+}
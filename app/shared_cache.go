@@ -0,0 +1,110 @@
+package main
+
+/*
+This module contains the shared cache, a second cache level in Redis through which several instances behind a load
+balancer share the answers any of them learned. The in-memory cache stays in front of it: answers are looked up in
+Redis only on an in-memory miss, before going upstream, and answers from upstream are written to both. An unreachable
+or slow Redis only costs a miss, never an answer.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// SharedCacheSource is the source recorded for answers learned from the shared cache
+	SharedCacheSource = "shared cache"
+	// sharedCacheKeyPrefix starts the Redis keys of cached answers
+	sharedCacheKeyPrefix = "dns:"
+)
+
+// SharedCache is a cache of RRsets held in Redis; a nil SharedCache holds nothing
+type SharedCache struct {
+	client *RedisClient
+}
+
+// NewSharedCache creates a shared cache in the Redis server given as redis://[:password@]host:port[/db]
+func NewSharedCache(spec string) (*SharedCache, error) {
+	client, err := NewRedisClient(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedCache{client: client}, nil
+}
+
+// Get returns the records cached under key with their TTLs decremented by the time they have spent in the cache
+func (c *SharedCache) Get(key CacheKey) ([]ResourceRecord, bool) {
+	if c == nil {
+		return nil, false
+	}
+	reply, err := c.client.Do("GET", sharedCacheKey(key))
+	if err != nil {
+		if err != errRedisNil {
+			debugf(ComponentCache, "Shared cache lookup of %s failed: %v", key.Name, err)
+		}
+		return nil, false
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+	records, stored, err := decodeSharedEntry([]byte(value))
+	if err != nil {
+		debugf(ComponentCache, "Discarding malformed shared cache entry for %s: %v", key.Name, err)
+		return nil, false
+	}
+	records = ageRecords(records, uint32(max(time.Since(stored), 0)/time.Second))
+	if minTTL(records) == 0 {
+		return nil, false
+	}
+	return records, true
+}
+
+// Set caches records under key for ttl
+func (c *SharedCache) Set(key CacheKey, records []ResourceRecord, ttl time.Duration) {
+	if c == nil || ttl <= 0 || len(records) == 0 {
+		return
+	}
+	value, err := encodeSharedEntry(records, time.Now())
+	if err != nil {
+		debugf(ComponentCache, "Failed to encode shared cache entry for %s: %v", key.Name, err)
+		return
+	}
+	_, err = c.client.Do("SET", sharedCacheKey(key), string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		debugf(ComponentCache, "Shared cache update of %s failed: %v", key.Name, err)
+	}
+}
+
+// sharedCacheKey returns the Redis key of a cache key
+func sharedCacheKey(key CacheKey) string {
+	return fmt.Sprintf("%s%s/%d/%d", sharedCacheKeyPrefix, key.Name, key.Type, key.Class)
+}
+
+// encodeSharedEntry encodes records cached at stored as the time in milliseconds followed by a message carrying the
+// records as its answers, so that they are read back with the message decoder
+func encodeSharedEntry(records []ResourceRecord, stored time.Time) ([]byte, error) {
+	message := &DNSMessage{Header: &DNSHeader{}, Answers: []*DNSAnswer{{ResourceRecords: records}}}
+	wire, err := message.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.BigEndian.AppendUint64(nil, uint64(stored.UnixMilli())), wire...), nil
+}
+
+// decodeSharedEntry decodes an entry encoded by encodeSharedEntry
+func decodeSharedEntry(value []byte) ([]ResourceRecord, time.Time, error) {
+	if len(value) < 8 {
+		return nil, time.Time{}, fmt.Errorf("entry of %d bytes is too short", len(value))
+	}
+	stored := time.UnixMilli(int64(binary.BigEndian.Uint64(value)))
+	message := &DNSMessage{}
+	if err := message.Decode(bytes.NewReader(value[8:])); err != nil {
+		return nil, time.Time{}, err
+	}
+	return sectionRecords(message.Answers), stored, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+/*
+This module contains the deduplication of identical in-flight upstream queries: concurrent callers asking the same
+question share a single upstream exchange and all receive its result.
+*/
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightCall is an in-flight or completed upstream exchange
+type flightCall struct {
+	done     chan struct{}
+	response *DNSMessage
+	err      error
+	waiters  int // Callers that joined the exchange after it started
+}
+
+// flightGroup collapses concurrent calls with the same key into one; the zero value is ready to use
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[CacheKey]*flightCall
+}
+
+// Do calls fn for key unless a call for key is already in flight, in which case it waits for and returns that call's
+// result; shared reports whether the result was delivered to more than one caller. The returned response must be
+// treated as read-only.
+func (g *flightGroup) Do(key CacheKey, fn func() (*DNSMessage, error)) (response *DNSMessage, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[CacheKey]*flightCall{}
+	}
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		g.mu.Unlock()
+		<-call.done
+		return call.response, call.err, true
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// The call is forgotten and its waiters woken even if fn panics, which fails them and is passed on to the caller
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			call.response, call.err = nil, fmt.Errorf("upstream exchange for %s panicked: %v", key.Name, recovered)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		shared = call.waiters > 0
+		g.mu.Unlock()
+		close(call.done)
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+	call.response, call.err = fn()
+	return call.response, call.err, shared
+}
@@ -0,0 +1,278 @@
+package main
+
+/*
+This module contains strict parsing. DNSMessage.Decode is lenient wherever the server can still make sense of a
+message, and stops at the first thing it cannot; DecodeStrict instead walks the whole message checking it against the
+wire format rules of RFC 1035 and its successors, and reports every violation it finds, each with the byte offset, the
+section, and a stable rule identifier, in a form that serializes to JSON. It is meant for fuzzing harnesses, which
+compare the two parsers, and for linting captured packets.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Violation is a breach of the wire format found by strict parsing
+type Violation struct {
+	Offset  int    `json:"offset"`  // Byte offset into the message
+	Section string `json:"section"` // "header", a section name, or "trailer"
+	Rule    string `json:"rule"`    // Stable identifier of the rule broken, such as "name-too-long"
+	Detail  string `json:"detail"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("offset %d (%s): %s: %s", v.Offset, v.Section, v.Rule, v.Detail)
+}
+
+// ParseReport is the error of a strict decode, listing the violations in the order of their offsets
+type ParseReport struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (r *ParseReport) Error() string {
+	lines := make([]string, len(r.Violations))
+	for i, violation := range r.Violations {
+		lines[i] = violation.String()
+	}
+	return fmt.Sprintf("%d wire format violations: %s", len(r.Violations), strings.Join(lines, "; "))
+}
+
+// strictParser walks a message, collecting violations
+type strictParser struct {
+	raw        []byte
+	section    string
+	violations []Violation
+}
+
+// DecodeStrict decodes raw only if it breaks no wire format rule, and otherwise returns a *ParseReport of every
+// violation found
+func DecodeStrict(raw []byte) (*DNSMessage, error) {
+	p := &strictParser{raw: raw}
+	p.walk()
+	if len(p.violations) > 0 {
+		return nil, &ParseReport{Violations: p.violations}
+	}
+	lazy, err := ParseLazy(raw)
+	if err != nil {
+		return nil, err
+	}
+	return lazy.Decode()
+}
+
+// report records a violation at offset in the current section
+func (p *strictParser) report(offset int, rule, format string, args ...any) {
+	p.violations = append(p.violations, Violation{Offset: offset, Section: p.section, Rule: rule, Detail: fmt.Sprintf(format, args...)})
+}
+
+// walk checks the header and every section; it stops early only where the message is cut short, as nothing after that
+// point can be located
+func (p *strictParser) walk() {
+	p.section = "header"
+	if len(p.raw) < DNSHeaderSize {
+		p.report(len(p.raw), "truncated", "message of %d bytes is shorter than a header", len(p.raw))
+		return
+	}
+	flags := binary.BigEndian.Uint16(p.raw[2:])
+	counts := [sectionEnd]uint16{}
+	for i := range counts {
+		counts[i] = binary.BigEndian.Uint16(p.raw[4+2*i:])
+	}
+	p.checkHeader(flags, counts[SectionQuestion])
+	offset := DNSHeaderSize
+	seen := map[uint16]bool{} // Meta-records already seen, which may appear once per message
+	for section, count := range counts {
+		p.section = sectionNames[section]
+		for i := 0; i < int(count); i++ {
+			var ok bool
+			if section == SectionQuestion {
+				offset, ok = p.question(offset)
+			} else {
+				offset, ok = p.record(offset, section, i == int(count)-1, seen)
+			}
+			if !ok {
+				return
+			}
+		}
+	}
+	if offset < len(p.raw) {
+		p.section = "trailer"
+		p.report(offset, "trailing-data", "%d bytes after the last section", len(p.raw)-offset)
+	}
+}
+
+// checkHeader checks the flags and the question count
+func (p *strictParser) checkHeader(flags, qdCount uint16) {
+	response := flags&QRMask != 0
+	opCode := flags & OpCodeMask >> OpCodeShift
+	if flags&(4<<ZShift) != 0 {
+		p.report(3, "z-bit-set", "the reserved Z bit must be zero")
+	}
+	if opCode == 3 || opCode > 6 { // 6 is DSO (RFC 8490)
+		p.report(2, "opcode-unassigned", "opcode %d is unassigned", opCode)
+	}
+	if !response && flags&RCodeMask != 0 {
+		p.report(3, "rcode-in-query", "query has RCODE %s", RCodeString(flags&RCodeMask>>RCodeShift))
+	}
+	if !response && flags&AAMask != 0 {
+		p.report(2, "aa-in-query", "the AA bit is only meaningful in responses")
+	}
+	if opCode == OpCodeQuery && qdCount > 1 { // RFC 9619
+		p.report(4, "qdcount-above-one", "standard query with %d questions", qdCount)
+	}
+}
+
+// question checks a question and returns the offset past it
+func (p *strictParser) question(offset int) (int, bool) {
+	offset, ok := p.name(offset, true)
+	if !ok {
+		return 0, false
+	}
+	if offset+4 > len(p.raw) {
+		p.report(offset, "truncated", "question ends inside its type and class")
+		return 0, false
+	}
+	if qType := binary.BigEndian.Uint16(p.raw[offset:]); qType == 0 {
+		p.report(offset, "type-reserved", "type 0 is reserved")
+	}
+	if class := binary.BigEndian.Uint16(p.raw[offset+2:]); class == 0 || class == 0xFFFF {
+		p.report(offset+2, "class-reserved", "class %d is reserved", class)
+	}
+	return offset + 4, true
+}
+
+// record checks a resource record and returns the offset past it; last is whether it ends its section, and seen the
+// meta-record types met so far
+func (p *strictParser) record(offset, section int, last bool, seen map[uint16]bool) (int, bool) {
+	start := offset
+	offset, ok := p.name(offset, true)
+	if !ok {
+		return 0, false
+	}
+	if offset+10 > len(p.raw) {
+		p.report(offset, "truncated", "record ends inside its fixed fields")
+		return 0, false
+	}
+	rrType := binary.BigEndian.Uint16(p.raw[offset:])
+	ttl := binary.BigEndian.Uint32(p.raw[offset+4:])
+	length := int(binary.BigEndian.Uint16(p.raw[offset+8:]))
+	data := offset + 10
+	if data+length > len(p.raw) {
+		p.report(offset+8, "rdlength-overrun", "RDLENGTH %d runs %d bytes past the end of the message", length, data+length-len(p.raw))
+		return 0, false
+	}
+	switch {
+	case rrType == 0:
+		p.report(offset, "type-reserved", "type 0 is reserved")
+	case TypeIXFR <= rrType && rrType <= TypeANY:
+		p.report(offset, "qtype-in-record", "%s is a query type, not a record type", TypeString(rrType))
+	}
+	if rrType == TypeOPT || rrType == TypeTSIG {
+		if section != SectionAdditional {
+			p.report(offset, "meta-outside-additional", "%s record outside the additional section", TypeString(rrType))
+		}
+		if seen[rrType] {
+			p.report(offset, "meta-duplicate", "more than one %s record", TypeString(rrType))
+		}
+		seen[rrType] = true
+	}
+	switch {
+	case rrType == TypeOPT && p.raw[start] != 0:
+		p.report(start, "opt-owner-not-root", "OPT record owned by a name other than the root")
+	case rrType == TypeTSIG && !last:
+		p.report(start, "tsig-not-last", "TSIG record is not the last record of the message")
+	case rrType != TypeOPT && ttl&(1<<31) != 0: // RFC 2181 section 8; the OPT TTL holds flags instead
+		p.report(offset+4, "ttl-high-bit", "TTL %d has its most significant bit set", ttl)
+	}
+	p.rdata(rrType, data, length)
+	return data + length, true
+}
+
+// rdata checks the data of the record types whose layout the server knows
+func (p *strictParser) rdata(rrType uint16, start, length int) {
+	end := start + length
+	fixed := map[uint16]int{TypeA: 4, TypeAAAA: 16}
+	if size, ok := fixed[rrType]; ok && length != size {
+		p.report(start, "rdata-length", "%s data of %d bytes, expected %d", TypeString(rrType), length, size)
+		return
+	}
+	layout, ok := rdataLayouts[rrType]
+	if !ok {
+		return
+	}
+	offset := start + layout.prefix
+	for range layout.names {
+		if offset >= end {
+			p.report(start, "rdata-length", "%s data of %d bytes is too short", TypeString(rrType), length)
+			return
+		}
+		next, ok := p.nameWithin(offset, end, layout.compressed)
+		if !ok {
+			return
+		}
+		offset = next
+	}
+	if offset += layout.suffix; offset != end {
+		p.report(start, "rdata-length", "%s data of %d bytes does not match its fields, which take %d", TypeString(rrType), length, offset-start)
+	}
+}
+
+// name checks the name at offset and returns the offset past it
+func (p *strictParser) name(offset int, compressible bool) (int, bool) {
+	return p.nameWithin(offset, len(p.raw), compressible)
+}
+
+// nameWithin checks the name at offset, which must end before end, following its compression pointers, and returns
+// the offset past it; compressible is whether pointers are allowed at all
+func (p *strictParser) nameWithin(offset, end int, compressible bool) (int, bool) {
+	start, past, length := offset, 0, 0
+	for {
+		if offset >= end {
+			if past == 0 {
+				p.report(start, "truncated", "name runs past the end of its data")
+				return 0, false
+			}
+			p.report(start, "pointer-out-of-range", "name continues past the end of the message")
+			return past, true
+		}
+		b := p.raw[offset]
+		switch {
+		case b == 0:
+			if length+1 > MaxNameLength {
+				p.report(start, "name-too-long", "name of %d bytes, the limit is %d", length+1, MaxNameLength)
+			}
+			if past == 0 {
+				past = offset + 1
+			}
+			return past, true
+		case b >= 0xC0:
+			if offset+2 > end {
+				p.report(offset, "truncated", "compression pointer cut short")
+				return 0, false
+			}
+			target := int(binary.BigEndian.Uint16(p.raw[offset:]) & 0x3FFF)
+			if past == 0 {
+				past = offset + 2
+				if !compressible {
+					p.report(offset, "compression-forbidden", "compressed name in data of a type that forbids it")
+				}
+			}
+			// Pointers must go strictly backwards, which also rules out loops
+			if target >= offset {
+				p.report(offset, "pointer-forward", "compression pointer to offset %d, which is not before it", target)
+				return past, true
+			}
+			offset, end = target, len(p.raw)
+		case b > MaxLabelLength:
+			p.report(offset, "label-type-reserved", "label type 0x%02x is reserved or obsolete (RFC 6891 section 5)", b&0xC0)
+			if past == 0 {
+				return 0, false // The name's extent is unknown
+			}
+			return past, true
+		default:
+			length += 1 + int(b)
+			offset += 1 + int(b)
+		}
+	}
+}
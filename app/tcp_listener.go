@@ -0,0 +1,80 @@
+package main
+
+/*
+This module contains the client-facing TCP listener (RFC 7766). Each connection carries length-prefixed messages; the
+queries on a connection are handled concurrently, up to a limit, and their responses written back in completion order,
+which clients match by message ID. Idle connections are closed after a timeout.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxStreamMessageSize is the largest message a two-byte length prefix can frame
+	MaxStreamMessageSize = 65535
+	// DefaultTCPIdleTimeout is how long a client connection may stay without a query before it is closed
+	DefaultTCPIdleTimeout = 10 * time.Second
+	// tcpMaxInFlight bounds the queries of one connection that are handled at once
+	tcpMaxInFlight = 16
+)
+
+// serveTCP accepts client connections until the listener is closed, answering each query with handle; a nil response
+// leaves the query unanswered
+func serveTCP(listener net.Listener, handle func(message []byte, source net.Addr) []byte, idleTimeout time.Duration) {
+	failures := 0 // Consecutive accept errors
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Accepting fails transiently, e.g. with EMFILE while file descriptors are exhausted
+			failures++
+			fmt.Println("Failed to accept client connection:", err)
+			time.Sleep(listenerBackoff(failures))
+			continue
+		}
+		failures = 0
+		go serveTCPConn(conn, handle, idleTimeout)
+	}
+}
+
+// serveTCPConn answers the queries of one client connection until it is closed or idles out
+func serveTCPConn(conn net.Conn, handle func(message []byte, source net.Addr) []byte, idleTimeout time.Duration) {
+	defer conn.Close()
+	var writeMu sync.Mutex
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	inFlight := make(chan struct{}, tcpMaxInFlight)
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		message, err := readStreamMessage(reader)
+		if err != nil {
+			return // Closed by the client, idle, or broken; nothing can be answered
+		}
+		inFlight <- struct{}{}
+		handlers.Add(1)
+		go func() {
+			defer func() { <-inFlight; handlers.Done() }()
+			response := handle(message, conn.RemoteAddr())
+			if response == nil {
+				return
+			}
+			framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(response)), uint16(len(response)))
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			if _, err := conn.Write(append(framed, response...)); err != nil {
+				fmt.Printf("Failed to send client response to %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
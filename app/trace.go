@@ -0,0 +1,60 @@
+package main
+
+/*
+This module contains the "trace" subcommand, the counterpart of "dig +trace": it resolves a name iteratively from the
+root name servers and prints the records each server returned, which server was consulted, and how long it took.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// runTrace implements the "trace" subcommand
+func runTrace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	roots := flags.String("roots", "", "Comma-separated IP addresses to start from instead of the root name servers")
+	port := flags.Int("port", 53, "Port every name server is queried on")
+	timeout := flags.Duration("timeout", DefaultIterationTimeout, "Bound of every exchange")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: trace [flags] <name> [type]")
+	}
+	question := DNSQuestionOptions{Name: flags.Arg(0), Type: TypeA, Class: ClassIN}
+	if !strings.HasSuffix(question.Name, ".") {
+		question.Name += "."
+	}
+	if flags.NArg() == 2 {
+		var err error
+		if question.Type, err = ParseRecordType(flags.Arg(1)); err != nil {
+			return err
+		}
+	}
+	iterator := &Iterator{Port: *port, Timeout: *timeout, OnStep: printTraceStep}
+	for _, root := range splitList(*roots) {
+		iterator.Roots = append(iterator.Roots, NameServer{Name: root, Addrs: []string{root}})
+	}
+	_, err := iterator.Resolve(question)
+	return err
+}
+
+// printTraceStep prints the records of one exchange followed by where they came from
+func printTraceStep(step IterationStep) {
+	if step.Err != nil {
+		fmt.Printf(";; %s %s for zone %s: no response from %s(%s): %v\n\n",
+			strings.TrimSuffix(step.Question.Name, "."), TypeString(step.Question.Type), step.Zone, step.Addr, step.Server, step.Err)
+		return
+	}
+	for _, section := range [][]*DNSAnswer{step.Response.Answers, step.Response.Authorities} {
+		for _, answer := range section {
+			for _, record := range answer.ResourceRecords {
+				fmt.Println(strings.Replace(FormatRecord(record), " ", "\t", 4))
+			}
+		}
+	}
+	rCode := step.Response.Header.Flags & RCodeMask >> RCodeShift
+	fmt.Printf(";; %s %s for zone %s: %s from %s(%s) in %d ms\n\n",
+		strings.TrimSuffix(step.Question.Name, "."), TypeString(step.Question.Type), step.Zone, RCodeString(rCode),
+		step.Addr, step.Server, step.RTT.Milliseconds())
+}
@@ -0,0 +1,189 @@
+package main
+
+/*
+This module contains TSIG (RFC 8945), with which messages are signed by a key shared with the server they are sent
+to, as servers accepting dynamic updates usually require. Only HMAC-SHA256 is implemented. Keys are given as
+"<name>:<base64 secret>", the form BIND's tsig-keygen prints them in, minus the algorithm.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// TSIGAlgorithm is the name of the only TSIG algorithm implemented
+	TSIGAlgorithm = "hmac-sha256."
+	// TSIGFudge is the number of seconds by which the clocks of the signer and the server may differ
+	TSIGFudge = 300
+)
+
+// TSIGKey is a key shared with a server for signing messages to it
+type TSIGKey struct {
+	Name   string
+	Secret []byte
+}
+
+// ParseTSIGKey parses a key given as "<name>:<base64 secret>"
+func ParseTSIGKey(spec string) (*TSIGKey, error) {
+	name, secret, found := strings.Cut(spec, ":")
+	if !found || name == "" {
+		return nil, fmt.Errorf("TSIG key %q is not of the form <name>:<base64 secret>", spec)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret of TSIG key %s: %w", name, err)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return &TSIGKey{Name: name, Secret: decoded}, nil
+}
+
+// Sign returns a copy of message with a TSIG record signing it appended to its additional section; the message must
+// not be modified afterwards, as servers check the signature against the bytes they receive
+func (key *TSIGKey) Sign(message *DNSMessage, now time.Time) (*DNSMessage, error) {
+	return key.sign(message, now, nil)
+}
+
+// SignResponse signs a response like Sign, chaining the signature to the MAC of the request it answers as RFC 8945
+// section 5.3 requires
+func (key *TSIGKey) SignResponse(message *DNSMessage, requestMAC []byte, now time.Time) (*DNSMessage, error) {
+	return key.sign(message, now, requestMAC)
+}
+
+// sign signs message, prefixing the MAC input with requestMAC unless it is nil
+func (key *TSIGKey) sign(message *DNSMessage, now time.Time, requestMAC []byte) (*DNSMessage, error) {
+	wire, err := message.Encode()
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := nameToWire(TSIGAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	signed := uint64(now.Unix())
+	digest, err := key.mac(requestMAC, wire, signed, TSIGFudge)
+	if err != nil {
+		return nil, err
+	}
+	data := append(append([]byte(nil), algorithm...), tsigTimers(signed, TSIGFudge)...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(digest)))
+	data = append(data, digest...)
+	data = binary.BigEndian.AppendUint16(data, message.Header.ID) // Original ID
+	data = binary.BigEndian.AppendUint16(data, 0)                 // Error
+	data = binary.BigEndian.AppendUint16(data, 0)                 // Other data length
+	name, err := StringToLabels(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	record := ResourceRecord{Name: name, Type: TypeTSIG, Class: ClassANY, Length: uint16(len(data)), Data: data}
+	signedMessage := *message
+	signedMessage.Additionals = append(append([]*DNSAnswer(nil), message.Additionals...), &DNSAnswer{ResourceRecords: []ResourceRecord{record}})
+	return &signedMessage, nil
+}
+
+// Verify checks that a received message is signed by the key, with a TSIG record that is the last of its additional
+// section, and returns the signature's MAC, which the response to the message is signed with. Signatures with errors
+// or other data, which only responses carry, are not accepted.
+func (key *TSIGKey) Verify(raw []byte, now time.Time) ([]byte, error) {
+	message, err := ParseLazy(raw)
+	if err != nil {
+		return nil, err
+	}
+	if message.Header.ARCount == 0 {
+		return nil, fmt.Errorf("message is not signed")
+	}
+	if _, err := message.SectionBytes(SectionAdditional); err != nil {
+		return nil, err
+	}
+	offset := message.offsets[SectionAdditional]
+	for range message.Header.ARCount - 1 {
+		if offset, err = skipName(raw, offset); err != nil {
+			return nil, err
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(raw[offset+8:])) // Located before, so known to be in bounds
+	}
+	buf := bytes.NewReader(raw)
+	buf.Seek(int64(offset), io.SeekStart)
+	var record ResourceRecord
+	if err := record.Decode(buf); err != nil {
+		return nil, err
+	}
+	name, err := LabelsToString(record.Name)
+	if err != nil || record.Type != TypeTSIG {
+		return nil, fmt.Errorf("message is not signed")
+	}
+	if !EqualNames(strings.TrimSuffix(name, ".")+".", key.Name) {
+		return nil, fmt.Errorf("message is signed with key %s, not %s", name, key.Name)
+	}
+	algorithm, data, ok := wireName(record.Data)
+	if !ok || !EqualNames(strings.TrimSuffix(algorithm, ".")+".", TSIGAlgorithm) {
+		return nil, fmt.Errorf("message is not signed with %s", TSIGAlgorithm)
+	}
+	if len(data) < 10 {
+		return nil, fmt.Errorf("truncated TSIG record")
+	}
+	signed := uint64(data[0])<<40 | uint64(data[1])<<32 | uint64(binary.BigEndian.Uint32(data[2:]))
+	fudge := binary.BigEndian.Uint16(data[6:])
+	macSize := int(binary.BigEndian.Uint16(data[8:]))
+	if len(data) != 10+macSize+6 || binary.BigEndian.Uint16(data[10+macSize+2:]) != 0 || binary.BigEndian.Uint16(data[10+macSize+4:]) != 0 {
+		return nil, fmt.Errorf("malformed TSIG record")
+	}
+	received := data[10 : 10+macSize]
+	// The MAC covers the message as it was before the TSIG record was added: without it, and with the original ID
+	unsigned := append([]byte(nil), raw[:offset]...)
+	copy(unsigned, data[10+macSize:10+macSize+2])
+	binary.BigEndian.PutUint16(unsigned[10:], message.Header.ARCount-1)
+	expected, err := key.mac(nil, unsigned, signed, fudge)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(received, expected) {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if skew := now.Unix() - int64(signed); skew > int64(fudge) || -skew > int64(fudge) {
+		return nil, fmt.Errorf("signature time is %ds off, more than the fudge of %ds", skew, fudge)
+	}
+	return received, nil
+}
+
+// mac computes the MAC over a message and the TSIG variables (RFC 8945 section 4.3.3), preceded by the MAC of the
+// request if the message is a response to a signed one
+func (key *TSIGKey) mac(requestMAC, wire []byte, signed uint64, fudge uint16) ([]byte, error) {
+	keyName, err := nameToWire(CanonicalName(key.Name))
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := nameToWire(TSIGAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	if requestMAC != nil {
+		binary.Write(mac, binary.BigEndian, uint16(len(requestMAC)))
+		mac.Write(requestMAC)
+	}
+	mac.Write(wire)
+	mac.Write(keyName)
+	binary.Write(mac, binary.BigEndian, uint16(ClassANY))
+	binary.Write(mac, binary.BigEndian, uint32(0)) // TTL
+	mac.Write(algorithm)
+	mac.Write(tsigTimers(signed, fudge))
+	binary.Write(mac, binary.BigEndian, [2]uint16{0, 0}) // Error and other data length
+	return mac.Sum(nil), nil
+}
+
+// tsigTimers encodes the time signed, a 48-bit count of seconds, and the fudge, which the signed variables and the
+// record have in common
+func tsigTimers(signed uint64, fudge uint16) []byte {
+	timers := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+	return binary.BigEndian.AppendUint16(timers, fudge)
+}
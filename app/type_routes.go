@@ -0,0 +1,79 @@
+package main
+
+/*
+This module contains routing by query type: questions of the types given with --route-type are forwarded to an
+upstream of their own instead of --resolver (reverse lookups to the router that knows the LAN's names, say), or are
+refused instead of being forwarded at all (ANY, whose answers make for amplification attacks). Routed answers are
+cached like any other, the type being part of the cache key, and refreshed through the same route.
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TypeRouteBlock is the route refusing the questions of a type
+const TypeRouteBlock = "block"
+
+// TypeRoute routes the questions of a type
+type TypeRoute struct {
+	Type uint16
+	Spec string // Upstream, in the form of --resolver, or TypeRouteBlock
+}
+
+// TypeRoutes holds the routes of query types
+type TypeRoutes struct {
+	upstreams map[uint16]Upstream
+	blocked   map[uint16]bool
+}
+
+// ParseTypeRoute parses a route given as "<type> <upstream>" or "<type> block"
+func ParseTypeRoute(line string) (TypeRoute, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return TypeRoute{}, fmt.Errorf("%q is not of the form \"<type> <upstream>\" or \"<type> %s\"", line, TypeRouteBlock)
+	}
+	recordType, err := ParseRecordType(fields[0])
+	if err != nil {
+		return TypeRoute{}, err
+	}
+	return TypeRoute{Type: recordType, Spec: fields[1]}, nil
+}
+
+// NewTypeRoutes sets up routes, connecting to their upstreams with opts, or returns nil if there are none
+func NewTypeRoutes(routes []TypeRoute, opts UpstreamOptions) (*TypeRoutes, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	r := &TypeRoutes{upstreams: map[uint16]Upstream{}, blocked: map[uint16]bool{}}
+	for _, route := range routes {
+		if r.blocked[route.Type] || r.upstreams[route.Type] != nil {
+			return nil, fmt.Errorf("type %s is routed twice", TypeString(route.Type))
+		}
+		if route.Spec == TypeRouteBlock {
+			r.blocked[route.Type] = true
+			continue
+		}
+		upstream, err := NewUpstream(route.Spec, opts)
+		if err != nil {
+			return nil, fmt.Errorf("route of %s: %w", TypeString(route.Type), err)
+		}
+		r.upstreams[route.Type] = upstream
+	}
+	return r, nil
+}
+
+// Route returns the upstream questions of qType are forwarded to, fallback unless they are routed, and whether they
+// are blocked instead
+func (r *TypeRoutes) Route(qType uint16, fallback Upstream) (upstream Upstream, blocked bool) {
+	if r == nil {
+		return fallback, false
+	}
+	if r.blocked[qType] {
+		return nil, true
+	}
+	if upstream, ok := r.upstreams[qType]; ok {
+		return upstream, false
+	}
+	return fallback, false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"net/netip"
 )
 
 /*
@@ -22,9 +23,16 @@ type Serializable interface {
 }
 
 type DNSMessage struct {
-	Header    *DNSHeader
-	Questions []*DNSQuestion
-	Answers   []*DNSAnswer
+	Header      *DNSHeader
+	Questions   []*DNSQuestion
+	Answers     []*DNSAnswer
+	Authorities []*DNSAnswer
+	Additionals []*DNSAnswer
+	// PreserveCounts makes Encode emit the header section counts as-is instead of deriving them from the
+	// section slices; it exists for deliberately malformed messages (e.g. in testing)
+	PreserveCounts bool
+	// Client is the network a query came from, for answers that depend on it; it is not part of the wire format
+	Client netip.Prefix
 }
 
 // DNSHeaderModifications can be passed to ModifyDNSHeader to optionally change the header fields
@@ -33,6 +41,12 @@ type DNSHeaderModification func(*DNSHeader) error
 // DNSQuestionModifications can be passed to ModifyDNSQuestion to optionally change the question fields
 type DNSQuestionModification func(*DNSQuestion) error
 
+// DNSModification constrains the modifications accepted by applyModifications to functions mutating a T, so that
+// passing a modification for the wrong part of a message is a compile-time error
+type DNSModification[T any] interface {
+	~func(*T) error
+}
+
 // DNSHeaderOptions represents the options for creating a new DNS header
 type DNSHeaderOptions struct {
 	ID      uint16
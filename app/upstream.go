@@ -0,0 +1,333 @@
+package main
+
+/*
+This module contains the transports used to exchange queries with downstream resolvers. UDP upstreams use one socket
+per exchange, and retry over TCP when the response comes back truncated; TCP upstreams pipeline every outstanding query
+over a shared connection. Either way, responses are only accepted by the query matching their ID, question, and source
+address.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamTimeout is the default upper bound of how long an exchange with an upstream may take
+const UpstreamTimeout = 5 * time.Second
+
+// Upstream exchanges single-question queries with a downstream resolver
+type Upstream interface {
+	// Exchange sends query and waits for its response until the exchange times out or ctx is cancelled
+	Exchange(ctx context.Context, query *DNSMessage) (*DNSMessage, error)
+	String() string
+}
+
+// UpstreamOptions represents the options for creating a new Upstream
+type UpstreamOptions struct {
+	IdleTimeout time.Duration     // How long an unused stream connection stays open
+	MaxStreams  int               // Maximum outstanding queries per stream connection
+	MaxConns    int               // Maximum stream connections per upstream
+	MinTimeout  time.Duration     // Lower bound of the adaptive exchange timeout
+	MaxTimeout  time.Duration     // Upper bound of the adaptive exchange timeout, used until the RTT is known
+	Bootstrap   string            // Resolver for upstream host names as ip:port; empty for the system resolver
+	Latency     []time.Duration   // Delay injected into the exchanges of each upstream in order; one value applies to all
+	Jitter      time.Duration     // Upper bound of a random delay injected on top of Latency
+	JitterSeed  uint64            // Seed of the jitter, for reproducible delays; 0 picks a random one
+	RootCAs     *x509.CertPool    // Authorities TLS upstreams are verified against; nil for the system trust store
+	ClientCert  []tls.Certificate // Presented to TLS upstreams that ask for a client certificate
+}
+
+// LoadUpstreamTLS loads the authorities in the PEM bundle caFile on top of the system trust store, and the client
+// certificate in certFile with its key in keyFile; empty files leave the respective defaults
+func LoadUpstreamTLS(caFile, certFile, keyFile string) (*x509.CertPool, []tls.Certificate, error) {
+	var roots *x509.CertPool
+	if caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if roots, err = x509.SystemCertPool(); err != nil {
+			roots = x509.NewCertPool() // No system trust store to extend, as on some minimal containers
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile == "" {
+		return roots, nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roots, []tls.Certificate{certificate}, nil
+}
+
+// NewUpstream creates an upstream from a spec of the form [udp://|tcp://|tls://]host:port[#tls-server-name], where the
+// host is an IP address or a name resolved through the bootstrap resolver
+func NewUpstream(spec string, opts UpstreamOptions) (Upstream, error) {
+	scheme, address, found := strings.Cut(spec, "://")
+	if !found {
+		scheme, address = "udp", spec
+	}
+	address, serverName, _ := strings.Cut(address, "#")
+	if scheme != "udp" && scheme != "tcp" && scheme != "tls" {
+		return nil, fmt.Errorf("unsupported upstream transport %q in %q", scheme, spec)
+	}
+	addr, err := newUpstreamAddress(address, opts.Bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "udp" {
+		return &udpUpstream{
+			addr:    addr,
+			name:    address,
+			rtt:     newRTTEstimator(opts.MinTimeout, opts.MaxTimeout),
+			latency: newLatencyInjector(opts),
+			tcp:     newStreamUpstream("tcp", address, addr, nil, opts),
+		}, nil
+	}
+	var tlsConfig *tls.Config
+	if scheme == "tls" {
+		if serverName == "" {
+			serverName = addr.host // Certificates are issued for the host name, or for the IP address if given one
+		}
+		tlsConfig = &tls.Config{ServerName: serverName, RootCAs: opts.RootCAs, Certificates: opts.ClientCert}
+	}
+	return newStreamUpstream(scheme, address, addr, tlsConfig, opts), nil
+}
+
+// udpUpstream exchanges queries over UDP
+type udpUpstream struct {
+	addr    *upstreamAddress
+	name    string // Address as configured
+	rtt     *rttEstimator
+	latency *latencyInjector // Nil unless latency is injected
+	tcp     *streamUpstream  // The same server over TCP, which truncated responses are retried on
+}
+
+// Exchange sends query over a fresh UDP socket and waits for the response within the adaptive timeout; a truncated
+// response is not returned, the query being retried over TCP for the complete one instead (RFC 7766 section 5)
+func (u *udpUpstream) Exchange(ctx context.Context, query *DNSMessage) (*DNSMessage, error) {
+	addr, err := net.ResolveUDPAddr("udp", u.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	response, err := u.rtt.Exchange(ctx, func(ctx context.Context) (*DNSMessage, error) {
+		if err := u.latency.Wait(ctx); err != nil {
+			return nil, err
+		}
+		responses, err := DNSServerHandler(ctx, addr, []*DNSMessage{query})
+		if err != nil {
+			return nil, err
+		}
+		return responses[0], nil
+	})
+	if err != nil || response.Header.Flags&TCMask == 0 {
+		return response, err
+	}
+	debugf(ComponentForwarder, "Truncated response from %s, retrying over TCP: %s", u, query.Questions[0])
+	return u.tcp.Exchange(ctx, query)
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.name
+}
+
+// streamUpstream pipelines queries over pooled TCP or TLS connections
+type streamUpstream struct {
+	scheme  string
+	name    string // Address as configured
+	pool    *connPool
+	rtt     *rttEstimator
+	latency *latencyInjector // Nil unless latency is injected
+}
+
+// newStreamUpstream creates an upstream exchanging queries over pooled connections to addr, secured with tlsConfig
+// unless it is nil
+func newStreamUpstream(scheme, name string, addr *upstreamAddress, tlsConfig *tls.Config, opts UpstreamOptions) *streamUpstream {
+	return &streamUpstream{
+		scheme:  scheme,
+		name:    name,
+		pool:    newConnPool(addr, tlsConfig, opts),
+		rtt:     newRTTEstimator(opts.MinTimeout, opts.MaxTimeout),
+		latency: newLatencyInjector(opts),
+	}
+}
+
+// Exchange sends query on a pooled connection and waits for the response carrying its ID within the adaptive timeout
+func (u *streamUpstream) Exchange(ctx context.Context, query *DNSMessage) (*DNSMessage, error) {
+	conn, release, err := u.pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return u.rtt.Exchange(ctx, func(ctx context.Context) (*DNSMessage, error) {
+		if err := u.latency.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return conn.Exchange(ctx, query, u.rtt.max)
+	})
+}
+
+func (u *streamUpstream) String() string {
+	return u.scheme + "://" + u.name
+}
+
+// pipelinedConn multiplexes concurrent exchanges over one stream connection using the message ID and question
+type pipelinedConn struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	pending  *pendingTable
+	err      error     // Set once the connection is broken
+	streams  int       // Exchanges currently assigned by the pool; guarded by the pool lock
+	lastUsed time.Time // When the last exchange was released; guarded by the pool lock
+}
+
+// newPipelinedConn wraps conn and starts demultiplexing its responses
+func newPipelinedConn(conn net.Conn) *pipelinedConn {
+	p := &pipelinedConn{conn: conn, pending: newPendingTable()}
+	go p.readLoop()
+	return p
+}
+
+// Broken reports whether the connection has failed and must be replaced
+func (p *pipelinedConn) Broken() bool {
+	return p.failure() != nil
+}
+
+// failure returns the error that broke the connection, if any
+func (p *pipelinedConn) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Exchange writes query under a connection-unique ID and waits up to timeout for the matching response, which is
+// returned with the caller's original ID; on cancellation the ID is released and a late response is discarded
+func (p *pipelinedConn) Exchange(ctx context.Context, query *DNSMessage, timeout time.Duration) (*DNSMessage, error) {
+	wireQuery := *query
+	key, responseCh, err := p.register(&wireQuery)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := wireQuery.Encode()
+	if err != nil {
+		p.pending.Cancel(key, responseCh)
+		return nil, err
+	}
+	if err := p.write(encoded); err != nil {
+		p.pending.Cancel(key, responseCh)
+		return nil, err
+	}
+	response, err := p.pending.Await(ctx, key, responseCh, timeout, func() error {
+		return fmt.Errorf("connection to %s failed: %w", p.conn.RemoteAddr(), p.failure())
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Header.ID = query.Header.ID
+	return response, nil
+}
+
+// register gives query a message ID that no other pending query uses on the connection, and registers it as pending
+func (p *pipelinedConn) register(query *DNSMessage) (pendingKey, chan *DNSMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return pendingKey{}, nil, p.err
+	}
+	if p.pending.Len() >= 1<<16 {
+		return pendingKey{}, nil, fmt.Errorf("no free message IDs on connection to %s", p.conn.RemoteAddr())
+	}
+	key := pendingKeyOf(query, p.conn.RemoteAddr().String())
+	key.id = uint16(rand.IntN(1 << 16))
+	for p.pending.Taken(key) {
+		key.id++
+	}
+	header, err := query.Header.ModifyDNSHeader(ModifyID(key.id))
+	if err != nil {
+		return pendingKey{}, nil, err
+	}
+	responseCh, err := p.pending.Register(key)
+	if err != nil {
+		return pendingKey{}, nil, err
+	}
+	query.Header = header
+	return key, responseCh, nil
+}
+
+// write sends a length-prefixed message
+func (p *pipelinedConn) write(message []byte) error {
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+	logPacket("server -> upstream "+p.conn.RemoteAddr().String(), message)
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(UpstreamTimeout))
+	if _, err := p.conn.Write(framed); err != nil {
+		p.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop delivers each response to the exchange waiting on its ID and question, discarding unsolicited ones
+func (p *pipelinedConn) readLoop() {
+	reader := bufio.NewReader(p.conn)
+	for {
+		message, err := readStreamMessage(reader)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		logPacket("upstream "+p.conn.RemoteAddr().String()+" -> server", message)
+		response := &DNSMessage{}
+		if err := response.Decode(bytes.NewReader(message)); err != nil {
+			fmt.Printf("Discarding undecodable response from %s: %v\n", p.conn.RemoteAddr(), err)
+			continue
+		}
+		if !p.pending.Deliver(response, p.conn.RemoteAddr().String()) {
+			fmt.Printf("Discarding unsolicited response with ID %d from %s\n", response.Header.ID, p.conn.RemoteAddr())
+		}
+	}
+}
+
+// fail marks the connection broken and wakes every pending exchange
+func (p *pipelinedConn) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	p.conn.Close()
+	p.pending.Fail()
+}
+
+// readStreamMessage reads one length-prefixed DNS message from a stream
+func readStreamMessage(reader io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
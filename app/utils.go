@@ -2,50 +2,186 @@ package main
 
 import (
 	"bytes"
-	"flag"
+	"context"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"strings"
+	"time"
 )
 
 // Convert a string into a list of DNSLabels
+//   - The root domain is written "." (or ""), and is only the "Null" label; no other label may be empty.
+//   - Labels may escape any character as \X and any byte as \DDD (RFC 4343), so an escaped dot does not split labels.
 func StringToLabels(name string) ([]DNSLabel, error) {
 	labels := []DNSLabel{}
-	for _, label := range strings.Split(name, ".") {
-		content := []byte(label)
+	wireLength := 1 // The "Null" label
+	for _, label := range splitName(name) {
+		content, err := unescapeLabel(label)
+		if err != nil {
+			return nil, err
+		}
 		length := len(content)
-		if length > 255 {
-			return nil, fmt.Errorf("label %s is too long", label)
+		if length == 0 {
+			return nil, fmt.Errorf("name %q has an empty label", name)
 		}
+		if length > MaxLabelLength {
+			return nil, fmt.Errorf("label %s is longer than %d bytes", label, MaxLabelLength)
+		}
+		wireLength += 1 + length
 		labels = append(labels, DNSLabel{Length: uint8(length), Content: content})
 	}
+	if wireLength > MaxNameLength {
+		return nil, fmt.Errorf("name %q is longer than %d bytes", name, MaxNameLength)
+	}
+	// Names given without a trailing dot still end in the "Null" label on the wire
+	labels = append(labels, DNSLabel{Length: 0, Content: []byte{}})
 	return labels, nil
 }
 
 // Convert a list of DNSLabels into a string
+//   - The root domain, which is only the "Null" label, is written ".".
+//   - Dots, backslashes, and the characters special in zone files are escaped as \X, and bytes that are not printable
+//     ASCII as \DDD, so that the name reads back unchanged.
 func LabelsToString(labels []DNSLabel) (string, error) {
 	parts := []string{}
 	for _, label := range labels {
-		parts = append(parts, string(label.Content))
+		parts = append(parts, escapeLabel(label.Content))
+	}
+	if name := strings.Join(parts, "."); name != "" {
+		return name, nil
+	}
+	return ".", nil
+}
+
+// splitName splits a presentation-format name at its unescaped dots, leaving the labels escaped; neither the root
+// name nor the trailing dot of other names yields a label
+func splitName(name string) []string {
+	if name == "." {
+		return nil
+	}
+	var labels []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++ // The escaped character cannot end the label
+		case '.':
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(name) {
+		labels = append(labels, name[start:])
+	}
+	return labels
+}
+
+// escapeLabel returns the presentation format of a label's content
+func escapeLabel(content []byte) string {
+	return escapePresentation(content, '!', `.\"();@$`)
+}
+
+// escapeText returns the presentation format of a character-string's content, to be enclosed in quotes
+func escapeText(content []byte) string {
+	return escapePresentation(content, ' ', `\"`)
+}
+
+// escapePresentation escapes the bytes of content in special as \X and those outside lowest to '~' as \DDD
+func escapePresentation(content []byte, lowest byte, special string) string {
+	escaped := func(c byte) bool { return c < lowest || c > '~' || strings.IndexByte(special, c) >= 0 }
+	plain := true
+	for _, c := range content {
+		plain = plain && !escaped(c)
+	}
+	if plain {
+		return string(content)
+	}
+	var presentation strings.Builder
+	for _, c := range content {
+		switch {
+		case !escaped(c):
+			presentation.WriteByte(c)
+		case c < lowest || c > '~':
+			fmt.Fprintf(&presentation, "\\%03d", c)
+		default:
+			presentation.WriteByte('\\')
+			presentation.WriteByte(c)
+		}
+	}
+	return presentation.String()
+}
+
+// unescapeLabel returns the content of a label, or of a character-string, in presentation format
+func unescapeLabel(label string) ([]byte, error) {
+	if strings.IndexByte(label, '\\') < 0 {
+		return []byte(label), nil
 	}
-	return strings.Join(parts, "."), nil
+	content := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' {
+			content = append(content, label[i])
+			continue
+		}
+		switch {
+		case i+1 >= len(label):
+			return nil, fmt.Errorf("label %q ends in a lone backslash", label)
+		case isDigit(label[i+1]):
+			if i+3 >= len(label) || !isDigit(label[i+2]) || !isDigit(label[i+3]) {
+				return nil, fmt.Errorf("label %q has an escape that is not \\DDD", label)
+			}
+			value := int(label[i+1]-'0')*100 + int(label[i+2]-'0')*10 + int(label[i+3]-'0')
+			if value > 255 {
+				return nil, fmt.Errorf("label %q escapes %d, which is not a byte", label, value)
+			}
+			content = append(content, byte(value))
+			i += 3
+		default:
+			content = append(content, label[i+1])
+			i++
+		}
+	}
+	return content, nil
+}
+
+// isDigit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
 }
 
+// internedLabels holds shared storage for labels that appear in most names; their contents must never be mutated
+var internedLabels = func() map[string][]byte {
+	interned := map[string][]byte{}
+	for _, label := range []string{"com", "net", "org", "www", "io", "de", "uk", "co", "arpa", "in-addr", "ip6", "cdn", "api", "mail"} {
+		interned[label] = []byte(label)
+	}
+	return interned
+}()
+
 // Convert a byte slice into a list of DNSLabels (with a "Null" label last); consumes all bytes in the input slice
+//   - The label slice is sized by a pre-scan and all label contents share one allocation, except for common labels,
+//     which share interned storage across names; label contents must therefore be treated as read-only.
 func BytesToLabels(data []byte) ([]DNSLabel, error) {
-	labels := []DNSLabel{}
-	buf := bytes.NewReader(data)
-	for buf.Len() > 0 {
-		length, err := buf.ReadByte()
-		if err != nil {
-			return nil, err
+	count := 0
+	for i := 0; i < len(data); i += int(data[i]) + 1 {
+		count++
+	}
+	labels := make([]DNSLabel, 0, count)
+	contents := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		length := data[i]
+		i++
+		if i+int(length) > len(data) {
+			return nil, io.ErrUnexpectedEOF
 		}
-		content := make([]byte, length)
-		if length > 0 {
-			if _, err := buf.Read(content); err != nil {
-				return nil, err
-			}
+		raw := data[i : i+int(length)]
+		i += int(length)
+		content, ok := internedLabels[string(raw)] // Map lookups with a converted key do not allocate
+		if !ok {
+			start := len(contents)
+			contents = append(contents, raw...)
+			content = contents[start:len(contents):len(contents)]
 		}
 		labels = append(labels, DNSLabel{Length: length, Content: content})
 	}
@@ -53,12 +189,22 @@ func BytesToLabels(data []byte) ([]DNSLabel, error) {
 }
 
 // ReadQName consumes bytes until a NULL byte or pointer is encountered to recover the uncompressed bytes of a DNS name
-// - If a NULL byte is encountered, it is included in the result.
-// - If a pointer is encountered, it recursively resolves and appends the pointed data.
+//   - If a NULL byte is encountered, it is included in the result.
+//   - If a pointer is encountered, it recursively resolves and appends the pointed data.
+//   - Pointers must point strictly before the start of the name, or of the pointed-to data they are part of; encoders
+//     only ever point back to names already written, and the rule rules out pointer loops.
+//   - Names expanding to more than MaxNameLength bytes are rejected as soon as they exceed it, so that chains of
+//     pointers cannot inflate a small packet.
 func ReadQName(buf *bytes.Reader) ([]byte, error) {
+	return readQName(buf, buf.Size()-int64(buf.Len()), MaxNameLength)
+}
+
+// readQName is ReadQName for a name, or pointed-to part of one, starting at offset start and allowed to expand to at
+// most budget bytes
+func readQName(buf *bytes.Reader, start int64, budget int) ([]byte, error) {
 	var result []byte
 	for {
-		// Read the next byte
+		// Read the next length byte
 		b, err := buf.ReadByte()
 		if err != nil {
 			return nil, err
@@ -67,6 +213,9 @@ func ReadQName(buf *bytes.Reader) ([]byte, error) {
 		// Handle NULL byte (0x00)
 		case b == 0x00:
 			result = append(result, b) // Include the NULL byte
+			if len(result) > budget {
+				return nil, fmt.Errorf("name is longer than %d bytes", MaxNameLength)
+			}
 			return result, nil
 		// Handle pointer (first octect will be 0xC0-0xFF)
 		case b >= 0xC0:
@@ -76,49 +225,52 @@ func ReadQName(buf *bytes.Reader) ([]byte, error) {
 			}
 			offset := uint16(b&0x3F)<<8 | uint16(next)  // Extract the offset from the pointer
 			currentPos := buf.Size() - int64(buf.Len()) // Current position
-			buf.Seek(int64(offset), io.SeekStart)       // Move to the pointer offset
-			pointedData, err := ReadQName(buf)          // Recursively resolve the pointer
+			if debugging(ComponentCodec) {
+				debugf(ComponentCodec, "Compression pointer at offset %d refers to offset %d", currentPos-2, offset)
+			}
+			if int64(offset) >= start {
+				return nil, fmt.Errorf("compression pointer at offset %d refers to offset %d, which is not before its name", currentPos-2, offset)
+			}
+			buf.Seek(int64(offset), io.SeekStart)                                 // Move to the pointer offset
+			pointedData, err := readQName(buf, int64(offset), budget-len(result)) // Recursively resolve the pointer
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, pointedData...)
 			buf.Seek(currentPos, io.SeekStart) // Move back to the original position
 			return result, nil
+		case b > MaxLabelLength:
+			return nil, fmt.Errorf("invalid label length %d", b) // Extended label types are not supported
+		// Handle a label, whose content may hold any byte
 		default:
+			if len(result)+1+int(b) > budget {
+				return nil, fmt.Errorf("name is longer than %d bytes", MaxNameLength)
+			}
 			result = append(result, b)
+			result = append(result, make([]byte, b)...)
+			if _, err := io.ReadFull(buf, result[len(result)-int(b):]); err != nil {
+				return nil, err
+			}
 		}
 	}
 }
 
-// Captures input to --resolver flag
-func parseResolverFlag() (*net.UDPAddr, error) {
-	resolverFlag := flag.String("resolver", "", "The resolver address in the form ip:port")
-	flag.Parse()
-	if *resolverFlag == "" {
-		return nil, fmt.Errorf("please provide a resolver address with --resolver flag")
-	}
-	resolverAddr, err := net.ResolveUDPAddr("udp", *resolverFlag)
-	if err != nil {
-		return nil, err
-	}
-	return resolverAddr, nil
-}
-
 // Breaks a DNSMessage containing potentially multiple questions into a slice of individual DNSMessages
 //   - The input message must have an empty DNSAnswer, which is replicated across ouput messages.
 func (m *DNSMessage) SplitDNSMessage() []*DNSMessage {
 	messages := make([]*DNSMessage, m.Header.QDCount)
 	for i := uint16(0); i < m.Header.QDCount; i++ {
-		newMessage := DNSMessage{Header: &DNSHeader{}, Questions: []*DNSQuestion{m.Questions[i]}, Answers: m.Answers}
+		newMessage := DNSMessage{Header: &DNSHeader{}, Questions: []*DNSQuestion{m.Questions[i]}, Answers: m.Answers, Client: m.Client}
 		*newMessage.Header = *m.Header
 		newMessage.Header.ModifyDNSHeader(ModifyQDCount(1))
+		newMessage.Header.Flags &^= AAMask // Answers reusing the request header must not claim authority
 		messages[i] = &newMessage
 	}
 	return messages
 }
 
 // Handles responses from downstream server for given set of requestMessages
-func DNSServerHandler(downstreamAddr *net.UDPAddr, requestMessages []*DNSMessage) ([]*DNSMessage, error) {
+func DNSServerHandler(ctx context.Context, downstreamAddr *net.UDPAddr, requestMessages []*DNSMessage) ([]*DNSMessage, error) {
 	var downstreamResponses []*DNSMessage
 	for _, requestMessage := range requestMessages {
 		// Dial DNS server via UDP
@@ -127,17 +279,24 @@ func DNSServerHandler(downstreamAddr *net.UDPAddr, requestMessages []*DNSMessage
 			return nil, err
 		}
 		defer resolverConn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			resolverConn.SetDeadline(deadline)
+		} else {
+			resolverConn.SetDeadline(time.Now().Add(UpstreamTimeout))
+		}
+		// Cancelling the context expires the deadline, which unblocks the pending read or write
+		stop := context.AfterFunc(ctx, func() { resolverConn.SetDeadline(time.Now()) })
+		defer stop()
 
-		// Modify the client response header
-		requestMessage.Header, err = requestMessage.Header.ModifyDNSHeader(
-			ModifyQDCount(1), // Sending only singleton questions to downstream server
-		)
+		// Send request to downstream resolver under a random ID of its own, so that clients cannot choose the ID the
+		// response is matched on (RFC 5452 section 9.2); Encode derives its counts, so the rest is sent as is
+		header, err := requestMessage.Header.ModifyDNSHeader(ModifyID(uint16(rand.IntN(1 << 16))))
 		if err != nil {
 			return nil, err
 		}
-
-		// Send request to downstream resolver
-		request, err := requestMessage.Encode()
+		upstreamMessage := *requestMessage
+		upstreamMessage.Header = header
+		request, err := upstreamMessage.Encode()
 		if err != nil {
 			return nil, err
 		}
@@ -145,21 +304,41 @@ func DNSServerHandler(downstreamAddr *net.UDPAddr, requestMessages []*DNSMessage
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("Sent %d bytes to downstream server: %v\n", len(request), request)
+		logPacket("server -> upstream udp://"+downstreamAddr.String(), request)
 
 		// Read and process downstream server message
-		downstreamMessage := &DNSMessage{}
-		downstreamBytes := make([]byte, 512)
-		size, err := resolverConn.Read(downstreamBytes)
+		downstreamMessage, err := readMatchingResponse(resolverConn, &upstreamMessage)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("Received %d bytes from downstream server: %v\n", size, downstreamBytes[:size])
-		buf := bytes.NewReader(downstreamBytes[:size])
-		if err = downstreamMessage.Decode(buf); err != nil {
-			return nil, err
-		}
+		downstreamMessage.Header.ID = requestMessage.Header.ID
 		downstreamResponses = append(downstreamResponses, downstreamMessage)
 	}
 	return downstreamResponses, nil
 }
+
+// readMatchingResponse reads from a socket connected to the upstream until the response to query arrives, discarding
+// undecodable datagrams and responses to other queries, until the socket's deadline passes
+func readMatchingResponse(resolverConn *net.UDPConn, query *DNSMessage) (*DNSMessage, error) {
+	upstream := resolverConn.RemoteAddr().String()
+	expected := pendingKeyOf(query, upstream)
+	downstreamBytes := getBuffer()
+	defer putBuffer(downstreamBytes)
+	for {
+		size, err := resolverConn.Read(*downstreamBytes)
+		if err != nil {
+			return nil, err
+		}
+		logPacket("upstream udp://"+upstream+" -> server", (*downstreamBytes)[:size])
+		downstreamMessage := &DNSMessage{}
+		if err := downstreamMessage.Decode(bytes.NewReader((*downstreamBytes)[:size])); err != nil {
+			fmt.Printf("Discarding undecodable response from %s: %v\n", upstream, err)
+			continue
+		}
+		if !expected.Matches(pendingKeyOf(downstreamMessage, upstream)) {
+			fmt.Printf("Discarding unsolicited response with ID %d from %s\n", downstreamMessage.Header.ID, upstream)
+			continue
+		}
+		return downstreamMessage, nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadQNameErrors(t *testing.T) {
+	header := make([]byte, DNSHeaderSize)
+	label := append([]byte{MaxLabelLength}, bytes.Repeat([]byte{'a'}, MaxLabelLength)...)
+	long := bytes.Repeat(label, 3) // 192 bytes, leaving room for one more short label
+	withLabel := func(length int) []byte {
+		return append(append(append([]byte{}, long...), byte(length)), bytes.Repeat([]byte{'a'}, length)...)
+	}
+	tests := []struct {
+		name    string
+		message []byte // Appended to a header, with the name read from the end of the header
+		want    string // Substring of the error, or "" for the io error in wantIO
+		wantIO  error
+	}{
+		{"pointer to itself", []byte{0xC0, 12}, "not before its name", nil},
+		// The name at 12 points to the one at 14, which points back to 12
+		{"pointer loop", []byte{0xC0, 14, 0xC0, 12}, "not before its name", nil},
+		{"forward pointer", []byte{0xC0, 20, 0, 0, 0, 0, 0, 0, 1, 'a', 0}, "not before its name", nil},
+		{"pointer past the end", []byte{0xC0, 0xFF}, "not before its name", nil},
+		{"longest name", append(withLabel(61), 0), "", nil},
+		{"overflow by a label", append(withLabel(63), 0), "longer than 255 bytes", nil},
+		{"overflow by the terminator", append(withLabel(62), 0), "longer than 255 bytes", nil},
+		{"label type 0x40", []byte{0x41, 'a', 0}, "invalid label length 65", nil},
+		{"label type 0x80", []byte{0x81, 'a', 0}, "invalid label length 129", nil},
+		{"truncated label", []byte{5, 'a', 'b'}, "", io.ErrUnexpectedEOF},
+		{"missing terminator", []byte{1, 'a'}, "", io.EOF},
+		{"truncated pointer", []byte{0xC0}, "", io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewReader(append(append([]byte{}, header...), test.message...))
+			buf.Seek(DNSHeaderSize, io.SeekStart)
+			_, err := ReadQName(buf)
+			switch {
+			case test.want == "" && test.wantIO == nil:
+				if err != nil {
+					t.Fatalf("ReadQName() = %v, want no error", err)
+				}
+			case test.wantIO != nil:
+				if !errors.Is(err, test.wantIO) {
+					t.Fatalf("ReadQName() = %v, want %v", err, test.wantIO)
+				}
+			case err == nil || !strings.Contains(err.Error(), test.want):
+				t.Fatalf("ReadQName() = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRootName(t *testing.T) {
+	for _, name := range []string{".", ""} {
+		labels, err := StringToLabels(name)
+		if err != nil || len(labels) != 1 || labels[0].Length != 0 {
+			t.Fatalf("StringToLabels(%q) = %v, %v, want only the null label", name, labels, err)
+		}
+		if got, err := LabelsToString(labels); got != "." || err != nil {
+			t.Fatalf("LabelsToString(StringToLabels(%q)) = %q, %v, want \".\"", name, got, err)
+		}
+	}
+	question, err := NewDNSQuestion(DNSQuestionOptions{Name: ".", Type: TypeNS, Class: ClassIN})
+	if err != nil {
+		t.Fatalf("NewDNSQuestion() = %v", err)
+	}
+	query := &DNSMessage{Header: &DNSHeader{ID: 1, Flags: 1 << RDShift}, Questions: []*DNSQuestion{question}}
+	raw, err := query.Encode()
+	if err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+	if want := []byte{0, 0, byte(TypeNS), 0, byte(ClassIN)}; !bytes.Equal(raw[DNSHeaderSize:], want) {
+		t.Fatalf("encoded question = %x, want %x", raw[DNSHeaderSize:], want)
+	}
+	decoded := &DNSMessage{}
+	if err := decoded.Decode(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("Decode() = %v", err)
+	}
+	if len(decoded.Questions) != 1 || decoded.Questions[0].Type != TypeNS {
+		t.Fatalf("decoded questions = %v, want one NS question", decoded.Questions)
+	}
+	if name, err := LabelsToString(decoded.Questions[0].Name); name != "." || err != nil {
+		t.Fatalf("decoded question name = %q, %v, want \".\"", name, err)
+	}
+}
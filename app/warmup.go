@@ -0,0 +1,74 @@
+package main
+
+/*
+This module contains the cache warm-up, which resolves a seed list of popular names in the background at startup so
+that the cache is populated before real clients arrive.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmupConcurrency bounds how many seed names are resolved at once, to avoid flooding the upstream after a restart
+const WarmupConcurrency = 8
+
+// LoadQuestionFile reads a list of questions holding one name per line, optionally followed by a record type (A by
+// default), as used by warm-up seed lists and benchmark query files; '#' starts a comment
+func LoadQuestionFile(path string) ([]CacheKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var keys []CacheKey
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name, err := ToASCIIName(strings.ToLower(strings.TrimSuffix(fields[0], ".")) + ".")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		key := CacheKey{Name: name, Type: TypeA, Class: ClassIN}
+		if len(fields) > 1 {
+			if key.Type, err = ParseRecordType(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// Warm resolves keys through the upstream and caches the answers, logging failures without giving up on the rest
+func (f *Forwarder) Warm(keys []CacheKey) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+	semaphore := make(chan struct{}, WarmupConcurrency)
+	for _, key := range keys {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := f.Refresh(key); err != nil {
+				fmt.Printf("Failed to warm %s: %v\n", key.Name, err)
+				mu.Lock()
+				failures++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("Warmed cache with %d of %d names in %s\n", len(keys)-failures, len(keys), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,132 @@
+package main
+
+/*
+This module contains the "watch" subcommand, which polls a name through a resolver and reports how its answer changes
+over time: values that appear or disappear, changes of the RCODE, and TTLs that were reset rather than counting down,
+which shows when caches along the way picked up a new copy during a migration.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// watchTTLSlack is how much a TTL may exceed its expected countdown before it counts as reset, absorbing rounding
+const watchTTLSlack = 1
+
+// watchedValue is a value of the watched RRset as of the last poll
+type watchedValue struct {
+	ttl  uint32
+	seen time.Time
+}
+
+// runWatch implements the "watch" subcommand
+func runWatch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	server := flags.String("server", DefaultQueryServer, "Resolver to poll in the form [udp://|tcp://|tls://]ip:port")
+	interval := flags.Duration("interval", 30*time.Second, "Time between polls")
+	count := flags.Int("count", 0, "Number of polls before exiting (0 polls forever)")
+	flags.Parse(reorderFlags(flags, args))
+	if flags.NArg() < 1 || flags.NArg() > 2 || *interval <= 0 {
+		return fmt.Errorf("usage: watch <name> [type] [--server ip:port] [--interval 30s] [--count n]")
+	}
+	question := DNSQuestionOptions{Name: flags.Arg(0), Type: TypeA, Class: ClassIN}
+	if flags.NArg() == 2 {
+		var err error
+		if question.Type, err = ParseRecordType(flags.Arg(1)); err != nil {
+			return err
+		}
+	}
+	client, err := NewClient(*server)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Watching %s %s via %s every %s\n", question.Name, TypeString(question.Type), *server, *interval)
+	previous := map[string]watchedValue{}
+	previousRCode := ""
+	for poll := 1; *count == 0 || poll <= *count; poll++ {
+		if poll > 1 {
+			time.Sleep(*interval)
+		}
+		now := time.Now()
+		stamp := now.Format(time.RFC3339)
+		response, _, err := client.Query(question)
+		if err != nil {
+			fmt.Printf("%s ! %v\n", stamp, err)
+			continue
+		}
+		if rCode := RCodeString(response.Header.Flags & RCodeMask >> RCodeShift); rCode != previousRCode {
+			fmt.Printf("%s status %s\n", stamp, rCode)
+			previousRCode = rCode
+		}
+		current := map[string]watchedValue{}
+		for _, answer := range response.Answers {
+			for _, record := range answer.ResourceRecords {
+				if record.Type == question.Type {
+					current[FormatRData(record.Type, record.Data)] = watchedValue{ttl: record.TTL, seen: now}
+				}
+			}
+		}
+		for _, value := range sortedValues(current) {
+			seen := current[value]
+			last, known := previous[value]
+			switch {
+			case !known:
+				fmt.Printf("%s + %s (ttl %d)\n", stamp, value, seen.ttl)
+			case seen.ttl > expectedTTL(last, now)+watchTTLSlack:
+				fmt.Printf("%s ~ %s ttl reset from %d to %d\n", stamp, value, expectedTTL(last, now), seen.ttl)
+			}
+		}
+		for _, value := range sortedValues(previous) {
+			if _, ok := current[value]; !ok {
+				fmt.Printf("%s - %s\n", stamp, value)
+			}
+		}
+		previous = current
+	}
+	return nil
+}
+
+// sortedValues returns the values of an RRset in order, so that changes print in a stable order
+func sortedValues(values map[string]watchedValue) []string {
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	slices.Sort(sorted)
+	return sorted
+}
+
+// expectedTTL is the TTL a value would have at now had it kept counting down since it was last seen
+func expectedTTL(last watchedValue, now time.Time) uint32 {
+	elapsed := uint32(now.Sub(last.seen) / time.Second)
+	return last.ttl - min(last.ttl, elapsed)
+}
+
+// reorderFlags moves the flags in args in front of the positional arguments, which the flag package otherwise stops at
+func reorderFlags(flags *flag.FlagSet, args []string) []string {
+	var flagArgs, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		flagArgs = append(flagArgs, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := flags.Lookup(name); f != nil && i+1 < len(args) {
+			if boolean, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolean.IsBoolFlag() {
+				flagArgs = append(flagArgs, args[i+1])
+				i++
+			}
+		}
+	}
+	return append(flagArgs, positional...)
+}
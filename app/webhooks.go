@@ -0,0 +1,193 @@
+package main
+
+/*
+This module contains webhooks, which let external automation react to DNS activity. Each webhook is a URL and the
+events it subscribes to; client queries matching them are collected and POSTed to the URL as one JSON payload per batch
+interval, so that a burst of queries costs a single request. The events are:
+
+  - blocked: a query answered from the blocklist
+  - nxdomain: a query answered with NXDOMAIN
+  - nxdomain-spike=<n>: at least n queries answered with NXDOMAIN within one batch interval, reported once per interval
+  - name=<domain>: a query for domain or a name beneath it
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWebhookInterval is how often collected events are sent by default
+	DefaultWebhookInterval = 10 * time.Second
+	// WebhookMaxBatch bounds the events collected per webhook and interval; further events are only counted
+	WebhookMaxBatch = 1000
+)
+
+// webhooks receives every client query if set; it is set once at startup, before any packet is handled
+var webhooks *Webhooks
+
+// WebhookOptions configures a webhook
+type WebhookOptions struct {
+	URL          string
+	Blocked      bool
+	NXDomain     bool
+	SpikeMinimum int      // Number of NXDOMAIN answers within an interval reported as a spike; zero disables it
+	Names        []string // Domains whose queries are reported
+}
+
+// WebhookEvent is an event in a webhook payload
+type WebhookEvent struct {
+	Event string         `json:"event"`
+	Query *QueryLogEntry `json:"query,omitempty"`
+	Count int            `json:"count,omitempty"` // NXDOMAIN answers within the interval, for spikes
+}
+
+// WebhookPayload is the body POSTed to a webhook
+type WebhookPayload struct {
+	Time    time.Time      `json:"time"`
+	Events  []WebhookEvent `json:"events"`
+	Dropped int            `json:"dropped,omitempty"` // Events beyond WebhookMaxBatch, not included
+}
+
+// Webhooks collects the events of every configured webhook and sends them every interval; it is safe for concurrent use
+type Webhooks struct {
+	hooks   []*webhook
+	blocked func(name string) bool
+	client  http.Client
+}
+
+// webhook is a configured webhook and the events collected for it since the last batch
+type webhook struct {
+	WebhookOptions
+	mu        sync.Mutex
+	events    []WebhookEvent
+	dropped   int
+	nxDomains int
+}
+
+// ParseWebhook parses a webhook given as "<url> <event>[,<event>...]"
+func ParseWebhook(spec string) (WebhookOptions, error) {
+	url, events, found := strings.Cut(strings.TrimSpace(spec), " ")
+	if !found || !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return WebhookOptions{}, fmt.Errorf("webhook %q is not of the form \"<http(s) url> <event>[,<event>...]\"", spec)
+	}
+	opts := WebhookOptions{URL: url}
+	for _, event := range strings.Split(strings.TrimSpace(events), ",") {
+		kind, argument, _ := strings.Cut(strings.TrimSpace(event), "=")
+		switch kind {
+		case "blocked":
+			opts.Blocked = true
+		case "nxdomain":
+			opts.NXDomain = true
+		case "nxdomain-spike":
+			minimum, err := strconv.Atoi(argument)
+			if err != nil || minimum <= 0 {
+				return WebhookOptions{}, fmt.Errorf("webhook %q: nxdomain-spike needs a positive count, got %q", spec, argument)
+			}
+			opts.SpikeMinimum = minimum
+		case "name":
+			if argument == "" {
+				return WebhookOptions{}, fmt.Errorf("webhook %q: name needs a domain", spec)
+			}
+			if !strings.HasSuffix(argument, ".") {
+				argument += "."
+			}
+			opts.Names = append(opts.Names, argument)
+		default:
+			return WebhookOptions{}, fmt.Errorf("webhook %q: unknown event %q", spec, kind)
+		}
+	}
+	return opts, nil
+}
+
+// StartWebhooks starts sending the events of the configured webhooks every interval; blocked reports whether a name
+// is blocked
+func StartWebhooks(options []WebhookOptions, interval time.Duration, blocked func(name string) bool) *Webhooks {
+	if interval <= 0 {
+		interval = DefaultWebhookInterval
+	}
+	w := &Webhooks{blocked: blocked, client: http.Client{Timeout: UpstreamTimeout}}
+	for _, opts := range options {
+		w.hooks = append(w.hooks, &webhook{WebhookOptions: opts})
+	}
+	go func() {
+		for range time.Tick(interval) {
+			for _, hook := range w.hooks {
+				w.send(hook)
+			}
+		}
+	}()
+	return w
+}
+
+// Notify collects the events a client query triggers
+func (w *Webhooks) Notify(entry QueryLogEntry) {
+	nxDomain := entry.RCode == RCodeString(RCodeNXDomain)
+	blocked, checked := false, false // The blocklist is only consulted if some webhook subscribes to blocked queries
+	for _, hook := range w.hooks {
+		if hook.Blocked && !checked {
+			blocked, checked = w.blocked(entry.Name), true
+		}
+		var events []string
+		if hook.Blocked && blocked {
+			events = append(events, "blocked")
+		}
+		if hook.NXDomain && nxDomain {
+			events = append(events, "nxdomain")
+		}
+		for _, domain := range hook.Names {
+			if isSubdomain(entry.Name, domain) {
+				events = append(events, "name")
+				break
+			}
+		}
+		if len(events) == 0 && !(hook.SpikeMinimum > 0 && nxDomain) {
+			continue
+		}
+		hook.mu.Lock()
+		if nxDomain {
+			hook.nxDomains++
+		}
+		for _, event := range events {
+			if len(hook.events) >= WebhookMaxBatch {
+				hook.dropped++
+				continue
+			}
+			hook.events = append(hook.events, WebhookEvent{Event: event, Query: &entry})
+		}
+		hook.mu.Unlock()
+	}
+}
+
+// send POSTs the events collected for a webhook, if any; failed batches are logged and discarded
+func (w *Webhooks) send(hook *webhook) {
+	hook.mu.Lock()
+	payload := WebhookPayload{Time: time.Now().UTC(), Events: hook.events, Dropped: hook.dropped}
+	if hook.SpikeMinimum > 0 && hook.nxDomains >= hook.SpikeMinimum {
+		payload.Events = append(payload.Events, WebhookEvent{Event: "nxdomain-spike", Count: hook.nxDomains})
+	}
+	hook.events, hook.dropped, hook.nxDomains = nil, 0, 0
+	hook.mu.Unlock()
+	if len(payload.Events) == 0 && payload.Dropped == 0 {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	response, err := w.client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Failed to send %d events to webhook %s: %v\n", len(payload.Events), hook.URL, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		fmt.Printf("Webhook %s rejected %d events with %s\n", hook.URL, len(payload.Events), response.Status)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+This module contains the worker pool that handles client packets. Each worker owns a bounded queue that the event loop
+fills round-robin; when the chosen queue is full the packet is either dropped, so the server sheds load it cannot keep
+up with, or the event loop waits, pushing back into the socket's receive buffer.
+*/
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// workersPerProc is the default number of workers per GOMAXPROCS; workers mostly wait on upstreams, so there are
+	// many more of them than CPUs
+	workersPerProc = 64
+	// DefaultWorkerQueueDepth is the default number of packets each worker may have waiting
+	DefaultWorkerQueueDepth = 64
+	// OverloadDrop drops packets that find their worker's queue full
+	OverloadDrop = "drop"
+	// OverloadQueue makes the event loop wait until the worker's queue has room
+	OverloadQueue = "queue"
+)
+
+// WorkerPoolOptions represents the options for creating a new WorkerPool
+type WorkerPoolOptions struct {
+	Workers    int
+	QueueDepth int
+	Overload   string // OverloadDrop or OverloadQueue
+}
+
+// WorkerPool runs a fixed set of workers handling client packets
+type WorkerPool struct {
+	queues  []chan packet
+	next    int // Queue the next packet goes to; only used by the submitting goroutine
+	drop    bool
+	dropped atomic.Uint64
+	workers sync.WaitGroup
+}
+
+// DefaultWorkers returns the default worker count derived from GOMAXPROCS
+func DefaultWorkers() int {
+	return workersPerProc * runtime.GOMAXPROCS(0)
+}
+
+// NewWorkerPool starts the workers, each calling handle for the packets queued to it and releasing their buffers
+func NewWorkerPool(opts WorkerPoolOptions, handle func(p packet)) (*WorkerPool, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers()
+	}
+	if opts.QueueDepth <= 0 {
+		opts.QueueDepth = DefaultWorkerQueueDepth
+	}
+	if opts.Overload != OverloadDrop && opts.Overload != OverloadQueue {
+		return nil, fmt.Errorf("unknown overload behavior %q, expected %q or %q", opts.Overload, OverloadDrop, OverloadQueue)
+	}
+	pool := &WorkerPool{queues: make([]chan packet, opts.Workers), drop: opts.Overload == OverloadDrop}
+	for i := range pool.queues {
+		queue := make(chan packet, opts.QueueDepth)
+		pool.queues[i] = queue
+		pool.workers.Add(1)
+		go func() {
+			defer pool.workers.Done()
+			for p := range queue {
+				handle(p)
+				putBuffer(p.Buffer)
+			}
+		}()
+	}
+	return pool, nil
+}
+
+// Submit hands a packet to the next worker, dropping it or waiting if that worker's queue is full; it must not be
+// called concurrently
+func (pool *WorkerPool) Submit(p packet) {
+	queue := pool.queues[pool.next]
+	pool.next = (pool.next + 1) % len(pool.queues)
+	if !pool.drop {
+		queue <- p
+		return
+	}
+	select {
+	case queue <- p:
+	default:
+		putBuffer(p.Buffer)
+		if dropped := pool.dropped.Add(1); dropped&(dropped-1) == 0 {
+			fmt.Printf("Workers overloaded, %d packets dropped so far\n", dropped) // Logged at powers of two
+		}
+	}
+}
+
+// Close stops the workers and waits for them to drain their queues
+func (pool *WorkerPool) Close() {
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+	pool.workers.Wait()
+}
@@ -0,0 +1,235 @@
+package main
+
+/*
+This module contains the master file parser (RFC 1035 section 5). On top of the single-line record syntax it handles
+the $ORIGIN, $TTL, and $INCLUDE directives, records spanning lines in parentheses, and owners omitted to repeat the
+previous one. Every record keeps the line it was read from so that problems can be reported precisely.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxZoneIncludeDepth bounds nested $INCLUDE directives, which could otherwise include each other forever
+const maxZoneIncludeDepth = 8
+
+// ZoneRecord is a record of a master file along with where it was read from
+type ZoneRecord struct {
+	ResourceRecord
+	File string
+	Line int
+}
+
+// Position returns the "file:line" a record was read from
+func (record ZoneRecord) Position() string {
+	return fmt.Sprintf("%s:%d", record.File, record.Line)
+}
+
+// zoneParser holds the state that carries over between the entries of a master file
+type zoneParser struct {
+	origin    string
+	ttl       uint32
+	lastOwner string
+	records   []ZoneRecord
+	errs      []error
+	depth     int
+}
+
+// ParseZoneFile parses the master file at path for the zone origin; it reads the whole file and returns every record
+// that parsed along with an error joining one error per malformed entry
+func ParseZoneFile(path, origin string) ([]ZoneRecord, error) {
+	parser := &zoneParser{origin: strings.TrimSuffix(origin, ".") + "."}
+	if err := parser.parseFile(path); err != nil {
+		return nil, err
+	}
+	return parser.records, errors.Join(parser.errs...)
+}
+
+// parseFile parses the master file at path into the parser's records
+func (p *zoneParser) parseFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return p.parse(file, path)
+}
+
+// parse reads the entries of a master file
+func (p *zoneParser) parse(r io.Reader, path string) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for {
+		entry, start, err := readZoneEntry(scanner, &lineNumber)
+		if err != nil {
+			p.errs = append(p.errs, fmt.Errorf("%s:%d: %w", path, start, err))
+		}
+		if entry == "" && err == nil {
+			return scanner.Err()
+		}
+		if err := p.parseEntry(entry, path, start); err != nil {
+			p.errs = append(p.errs, fmt.Errorf("%s:%d: %w", path, start, err))
+		}
+	}
+}
+
+// parseEntry interprets a logical line: a directive or a record
+func (p *zoneParser) parseEntry(entry, path string, line int) error {
+	fields, err := tokenizeRecord(entry)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	ownerOmitted := entry[0] == ' ' || entry[0] == '\t'
+	switch strings.ToUpper(fields[0]) {
+	case "$ORIGIN":
+		if len(fields) != 2 {
+			return fmt.Errorf("$ORIGIN takes exactly one name")
+		}
+		p.origin = absoluteName(fields[1], p.origin)
+		return nil
+	case "$TTL":
+		if len(fields) != 2 {
+			return fmt.Errorf("$TTL takes exactly one value")
+		}
+		ttl, err := parseTTL(fields[1])
+		p.ttl = ttl
+		return err
+	case "$INCLUDE":
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("$INCLUDE takes a file name and an optional origin")
+		}
+		if p.depth >= maxZoneIncludeDepth {
+			return fmt.Errorf("$INCLUDE nested more than %d deep", maxZoneIncludeDepth)
+		}
+		included := fields[1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(path), included)
+		}
+		// The included file may change the origin and owner for itself only
+		saved := *p
+		if len(fields) == 3 {
+			p.origin = absoluteName(fields[2], p.origin)
+		}
+		p.depth++
+		err := p.parseFile(included)
+		saved.records, saved.errs = p.records, p.errs
+		*p = saved
+		return err
+	}
+	if ownerOmitted {
+		if p.lastOwner == "" {
+			return fmt.Errorf("record has no owner and there is no previous one to repeat")
+		}
+		fields = append([]string{p.lastOwner}, fields...)
+	}
+	fields[0] = absoluteName(fields[0], p.origin)
+	p.lastOwner = fields[0]
+	record, err := parseRecordFields(fields, RecordParseOptions{Origin: p.origin, TTL: p.ttl})
+	if err != nil {
+		return err
+	}
+	p.records = append(p.records, ZoneRecord{ResourceRecord: record, File: path, Line: line})
+	return nil
+}
+
+// readZoneEntry reads the next logical line, joining the physical lines of a parenthesized record and dropping the
+// parentheses and comments; it returns an empty entry at the end of the input. Leading whitespace is preserved since
+// it marks an omitted owner.
+func readZoneEntry(scanner *bufio.Scanner, lineNumber *int) (string, int, error) {
+	var entry strings.Builder
+	depth, start := 0, 0
+	for scanner.Scan() {
+		*lineNumber++
+		line := scanner.Text()
+		if start == 0 {
+			if strings.TrimSpace(stripZoneComment(line)) == "" {
+				continue
+			}
+			start = *lineNumber
+		}
+		inQuotes := false
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case c == '\\' && i+1 < len(line):
+				entry.WriteByte(c)
+				i++
+				c = line[i]
+			case c == '"':
+				inQuotes = !inQuotes
+			case inQuotes:
+			case c == ';':
+				i = len(line)
+				continue
+			case c == '(':
+				depth++
+				c = ' '
+			case c == ')':
+				if depth == 0 {
+					return entry.String(), start, fmt.Errorf("unbalanced ')'")
+				}
+				depth--
+				c = ' '
+			}
+			entry.WriteByte(c)
+		}
+		if depth == 0 {
+			return entry.String(), start, nil
+		}
+		entry.WriteByte(' ')
+	}
+	if depth > 0 {
+		return entry.String(), start, fmt.Errorf("'(' is never closed")
+	}
+	return entry.String(), start, nil
+}
+
+// stripZoneComment removes a trailing comment from a line, ignoring semicolons in quoted strings
+func stripZoneComment(line string) string {
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuotes = !inQuotes
+		case ';':
+			if !inQuotes {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// parseTTL parses a TTL given in seconds or with BIND-style unit suffixes (1h30m, 2d, 1w)
+func parseTTL(s string) (uint32, error) {
+	var total, current uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			current, digits = current*10+uint64(c-'0'), true
+			if current > 1<<32 {
+				return 0, fmt.Errorf("TTL %q is out of range", s)
+			}
+			continue
+		}
+		unit, ok := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c|0x20]
+		if !ok || !digits {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		total, current, digits = total+current*unit, 0, false
+	}
+	total += current
+	if total >= 1<<31 {
+		return 0, fmt.Errorf("TTL %q is out of range", s)
+	}
+	return uint32(total), nil
+}
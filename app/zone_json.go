@@ -0,0 +1,123 @@
+package main
+
+/*
+This module contains the "zone" subcommand, which converts master files to a JSON document and back. Each record
+becomes an object with its owner, TTL, class, type, and RDATA in presentation format, so zones can be generated and
+edited by programs that know nothing of master file syntax.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ZoneDocument is the JSON form of a zone
+type ZoneDocument struct {
+	Origin  string       `json:"origin"`
+	Records []JSONRecord `json:"records"`
+}
+
+// JSONRecord is the JSON form of a resource record; Name may be relative to the zone origin, and a missing TTL or class
+// defaults to DefaultRecordTTL and IN
+type JSONRecord struct {
+	Name  string  `json:"name"`
+	TTL   *uint32 `json:"ttl"`
+	Class string  `json:"class"`
+	Type  string  `json:"type"`
+	Data  string  `json:"data"`
+}
+
+// runZone implements the "zone" subcommand
+func runZone(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "to-json":
+		origin := strings.TrimSuffix(args[1], ".") + "."
+		records, err := ParseZoneFile(args[2], origin)
+		if err != nil {
+			return err
+		}
+		document := ZoneDocument{Origin: origin, Records: make([]JSONRecord, len(records))}
+		for i, record := range records {
+			document.Records[i] = NewJSONRecord(record.ResourceRecord)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	case len(args) == 2 && args[0] == "from-json":
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		var document ZoneDocument
+		if err := json.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		records, err := document.ResourceRecords()
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		fmt.Printf("$ORIGIN %s\n", strings.TrimSuffix(document.Origin, ".")+".")
+		for _, record := range records {
+			fmt.Println(FormatRecord(record))
+		}
+		return nil
+	}
+	return fmt.Errorf("usage: zone to-json <origin> <file> | zone from-json <file>")
+}
+
+// NewJSONRecord converts a resource record to its JSON form
+func NewJSONRecord(record ResourceRecord) JSONRecord {
+	name, _ := LabelsToString(record.Name)
+	return JSONRecord{
+		Name:  name,
+		TTL:   &record.TTL,
+		Class: ClassString(record.Class),
+		Type:  TypeString(record.Type),
+		Data:  FormatRData(record.Type, record.Data),
+	}
+}
+
+// ResourceRecords converts the records of a document back, resolving relative names against its origin; every record
+// is checked, and the errors of all invalid ones are reported together
+func (document *ZoneDocument) ResourceRecords() ([]ResourceRecord, error) {
+	origin := strings.TrimSuffix(document.Origin, ".") + "."
+	records := make([]ResourceRecord, 0, len(document.Records))
+	var problems []string
+	for i, jsonRecord := range document.Records {
+		record, err := jsonRecord.ResourceRecord(origin)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("record %d: %v", i, err))
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return records, nil
+}
+
+// ResourceRecord converts a JSON record back to a resource record
+func (jsonRecord JSONRecord) ResourceRecord(origin string) (ResourceRecord, error) {
+	recordType, err := ParseRecordType(jsonRecord.Type)
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	class := uint16(ClassIN)
+	if jsonRecord.Class != "" {
+		if class, err = ParseRecordClass(jsonRecord.Class); err != nil {
+			return ResourceRecord{}, err
+		}
+	}
+	rdata, err := tokenizeRecord(jsonRecord.Data)
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	ttl := uint32(DefaultRecordTTL)
+	if jsonRecord.TTL != nil {
+		ttl = *jsonRecord.TTL
+	}
+	return NewResourceRecord(jsonRecord.Name, recordType, class, ttl, rdata, origin)
+}